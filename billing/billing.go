@@ -0,0 +1,417 @@
+// Package billing computes monthly electricity bills of plots from meter readings, the tariff and loss
+// coefficient history and payments, and carries the balance of a plot from month to month.
+package billing
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Period is a billing month
+type Period struct {
+	Year  int
+	Month int
+}
+
+// ParsePeriod accepts "2024-05" and "202405"
+func ParsePeriod(s string) (Period, error) {
+	s = strings.ReplaceAll(s, "-", "")
+	if len(s) != 6 {
+		return Period{}, fmt.Errorf("bad month %q, yyyy-mm expected", s)
+	}
+	y, err1 := strconv.Atoi(s[:4])
+	m, err2 := strconv.Atoi(s[4:])
+	if err1 != nil || err2 != nil || m < 1 || m > 12 {
+		return Period{}, fmt.Errorf("bad month %q, yyyy-mm expected", s)
+	}
+	return Period{y, m}, nil
+}
+
+func (p Period) String() string { return fmt.Sprintf("%d-%02d", p.Year, p.Month) }
+
+func (p Period) IsZero() bool { return p == Period{} }
+
+func (p Period) Next() Period {
+	if p.Month == 12 {
+		return Period{p.Year + 1, 1}
+	}
+	return Period{p.Year, p.Month + 1}
+}
+
+func (p Period) Prev() Period {
+	if p.Month == 1 {
+		return Period{p.Year - 1, 12}
+	}
+	return Period{p.Year, p.Month - 1}
+}
+
+func (p Period) Compare(o Period) int {
+	return cmp.Or(cmp.Compare(p.Year, o.Year), cmp.Compare(p.Month, o.Month))
+}
+
+func (p Period) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *Period) UnmarshalText(b []byte) error {
+	var err error
+	*p, err = ParsePeriod(string(b))
+	return err
+}
+
+// Money is in kopecks
+type Money int64
+
+// ParseMoney accepts "1234.5", "1 234,50" and "", which is zero
+func ParseMoney(s string) (Money, error) {
+	s = strings.NewReplacer(" ", "", " ", "", ",", ".").Replace(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return Rubles(v), nil
+}
+
+func Rubles(v float64) Money { return Money(math.Round(v * 100)) }
+
+func (m Money) Rubles() float64 { return float64(m) / 100 }
+
+func (m Money) String() string { return fmt.Sprintf("%.2f", m.Rubles()) }
+
+// Rate is a tariff or a loss coefficient effective from the month
+type Rate struct {
+	From  Period
+	Value float64
+}
+
+// Rates are sorted by From
+type Rates []Rate
+
+// RatesFromMap converts the config map "yyyymm" -> value
+func RatesFromMap(m map[string]float64) (Rates, error) {
+	var rr Rates
+	var errs []error
+	for k, v := range m {
+		p, err := ParsePeriod(k)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rr = append(rr, Rate{From: p, Value: v})
+	}
+	slices.SortFunc(rr, func(a, b Rate) int { return a.From.Compare(b.From) })
+	return rr, errors.Join(errs...)
+}
+
+// At returns the rate effective in the month, the earliest one before the history
+func (rr Rates) At(p Period) float64 {
+	if len(rr) == 0 {
+		return 0
+	}
+	v := rr[0].Value
+	for _, r := range rr {
+		if r.From.Compare(p) > 0 {
+			break
+		}
+		v = r.Value
+	}
+	return v
+}
+
+// Reading is a meter value at the end of the month
+type Reading struct {
+	Plot   string
+	Period Period
+	Value  float64
+	Value2 float64 `json:",omitempty"` // curr_evidence2 of the CSV, not billed
+	Time   int64   `json:",omitempty"` // unix milli of the submission
+	By     string  `json:",omitempty"`
+}
+
+// Payment reduces the debt of the plot in the month of Period
+type Payment struct {
+	ID      string
+	Plot    string
+	Period  Period
+	Date    string `json:",omitempty"` // 2006-01-02
+	Amount  Money
+	Purpose string `json:",omitempty"`
+	Source  string `json:",omitempty"` // csv, bank statement, ...
+}
+
+// Opening is the debt of the plot before the month, negative if prepaid
+type Opening struct {
+	Plot   string
+	Period Period
+	Debt   Money
+}
+
+// Bill of the plot for the month. Debt is negative if prepaid.
+type Bill struct {
+	Plot         string
+	Period       Period
+	Prev         float64 // reading of the previous month billed
+	Curr         float64
+	HasReading   bool    // Curr is read in the month, otherwise nothing is billed
+	Spent        float64 // kWh
+	Losses       float64 // kWh
+	Price        float64
+	Coef         float64 // losses, %
+	SpentAmount  Money
+	LossesAmount Money
+	Total        Money
+	PrevDebt     Money
+	Paid         Money
+	LastPayment  string // date of the last payment of the month
+	Debt         Money
+}
+
+// Prepayment is the amount paid in advance
+func (b *Bill) Prepayment() Money { return max(-b.Debt, 0) }
+
+// Ledger is replaced as a whole on change, it is not changed after it is shared
+type Ledger struct {
+	Price    Rates
+	Coef     Rates
+	readings map[string][]Reading // plot -> sorted by period
+	payments map[string][]Payment // plot -> sorted by period and date
+	openings map[string]Opening
+}
+
+// Clone returns a copy sharing unchanged plots
+func (l *Ledger) Clone() *Ledger {
+	if l == nil {
+		return &Ledger{}
+	}
+	return &Ledger{Price: l.Price, Coef: l.Coef, readings: maps.Clone(l.readings), payments: maps.Clone(l.payments),
+		openings: maps.Clone(l.openings)}
+}
+
+// PutReading adds the reading or replaces the one of the same plot and month
+func (l *Ledger) PutReading(r Reading) error {
+	if r.Plot == "" || r.Period.IsZero() {
+		return errors.New("plot and month expected")
+	}
+	if l.readings == nil {
+		l.readings = make(map[string][]Reading)
+	}
+	rr := slices.Clone(l.readings[r.Plot])
+	i, found := slices.BinarySearchFunc(rr, r.Period, func(x Reading, p Period) int { return x.Period.Compare(p) })
+	if found {
+		rr[i] = r
+	} else {
+		rr = slices.Insert(rr, i, r)
+	}
+	l.readings[r.Plot] = rr
+	return nil
+}
+
+// Reading returns the reading of the month
+func (l *Ledger) Reading(plot string, p Period) (Reading, bool) {
+	rr := l.readings[plot]
+	i, found := slices.BinarySearchFunc(rr, p, func(x Reading, p Period) int { return x.Period.Compare(p) })
+	if !found {
+		return Reading{}, false
+	}
+	return rr[i], true
+}
+
+// LastReading returns the latest reading before the month
+func (l *Ledger) LastReading(plot string, before Period) (Reading, bool) {
+	rr := l.readings[plot]
+	i, _ := slices.BinarySearchFunc(rr, before, func(x Reading, p Period) int { return x.Period.Compare(p) })
+	if i == 0 {
+		return Reading{}, false
+	}
+	return rr[i-1], true
+}
+
+// PutPayment adds the payment or replaces the one with the same ID
+func (l *Ledger) PutPayment(p Payment) error {
+	if p.ID == "" || p.Plot == "" || p.Period.IsZero() {
+		return errors.New("id, plot and month expected")
+	}
+	if l.payments == nil {
+		l.payments = make(map[string][]Payment)
+	}
+	pp := slices.DeleteFunc(slices.Clone(l.payments[p.Plot]), func(x Payment) bool { return x.ID == p.ID })
+	pp = append(pp, p)
+	slices.SortStableFunc(pp, func(a, b Payment) int {
+		return cmp.Or(a.Period.Compare(b.Period), cmp.Compare(a.Date, b.Date))
+	})
+	l.payments[p.Plot] = pp
+	return nil
+}
+
+func (l *Ledger) Payments(plot string) []Payment {
+	return l.payments[plot]
+}
+
+func (l *Ledger) PutOpening(o Opening) error {
+	if o.Plot == "" || o.Period.IsZero() {
+		return errors.New("plot and month expected")
+	}
+	if l.openings == nil {
+		l.openings = make(map[string]Opening)
+	}
+	l.openings[o.Plot] = o
+	return nil
+}
+
+func (l *Ledger) Opening(plot string) (Opening, bool) {
+	o, ok := l.openings[plot]
+	return o, ok
+}
+
+// Plots returns plots with any records sorted as numbers
+func (l *Ledger) Plots() []string {
+	set := make(map[string]bool)
+	for _, m := range []map[string]bool{keys(l.readings), keys(l.payments), keys(l.openings)} {
+		maps.Copy(set, m)
+	}
+	plots := slices.Collect(maps.Keys(set))
+	slices.SortFunc(plots, ComparePlots)
+	return plots
+}
+
+func keys[V any](m map[string]V) map[string]bool {
+	res := make(map[string]bool, len(m))
+	for k := range m {
+		res[k] = true
+	}
+	return res
+}
+
+// ComparePlots orders plot numbers as numbers
+func ComparePlots(a, b string) int {
+	x, err1 := strconv.Atoi(a)
+	y, err2 := strconv.Atoi(b)
+	if err1 == nil && err2 == nil {
+		return cmp.Compare(x, y)
+	}
+	return cmp.Compare(a, b)
+}
+
+// start is the first month with records of the plot
+func (l *Ledger) start(plot string) (Period, bool) {
+	var ps []Period
+	if o, ok := l.openings[plot]; ok {
+		ps = append(ps, o.Period)
+	}
+	if rr := l.readings[plot]; len(rr) != 0 {
+		ps = append(ps, rr[0].Period)
+	}
+	if pp := l.payments[plot]; len(pp) != 0 {
+		ps = append(ps, pp[0].Period)
+	}
+	if len(ps) == 0 {
+		return Period{}, false
+	}
+	return slices.MinFunc(ps, Period.Compare), true
+}
+
+// Bill computes the bill of the month carrying the debt from the first month of the plot.
+// Consumption of a month without a reading is billed in the month of the next reading.
+func (l *Ledger) Bill(plot string, p Period) (*Bill, bool) {
+	start, ok := l.start(plot)
+	if !ok || start.Compare(p) > 0 {
+		return nil, false
+	}
+	var debt Money
+	var b *Bill
+	for m := start; m.Compare(p) <= 0; m = m.Next() {
+		if o, ok := l.openings[plot]; ok && o.Period == m {
+			debt = o.Debt
+		}
+		b = l.bill(plot, m, debt)
+		debt = b.Debt
+	}
+	return b, true
+}
+
+func (l *Ledger) bill(plot string, p Period, prevDebt Money) *Bill {
+	b := &Bill{Plot: plot, Period: p, Price: l.Price.At(p), Coef: l.Coef.At(p), PrevDebt: prevDebt}
+	if curr, ok := l.Reading(plot, p); ok {
+		b.Curr, b.HasReading = curr.Value, true
+		b.Prev = curr.Value
+		if prev, ok := l.LastReading(plot, p); ok {
+			b.Prev = prev.Value
+		}
+		b.Spent = b.Curr - b.Prev
+		b.Losses = b.Spent * b.Coef / 100
+		b.SpentAmount = Rubles(b.Spent * b.Price)
+		b.LossesAmount = Rubles(b.Losses * b.Price)
+		b.Total = b.SpentAmount + b.LossesAmount
+	}
+	for _, pm := range l.payments[plot] {
+		if pm.Period == p {
+			b.Paid += pm.Amount
+			b.LastPayment = max(b.LastPayment, pm.Date)
+		}
+	}
+	b.Debt = b.PrevDebt + b.Total - b.Paid
+	return b
+}
+
+// Bills returns bills of the month of all plots
+func (l *Ledger) Bills(p Period) []*Bill {
+	var bb []*Bill
+	for _, plot := range l.Plots() {
+		if b, ok := l.Bill(plot, p); ok {
+			bb = append(bb, b)
+		}
+	}
+	return bb
+}
+
+// Mismatch is a difference between the computed bill and the value from elsewhere
+type Mismatch struct {
+	Plot   string
+	Period Period
+	Field  string
+	Got    string // computed
+	Want   string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s plot %s %s: computed %s, given %s", m.Period, m.Plot, m.Field, m.Got, m.Want)
+}
+
+// Check compares the bill with given values, empty ones are not compared.
+// Money differing by less than a ruble and kWh by less than 0.01 are equal.
+func (b *Bill) Check(spent, losses, total, debt string) []Mismatch {
+	var res []Mismatch
+	add := func(field, got, want string) {
+		res = append(res, Mismatch{Plot: b.Plot, Period: b.Period, Field: field, Got: got, Want: want})
+	}
+	for _, c := range []struct {
+		field string
+		got   float64
+		want  string
+	}{{"spent", b.Spent, spent}, {"losses", b.Losses, losses}} {
+		if v, err := ParseMoney(c.want); err == nil && c.want != "" && math.Abs(c.got-v.Rubles()) >= 0.01 {
+			add(c.field, FormatKWh(c.got), c.want)
+		}
+	}
+	for _, c := range []struct {
+		field string
+		got   Money
+		want  string
+	}{{"total", b.Total, total}, {"curr_debt", b.Debt, debt}} {
+		if v, err := ParseMoney(c.want); err == nil && c.want != "" && math.Abs(float64(c.got-v)) >= 100 {
+			add(c.field, c.got.String(), c.want)
+		}
+	}
+	return res
+}
+
+func FormatKWh(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
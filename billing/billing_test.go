@@ -0,0 +1,186 @@
+package billing
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRates(t *testing.T) {
+	rr, err := RatesFromMap(map[string]float64{"202206": 10.2, "202201": 8.7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		p    Period
+		want float64
+	}{
+		{Period{2021, 12}, 8.7},
+		{Period{2022, 5}, 8.7},
+		{Period{2022, 6}, 10.2},
+		{Period{2023, 6}, 10.2},
+	}
+	for _, tt := range tests {
+		if got := rr.At(tt.p); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if _, err := RatesFromMap(map[string]float64{"2022": 1}); err == nil {
+		t.Error("got no error for a bad month")
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Money
+	}{
+		{"", 0},
+		{"12", 1200},
+		{"1 234,56", 123456},
+		{"-0.005", -1},
+	}
+	for _, tt := range tests {
+		if got, err := ParseMoney(tt.s); err != nil || got != tt.want {
+			t.Errorf("%q: got %v %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestBill(t *testing.T) {
+	l := &Ledger{
+		Price: Rates{{Period{2024, 1}, 5}, {Period{2024, 3}, 6}},
+		Coef:  Rates{{Period{2024, 1}, 10}},
+	}
+	for _, r := range []Reading{
+		{Plot: "12", Period: Period{2024, 1}, Value: 1000},
+		{Plot: "12", Period: Period{2024, 2}, Value: 1100},
+		// no reading in March
+		{Plot: "12", Period: Period{2024, 4}, Value: 1300},
+	} {
+		if err := l.PutReading(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.PutOpening(Opening{Plot: "12", Period: Period{2024, 1}, Debt: 5000})
+	l.PutPayment(Payment{ID: "1", Plot: "12", Period: Period{2024, 2}, Date: "2024-02-10", Amount: 60000})
+	l.PutPayment(Payment{ID: "2", Plot: "12", Period: Period{2024, 3}, Date: "2024-03-05", Amount: 10000})
+
+	tests := []struct {
+		p                 Period
+		spent             float64
+		total, paid, debt Money
+		prepayment        Money
+		prevDebt          Money
+		hasReading        bool
+	}{
+		{Period{2024, 1}, 0, 0, 0, 5000, 0, 5000, true},
+		// 100 kWh x 5 x 1.1 = 550
+		{Period{2024, 2}, 100, 55000, 60000, 0, 0, 5000, true},
+		{Period{2024, 3}, 0, 0, 10000, -10000, 10000, 0, false},
+		// 200 kWh of March and April at the April price 6 x 1.1 = 1320
+		{Period{2024, 4}, 200, 132000, 0, 122000, 0, -10000, true},
+	}
+	for _, tt := range tests {
+		b, ok := l.Bill("12", tt.p)
+		if !ok {
+			t.Fatalf("%s: no bill", tt.p)
+		}
+		if b.Spent != tt.spent || b.Total != tt.total || b.Paid != tt.paid || b.Debt != tt.debt ||
+			b.Prepayment() != tt.prepayment || b.PrevDebt != tt.prevDebt || b.HasReading != tt.hasReading {
+			t.Errorf("%s: got %+v, want spent %v total %v paid %v debt %v", tt.p, b, tt.spent, tt.total, tt.paid, tt.debt)
+		}
+	}
+	if _, ok := l.Bill("12", Period{2023, 12}); ok {
+		t.Error("got a bill before the first month")
+	}
+	if _, ok := l.Bill("13", Period{2024, 1}); ok {
+		t.Error("got a bill of an unknown plot")
+	}
+}
+
+const csv1 = `N,FIO,prepaid,last_payment_date,plot_number,curr_evidence,curr_evidence2,prev_evidence,spent,losses,spent_amount,losses_amount,total,prev_debt,curr_debt,qr_url,bot_url
+1,Иванов,100,2024-02-03,12,1100,,1000,100,10,500,50,550,200,650,,
+2,Петров,,,7,510,,500,10,1,50,5,55,,55,,
+3,,,,,,,,,,,,,,,,
+`
+
+const csv2 = `N,FIO,prepaid,last_payment_date,plot_number,curr_evidence,curr_evidence2,prev_evidence,spent,losses,spent_amount,losses_amount,total,prev_debt,curr_debt,qr_url,bot_url
+1,Иванов,650,2024-03-03,12,1200,,1100,100,10,500,50,550,650,550,,
+2,Петров,,,7,520,,510,10,1,50,5,55,55,999,,
+`
+
+func TestImport(t *testing.T) {
+	l := &Ledger{Price: Rates{{Period{2024, 1}, 5}}, Coef: Rates{{Period{2024, 1}, 10}}}
+	for _, c := range []struct {
+		p    Period
+		data string
+		want []string
+	}{
+		{Period{2024, 2}, csv1, nil},
+		// re-import is the same
+		{Period{2024, 2}, csv1, nil},
+		{Period{2024, 3}, csv2, []string{"2024-03 plot 7 curr_debt: computed 110.00, given 999"}},
+	} {
+		rows, err := ReadCSV(strings.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err := l.Import(c.p, rows)
+		if err != nil {
+			t.Fatalf("%s: %v", c.p, err)
+		}
+		var got []string
+		for _, m := range mm {
+			got = append(got, m.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%s: got %q, want %q", c.p, got, c.want)
+		}
+	}
+
+	rows := l.Export(Period{2024, 3})
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	got := rows[1]
+	if got.PlotNumber != "12" || got.PrevEvidence != "1100" || got.CurrEvidence != "1200" || got.Prepaid != "650.00" ||
+		got.LastPaymentDate != "2024-03-03" || got.Total != "550.00" || got.PrevDebt != "650.00" || got.CurrDebt != "550.00" {
+		t.Errorf("got %+v, want the row of plot 12", got)
+	}
+}
+
+func TestCheckReading(t *testing.T) {
+	l := &Ledger{}
+	for _, r := range []Reading{
+		{Plot: "12", Period: Period{2024, 1}, Value: 1000},
+		{Plot: "12", Period: Period{2024, 4}, Value: 1900},
+	} {
+		l.PutReading(r)
+	}
+	tests := []struct {
+		p     Period
+		value float64
+		want  error
+	}{
+		{Period{2024, 2}, 1300, nil},
+		{Period{2024, 2}, 999, ErrReadingDecreased},
+		{Period{2024, 3}, 1901, ErrReadingDecreased},
+		// 700 kWh in 2 months
+		{Period{2024, 3}, 1700, ErrReadingTooHigh},
+		{Period{2024, 5}, 2200, nil},
+		{Period{2024, 5}, 2201, ErrReadingTooHigh},
+		// replaces the reading of the month
+		{Period{2024, 4}, 1500, nil},
+		{Period{2023, 12}, 900, nil},
+	}
+	for _, tt := range tests {
+		err := l.CheckReading(Reading{Plot: "12", Period: tt.p, Value: tt.value}, 300)
+		if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s %v: got %v, want %v", tt.p, tt.value, err, tt.want)
+		}
+	}
+	if err := l.CheckReading(Reading{Plot: "7", Period: Period{2024, 3}, Value: 100000}, 300); err != nil {
+		t.Errorf("got %v, want any first reading", err)
+	}
+}
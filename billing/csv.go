@@ -0,0 +1,162 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gocarina/gocsv"
+	"io"
+	"strconv"
+)
+
+// CSVRow is a row of electr_YYYY-MM.csv, the import and export format of a month
+type CSVRow struct {
+	N               string `csv:"N"`
+	FIO             string `csv:"FIO"`
+	Prepaid         string `csv:"prepaid"`
+	LastPaymentDate string `csv:"last_payment_date"`
+	PlotNumber      string `csv:"plot_number"`
+	CurrEvidence    string `csv:"curr_evidence"`
+	CurrEvidence2   string `csv:"curr_evidence2"`
+	PrevEvidence    string `csv:"prev_evidence"`
+	Spent           string `csv:"spent"`
+	Losses          string `csv:"losses"`
+	SpentAmount     string `csv:"spent_amount"`
+	LossesAmount    string `csv:"losses_amount"`
+	Total           string `csv:"total"`
+	PrevDebt        string `csv:"prev_debt"`
+	CurrDebt        string `csv:"curr_debt"`
+	QRURL           string `csv:"qr_url"`
+	BotURL          string `csv:"bot_url"`
+	NotUsed         string `csv:"-"`
+}
+
+func ReadCSV(r io.Reader) ([]*CSVRow, error) {
+	var rows []*CSVRow
+	if err := gocsv.Unmarshal(r, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func parseKWh(s string) (float64, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	v, err := ParseMoney(s)
+	return v.Rubles(), err == nil, err
+}
+
+// CSVPaymentID is the ID of the payment imported from the prepaid column
+func CSVPaymentID(p Period, plot string) string {
+	return "csv-" + p.String() + "-" + plot
+}
+
+// Import adds readings, payments and opening debts of the month. The previous reading is added if the plot has
+// none, the previous debt is the opening one of a plot without records before the month. Computed values
+// differing from the rows are returned as mismatches.
+func (l *Ledger) Import(p Period, rows []*CSVRow) ([]Mismatch, error) {
+	var mismatches []Mismatch
+	var errs []error
+	var plots []*CSVRow
+	for _, row := range rows {
+		if row.PlotNumber == "" {
+			continue
+		}
+		if err := l.importRow(p, row, &mismatches); err != nil {
+			errs = append(errs, fmt.Errorf("plot %s: %w", row.PlotNumber, err))
+			continue
+		}
+		plots = append(plots, row)
+	}
+	for _, row := range plots {
+		if b, ok := l.Bill(row.PlotNumber, p); ok {
+			mismatches = append(mismatches, b.Check(row.Spent, row.Losses, row.Total, row.CurrDebt)...)
+		}
+	}
+	return mismatches, errors.Join(errs...)
+}
+
+func (l *Ledger) importRow(p Period, row *CSVRow, mismatches *[]Mismatch) error {
+	plot := row.PlotNumber
+	curr, hasCurr, err := parseKWh(row.CurrEvidence)
+	if err != nil {
+		return fmt.Errorf("curr_evidence: %w", err)
+	}
+	curr2, _, err := parseKWh(row.CurrEvidence2)
+	if err != nil {
+		return fmt.Errorf("curr_evidence2: %w", err)
+	}
+	prev, hasPrev, err := parseKWh(row.PrevEvidence)
+	if err != nil {
+		return fmt.Errorf("prev_evidence: %w", err)
+	}
+	prepaid, err := ParseMoney(row.Prepaid)
+	if err != nil {
+		return fmt.Errorf("prepaid: %w", err)
+	}
+	prevDebt, err := ParseMoney(row.PrevDebt)
+	if err != nil {
+		return fmt.Errorf("prev_debt: %w", err)
+	}
+	mismatch := func(field, got, want string) {
+		*mismatches = append(*mismatches, Mismatch{Plot: plot, Period: p, Field: field, Got: got, Want: want})
+	}
+
+	start, ok := l.start(plot)
+	if o, reimport := l.openings[plot]; !ok || start.Compare(p) >= 0 || reimport && o.Period == p {
+		if err := l.PutOpening(Opening{Plot: plot, Period: p, Debt: prevDebt}); err != nil {
+			return err
+		}
+	} else if b, _ := l.Bill(plot, p.Prev()); b.Debt != prevDebt && row.PrevDebt != "" {
+		mismatch("prev_debt", b.Debt.String(), row.PrevDebt)
+	}
+	if last, ok := l.LastReading(plot, p); !ok && hasPrev {
+		if err := l.PutReading(Reading{Plot: plot, Period: p.Prev(), Value: prev, By: "csv"}); err != nil {
+			return err
+		}
+	} else if ok && hasPrev && Rubles(last.Value) != Rubles(prev) {
+		mismatch("prev_evidence", FormatKWh(last.Value), row.PrevEvidence)
+	}
+	if hasCurr {
+		if err := l.PutReading(Reading{Plot: plot, Period: p, Value: curr, Value2: curr2, By: "csv"}); err != nil {
+			return err
+		}
+	}
+	if prepaid != 0 {
+		return l.PutPayment(Payment{ID: CSVPaymentID(p, plot), Plot: plot, Period: p, Date: row.LastPaymentDate,
+			Amount: prepaid, Source: "csv"})
+	}
+	return nil
+}
+
+// Export returns rows of the month computed from the ledger, FIO is not known to the ledger
+func (l *Ledger) Export(p Period) []*CSVRow {
+	var rows []*CSVRow
+	for i, b := range l.Bills(p) {
+		row := &CSVRow{
+			N:               strconv.Itoa(i + 1),
+			PlotNumber:      b.Plot,
+			LastPaymentDate: b.LastPayment,
+			PrevDebt:        b.PrevDebt.String(),
+			CurrDebt:        b.Debt.String(),
+		}
+		if b.Paid != 0 {
+			row.Prepaid = b.Paid.String()
+		}
+		if b.HasReading {
+			r, _ := l.Reading(b.Plot, p)
+			row.CurrEvidence = FormatKWh(b.Curr)
+			if r.Value2 != 0 {
+				row.CurrEvidence2 = FormatKWh(r.Value2)
+			}
+			row.PrevEvidence = FormatKWh(b.Prev)
+			row.Spent = FormatKWh(b.Spent)
+			row.Losses = FormatKWh(b.Losses)
+			row.SpentAmount = b.SpentAmount.String()
+			row.LossesAmount = b.LossesAmount.String()
+			row.Total = b.Total.String()
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
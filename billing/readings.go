@@ -0,0 +1,54 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+var (
+	ErrReadingDecreased = errors.New("readings of the plot decrease")
+	ErrReadingTooHigh   = errors.New("consumption is above the plausible")
+)
+
+// Months returns the number of months from p to o, negative if o is before p
+func (p Period) Months(o Period) int {
+	return (o.Year-p.Year)*12 + o.Month - p.Month
+}
+
+// NextReading returns the earliest reading after the month
+func (l *Ledger) NextReading(plot string, after Period) (Reading, bool) {
+	rr := l.readings[plot]
+	i, found := slices.BinarySearchFunc(rr, after, func(x Reading, p Period) int { return x.Period.Compare(p) })
+	if found {
+		i++
+	}
+	if i == len(rr) {
+		return Reading{}, false
+	}
+	return rr[i], true
+}
+
+// CheckReading validates a new reading against readings of other months of the plot: it is not less than
+// the previous one and not greater than the next one, and at most maxPerMonth kWh a month are spent since
+// the previous one, 0 - any consumption.
+func (l *Ledger) CheckReading(r Reading, maxPerMonth float64) error {
+	if r.Value < 0 || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+		return fmt.Errorf("bad reading %v", r.Value)
+	}
+	prev, hasPrev := l.LastReading(r.Plot, r.Period)
+	if hasPrev && r.Value < prev.Value {
+		return fmt.Errorf("%w: %s in %s, %s in %s", ErrReadingDecreased, FormatKWh(prev.Value), prev.Period,
+			FormatKWh(r.Value), r.Period)
+	}
+	if next, ok := l.NextReading(r.Plot, r.Period); ok && r.Value > next.Value {
+		return fmt.Errorf("%w: %s in %s, %s in %s", ErrReadingDecreased, FormatKWh(r.Value), r.Period,
+			FormatKWh(next.Value), next.Period)
+	}
+	if months := prev.Period.Months(r.Period); hasPrev && maxPerMonth > 0 && r.Value-prev.Value > maxPerMonth*float64(months) {
+		return fmt.Errorf("%w: %s kWh in %d months since %s", ErrReadingTooHigh, FormatKWh(r.Value-prev.Value), months,
+			prev.Period)
+	}
+	return nil
+}
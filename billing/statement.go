@@ -0,0 +1,409 @@
+package billing
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Statement formats of ReadStatement
+const (
+	Format1C   = "1c"       // 1CClientBankExchange
+	FormatCAMT = "camt.053" // ISO 20022 BkToCstmrStmt
+	FormatCSV  = "csv"
+)
+
+// Transaction is a credit of the bank statement
+type Transaction struct {
+	Number  string `json:",omitempty"` // document number or bank reference
+	Date    string // 2006-01-02
+	Amount  Money
+	Payer   string `json:",omitempty"`
+	Purpose string
+}
+
+// PaymentID is the same for the credit of any statement: the bank reference, the date and the amount.
+// Banks differ in payer and purpose texts of the same credit, so they are not a part of it.
+func (t *Transaction) PaymentID() string {
+	h := sha256.Sum256([]byte(strings.Join([]string{t.Number, t.Date, t.Amount.String()}, "\n")))
+	return "bank-" + hex.EncodeToString(h[:8])
+}
+
+// legacyPaymentID is the id of credits imported before the payer and the purpose were dropped from it
+func (t *Transaction) legacyPaymentID() string {
+	h := sha256.Sum256([]byte(strings.Join([]string{t.Number, t.Date, t.Amount.String(), t.Payer, t.Purpose}, "\n")))
+	return "bank-" + hex.EncodeToString(h[:8])
+}
+
+func (t *Transaction) Payment(plot string, p Period) Payment {
+	return Payment{ID: t.PaymentID(), Plot: plot, Period: p, Date: t.Date, Amount: t.Amount, Purpose: t.Purpose,
+		Source: "bank"}
+}
+
+// ReadStatement detects the format and returns credits, text in cp1251 is decoded
+func ReadStatement(data []byte) (string, []Transaction, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		var err error
+		if data, err = charmap.Windows1251.NewDecoder().Bytes(data); err != nil {
+			return "", nil, err
+		}
+	}
+	head := strings.TrimSpace(string(data[:min(len(data), 512)]))
+	var txs []Transaction
+	var err error
+	format := FormatCSV
+	switch {
+	case strings.HasPrefix(head, "1CClientBankExchange"):
+		format = Format1C
+		txs, err = read1C(data)
+	case strings.HasPrefix(head, "<"):
+		format = FormatCAMT
+		txs, err = readCAMT(data)
+	default:
+		txs, err = readStatementCSV(data)
+	}
+	return format, txs, err
+}
+
+// read1C takes documents paid to accounts of the header, or received ones if the header has no accounts
+func read1C(data []byte) ([]Transaction, error) {
+	accounts := make(map[string]bool)
+	var txs []Transaction
+	var errs []error
+	var doc map[string]string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		k, v, _ := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		switch {
+		case k == "СекцияДокумент":
+			doc = make(map[string]string)
+		case k == "КонецДокумента" && doc != nil:
+			credit := doc["ДатаПоступило"] != ""
+			if len(accounts) != 0 {
+				credit = accounts[doc["ПолучательСчет"]]
+			}
+			if credit {
+				t, err := transaction1C(doc)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("document %s of %s: %w", doc["Номер"], doc["Дата"], err))
+				} else {
+					txs = append(txs, t)
+				}
+			}
+			doc = nil
+		case doc != nil:
+			doc[k] = v
+		case k == "РасчСчет":
+			accounts[v] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return txs, errors.Join(errs...)
+}
+
+func transaction1C(doc map[string]string) (Transaction, error) {
+	t := Transaction{Number: doc["Номер"], Payer: doc["Плательщик1"], Purpose: doc["НазначениеПлатежа"]}
+	if t.Payer == "" {
+		t.Payer = doc["Плательщик"]
+	}
+	var err1, err2 error
+	t.Date, err1 = parseDate(firstNonEmpty(doc["ДатаПоступило"], doc["Дата"]))
+	t.Amount, err2 = ParseMoney(doc["Сумма"])
+	return t, errors.Join(err1, err2)
+}
+
+type camtDocument struct {
+	XMLName xml.Name
+	Entries []camtEntry `xml:"BkToCstmrStmt>Stmt>Ntry"`
+}
+
+type camtEntry struct {
+	Amount       string   `xml:"Amt"`
+	CdtDbtInd    string   `xml:"CdtDbtInd"`
+	BookingDate  string   `xml:"BookgDt>Dt"`
+	BookingTime  string   `xml:"BookgDt>DtTm"`
+	Ref          string   `xml:"AcctSvcrRef"`
+	Info         string   `xml:"AddtlNtryInf"`
+	Transactions []camtTx `xml:"NtryDtls>TxDtls"`
+}
+
+type camtTx struct {
+	Amount   string   `xml:"Amt"`
+	Ref      string   `xml:"Refs>AcctSvcrRef"`
+	EndToEnd string   `xml:"Refs>EndToEndId"`
+	Debtor   string   `xml:"RltdPties>Dbtr>Nm"`
+	Party    string   `xml:"RltdPties>Dbtr>Pty>Nm"`
+	Purpose  []string `xml:"RmtInf>Ustrd"`
+}
+
+// readCAMT takes credit entries, an entry of a batch is a credit of each of its transactions
+func readCAMT(data []byte) ([]Transaction, error) {
+	var doc camtDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.XMLName.Local != "Document" {
+		return nil, fmt.Errorf("unknown statement <%s>", doc.XMLName.Local)
+	}
+	var txs []Transaction
+	var errs []error
+	for _, e := range doc.Entries {
+		if e.CdtDbtInd != "CRDT" {
+			continue
+		}
+		date, err := parseDate(firstNonEmpty(e.BookingDate, e.BookingTime))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("entry %s: %w", e.Ref, err))
+			continue
+		}
+		if len(e.Transactions) == 0 {
+			e.Transactions = []camtTx{{}}
+		}
+		for _, tx := range e.Transactions {
+			t := Transaction{Number: firstNonEmpty(tx.Ref, tx.EndToEnd, e.Ref), Date: date,
+				Payer: firstNonEmpty(tx.Debtor, tx.Party), Purpose: firstNonEmpty(strings.Join(tx.Purpose, " "), e.Info)}
+			if len(e.Transactions) == 1 {
+				tx.Amount = firstNonEmpty(tx.Amount, e.Amount)
+			}
+			if t.Amount, err = ParseMoney(tx.Amount); err != nil || t.Amount == 0 {
+				errs = append(errs, fmt.Errorf("entry %s: bad amount %q", e.Ref, tx.Amount))
+				continue
+			}
+			txs = append(txs, t)
+		}
+	}
+	return txs, errors.Join(errs...)
+}
+
+// statementColumns are lower case names of CSV columns of banks
+var statementColumns = map[string][]string{
+	"date":    {"дата", "дата операции", "дата проводки", "date"},
+	"amount":  {"сумма", "сумма операции", "amount"},
+	"credit":  {"приход", "кредит", "поступление", "credit"},
+	"purpose": {"назначение платежа", "назначение", "описание", "purpose", "description"},
+	"payer":   {"плательщик", "контрагент", "payer"},
+	"number":  {"номер", "номер документа", "№", "number", "id"},
+}
+
+// readStatementCSV finds the header with date, amount or credit and purpose columns, lines above it are skipped.
+// A negative amount or an empty credit is a debit.
+func readStatementCSV(data []byte) ([]Transaction, error) {
+	head := string(data[:min(len(data), 1024)])
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = ','
+	if strings.Count(head, ";") > strings.Count(head, ",") {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var cols map[string]int
+	var txs []Transaction
+	var errs []error
+	for n, row := range rows {
+		if cols == nil {
+			cols = statementHeader(row)
+			continue
+		}
+		get := func(col string) string {
+			if i, ok := cols[col]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		if get("date") == "" {
+			continue
+		}
+		v := get("amount")
+		if _, ok := cols["credit"]; ok {
+			v = get("credit")
+		}
+		amount, err := ParseMoney(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n+1, err))
+			continue
+		}
+		if amount <= 0 {
+			continue
+		}
+		date, err := parseDate(get("date"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n+1, err))
+			continue
+		}
+		txs = append(txs, Transaction{Number: get("number"), Date: date, Amount: amount, Payer: get("payer"),
+			Purpose: get("purpose")})
+	}
+	if cols == nil {
+		return nil, errors.New("no header with date, amount and purpose columns")
+	}
+	return txs, errors.Join(errs...)
+}
+
+// statementHeader returns indexes of known columns, nil if the row is not a header
+func statementHeader(row []string) map[string]int {
+	cols := make(map[string]int)
+	for i, name := range row {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for col, names := range statementColumns {
+			if _, ok := cols[col]; !ok && slices.Contains(names, name) {
+				cols[col] = i
+			}
+		}
+	}
+	_, hasAmount := cols["amount"]
+	_, hasCredit := cols["credit"]
+	_, hasDate := cols["date"]
+	_, hasPurpose := cols["purpose"]
+	if !hasDate || !hasPurpose || !hasAmount && !hasCredit {
+		return nil
+	}
+	return cols
+}
+
+func parseDate(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"02.01.2006", "2006-01-02", "02.01.06"} {
+		if len(s) >= len(layout) {
+			if t, err := time.Parse(layout, s[:len(layout)]); err == nil {
+				return t.Format("2006-01-02"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("bad date %q", s)
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// purposeRE matches the purpose of the bill "За эл-энергию, {mnt} {year}, [fio] участок {number}, ...",
+// the month is a name or a number
+var purposeRE = regexp.MustCompile(`(?i)эл(?:ектро)?[.-]?\s*энерги\S*\s*,?\s*([а-яё]+|\d{1,2})\.?\s*(\d{4})\b.*?уч(?:асток|\.)?\s*№?\s*(\d+)`)
+
+var monthPrefixes = map[string]int{"янв": 1, "фев": 2, "мар": 3, "апр": 4, "май": 5, "мая": 5, "июн": 6, "июл": 7,
+	"авг": 8, "сен": 9, "окт": 10, "ноя": 11, "дек": 12}
+
+// ParsePurpose returns the plot and the month of the bill paid
+func ParsePurpose(s string) (string, Period, bool) {
+	m := purposeRE.FindStringSubmatch(s)
+	if m == nil {
+		return "", Period{}, false
+	}
+	month, err := strconv.Atoi(m[1])
+	if err != nil {
+		name := []rune(strings.ToLower(m[1]))
+		month = monthPrefixes[string(name[:min(len(name), 3)])]
+	}
+	year, _ := strconv.Atoi(m[2])
+	if month < 1 || month > 12 {
+		return "", Period{}, false
+	}
+	return strings.TrimLeft(m[3], "0"), Period{year, month}, true
+}
+
+// Unmatched is a credit without a bill of a known plot in the purpose
+type Unmatched struct {
+	Transaction
+	ID     string
+	Reason string
+}
+
+// Reconciliation is the result of adding credits of a statement to the ledger
+type Reconciliation struct {
+	Matched   []Payment   `json:",omitempty"` // added
+	Known     []Payment   `json:",omitempty"` // added before
+	Unmatched []Unmatched `json:",omitempty"`
+	// Duplicates have the reference, the date and the amount of another credit but other purpose,
+	// they are not added and are checked by hand
+	Duplicates []Unmatched `json:",omitempty"`
+}
+
+// Reconcile adds payments of credits with the purpose of a bill of a plot with records, credits added
+// before, matched or assigned by hand, are known. A credit of the id of another one is a possible duplicate.
+func (l *Ledger) Reconcile(txs []Transaction) *Reconciliation {
+	res := &Reconciliation{}
+	seen := make(map[string]Transaction)
+	for _, t := range txs {
+		id := t.PaymentID()
+		if prev, ok := seen[id]; ok {
+			res.Duplicates = append(res.Duplicates, Unmatched{t, id,
+				fmt.Sprintf("same reference, date and amount as the credit of %s: %s", prev.Payer, prev.Purpose)})
+			continue
+		}
+		seen[id] = t
+		if pm, ok := l.payment(t.legacyPaymentID()); ok {
+			res.Known = append(res.Known, pm)
+			continue
+		}
+		if pm, ok := l.payment(id); ok {
+			if pm.Purpose != t.Purpose {
+				res.Duplicates = append(res.Duplicates, Unmatched{t, id,
+					fmt.Sprintf("same reference, date and amount as payment %s of plot %s: %s", pm.ID, pm.Plot, pm.Purpose)})
+				continue
+			}
+			res.Known = append(res.Known, pm)
+			continue
+		}
+		plot, p, ok := ParsePurpose(t.Purpose)
+		if !ok {
+			res.Unmatched = append(res.Unmatched, Unmatched{t, t.PaymentID(), "no bill in the purpose"})
+			continue
+		}
+		if _, ok := l.start(plot); !ok {
+			res.Unmatched = append(res.Unmatched, Unmatched{t, t.PaymentID(), "unknown plot " + plot})
+			continue
+		}
+		pm := t.Payment(plot, p)
+		if err := l.PutPayment(pm); err != nil {
+			res.Unmatched = append(res.Unmatched, Unmatched{t, pm.ID, err.Error()})
+			continue
+		}
+		res.Matched = append(res.Matched, pm)
+	}
+	return res
+}
+
+func (l *Ledger) payment(id string) (Payment, bool) {
+	for _, pp := range l.payments {
+		for _, pm := range pp {
+			if pm.ID == id {
+				return pm, true
+			}
+		}
+	}
+	return Payment{}, false
+}
+
+// Total is the sum of payments
+func Total(pp []Payment) Money {
+	var sum Money
+	for _, pm := range pp {
+		sum += pm.Amount
+	}
+	return sum
+}
@@ -0,0 +1,156 @@
+package billing
+
+import (
+	"golang.org/x/text/encoding/charmap"
+	"testing"
+)
+
+func TestParsePurpose(t *testing.T) {
+	tests := []struct {
+		s    string
+		plot string
+		p    Period
+		ok   bool
+	}{
+		{"За эл-энергию, мар 2024, участок 12, 200.00 + (1100.00 - 1000.00)x5.00x10.00 :: 750.00", "12", Period{2024, 3}, true},
+		{"За эл-энергию, 03 2024, участок 12, (1100.00 - 1000.00)x5.00x10.00 :: 550.00", "12", Period{2024, 3}, true},
+		{"За эл-энергию, дек 2023, Иванов И.И. участок 7, (510.00 - 500.00)x5.00x1.1000 :: 55.00", "7", Period{2023, 12}, true},
+		{"ОПЛАТА ЗА ЭЛЕКТРОЭНЕРГИЮ МАЯ 2024 УЧ. №045 БЕЗ НДС", "45", Period{2024, 5}, true},
+		{"За эл-энергию, 13 2024, участок 12", "", Period{}, false},
+		{"Членские взносы 2024, участок 12", "", Period{}, false},
+	}
+	for _, tt := range tests {
+		plot, p, ok := ParsePurpose(tt.s)
+		if plot != tt.plot || p != tt.p || ok != tt.ok {
+			t.Errorf("%q: got %q %v %v, want %q %v %v", tt.s, plot, p, ok, tt.plot, tt.p, tt.ok)
+		}
+	}
+}
+
+const statement1C = `1CClientBankExchange
+ВерсияФормата=1.03
+Кодировка=Windows
+РасчСчет=40703810000000000001
+СекцияРасчСчет
+РасчСчет=40703810000000000001
+НачальныйОстаток=1000.00
+КонецРасчСчет
+СекцияДокумент=Платежное поручение
+Номер=15
+Дата=02.04.2024
+Сумма=650.00
+ПлательщикСчет=40817810000000000002
+Плательщик1=Иванов Иван Иванович
+ПолучательСчет=40703810000000000001
+ДатаПоступило=03.04.2024
+НазначениеПлатежа=За эл-энергию, мар 2024, участок 12, 200.00 + (1100.00 - 1000.00)x5.00x10.00 :: 750.00
+КонецДокумента
+СекцияДокумент=Платежное поручение
+Номер=16
+Дата=03.04.2024
+Сумма=300.00
+ПлательщикСчет=40703810000000000001
+ПолучательСчет=40702810000000000003
+НазначениеПлатежа=Оплата по счету 7
+КонецДокумента
+КонецФайла
+`
+
+const statementCAMT = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"><BkToCstmrStmt><Stmt>
+<Ntry><Amt Ccy="RUB">650.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><BookgDt><Dt>2024-04-03</Dt></BookgDt><AcctSvcrRef>A1</AcctSvcrRef>
+<NtryDtls><TxDtls><RltdPties><Dbtr><Nm>Иванов</Nm></Dbtr></RltdPties><RmtInf><Ustrd>За эл-энергию, мар 2024,</Ustrd><Ustrd>участок 12</Ustrd></RmtInf></TxDtls></NtryDtls></Ntry>
+<Ntry><Amt Ccy="RUB">300.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><BookgDt><Dt>2024-04-03</Dt></BookgDt><AcctSvcrRef>A2</AcctSvcrRef></Ntry>
+<Ntry><Amt Ccy="RUB">155.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><BookgDt><DtTm>2024-04-04T10:00:00</DtTm></BookgDt><AcctSvcrRef>A3</AcctSvcrRef>
+<NtryDtls><TxDtls><Refs><EndToEndId>E1</EndToEndId></Refs><Amt Ccy="RUB">55.00</Amt><RmtInf><Ustrd>За эл-энергию, 03 2024, участок 7</Ustrd></RmtInf></TxDtls>
+<TxDtls><Refs><EndToEndId>E2</EndToEndId></Refs><Amt Ccy="RUB">100.00</Amt><RmtInf><Ustrd>Членские взносы</Ustrd></RmtInf></TxDtls></NtryDtls></Ntry>
+</Stmt></BkToCstmrStmt></Document>`
+
+const statementCSV = `Выписка по счету 40703810000000000001;;;;
+Дата;Номер;Плательщик;Приход;Расход;Назначение платежа
+03.04.2024;15;Иванов;650,00;;За эл-энергию, мар 2024, участок 12
+03.04.2024;16;;;300,00;Оплата по счету 7
+`
+
+func TestReadStatement(t *testing.T) {
+	cp1251, err := charmap.Windows1251.NewEncoder().String(statement1C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		data   string
+		format string
+		want   []Transaction
+	}{
+		{cp1251, Format1C, []Transaction{{Number: "15", Date: "2024-04-03", Amount: 65000, Payer: "Иванов Иван Иванович",
+			Purpose: "За эл-энергию, мар 2024, участок 12, 200.00 + (1100.00 - 1000.00)x5.00x10.00 :: 750.00"}}},
+		{statementCAMT, FormatCAMT, []Transaction{
+			{Number: "A1", Date: "2024-04-03", Amount: 65000, Payer: "Иванов", Purpose: "За эл-энергию, мар 2024, участок 12"},
+			{Number: "E1", Date: "2024-04-04", Amount: 5500, Purpose: "За эл-энергию, 03 2024, участок 7"},
+			{Number: "E2", Date: "2024-04-04", Amount: 10000, Purpose: "Членские взносы"}}},
+		{statementCSV, FormatCSV, []Transaction{{Number: "15", Date: "2024-04-03", Amount: 65000, Payer: "Иванов",
+			Purpose: "За эл-энергию, мар 2024, участок 12"}}},
+	}
+	for _, tt := range tests {
+		format, got, err := ReadStatement([]byte(tt.data))
+		if err != nil || format != tt.format {
+			t.Fatalf("got %q %v, want %q", format, err, tt.format)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %+v, want %+v", tt.format, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %+v, want %+v", tt.format, got[i], tt.want[i])
+			}
+		}
+	}
+	if _, _, err := ReadStatement([]byte("a,b\n1,2\n")); err == nil {
+		t.Error("got no error for a CSV without the header")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	l := &Ledger{Price: Rates{{Period{2024, 1}, 5}}}
+	for _, r := range []Reading{{Plot: "12", Period: Period{2024, 2}, Value: 1000}, {Plot: "12", Period: Period{2024, 3}, Value: 1100}} {
+		if err := l.PutReading(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txs := []Transaction{
+		{Number: "1", Date: "2024-04-03", Amount: 50000, Purpose: "За эл-энергию, мар 2024, участок 12"},
+		{Number: "2", Date: "2024-04-03", Amount: 5500, Purpose: "За эл-энергию, мар 2024, участок 7"},
+		{Number: "3", Date: "2024-04-03", Amount: 10000, Purpose: "Членские взносы"},
+	}
+	res := l.Reconcile(txs)
+	if len(res.Matched) != 1 || res.Matched[0].Plot != "12" || len(res.Known) != 0 || len(res.Unmatched) != 2 {
+		t.Fatalf("got %+v, want plot 12 matched", res)
+	}
+	if b, _ := l.Bill("12", Period{2024, 3}); b.Paid != 50000 || b.Debt != 0 {
+		t.Errorf("got %+v, want the bill paid", b)
+	}
+	if res := l.Reconcile(txs); len(res.Matched) != 0 || len(res.Known) != 1 {
+		t.Errorf("got %+v, want the payment known", res)
+	}
+
+	// a bank writes the purpose of the same credit in another way, a credit without a reference has the same key
+	other := txs[0]
+	other.Purpose = "За эл-энергию, март 2024, участок 12"
+	again := Transaction{Date: "2024-04-04", Amount: 5500, Purpose: "За эл-энергию, мар 2024, участок 12"}
+	twice := again
+	twice.Purpose = "За эл-энергию, фев 2024, участок 12"
+	res = l.Reconcile([]Transaction{other, again, twice})
+	if len(res.Matched) != 1 || len(res.Known) != 0 || len(res.Duplicates) != 2 {
+		t.Errorf("got %+v, want possible duplicates", res)
+	}
+	if b, _ := l.Bill("12", Period{2024, 3}); b.Paid != 55500 {
+		t.Errorf("got %+v, want duplicates not paid", b)
+	}
+
+	// payments of the id with the payer and the purpose are known
+	legacy := Transaction{Number: "4", Date: "2024-04-05", Amount: 100, Purpose: "За эл-энергию, мар 2024, участок 12"}
+	l.PutPayment(Payment{ID: legacy.legacyPaymentID(), Plot: "12", Period: Period{2024, 3}, Amount: 100, Purpose: legacy.Purpose})
+	if res := l.Reconcile([]Transaction{legacy}); len(res.Known) != 1 || res.Known[0].ID != legacy.legacyPaymentID() {
+		t.Errorf("got %+v, want the legacy payment known", res)
+	}
+}
@@ -0,0 +1,260 @@
+// Package calendar is a gate calendar of date exceptions: holidays, transferred work days,
+// keep open days and seasons with own schedules.
+package calendar
+
+import (
+	"7stgbot/gate"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Kind string
+
+const (
+	// Holiday is checked by time groups as Sunday
+	Holiday Kind = "holiday"
+	// Workday is checked by time groups as Monday
+	Workday Kind = "workday"
+	// KeepOpen keeps the gate open from TimeFrom to TimeTo, the whole day if they are empty
+	KeepOpen Kind = "keep-open"
+	// Season only carries schedules for its date range
+	Season Kind = "season"
+)
+
+var Kinds = []Kind{Holiday, Workday, KeepOpen, Season}
+
+const dateLayout = time.DateOnly
+
+// Exception is a named date range, Start and End are inclusive local dates "2006-01-02".
+// Schedule and BLESchedule are in the /7_timer format "hh:mm" -> minutes.
+type Exception struct {
+	ID          string
+	Name        string
+	Kind        Kind
+	Start       string
+	End         string
+	TimeFrom    string         `json:",omitempty"` // 08:00
+	TimeTo      string         `json:",omitempty"` // 18:00
+	Schedule    map[string]int `json:",omitempty"`
+	BLESchedule map[string]int `json:",omitempty"`
+}
+
+func (e *Exception) Validate() error {
+	if e.ID == "" {
+		return errors.New("id is empty")
+	}
+	if !slices.Contains(Kinds, e.Kind) {
+		return fmt.Errorf("unknown kind %q", e.Kind)
+	}
+	start, err := time.ParseInLocation(dateLayout, e.Start, gate.Location)
+	if err != nil {
+		return err
+	}
+	if e.End == "" {
+		e.End = e.Start
+	}
+	end, err := time.ParseInLocation(dateLayout, e.End, gate.Location)
+	if err != nil {
+		return err
+	}
+	if end.Before(start) {
+		return fmt.Errorf("end %s is before start %s", e.End, e.Start)
+	}
+	if (e.TimeFrom == "") != (e.TimeTo == "") {
+		return errors.New("both time from and time to expected")
+	}
+	// "8:00" is kept as "08:00" as it is shown and exported
+	for _, t := range []*string{&e.TimeFrom, &e.TimeTo} {
+		if *t == "" {
+			continue
+		}
+		tm, err := time.Parse("15:04", *t)
+		if err != nil {
+			return fmt.Errorf("bad time %q", *t)
+		}
+		*t = tm.Format("15:04")
+	}
+	if e.TimeFrom != "" && e.TimeFrom >= e.TimeTo {
+		return fmt.Errorf("time from %s is not before time to %s", e.TimeFrom, e.TimeTo)
+	}
+	for _, sch := range []map[string]int{e.Schedule, e.BLESchedule} {
+		for k := range sch {
+			if _, err := time.Parse("15:04", k); err != nil {
+				return fmt.Errorf("bad schedule time %q", k)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Exception) contains(date string) bool {
+	return e.Start <= date && date <= e.End
+}
+
+func (e *Exception) days() int {
+	start, _ := time.Parse(dateLayout, e.Start)
+	end, _ := time.Parse(dateLayout, e.End)
+	return int(end.Sub(start).Hours() / 24)
+}
+
+func (e *Exception) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s %s", e.ID, e.Kind, e.Start)
+	if e.End != e.Start {
+		sb.WriteString("/" + e.End)
+	}
+	if e.TimeFrom != "" {
+		fmt.Fprintf(&sb, " %s-%s", e.TimeFrom, e.TimeTo)
+	}
+	sb.WriteString(" " + e.Name)
+	if len(e.Schedule) != 0 {
+		bb, _ := json.Marshal(e.Schedule)
+		sb.WriteString(" timer " + strings.Trim(string(bb), "{}"))
+	}
+	if len(e.BLESchedule) != 0 {
+		bb, _ := json.Marshal(e.BLESchedule)
+		sb.WriteString(" ble_timer " + strings.Trim(string(bb), "{}"))
+	}
+	return sb.String()
+}
+
+type Calendar struct {
+	Exceptions []*Exception
+}
+
+// Put adds the exception or replaces the one with the same ID
+func (c *Calendar) Put(e *Exception) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(c.Exceptions, func(x *Exception) bool { return x.ID == e.ID })
+	if i < 0 {
+		c.Exceptions = append(c.Exceptions, e)
+	} else {
+		c.Exceptions[i] = e
+	}
+	slices.SortStableFunc(c.Exceptions, func(a, b *Exception) int {
+		return cmp.Or(cmp.Compare(a.Start, b.Start), cmp.Compare(a.ID, b.ID))
+	})
+	return nil
+}
+
+func (c *Calendar) Get(id string) *Exception {
+	for _, e := range c.Exceptions {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *Calendar) Delete(id string) bool {
+	n := len(c.Exceptions)
+	c.Exceptions = slices.DeleteFunc(c.Exceptions, func(x *Exception) bool { return x.ID == id })
+	return len(c.Exceptions) != n
+}
+
+// Clone returns a copy sharing exceptions, calendars are replaced as a whole on change
+func (c *Calendar) Clone() *Calendar {
+	if c == nil {
+		return &Calendar{}
+	}
+	return &Calendar{Exceptions: slices.Clone(c.Exceptions)}
+}
+
+// Upcoming returns exceptions not ended before t
+func (c *Calendar) Upcoming(t time.Time) []*Exception {
+	if c == nil {
+		return nil
+	}
+	date := t.In(gate.Location).Format(dateLayout)
+	var res []*Exception
+	for _, e := range c.Exceptions {
+		if e.End >= date {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Day is an effect of exceptions on a date
+type Day struct {
+	Weekday     time.Weekday
+	Schedule    map[string]int
+	BLESchedule map[string]int
+	KeepOpen    *Exception
+	Names       []string
+}
+
+// On returns the effect of exceptions on the date of t.
+// On conflicts the shortest exception wins, so a holiday inside a season overrides it.
+func (c *Calendar) On(t time.Time) *Day {
+	local := t.In(gate.Location)
+	day := &Day{Weekday: local.Weekday()}
+	if c == nil {
+		return day
+	}
+	date := local.Format(dateLayout)
+	var active []*Exception
+	for _, e := range c.Exceptions {
+		if e.contains(date) {
+			active = append(active, e)
+		}
+	}
+	// longest first, so shorter ones override
+	slices.SortStableFunc(active, func(a, b *Exception) int {
+		return cmp.Compare(b.days(), a.days())
+	})
+	for _, e := range active {
+		day.Names = append(day.Names, e.Name)
+		switch e.Kind {
+		case Holiday:
+			day.Weekday = time.Sunday
+		case Workday:
+			day.Weekday = time.Monday
+		case KeepOpen:
+			day.KeepOpen = e
+		}
+		if len(e.Schedule) != 0 {
+			day.Schedule = e.Schedule
+		}
+		if len(e.BLESchedule) != 0 {
+			day.BLESchedule = e.BLESchedule
+		}
+	}
+	return day
+}
+
+// Weekday returns weekday used by time group checks
+func (c *Calendar) Weekday(t time.Time) time.Weekday {
+	return c.On(t).Weekday
+}
+
+// KeepOpenAt returns the keep open exception active at t
+func (c *Calendar) KeepOpenAt(t time.Time) *Exception {
+	e := c.On(t).KeepOpen
+	if e == nil || e.TimeFrom == "" {
+		return e
+	}
+	// times are parsed, exceptions saved before they were validated may have "8:00"
+	from, err1 := time.Parse("15:04", e.TimeFrom)
+	to, err2 := time.Parse("15:04", e.TimeTo)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	t = t.In(gate.Location)
+	m := minuteOfDay(t)
+	if minuteOfDay(from) <= m && m < minuteOfDay(to) {
+		return e
+	}
+	return nil
+}
+
+func minuteOfDay(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
@@ -0,0 +1,114 @@
+package calendar
+
+import (
+	"7stgbot/gate"
+	"testing"
+	"time"
+)
+
+func at(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, gate.Location)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestOn(t *testing.T) {
+	var c Calendar
+	for _, e := range []*Exception{
+		{ID: "summer", Kind: Season, Start: "2026-06-01", End: "2026-08-31", Schedule: map[string]int{"07:00": 5}},
+		{ID: "may1", Kind: Holiday, Start: "2026-05-01", End: "2026-05-03"},
+		{ID: "june12", Kind: Holiday, Start: "2026-06-12", Schedule: map[string]int{"00:00": 30}},
+		{ID: "sat", Kind: Workday, Start: "2026-06-13"},
+		{ID: "fair", Kind: KeepOpen, Start: "2026-06-20", TimeFrom: "10:00", TimeTo: "18:00"},
+		{ID: "market", Kind: KeepOpen, Start: "2026-06-27", TimeFrom: "8:00", TimeTo: "18:00"},
+	} {
+		if err := c.Put(e); err != nil {
+			t.Fatalf("put %s: %v", e.ID, err)
+		}
+	}
+	if got, want := c.Exceptions[len(c.Exceptions)-1].TimeFrom, "08:00"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// saved before times were normalized
+	c.Exceptions = append(c.Exceptions, &Exception{ID: "old", Kind: KeepOpen, Start: "2026-07-04", End: "2026-07-04", TimeFrom: "9:00", TimeTo: "18:00"})
+	tests := []struct {
+		t        string
+		weekday  time.Weekday
+		schedule int
+		keepOpen string
+	}{
+		{"2026-04-30 12:00", time.Thursday, 0, ""},
+		{"2026-05-01 12:00", time.Sunday, 0, ""},
+		{"2026-05-03 23:59", time.Sunday, 0, ""},
+		{"2026-05-04 00:00", time.Monday, 0, ""},
+		{"2026-06-11 12:00", time.Thursday, 5, ""},
+		{"2026-06-12 12:00", time.Sunday, 30, ""},
+		{"2026-06-13 12:00", time.Monday, 5, ""},
+		{"2026-06-20 09:59", time.Saturday, 5, ""},
+		{"2026-06-20 10:00", time.Saturday, 5, "fair"},
+		{"2026-06-20 18:00", time.Saturday, 5, ""},
+		{"2026-06-27 07:59", time.Saturday, 5, ""},
+		{"2026-06-27 12:00", time.Saturday, 5, "market"},
+		{"2026-07-04 08:59", time.Saturday, 5, ""},
+		{"2026-07-04 12:00", time.Saturday, 5, "old"},
+	}
+	for _, tt := range tests {
+		tm := at(tt.t)
+		day := c.On(tm)
+		if day.Weekday != tt.weekday {
+			t.Errorf("%s weekday: got %v, want %v", tt.t, day.Weekday, tt.weekday)
+		}
+		sch := 0
+		for _, v := range day.Schedule {
+			sch = v
+		}
+		if sch != tt.schedule {
+			t.Errorf("%s schedule: got %v, want %v", tt.t, sch, tt.schedule)
+		}
+		ko := ""
+		if e := c.KeepOpenAt(tm); e != nil {
+			ko = e.ID
+		}
+		if ko != tt.keepOpen {
+			t.Errorf("%s keep open: got %q, want %q", tt.t, ko, tt.keepOpen)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		e  Exception
+		ok bool
+	}{
+		{Exception{ID: "a", Kind: Holiday, Start: "2026-01-01"}, true},
+		{Exception{ID: "", Kind: Holiday, Start: "2026-01-01"}, false},
+		{Exception{ID: "a", Kind: "vacation", Start: "2026-01-01"}, false},
+		{Exception{ID: "a", Kind: Holiday, Start: "2026-01-02", End: "2026-01-01"}, false},
+		{Exception{ID: "a", Kind: KeepOpen, Start: "2026-01-01", TimeFrom: "10:00"}, false},
+		{Exception{ID: "a", Kind: KeepOpen, Start: "2026-01-01", TimeFrom: "10:00", TimeTo: "25:00"}, false},
+		{Exception{ID: "a", Kind: KeepOpen, Start: "2026-01-01", TimeFrom: "18:00", TimeTo: "8:00"}, false},
+		{Exception{ID: "a", Kind: KeepOpen, Start: "2026-01-01", TimeFrom: "8:00", TimeTo: "18:00"}, true},
+		{Exception{ID: "a", Kind: Season, Start: "2026-01-01", Schedule: map[string]int{"7": 1}}, false},
+	}
+	for i, tt := range tests {
+		err := tt.e.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: got %v, want ok %v", i, err, tt.ok)
+		}
+	}
+}
+
+func TestPutReplaces(t *testing.T) {
+	var c Calendar
+	c.Put(&Exception{ID: "b", Kind: Holiday, Start: "2026-03-08"})
+	c.Put(&Exception{ID: "a", Kind: Holiday, Start: "2026-02-23"})
+	c.Put(&Exception{ID: "b", Kind: Workday, Start: "2026-03-07"})
+	if len(c.Exceptions) != 2 || c.Exceptions[0].ID != "a" || c.Get("b").Kind != Workday {
+		t.Errorf("got %v, want a, b workday", c.Exceptions)
+	}
+	if !c.Delete("a") || c.Delete("a") || len(c.Exceptions) != 1 {
+		t.Errorf("delete: got %v", c.Exceptions)
+	}
+}
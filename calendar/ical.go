@@ -0,0 +1,206 @@
+package calendar
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	icalDate = "20060102"
+	prodID   = "-//7slavka//gate calendar//RU"
+)
+
+// WriteICal writes calendar as iCalendar (RFC 5545) with all-day events.
+// Kind, time window and schedules are kept in X-7S- properties, so the file can be imported back.
+func (c *Calendar) WriteICal(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	line := func(s string) {
+		// lines are folded at 75 octets without breaking utf-8 sequences
+		for len(s) > 75 {
+			n := 75
+			for n > 0 && s[n]&0xC0 == 0x80 {
+				n--
+			}
+			bw.WriteString(s[:n] + "\r\n")
+			s = " " + s[n:]
+		}
+		bw.WriteString(s + "\r\n")
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:" + prodID)
+	line("CALSCALE:GREGORIAN")
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, e := range c.Exceptions {
+		start, err := time.Parse(dateLayout, e.Start)
+		if err != nil {
+			return err
+		}
+		end, err := time.Parse(dateLayout, e.End)
+		if err != nil {
+			return err
+		}
+		line("BEGIN:VEVENT")
+		line("UID:" + escapeText(e.ID))
+		line("DTSTAMP:" + stamp)
+		line("DTSTART;VALUE=DATE:" + start.Format(icalDate))
+		line("DTEND;VALUE=DATE:" + end.AddDate(0, 0, 1).Format(icalDate))
+		line("SUMMARY:" + escapeText(e.Name))
+		line("CATEGORIES:" + escapeText(string(e.Kind)))
+		line("TRANSP:TRANSPARENT")
+		line("X-7S-KIND:" + string(e.Kind))
+		if e.TimeFrom != "" {
+			line("X-7S-TIME:" + e.TimeFrom + "-" + e.TimeTo)
+		}
+		if len(e.Schedule) != 0 {
+			bb, _ := json.Marshal(e.Schedule)
+			line("X-7S-SCHEDULE:" + escapeText(string(bb)))
+		}
+		if len(e.BLESchedule) != 0 {
+			bb, _ := json.Marshal(e.BLESchedule)
+			line("X-7S-BLE-SCHEDULE:" + escapeText(string(bb)))
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return bw.Flush()
+}
+
+// ReadICal reads events of iCalendar. Events without X-7S-KIND are holidays,
+// so public holiday calendars can be imported as is.
+func ReadICal(r io.Reader) ([]*Exception, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var res []*Exception
+	var e *Exception
+	var dtEnd string
+	var dtEndExclusive bool
+	for i, l := range lines {
+		name, params, value := splitProperty(l)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			e = &Exception{Kind: Holiday}
+			dtEnd, dtEndExclusive = "", false
+			continue
+		case e == nil:
+			continue
+		}
+		switch name {
+		case "END":
+			if value != "VEVENT" {
+				continue
+			}
+			if e.Start == "" {
+				return nil, fmt.Errorf("line %d: event %q without DTSTART", i+1, e.ID)
+			}
+			e.End = e.Start
+			if dtEnd != "" {
+				end, err := time.Parse(dateLayout, dtEnd)
+				if err != nil {
+					return nil, err
+				}
+				if dtEndExclusive {
+					end = end.AddDate(0, 0, -1)
+				}
+				if f := end.Format(dateLayout); f > e.Start {
+					e.End = f
+				}
+			}
+			if e.ID == "" {
+				e.ID = e.Start + "-" + e.Name
+			}
+			if err := e.Validate(); err != nil {
+				return nil, fmt.Errorf("line %d: event %q: %w", i+1, e.ID, err)
+			}
+			res = append(res, e)
+			e = nil
+		case "UID":
+			e.ID = unescapeText(value)
+		case "SUMMARY":
+			e.Name = unescapeText(value)
+		case "DTSTART":
+			d, err := icalDateOf(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			e.Start = d
+		case "DTEND":
+			d, err := icalDateOf(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			dtEnd = d
+			// DTEND of all-day events and events ending at midnight is exclusive
+			dtEndExclusive = strings.Contains(params, "VALUE=DATE") || len(value) == 8 ||
+				strings.HasPrefix(value[8:], "T000000")
+		case "X-7S-KIND":
+			e.Kind = Kind(value)
+		case "X-7S-TIME":
+			e.TimeFrom, e.TimeTo, _ = strings.Cut(value, "-")
+		case "X-7S-SCHEDULE":
+			if err := json.Unmarshal([]byte(unescapeText(value)), &e.Schedule); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		case "X-7S-BLE-SCHEDULE":
+			if err := json.Unmarshal([]byte(unescapeText(value)), &e.BLESchedule); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+	}
+	return res, nil
+}
+
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		l := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) != 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, sc.Err()
+}
+
+// splitProperty splits "DTSTART;VALUE=DATE:20260501" into name, params and value
+func splitProperty(l string) (name, params, value string) {
+	head, value, _ := strings.Cut(l, ":")
+	name, params, _ = strings.Cut(head, ";")
+	return strings.ToUpper(name), strings.ToUpper(params), value
+}
+
+// icalDateOf returns local date of DATE or DATE-TIME value
+func icalDateOf(v string) (string, error) {
+	if len(v) < 8 {
+		return "", fmt.Errorf("bad date %q", v)
+	}
+	t, err := time.Parse(icalDate, v[:8])
+	if err != nil {
+		return "", err
+	}
+	return t.Format(dateLayout), nil
+}
+
+var (
+	textEscaper   = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+	textUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+)
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func unescapeText(s string) string {
+	return textUnescaper.Replace(s)
+}
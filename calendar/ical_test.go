@@ -0,0 +1,58 @@
+package calendar
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestICalRoundTrip(t *testing.T) {
+	var c Calendar
+	for _, e := range []*Exception{
+		{ID: "ny", Name: "Новогодние каникулы, отдых; " + strings.Repeat("длинное имя ", 8), Kind: Holiday,
+			Start: "2026-01-01", End: "2026-01-08"},
+		{ID: "fair", Name: "Ярмарка", Kind: KeepOpen, Start: "2026-06-20", TimeFrom: "10:00", TimeTo: "18:00"},
+		{ID: "summer", Name: "Лето", Kind: Season, Start: "2026-06-01", End: "2026-08-31",
+			Schedule: map[string]int{"07:00": 5, "22:00": 30}, BLESchedule: map[string]int{"00:00": 1}},
+	} {
+		if err := c.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := c.WriteICal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range strings.Split(buf.String(), "\r\n") {
+		if len(l) > 75 {
+			t.Errorf("line is longer than 75 octets: %q", l)
+		}
+	}
+	got, err := ReadICal(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c.Exceptions) {
+		t.Errorf("got %v, want %v", got, c.Exceptions)
+	}
+}
+
+func TestReadICalHolidays(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\nUID:d1@example.com\r\nDTSTART;VALUE=DATE:20260501\r\nDTEND;VALUE=DATE:20260502\r\n" +
+		"SUMMARY:Праздник Весны\r\n  и Труда\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nDTSTART:20260609T000000\r\nDTEND:20260613T000000\r\nSUMMARY:Дни\\, России\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	got, err := ReadICal(strings.NewReader(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Exception{
+		{ID: "d1@example.com", Name: "Праздник Весны и Труда", Kind: Holiday, Start: "2026-05-01", End: "2026-05-01"},
+		{ID: "2026-06-09-Дни, России", Name: "Дни, России", Kind: Holiday, Start: "2026-06-09", End: "2026-06-12"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
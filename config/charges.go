@@ -0,0 +1,61 @@
+package config
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultChargePurpose is the purpose of a charge without Purpose
+const DefaultChargePurpose = "{name}, срок {due}, участок {plot}"
+
+var chargeIDRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ChargeConfig is a payment of plots other than electricity, [Charges.<id>] in config.toml: membership fee,
+// target contributions, fines, pass cards. The amount is charged by each of Due dates.
+type ChargeConfig struct {
+	Name    string             // "Членский взнос"
+	Amount  float64            // rubles of a plot
+	Plots   map[string]float64 // amounts of plots other than Amount, 0 - the plot is not charged
+	Due     []string           // 2006-01-02
+	Purpose string             // {name}, {plot}, {due} dd.mm.yyyy, {year} of the due date and {sum}
+}
+
+// PlotAmount returns the amount of the plot in rubles
+func (c *ChargeConfig) PlotAmount(plot string) float64 {
+	if v, ok := c.Plots[plot]; ok {
+		return v
+	}
+	return c.Amount
+}
+
+func (c *Config) validateCharges(add func(format string, a ...any)) {
+	for id, ch := range c.Charges {
+		name := "Charges." + id
+		if !chargeIDRE.MatchString(id) {
+			add("%s: bad id, [a-z0-9_-] expected", name)
+		}
+		if ch.Name == "" {
+			add("%s: Name expected", name)
+		}
+		if ch.Amount < 0 {
+			add("%s: negative Amount %v", name, ch.Amount)
+		}
+		for plot, v := range ch.Plots {
+			if v < 0 {
+				add("%s: plot %s negative amount %v", name, plot, v)
+			}
+		}
+		if len(ch.Due) == 0 {
+			add("%s: Due dates expected", name)
+		}
+		for _, d := range ch.Due {
+			if _, err := time.Parse(time.DateOnly, d); err != nil {
+				add("%s: bad due date %q, yyyy-mm-dd expected", name, d)
+			}
+		}
+		if ch.Purpose != "" && !strings.Contains(ch.Purpose, "{plot}") {
+			add("%s: Purpose without {plot}", name)
+		}
+	}
+}
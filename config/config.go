@@ -6,37 +6,36 @@ import (
 )
 
 type Config struct {
-	Port                   int
-	StaticDir              string
-	StaticGateAppDir       string
-	TgToken                string
-	Price                  map[string]float64
-	Coef                   map[string]float64
-	QR                     map[string]string
-	DiscordAlertChannelURL string
-	IfTTTKey               string
-	AdminEmails            []string
-	AdminPhone             string
-	SMSRateLimiterCfg      map[string]int
-	SMSRateLimiter         []Rate
-	Gate                   struct {
-		IP   string
-		User string
-		Pwd  string
-
-		Relay struct {
-			OnOffTextName string
-			OnTextName    string
-			OffTextName   string
-			SwitchName    string
-		}
-	}
+	Port                          int
+	StaticDir                     string
+	StaticGateAppDir              string
+	TgToken                       string
+	TgWebhookURL                  string // https://<domain>/tg/webhook, long polling if empty
+	TgWebhookSecret               string // secret "telegram-webhook-secret", random on start if empty
+	Price                         map[string]float64
+	Coef                          map[string]float64
+	QR                            map[string]string       // requisites of the payee of ГОСТ Р 56042, Name, PersonalAcc, ...
+	QREncoding                    string                  // ST00012 (UTF-8) by default or ST00011 (cp1251)
+	Charges                       map[string]ChargeConfig // payments other than electricity by id, see ChargeConfig
+	DiscordAlertChannelURL        string
+	IfTTTKey                      string
+	AdminEmails                   []string
+	AdminPhone                    string
+	SMSRateLimiterCfg             map[string]int
+	SMSRateLimiter                []Rate `toml:"-"` // derived from SMSRateLimiterCfg
+	Gate                          RelayConfig
 	TelegramUrl                   string
 	TelegramChatId                string
 	TelegramTimeoutSec            int
 	ProxyUrl                      string
 	PalesPortalUser               string
 	PalesPortalPwd                string
+	PalesPortalURL                string
+	PalesDeviceID                 string
+	MattermostCommandTokens       map[string]string // command -> token, secrets "mattermost-token-<command>" are checked first
+	MattermostAdmins              []string          // user ids allowed to run admin commands, names are not unique over time
+	MattermostURL                 string            // server of the bot, https://mattermost.example.com
+	MattermostBotToken            string            // access token of the bot, secret "mattermost-bot-token"
 	BleWatchLocation              int
 	GateOpenNumber                string
 	GateInfoNumber                string
@@ -59,6 +58,16 @@ type Config struct {
 	LogsTikerMinutes              int64
 	TestLocation                  int
 	LogLocations                  map[string]bool
+	GateID                        string // id of the gate configured at the top level, "main" by default
+	GateName                      string
+	GatePath                      string       `toml:"-"` // "/g/<id>" URL prefix of additional gates, derived
+	Gates                         []GateConfig // additional gates, see GateConfig
+	AppDomain                     string
+	SiteDomain                    string
+	NtfyEventsTopic               string
+	NtfySystemTopic               string
+	BLELocation                   int // location of BLE trackers of the gate, 100 by default
+	Notify                        NotifyConfig
 	MQTT                          struct {
 		F struct {
 			URL             string
@@ -71,6 +80,19 @@ type Config struct {
 	}
 }
 
+type RelayConfig struct {
+	IP   string
+	User string
+	Pwd  string
+
+	Relay struct {
+		OnOffTextName string
+		OnTextName    string
+		OffTextName   string
+		SwitchName    string
+	}
+}
+
 func (c *Config) GateRelayTextGetURL(name string) string {
 	return fmt.Sprintf("http://%s/text/%s", c.Gate.IP, name)
 }
@@ -93,6 +115,20 @@ func (h *ConfigSubscription) Subscribe() chan *Config {
 	return ch
 }
 
+// Publish sends the config to subscribers without blocking, a config not received yet is replaced
+func (h *ConfigSubscription) Publish(cfg *Config) {
+	for _, ch := range h.Subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- cfg:
+		default:
+		}
+	}
+}
+
 type Rate struct {
 	Ticker time.Duration
 	Cnt    int
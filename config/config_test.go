@@ -0,0 +1,248 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const good = `
+Port = 8084
+AdminPhone = "+79261234567"
+TgToken = "5518888888:AAH"
+TelegramUrl = "https://api.telegram.org/bot551:AAHVFsEYIa/sendMessage"
+KeypadHitLimit = 5
+MattermostAdmins = ["8xk1qz3m5bf7jrd9a6yw4pcn2e"]
+
+[SMSRateLimiterCfg]
+1h = 100
+5s = 1
+
+[OpenSchedule]
+"9:00" = 10
+"22:00" = 15
+
+[BTMacAutoOpenGate]
+"5B:BB:2D:AD:B1:E7" = "79851234567"
+
+[WiFiMacNames]
+"ce:09:55:75:33:1b" = "Сергей"
+
+[Price]
+202201 = 5.93
+
+[QR]
+Name = "СНТ"
+PersonalAcc = "40703810000000000001"
+BankName = "Банк"
+BIC = "044525225"
+CorrespAcc = "30101810400000000225"
+
+[Charges.membership]
+Name = "Членский взнос"
+Amount = 6000
+Due = ["2024-06-30"]
+Purpose = "Членский взнос за {year}, участок {plot}"
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rate{{Ticker: 5 * time.Second, Cnt: 1}, {Ticker: time.Hour, Cnt: 100}}
+	if !slices.Equal(c.SMSRateLimiter, want) {
+		t.Errorf("got %v, want %v", c.SMSRateLimiter, want)
+	}
+
+	bad := strings.NewReplacer(
+		`"+79261234567"`, `"+7926"`,
+		`1h = 100`, `1x = 100`,
+		`"9:00"`, `"9"`,
+		`"5B:BB:2D:AD:B1:E7" = "79851234567"`, `"5B:BB:2D:AD:B1" = "mike"`,
+		`https://api`, `api`,
+		`202201`, `2022`,
+		`8xk1qz3m5bf7jrd9a6yw4pcn2e`, `boss`,
+		`BIC = "044525225"`, `BIC = "04452522"`,
+		`"2024-06-30"`, `"30.06.2024"`,
+	).Replace(good)
+	_, err = Parse([]byte(bad))
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	for _, s := range []string{
+		`AdminPhone: bad phone "+7926"`,
+		`SMSRateLimiterCfg: bad duration "1x"`,
+		`OpenSchedule: bad time "9"`,
+		`BTMacAutoOpenGate: bad MAC "5B:BB:2D:AD:B1"`,
+		`BTMacAutoOpenGate: 5B:BB:2D:AD:B1 bad phone "mike"`,
+		`TelegramUrl: bad URL`,
+		`Price: bad month "2022"`,
+		`MattermostAdmins: "boss" is not a user id`,
+		`QR: BIC: "04452522" is not of 9 digits`,
+		`Charges.membership: bad due date "30.06.2024"`,
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("got %v, want %q", err, s)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, err := Parse([]byte(good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Parse([]byte(strings.NewReplacer(
+		"Port = 8084", "Port = 8085",
+		`TgToken = "5518888888:AAH"`, `TgToken = "5518888888:BBB"`,
+		`"22:00" = 15`, ``,
+		`"Сергей"`, `"Сергей 2"`,
+	).Replace(good) + "\n[BTMacNames]\n\"C1:58:53:EB:43:32\" = \"помойка\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Diff(a, b)
+	want := []string{
+		`BTMacNames[C1:58:53:EB:43:32]: + "помойка"`,
+		`OpenSchedule[22:00]: - "15"`,
+		`Port: "8084" -> "8085"`,
+		`TgToken: "***" -> "***"`,
+		`WiFiMacNames[ce:09:55:75:33:1b]: "Сергей" -> "Сергей 2"`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if d := Diff(a, a); len(d) != 0 {
+		t.Errorf("got %v, want no changes", d)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	var h ConfigSubscription
+	ch := h.Subscribe()
+	a, b := &Config{Port: 1}, &Config{Port: 2}
+	h.Publish(a)
+	h.Publish(b) // not received a is replaced, no blocking
+	if got := <-ch; got != b {
+		t.Errorf("got %v, want %v", got.Port, b.Port)
+	}
+}
+
+func TestGateConfigs(t *testing.T) {
+	c, err := Parse([]byte(good + `
+[[Gates]]
+ID = "service"
+GateOpenNumber = "79001112233"
+PalesDeviceID = "4G600000"
+Gate.IP = "192.168.1.200"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gg := c.GateConfigs()
+	if got, want := len(gg), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	tests := []struct {
+		got, want any
+	}{
+		{gg[0].GateID, DefaultGateID},
+		{gg[0].GatePath, ""},
+		{gg[1].GatePath, "/g/service"},
+		{gg[1].GateOpenNumber, "79001112233"},
+		{gg[1].PalesDeviceID, "4G600000"},
+		{gg[1].Gate.IP, "192.168.1.200"},
+		{gg[1].AdminPhone, c.AdminPhone},
+		{gg[1].BLELocation, 0},
+		{len(gg[1].BTMacAutoOpenGate), 0},
+	}
+	for i, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%d: got %v, want %v", i, tt.got, tt.want)
+		}
+	}
+
+	_, err = Parse([]byte(good + `
+[[Gates]]
+ID = "main"
+BLELocation = 100
+[[Gates]]
+ID = "Bad Id"
+`))
+	for _, s := range []string{
+		`Gates[0]: duplicate id "main"`,
+		`Gates[0]: BLELocation 100 is used by top level`,
+		`Gates[1]: bad id "Bad Id"`,
+		`Gates[1]: Gate.IP is required`,
+		`Gates[1]: PalesDeviceID is required`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), s) {
+			t.Errorf("got %v, want %q", err, s)
+		}
+	}
+}
+
+func TestNotifyConfig(t *testing.T) {
+	c, err := Parse([]byte(good + `
+[Notify.Sinks.board]
+Type = "mattermost"
+URL = "https://mm.example.com/hooks/abc"
+Target = "board"
+
+[[Notify.Rules]]
+Events = ["system.opened"]
+MinSeverity = "info"
+Sinks = ["board", "telegram"]
+Template = "{{.Text}} {{ts .Time}}"
+QuietHours = "23:00-07:00"
+Dedup = "10m"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.NotifyRules(); len(got) != 2 || got[0].Sinks[0] != SinkResident {
+		t.Errorf("got %+v, want the resident rule and the configured one", got)
+	}
+	if got, want := len((&Config{}).NotifyRules()), len(DefaultNotifyRules); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, err = Parse([]byte(good + `
+[Notify.Sinks.board]
+Type = "slack"
+
+[Notify.Sinks.chat]
+Type = "discord"
+
+[Notify.Sinks.mm]
+Type = "mattermost"
+Target = "@admin"
+
+[[Notify.Rules]]
+Events = ["system"]
+MinSeverity = "loud"
+Sinks = ["nowhere"]
+Template = "{{.Text"
+QuietHours = "23-07"
+Batch = "soon"
+`))
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	for _, s := range []string{
+		`Notify.Sinks.board: bad type "slack"`,
+		`Notify.Sinks.chat: webhook URL expected`,
+		`Notify.Sinks.mm: webhook URL or MattermostURL and Target expected`,
+		`Notify.Rules[0]: unknown sink "nowhere"`,
+		`Notify.Rules[0]: bad MinSeverity "loud"`,
+		`Notify.Rules[0]: bad template`,
+		`Notify.Rules[0]: bad QuietHours "23-07"`,
+		`Notify.Rules[0]: bad Batch duration "soon"`,
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("got %v, want %q", err, s)
+		}
+	}
+}
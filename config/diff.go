@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type flatValue struct {
+	value  string
+	secret bool
+}
+
+func (v flatValue) String() string {
+	if v.secret && v.value != "" {
+		return "***"
+	}
+	return v.value
+}
+
+// Diff returns human readable changes of the config, secrets are masked
+func Diff(old, cur *Config) []string {
+	a := make(map[string]flatValue)
+	b := make(map[string]flatValue)
+	flatten("", reflect.ValueOf(old).Elem(), false, a)
+	flatten("", reflect.ValueOf(cur).Elem(), false, b)
+	var res []string
+	for k, v := range a {
+		w, ok := b[k]
+		switch {
+		case !ok:
+			res = append(res, fmt.Sprintf("%s: - %q", k, v))
+		case v.value != w.value:
+			res = append(res, fmt.Sprintf("%s: %q -> %q", k, v, w))
+		}
+	}
+	for k, w := range b {
+		if _, ok := a[k]; !ok {
+			res = append(res, fmt.Sprintf("%s: + %q", k, w))
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func isSecret(name string) bool {
+	for _, s := range []string{"Pwd", "Token", "Tokens", "Key", "Password"} {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func flatten(path string, v reflect.Value, secret bool, out map[string]flatValue) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Tag.Get("toml") == "-" {
+				continue
+			}
+			name := f.Name
+			if path != "" {
+				name = path + "." + f.Name
+			}
+			flatten(name, v.Field(i), secret || isSecret(f.Name), out)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			flatten(fmt.Sprintf("%s[%d]", path, i), v.Index(i), secret, out)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			flatten(fmt.Sprintf("%s[%v]", path, k.Interface()), v.MapIndex(k), secret, out)
+		}
+	default:
+		out[path] = flatValue{value: fmt.Sprint(v.Interface()), secret: secret}
+	}
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+)
+
+const (
+	DefaultGateID          = "main"
+	DefaultAppDomain       = "gate.7slavka.ru"
+	DefaultSiteDomain      = "7slavka.ru"
+	DefaultNtfyEventsTopic = "7g-events"
+	DefaultNtfySystemTopic = "system"
+	DefaultBLELocation     = 100
+)
+
+var gateIDRE = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// GateConfig is an additional gate served by the same process, [[Gates]] in config.toml.
+// Empty fields are taken from the top level except Gate and PalesDeviceID, those are required. The gate has its own data dir gates/<id> with
+// pales_users.csv, gate-phones-restricted.txt and the db, its web routes are prefixed by /g/<id>.
+type GateConfig struct {
+	ID                      string
+	Name                    string
+	Gate                    RelayConfig
+	PalesDeviceID           string
+	GateOpenNumber          string
+	GateInfoNumber          string
+	TelegramChatId          string
+	NtfyEventsTopic         string
+	NtfySystemTopic         string
+	AppDomain               string
+	BLELocation             int
+	OpenSchedule            map[string]int
+	BTMacAutoOpenGate       map[string]string
+	WiFiMACAutoOpenGate     map[string]string
+	MattermostCommandTokens map[string]string
+}
+
+// GateConfigs returns the config of each gate, the top level gate is the first
+func (c *Config) GateConfigs() []*Config {
+	main := *c
+	main.GateID = cmp.Or(c.GateID, DefaultGateID)
+	main.GatePath = ""
+	res := []*Config{&main}
+	for _, gc := range c.Gates {
+		g := main
+		g.Gates = nil
+		g.GateID = gc.ID
+		g.GateName = gc.Name
+		g.GatePath = "/g/" + gc.ID
+		// the relay and the PalES device are the gate's own, validateGates requires them
+		g.Gate = gc.Gate
+		g.PalesDeviceID = gc.PalesDeviceID
+		g.GateOpenNumber = cmp.Or(gc.GateOpenNumber, g.GateOpenNumber)
+		g.GateInfoNumber = cmp.Or(gc.GateInfoNumber, g.GateInfoNumber)
+		g.TelegramChatId = cmp.Or(gc.TelegramChatId, g.TelegramChatId)
+		g.NtfyEventsTopic = cmp.Or(gc.NtfyEventsTopic, g.NtfyEventsTopic)
+		g.NtfySystemTopic = cmp.Or(gc.NtfySystemTopic, g.NtfySystemTopic)
+		g.AppDomain = cmp.Or(gc.AppDomain, g.AppDomain)
+		// BLE trackers of the top level location are not ones of the gate
+		g.BLELocation = gc.BLELocation
+		if gc.OpenSchedule != nil {
+			g.OpenSchedule = gc.OpenSchedule
+		}
+		g.BTMacAutoOpenGate = gc.BTMacAutoOpenGate
+		g.WiFiMACAutoOpenGate = gc.WiFiMACAutoOpenGate
+		g.MattermostCommandTokens = gc.MattermostCommandTokens
+		res = append(res, &g)
+	}
+	return res
+}
+
+func (c *Config) validateGates(add func(format string, a ...any)) {
+	ids := map[string]bool{cmp.Or(c.GateID, DefaultGateID): true}
+	locations := map[int]string{cmp.Or(c.BLELocation, DefaultBLELocation): "top level"}
+	if c.GateID != "" && !gateIDRE.MatchString(c.GateID) {
+		add("GateID: bad id %q, [a-z0-9-] expected", c.GateID)
+	}
+	for i, g := range c.Gates {
+		name := fmt.Sprintf("Gates[%d]", i)
+		switch {
+		case !gateIDRE.MatchString(g.ID):
+			add("%s: bad id %q, [a-z0-9-] expected", name, g.ID)
+		case ids[g.ID]:
+			add("%s: duplicate id %q", name, g.ID)
+		}
+		ids[g.ID] = true
+		if g.Gate.IP == "" {
+			add("%s: Gate.IP is required, the top level relay is not one of the gate", name)
+		}
+		if g.PalesDeviceID == "" {
+			add("%s: PalesDeviceID is required, the top level device is not one of the gate", name)
+		}
+		if g.BLELocation != 0 {
+			if other, ok := locations[g.BLELocation]; ok {
+				add("%s: BLELocation %d is used by %s", name, g.BLELocation, other)
+			}
+			locations[g.BLELocation] = g.ID
+		}
+		for k, v := range g.OpenSchedule {
+			if !hhmmRE.MatchString(k) || v < 0 {
+				add("%s: bad OpenSchedule %q = %d", name, k, v)
+			}
+		}
+		for _, m := range []map[string]string{g.BTMacAutoOpenGate, g.WiFiMACAutoOpenGate} {
+			for k, v := range m {
+				if !macRE.MatchString(k) || !phoneRE.MatchString(v) {
+					add("%s: bad MAC to phone %q = %q", name, k, v)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"7stgbot/paymentqr"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var (
+	macRE    = regexp.MustCompile(`^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$`)
+	phoneRE  = regexp.MustCompile(`^\+?[0-9]{10,15}$`)
+	hhmmRE   = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):[0-5][0-9]$`)
+	yyyymmRE = regexp.MustCompile(`^[0-9]{4}(0[1-9]|1[0-2])$`)
+	mmIDRE   = regexp.MustCompile(`^[a-z0-9]{26}$`)
+)
+
+// Load reads, validates the config and computes derived fields
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Config, error) {
+	c := new(Config)
+	if _, err := toml.Decode(string(data), c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	c.derive()
+	return c, nil
+}
+
+// derive computes fields which are not in the file
+func (c *Config) derive() {
+	c.SMSRateLimiter = nil
+	for k, v := range c.SMSRateLimiterCfg {
+		d, _ := time.ParseDuration(k)
+		c.SMSRateLimiter = append(c.SMSRateLimiter, Rate{Ticker: d, Cnt: v})
+	}
+	sort.Sort(ByRate(c.SMSRateLimiter))
+}
+
+// Validate returns all problems of the config joined
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		add("Port: bad port %d", c.Port)
+	}
+	for name, v := range map[string]int64{
+		"TelegramTimeoutSec":            int64(c.TelegramTimeoutSec),
+		"KeypadHitLimit":                int64(c.KeypadHitLimit),
+		"KeypadHitLimitDurationMinutes": c.KeypadHitLimitDurationMinutes,
+		"KeypadThrottleMinutes":         c.KeypadThrottleMinutes,
+		"BLEResumeAbsenceDurationSec":   c.BLEResumeAbsenceDurationSec,
+		"LogsTikerMinutes":              c.LogsTikerMinutes,
+	} {
+		if v < 0 {
+			add("%s: negative value %d", name, v)
+		}
+	}
+	for k, v := range c.SMSRateLimiterCfg {
+		if d, err := time.ParseDuration(k); err != nil || d <= 0 {
+			add("SMSRateLimiterCfg: bad duration %q", k)
+		}
+		if v <= 0 {
+			add("SMSRateLimiterCfg: %s count %d must be positive", k, v)
+		}
+	}
+	for k, v := range c.OpenSchedule {
+		if !hhmmRE.MatchString(k) {
+			add("OpenSchedule: bad time %q, hh:mm expected", k)
+		}
+		if v < 0 {
+			add("OpenSchedule: %s negative minutes %d", k, v)
+		}
+	}
+	for name, m := range map[string]map[string]float64{"Price": c.Price, "Coef": c.Coef} {
+		for k := range m {
+			if !yyyymmRE.MatchString(k) {
+				add("%s: bad month %q, yyyymm expected", name, k)
+			}
+		}
+	}
+	for name, p := range map[string]string{
+		"AdminPhone":     c.AdminPhone,
+		"GateOpenNumber": c.GateOpenNumber,
+		"GateInfoNumber": c.GateInfoNumber,
+	} {
+		if p != "" && !phoneRE.MatchString(p) {
+			add("%s: bad phone %q", name, p)
+		}
+	}
+	for _, id := range c.MattermostAdmins {
+		if !mmIDRE.MatchString(id) {
+			add("MattermostAdmins: %q is not a user id", id)
+		}
+	}
+	for name, m := range map[string]map[string]string{
+		"BTMacSystem":         c.BTMacSystem,
+		"BTMacIgnore":         c.BTMacIgnore,
+		"BTMacAutoOpenGate":   c.BTMacAutoOpenGate,
+		"BTMacNames":          c.BTMacNames,
+		"WiFiMACAutoOpenGate": c.WiFiMACAutoOpenGate,
+		"WiFiMacNames":        c.WiFiMacNames,
+	} {
+		for k := range m {
+			if !macRE.MatchString(k) {
+				add("%s: bad MAC %q", name, k)
+			}
+		}
+	}
+	for name, m := range map[string]map[string]string{
+		"BTMacAutoOpenGate":   c.BTMacAutoOpenGate,
+		"WiFiMACAutoOpenGate": c.WiFiMACAutoOpenGate,
+		"MaskedPhones":        c.MaskedPhones,
+	} {
+		for k, v := range m {
+			if !phoneRE.MatchString(v) {
+				add("%s: %s bad phone %q", name, k, v)
+			}
+		}
+	}
+	for name, u := range map[string]string{
+		"DiscordAlertChannelURL": c.DiscordAlertChannelURL,
+		"TelegramUrl":            c.TelegramUrl,
+		"TgWebhookURL":           c.TgWebhookURL,
+		"ProxyUrl":               c.ProxyUrl,
+		"PalesPortalURL":         c.PalesPortalURL,
+		"NtfyURL":                c.NtfyURL,
+		"MattermostURL":          c.MattermostURL,
+		"MQTT.F.URL":             c.MQTT.F.URL,
+	} {
+		if u == "" {
+			continue
+		}
+		if p, err := url.Parse(u); err != nil || p.Scheme == "" || p.Host == "" {
+			add("%s: bad URL %q", name, u)
+		}
+	}
+	if len(c.QR) != 0 {
+		p, err := paymentqr.FromMap(c.QR)
+		if err == nil {
+			err = p.Validate()
+		}
+		if err != nil {
+			for _, e := range strings.Split(err.Error(), "\n") {
+				add("QR: %s", e)
+			}
+		}
+	}
+	if _, err := paymentqr.ParseEncoding(c.QREncoding); err != nil {
+		add("QREncoding: %v", err)
+	}
+	c.validateGates(add)
+	c.validateNotify(add)
+	c.validateCharges(add)
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Sinks which exist without [Notify.Sinks], they follow the config of each gate
+const (
+	SinkTelegram   = "telegram"    // TelegramChatId
+	SinkNtfySystem = "ntfy-system" // NtfySystemTopic
+	SinkNtfyEvents = "ntfy-events" // NtfyEventsTopic
+	SinkResident   = "resident"    // Telegram chats and Web Push subscriptions of the phone of the event
+)
+
+// EventResident is the type of messages to residents, they go to SinkResident only
+const EventResident = "resident"
+
+var (
+	sinkTypes     = []string{"telegram", "ntfy", "mattermost", "discord", "email", "webpush"}
+	severityNames = []string{"", "debug", "info", "warning", "critical"}
+	// templateFuncs are stubs of notify.Funcs to check templates
+	templateFuncs = template.FuncMap{"ts": func(time.Time) string { return "" }}
+)
+
+// NotifyConfig routes events to sinks, [Notify] in config.toml. Without rules system events
+// go to telegram and ntfy-system, user ones to ntfy-events, BLE trackings are batched. Messages to residents
+// follow ResidentNotifyRule unless a rule routes them.
+type NotifyConfig struct {
+	Sinks map[string]SinkConfig
+	Rules []NotifyRule
+}
+
+type SinkConfig struct {
+	Type     string // telegram, ntfy, mattermost, discord, email, webpush
+	Target   string // chat id, topic, channel, mattermost channel id or @username, email address, empty webpush target is all subscriptions
+	URL      string // webhook of mattermost and discord, server of ntfy, mattermost without it posts by the bot of MattermostURL
+	Template string // default text/template of the sink, the event is the data
+}
+
+// NotifyRule matches events by types, "system" matches "system" and "system.ble", "*" matches all.
+// The first matching rule is applied.
+type NotifyRule struct {
+	Events      []string
+	MinSeverity string            // debug, info, warning, critical
+	Sinks       []string          // names of [Notify.Sinks] or built-in ones
+	Template    string            // for all sinks of the rule
+	Templates   map[string]string // by sink
+	QuietHours  string            // "23:00-07:00", events below critical are sent at the end
+	Dedup       string            // duration to drop the same events
+	Batch       string            // duration to collect events in one message
+	BatchFirst  string            // duration of the first batch, Batch by default
+}
+
+// ResidentNotifyRule holds messages to residents for the night and drops repeated ones
+var ResidentNotifyRule = NotifyRule{Events: []string{EventResident}, Sinks: []string{SinkResident},
+	QuietHours: "22:00-09:00", Dedup: "24h"}
+
+// DefaultNotifyRules reproduce notifications before rules
+var DefaultNotifyRules = []NotifyRule{
+	ResidentNotifyRule,
+	{Events: []string{"system.ble"}, Sinks: []string{SinkTelegram, SinkNtfySystem}, Batch: "30s", BatchFirst: "3s"},
+	{Events: []string{"system"}, Sinks: []string{SinkTelegram, SinkNtfySystem}},
+	{Events: []string{"user"}, Sinks: []string{SinkNtfyEvents}},
+}
+
+// NotifyRules returns configured rules or default ones, ResidentNotifyRule goes first if no rule
+// routes messages to residents, so that "*" does not send them to the board
+func (c *Config) NotifyRules() []NotifyRule {
+	if len(c.Notify.Rules) == 0 {
+		return DefaultNotifyRules
+	}
+	for _, r := range c.Notify.Rules {
+		if slices.Contains(r.Events, EventResident) {
+			return c.Notify.Rules
+		}
+	}
+	return append([]NotifyRule{ResidentNotifyRule}, c.Notify.Rules...)
+}
+
+func (c *Config) validateNotify(add func(format string, a ...any)) {
+	sinks := map[string]bool{SinkTelegram: true, SinkNtfySystem: true, SinkNtfyEvents: true, SinkResident: true}
+	for name, s := range c.Notify.Sinks {
+		sinks[name] = true
+		if !slices.Contains(sinkTypes, s.Type) {
+			add("Notify.Sinks.%s: bad type %q, one of %s expected", name, s.Type, strings.Join(sinkTypes, ", "))
+		}
+		if s.URL != "" {
+			if p, err := url.Parse(s.URL); err != nil || p.Scheme == "" || p.Host == "" {
+				add("Notify.Sinks.%s: bad URL %q", name, s.URL)
+			}
+		}
+		switch {
+		case s.Type == "mattermost" && s.URL == "" && (c.MattermostURL == "" || s.Target == ""):
+			add("Notify.Sinks.%s: webhook URL or MattermostURL and Target expected", name)
+		case s.Type == "discord" && s.URL == "":
+			add("Notify.Sinks.%s: webhook URL expected", name)
+		}
+		if s.Type == "email" && !strings.Contains(s.Target, "@") {
+			add("Notify.Sinks.%s: bad email %q", name, s.Target)
+		}
+		checkTemplate(add, "Notify.Sinks."+name, s.Template)
+	}
+	for i, r := range c.Notify.Rules {
+		name := fmt.Sprintf("Notify.Rules[%d]", i)
+		if len(r.Events) == 0 || len(r.Sinks) == 0 {
+			add("%s: events and sinks expected", name)
+		}
+		for _, s := range r.Sinks {
+			if !sinks[s] {
+				add("%s: unknown sink %q", name, s)
+			}
+		}
+		if !slices.Contains(severityNames, strings.ToLower(r.MinSeverity)) {
+			add("%s: bad MinSeverity %q", name, r.MinSeverity)
+		}
+		checkTemplate(add, name, r.Template)
+		for s, t := range r.Templates {
+			if !sinks[s] {
+				add("%s: template of unknown sink %q", name, s)
+			}
+			checkTemplate(add, name+".Templates."+s, t)
+		}
+		if r.QuietHours != "" {
+			from, to, ok := strings.Cut(r.QuietHours, "-")
+			if !ok || !hhmmRE.MatchString(strings.TrimSpace(from)) || !hhmmRE.MatchString(strings.TrimSpace(to)) {
+				add("%s: bad QuietHours %q, hh:mm-hh:mm expected", name, r.QuietHours)
+			}
+		}
+		for field, d := range map[string]string{"Dedup": r.Dedup, "Batch": r.Batch, "BatchFirst": r.BatchFirst} {
+			if d == "" {
+				continue
+			}
+			if v, err := time.ParseDuration(d); err != nil || v <= 0 {
+				add("%s: bad %s duration %q", name, field, d)
+			}
+		}
+	}
+}
+
+func checkTemplate(add func(format string, a ...any), name, text string) {
+	if text == "" {
+		return
+	}
+	if _, err := template.New(name).Funcs(templateFuncs).Parse(text); err != nil {
+		add("%s: bad template: %v", name, err)
+	}
+}
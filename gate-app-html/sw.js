@@ -14,3 +14,25 @@ self.addEventListener('activate', (event) => {
 self.addEventListener('fetch', (event) => {
     event.respondWith(fetch(event.request));
 });
+
+// Web Push: сервер шлёт {title, body}, показываем системное уведомление
+self.addEventListener('push', (event) => {
+    let msg = { title: 'Шлагбаум', body: '' };
+    try {
+        msg = { ...msg, ...event.data.json() };
+    } catch (e) {
+        msg.body = event.data ? event.data.text() : '';
+    }
+    event.waitUntil(self.registration.showNotification(msg.title, { body: msg.body, icon: '/icon192.png' }));
+});
+
+// По нажатию на уведомление открываем приложение
+self.addEventListener('notificationclick', (event) => {
+    event.notification.close();
+    event.waitUntil(self.clients.matchAll({ type: 'window' }).then((list) => {
+        for (const c of list) {
+            if ('focus' in c) return c.focus();
+        }
+        return self.clients.openWindow('/');
+    }));
+});
@@ -80,7 +80,7 @@ func (s *KeypadCodes) Update(p *KeypadCode) error {
 
 func (s *KeypadCodes) ListActive() ([]KeypadCode, error) {
 	now := time.Now().UnixMilli()
-	rows, err := s.db.Query("SELECT id, code, req_phone, created_at_ms, end_time_ms, ttl_min FROM kpcodes WHERE end_time_ms > ? || end_time_ms == 0", now)
+	rows, err := s.db.Query("SELECT id, code, req_phone, created_at_ms, end_time_ms, ttl_min FROM kpcodes WHERE end_time_ms > ? OR end_time_ms = 0", now)
 	if err != nil {
 		return nil, err
 	}
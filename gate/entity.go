@@ -34,6 +34,8 @@ type EntitiesDAO interface {
 	Insert(p Entity) error
 	Update(p Entity) error
 	Delete(p Entity) error
+	// List returns data of entities of the type by id
+	List(tp string) (map[string]string, error)
 }
 
 func NewEntities(db *sql.DB) EntitiesDAO {
@@ -118,6 +120,24 @@ func (s *Entities) Load(p Entity) (ok bool, err error) {
 	return false, nil
 }
 
+func (s *Entities) List(tp string) (map[string]string, error) {
+	rows, err := s.db.Query("SELECT id, data FROM entities WHERE tp = ?", tp)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]string)
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		res[id] = data
+	}
+	return res, rows.Err()
+}
+
 type NullEntities struct {
 }
 
@@ -136,3 +156,7 @@ func (s *NullEntities) Update(p Entity) error {
 func (s *NullEntities) Delete(p Entity) error {
 	return nil
 }
+
+func (s *NullEntities) List(tp string) (map[string]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,104 @@
+package gate
+
+import (
+	"database/sql"
+)
+
+const createEvents string = `
+  CREATE TABLE IF NOT EXISTS events (
+  id INTEGER PRIMARY KEY,
+  type TEXT NOT NULL,
+  severity INT NOT NULL,
+  gate TEXT NOT NULL,
+  text TEXT NOT NULL,
+  created_at_ms INT NOT NULL
+  );
+  CREATE INDEX IF NOT EXISTS events_created_at ON events (created_at_ms);`
+
+type Events struct {
+	db *sql.DB
+}
+
+// Event is a record of the journal of published events
+type Event struct {
+	ID             int64
+	Type           string
+	Severity       int
+	Gate           string
+	Text           string
+	CreatedAtMilli int64
+}
+
+type EventsDAO interface {
+	Insert(e *Event) error
+	// List returns last n events of the type and its children like "system.ble" of "system", of all types if typ is empty
+	List(typ string, n int) ([]Event, error)
+	// DeleteBefore removes events older than the time and returns how many were removed
+	DeleteBefore(milli int64) (int64, error)
+}
+
+func NewEvents(db *sql.DB) EventsDAO {
+	if db == nil {
+		return &NullEvents{}
+	}
+	if _, err := db.Exec(createEvents); err != nil {
+		Logger.Errorf("creating table events %v", err)
+		return &NullEvents{}
+	}
+	return &Events{
+		db: db,
+	}
+}
+
+func (s *Events) Insert(e *Event) error {
+	res, err := s.db.Exec("INSERT INTO events (type, severity, gate, text, created_at_ms) VALUES(?,?,?,?,?);",
+		e.Type, e.Severity, e.Gate, e.Text, e.CreatedAtMilli)
+	if err != nil {
+		return err
+	}
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *Events) List(typ string, n int) ([]Event, error) {
+	rows, err := s.db.Query("SELECT id, type, severity, gate, text, created_at_ms FROM events "+
+		"WHERE ? = '' OR type = ? OR substr(type, 1, ?) = ? ORDER BY id DESC LIMIT ?", typ, typ, len(typ)+1, typ+".", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		e := Event{}
+		err = rows.Scan(&e.ID, &e.Type, &e.Severity, &e.Gate, &e.Text, &e.CreatedAtMilli)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *Events) DeleteBefore(milli int64) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM events WHERE created_at_ms < ?;", milli)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type NullEvents struct {
+}
+
+func (s *NullEvents) Insert(e *Event) error {
+	return nil
+}
+
+func (s *NullEvents) List(typ string, n int) ([]Event, error) {
+	return nil, nil
+}
+
+func (s *NullEvents) DeleteBefore(milli int64) (int64, error) {
+	return 0, nil
+}
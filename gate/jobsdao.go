@@ -0,0 +1,179 @@
+package gate
+
+import (
+	"database/sql"
+	"strings"
+)
+
+const createJobs string = `
+  CREATE TABLE IF NOT EXISTS jobs (
+  id TEXT PRIMARY KEY,
+  command TEXT NOT NULL,
+  args TEXT NOT NULL,
+  cron TEXT NOT NULL,
+  next_run_ms INT NOT NULL,
+  catch_up INT NOT NULL,
+  creator TEXT NOT NULL,
+  created_at_ms INT NOT NULL
+  );
+  CREATE TABLE IF NOT EXISTS job_runs (
+  id INTEGER PRIMARY KEY,
+  job_id TEXT NOT NULL,
+  command TEXT NOT NULL,
+  args TEXT NOT NULL,
+  scheduled_ms INT NOT NULL,
+  started_ms INT NOT NULL,
+  finished_ms INT NOT NULL,
+  skipped INT NOT NULL,
+  result TEXT NOT NULL,
+  error TEXT NOT NULL
+  );
+  CREATE INDEX IF NOT EXISTS job_runs_job_id ON job_runs (job_id);`
+
+// alterJobs adds the catch-up bound, jobs created before catch up any time
+var alterJobs = []string{
+	`ALTER TABLE jobs ADD COLUMN catch_up_within_ms INT NOT NULL DEFAULT 0`,
+}
+
+type Jobs struct {
+	db *sql.DB
+}
+
+// Job is a scheduled command. Cron is empty for one-shot jobs, which are deleted after the run
+type Job struct {
+	ID             string
+	Command        string
+	Args           string
+	Cron           string
+	NextRunMilli   int64
+	CatchUp        bool   // run a job missed during downtime once, otherwise skip it
+	Creator        string // mm:<user id>, tg:<chat id>... of the principal, "system" for jobs of the gate
+	CreatedAtMilli int64
+
+	// CatchUpWithinMilli bounds the catch-up, a run missed by more is skipped. 0 is unbounded.
+	CatchUpWithinMilli int64
+}
+
+// JobRun is a record of a job run or of a skipped one
+type JobRun struct {
+	ID               int
+	JobID            string
+	Command          string
+	Args             string
+	ScheduledAtMilli int64
+	StartedAtMilli   int64
+	FinishedAtMilli  int64
+	Skipped          bool
+	Result           string
+	Error            string
+}
+
+type JobsDAO interface {
+	List() ([]Job, error)
+	Upsert(p *Job) error
+	Delete(id string) error
+	InsertRun(p *JobRun) error
+	// ListRuns returns last n runs of the job, of all jobs if jobID is empty
+	ListRuns(jobID string, n int) ([]JobRun, error)
+}
+
+func NewJobs(db *sql.DB) JobsDAO {
+	if db == nil {
+		return &NullJobs{}
+	}
+	if _, err := db.Exec(createJobs); err != nil {
+		Logger.Errorf("creating table jobs %v", err)
+		return &NullJobs{}
+	}
+	for _, q := range alterJobs {
+		if _, err := db.Exec(q); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			Logger.Errorf("altering table jobs %v", err)
+			return &NullJobs{}
+		}
+	}
+	return &Jobs{
+		db: db,
+	}
+}
+
+func (s *Jobs) List() ([]Job, error) {
+	rows, err := s.db.Query("SELECT id, command, args, cron, next_run_ms, catch_up, catch_up_within_ms, creator, created_at_ms FROM jobs ORDER BY next_run_ms, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j := Job{}
+		err = rows.Scan(&j.ID, &j.Command, &j.Args, &j.Cron, &j.NextRunMilli, &j.CatchUp, &j.CatchUpWithinMilli, &j.Creator, &j.CreatedAtMilli)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (s *Jobs) Upsert(p *Job) error {
+	_, err := s.db.Exec("INSERT INTO jobs (id, command, args, cron, next_run_ms, catch_up, catch_up_within_ms, creator, created_at_ms) VALUES (?,?,?,?,?,?,?,?,?) "+
+		"ON CONFLICT(id) DO UPDATE SET command = excluded.command, args = excluded.args, cron = excluded.cron, "+
+		"next_run_ms = excluded.next_run_ms, catch_up = excluded.catch_up, catch_up_within_ms = excluded.catch_up_within_ms;",
+		p.ID, p.Command, p.Args, p.Cron, p.NextRunMilli, p.CatchUp, p.CatchUpWithinMilli, p.Creator, p.CreatedAtMilli)
+	return err
+}
+
+func (s *Jobs) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM jobs WHERE id = ?;", id)
+	return err
+}
+
+func (s *Jobs) InsertRun(p *JobRun) error {
+	_, err := s.db.Exec("INSERT INTO job_runs (job_id, command, args, scheduled_ms, started_ms, finished_ms, skipped, result, error) VALUES(?,?,?,?,?,?,?,?,?);",
+		p.JobID, p.Command, p.Args, p.ScheduledAtMilli, p.StartedAtMilli, p.FinishedAtMilli, p.Skipped, p.Result, p.Error)
+	return err
+}
+
+func (s *Jobs) ListRuns(jobID string, n int) ([]JobRun, error) {
+	rows, err := s.db.Query("SELECT id, job_id, command, args, scheduled_ms, started_ms, finished_ms, skipped, result, error FROM job_runs "+
+		"WHERE ? = '' OR job_id = ? ORDER BY id DESC LIMIT ?", jobID, jobID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []JobRun{}
+	for rows.Next() {
+		r := JobRun{}
+		err = rows.Scan(&r.ID, &r.JobID, &r.Command, &r.Args, &r.ScheduledAtMilli, &r.StartedAtMilli, &r.FinishedAtMilli,
+			&r.Skipped, &r.Result, &r.Error)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+type NullJobs struct {
+}
+
+func (s *NullJobs) List() ([]Job, error) {
+	return nil, nil
+}
+
+func (s *NullJobs) Upsert(p *Job) error {
+	return nil
+}
+
+func (s *NullJobs) Delete(id string) error {
+	return nil
+}
+
+func (s *NullJobs) InsertRun(p *JobRun) error {
+	return nil
+}
+
+func (s *NullJobs) ListRuns(jobID string, n int) ([]JobRun, error) {
+	return nil, nil
+}
@@ -21,6 +21,8 @@ type MattermostUser struct {
 
 type MattermostUsersDAO interface {
 	Find(string) (*MattermostUser, error)
+	// ListByPhone returns users confirmed the phone by TOTP
+	ListByPhone(phone string) ([]MattermostUser, error)
 	Insert(p *MattermostUser) error
 	Update(p *MattermostUser) error
 }
@@ -54,7 +56,19 @@ func (s *MattermostUsers) Update(p *MattermostUser) error {
 }
 
 func (s *MattermostUsers) Find(userId string) (*MattermostUser, error) {
-	rows, err := s.db.Query("SELECT mm_user_id, phone FROM mm_users WHERE mm_user_id = ?", userId)
+	users, err := s.query("SELECT mm_user_id, phone FROM mm_users WHERE mm_user_id = ?", userId)
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+func (s *MattermostUsers) ListByPhone(phone string) ([]MattermostUser, error) {
+	return s.query("SELECT mm_user_id, phone FROM mm_users WHERE phone = ? ORDER BY mm_user_id", phone)
+}
+
+func (s *MattermostUsers) query(q string, args ...any) ([]MattermostUser, error) {
+	rows, err := s.db.Query(q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -69,10 +83,7 @@ func (s *MattermostUsers) Find(userId string) (*MattermostUser, error) {
 		}
 		users = append(users, phone)
 	}
-	if len(users) == 0 {
-		return nil, nil
-	}
-	return &users[0], nil
+	return users, rows.Err()
 }
 
 type NullMattermostUsers struct {
@@ -82,6 +93,10 @@ func (s *NullMattermostUsers) Find(postfix string) (*MattermostUser, error) {
 	return nil, nil
 }
 
+func (s *NullMattermostUsers) ListByPhone(phone string) ([]MattermostUser, error) {
+	return nil, nil
+}
+
 func (s *NullMattermostUsers) Insert(p *MattermostUser) error {
 	return nil
 }
@@ -0,0 +1,127 @@
+package gate
+
+import (
+	"database/sql"
+	"errors"
+)
+
+const createNotifyQueue string = `
+  CREATE TABLE IF NOT EXISTS notify_queue (
+  id INTEGER PRIMARY KEY,
+  sink TEXT NOT NULL,
+  text TEXT NOT NULL,
+  attempts INT NOT NULL,
+  next_try_ms INT NOT NULL,
+  created_at_ms INT NOT NULL,
+  last_error TEXT NOT NULL
+  );
+  CREATE INDEX IF NOT EXISTS notify_queue_next_try ON notify_queue (next_try_ms);`
+
+var errNoDB = errors.New("no db")
+
+type NotifyQueue struct {
+	db *sql.DB
+}
+
+// Notification is a rendered text waiting for delivery to the sink: failed, held by quiet hours or overflowed
+type Notification struct {
+	ID             int64
+	Sink           string
+	Text           string
+	Attempts       int
+	NextTryMilli   int64
+	CreatedAtMilli int64
+	LastError      string
+}
+
+type NotifyQueueDAO interface {
+	Insert(n *Notification) error
+	Update(n *Notification) error
+	Delete(id int64) error
+	// ListDue returns up to n notifications to try before the time, the oldest first
+	ListDue(beforeMilli int64, n int) ([]Notification, error)
+	Count() (int, error)
+}
+
+func NewNotifyQueue(db *sql.DB) NotifyQueueDAO {
+	if db == nil {
+		return &NullNotifyQueue{}
+	}
+	if _, err := db.Exec(createNotifyQueue); err != nil {
+		Logger.Errorf("creating table notify_queue %v", err)
+		return &NullNotifyQueue{}
+	}
+	return &NotifyQueue{
+		db: db,
+	}
+}
+
+func (s *NotifyQueue) Insert(n *Notification) error {
+	res, err := s.db.Exec("INSERT INTO notify_queue (sink, text, attempts, next_try_ms, created_at_ms, last_error) VALUES(?,?,?,?,?,?);",
+		n.Sink, n.Text, n.Attempts, n.NextTryMilli, n.CreatedAtMilli, n.LastError)
+	if err != nil {
+		return err
+	}
+	n.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *NotifyQueue) Update(n *Notification) error {
+	_, err := s.db.Exec("UPDATE notify_queue SET attempts = ?, next_try_ms = ?, last_error = ? WHERE id = ?;",
+		n.Attempts, n.NextTryMilli, n.LastError, n.ID)
+	return err
+}
+
+func (s *NotifyQueue) Delete(id int64) error {
+	_, err := s.db.Exec("DELETE FROM notify_queue WHERE id = ?;", id)
+	return err
+}
+
+func (s *NotifyQueue) ListDue(beforeMilli int64, n int) ([]Notification, error) {
+	rows, err := s.db.Query("SELECT id, sink, text, attempts, next_try_ms, created_at_ms, last_error FROM notify_queue "+
+		"WHERE next_try_ms <= ? ORDER BY created_at_ms, id LIMIT ?", beforeMilli, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []Notification{}
+	for rows.Next() {
+		var p Notification
+		err = rows.Scan(&p.ID, &p.Sink, &p.Text, &p.Attempts, &p.NextTryMilli, &p.CreatedAtMilli, &p.LastError)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, rows.Err()
+}
+
+func (s *NotifyQueue) Count() (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT count(*) FROM notify_queue").Scan(&n)
+	return n, err
+}
+
+type NullNotifyQueue struct {
+}
+
+func (s *NullNotifyQueue) Insert(n *Notification) error {
+	return errNoDB
+}
+
+func (s *NullNotifyQueue) Update(n *Notification) error {
+	return nil
+}
+
+func (s *NullNotifyQueue) Delete(id int64) error {
+	return nil
+}
+
+func (s *NullNotifyQueue) ListDue(beforeMilli int64, n int) ([]Notification, error) {
+	return nil, nil
+}
+
+func (s *NullNotifyQueue) Count() (int, error) {
+	return 0, nil
+}
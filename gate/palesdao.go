@@ -0,0 +1,87 @@
+package gate
+
+import (
+	"database/sql"
+)
+
+const createPalesChanges string = `
+  CREATE TABLE IF NOT EXISTS pales_changes (
+  id INTEGER PRIMARY KEY,
+  plan_id TEXT NOT NULL,
+  op TEXT NOT NULL,
+  phone TEXT NOT NULL,
+  data TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  error TEXT NOT NULL,
+  created_at_ms int NOT NULL
+  );`
+
+type PalesChanges struct {
+	db *sql.DB
+}
+
+// PalesChange is a record of a change applied to pal-es device users
+type PalesChange struct {
+	ID             int
+	PlanID         string
+	Op             string
+	Phone          string
+	Data           string // user json after the change
+	Actor          string
+	Error          string
+	CreatedAtMilli int64
+}
+
+type PalesChangesDAO interface {
+	Insert(p *PalesChange) error
+	ListByPhone(phone string, n int) ([]PalesChange, error)
+}
+
+func NewPalesChanges(db *sql.DB) PalesChangesDAO {
+	if db == nil {
+		return &NullPalesChanges{}
+	}
+	if _, err := db.Exec(createPalesChanges); err != nil {
+		Logger.Errorf("creating table pales_changes %v", err)
+		return &NullPalesChanges{}
+	}
+	return &PalesChanges{
+		db: db,
+	}
+}
+
+func (s *PalesChanges) Insert(p *PalesChange) error {
+	_, err := s.db.Exec("INSERT INTO pales_changes (plan_id, op, phone, data, actor, error, created_at_ms) VALUES(?,?,?,?,?,?,?);",
+		p.PlanID, p.Op, p.Phone, p.Data, p.Actor, p.Error, p.CreatedAtMilli)
+	return err
+}
+
+func (s *PalesChanges) ListByPhone(phone string, n int) ([]PalesChange, error) {
+	rows, err := s.db.Query("SELECT id, plan_id, op, phone, data, actor, error, created_at_ms FROM pales_changes WHERE phone = ? ORDER BY id DESC LIMIT ?", phone, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []PalesChange{}
+	for rows.Next() {
+		c := PalesChange{}
+		err = rows.Scan(&c.ID, &c.PlanID, &c.Op, &c.Phone, &c.Data, &c.Actor, &c.Error, &c.CreatedAtMilli)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+type NullPalesChanges struct {
+}
+
+func (s *NullPalesChanges) Insert(p *PalesChange) error {
+	return nil
+}
+
+func (s *NullPalesChanges) ListByPhone(phone string, n int) ([]PalesChange, error) {
+	return nil, nil
+}
@@ -94,32 +94,6 @@ func (s *Setting) SetFloat(p float64) {
 	s.value = strconv.FormatFloat(p, 'f', -1, 64)
 }
 
-func (s *Setting) Validate() (err error) {
-	if s.value == "" {
-		return nil
-	}
-	n := len(s.Key)
-	if n < 3 {
-		return nil
-	}
-	suffex := s.Key[n-2:]
-	switch suffex {
-	case ".b":
-		_, err = strconv.ParseBool(s.value)
-	case ".i":
-		_, err = strconv.Atoi(s.value)
-	case ".f":
-		_, err = strconv.ParseFloat(s.value, 64)
-	}
-	if err != nil {
-		return err
-	}
-	if s.IsScheduled() {
-		_, err = s.Schedule()
-	}
-	return err
-}
-
 func (s *Setting) IsScheduled() bool {
 	return strings.HasPrefix(s.Key, ScheduledSettingsKeyPrefix)
 }
@@ -138,3 +138,45 @@ func TestYAML(t *testing.T) {
 		}
 	}
 }
+
+func TestSettingsRegistry(t *testing.T) {
+	r := NewSettingsRegistry(
+		&SettingDef{Key: "g.on.b", Type: SettingBool},
+		&SettingDef{Key: "g.len.i", Type: SettingInt, Default: "3", Min: 1, Max: 10},
+		&SettingDef{Key: "g.rate.f", Type: SettingFloat},
+		&SettingDef{Key: "g.schedule", Type: SettingJSON},
+		&SettingDef{Key: "g.name"},
+		&SettingDef{Key: "tg.", Type: SettingInt},
+		&SettingDef{Key: ScheduledSettingsKeyPrefix, Type: SettingYAML},
+	)
+	tests := []struct {
+		key, value string
+		ok         bool
+	}{
+		{"g.on.b", "true", true},
+		{"g.on.b", "yes", false},
+		{"g.len.i", "5", true},
+		{"g.len.i", "0", false},
+		{"g.len.i", "11", false},
+		{"g.len.i", "5.5", false},
+		{"g.rate.f", "5.5", true},
+		{"g.schedule", `{"07:00":10}`, true},
+		{"g.schedule", `{"07:00":10`, false},
+		{"g.name", "any", true},
+		{"g.names", "any", false},
+		{"tg.79001234567", "3", true},
+		{"tg.", "3", false},
+		{"mm-daily.7_timer", "{from: 22:00, to: 7:00, args: 10}", true},
+		{"mm-daily.7_timer", "{from: 22:00, to", false},
+		{"g.len.i", "", true},
+	}
+	for _, tt := range tests {
+		s := Setting{Key: tt.key, value: tt.value}
+		if err := r.Validate(&s); (err == nil) != tt.ok {
+			t.Errorf("%s %q: got %v, want ok %v", tt.key, tt.value, err, tt.ok)
+		}
+	}
+	if got, want := r.ValueOrDefault(&Setting{Key: "g.len.i"}), "3"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
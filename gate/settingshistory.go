@@ -0,0 +1,86 @@
+package gate
+
+import (
+	"database/sql"
+)
+
+const createSettingsHistory string = `
+  CREATE TABLE IF NOT EXISTS settings_history (
+  id INTEGER PRIMARY KEY,
+  key TEXT NOT NULL,
+  old_value TEXT NOT NULL,
+  new_value TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  created_at_ms INT NOT NULL
+  );
+  CREATE INDEX IF NOT EXISTS settings_history_key ON settings_history (key);`
+
+type SettingsHistory struct {
+	db *sql.DB
+}
+
+// SettingChange is a record of a setting change, empty NewValue is deletion
+type SettingChange struct {
+	ID             int
+	Key            string
+	OldValue       string
+	NewValue       string
+	Actor          string
+	CreatedAtMilli int64
+}
+
+type SettingsHistoryDAO interface {
+	Insert(p *SettingChange) error
+	// List returns last n changes of keys with the prefix
+	List(prefix string, n int) ([]SettingChange, error)
+}
+
+func NewSettingsHistory(db *sql.DB) SettingsHistoryDAO {
+	if db == nil {
+		return &NullSettingsHistory{}
+	}
+	if _, err := db.Exec(createSettingsHistory); err != nil {
+		Logger.Errorf("creating table settings_history %v", err)
+		return &NullSettingsHistory{}
+	}
+	return &SettingsHistory{
+		db: db,
+	}
+}
+
+func (s *SettingsHistory) Insert(p *SettingChange) error {
+	_, err := s.db.Exec("INSERT INTO settings_history (key, old_value, new_value, actor, created_at_ms) VALUES(?,?,?,?,?);",
+		p.Key, p.OldValue, p.NewValue, p.Actor, p.CreatedAtMilli)
+	return err
+}
+
+func (s *SettingsHistory) List(prefix string, n int) ([]SettingChange, error) {
+	rows, err := s.db.Query("SELECT id, key, old_value, new_value, actor, created_at_ms FROM settings_history "+
+		"WHERE key like ? ORDER BY id DESC LIMIT ?", prefix+"%", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []SettingChange{}
+	for rows.Next() {
+		c := SettingChange{}
+		err = rows.Scan(&c.ID, &c.Key, &c.OldValue, &c.NewValue, &c.Actor, &c.CreatedAtMilli)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+type NullSettingsHistory struct {
+}
+
+func (s *NullSettingsHistory) Insert(p *SettingChange) error {
+	return nil
+}
+
+func (s *NullSettingsHistory) List(prefix string, n int) ([]SettingChange, error) {
+	return nil, nil
+}
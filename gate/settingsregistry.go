@@ -0,0 +1,151 @@
+package gate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type SettingType string
+
+const (
+	SettingString SettingType = "string"
+	SettingBool   SettingType = "bool"
+	SettingInt    SettingType = "int"
+	SettingFloat  SettingType = "float"
+	SettingJSON   SettingType = "json"
+	SettingYAML   SettingType = "yaml"
+)
+
+// SettingDef describes a known setting. Key ending with "." is a prefix of a family of keys like "pales-tg.<phone>"
+type SettingDef struct {
+	Key         string
+	Type        SettingType
+	Default     string
+	Min, Max    float64 // checked for int and float if Min < Max
+	Description string
+	// HotApply is false if the change is applied only after restart
+	HotApply bool
+	// Check is an additional validation of the value
+	Check func(value string) error
+}
+
+func (d *SettingDef) IsPrefix() bool {
+	return strings.HasSuffix(d.Key, ".")
+}
+
+func (d *SettingDef) Validate(value string) error {
+	if value == "" {
+		return nil
+	}
+	var n float64
+	var err error
+	switch d.Type {
+	case SettingBool:
+		_, err = strconv.ParseBool(value)
+	case SettingInt:
+		var i int
+		i, err = strconv.Atoi(value)
+		n = float64(i)
+	case SettingFloat:
+		n, err = strconv.ParseFloat(value, 64)
+	case SettingJSON:
+		if !json.Valid([]byte(value)) {
+			err = errors.New("invalid json")
+		}
+	case SettingYAML:
+		var v map[string]any
+		err = UnmarshalYAMLOneLine(value, &v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s expected: %w", d.Key, d.Type, err)
+	}
+	if (d.Type == SettingInt || d.Type == SettingFloat) && d.Min < d.Max && (n < d.Min || n > d.Max) {
+		return fmt.Errorf("%s: %v is out of range [%v, %v]", d.Key, value, d.Min, d.Max)
+	}
+	if d.Check != nil {
+		if err := d.Check(value); err != nil {
+			return fmt.Errorf("%s: %w", d.Key, err)
+		}
+	}
+	return nil
+}
+
+func (d *SettingDef) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s", d.Key, d.Type)
+	if d.Default != "" {
+		fmt.Fprintf(&sb, " default %s", d.Default)
+	}
+	if d.Min < d.Max {
+		fmt.Fprintf(&sb, " [%v, %v]", d.Min, d.Max)
+	}
+	if !d.HotApply {
+		sb.WriteString(" (restart)")
+	}
+	if d.Description != "" {
+		sb.WriteString(" - " + d.Description)
+	}
+	return sb.String()
+}
+
+type SettingsRegistry struct {
+	defs []*SettingDef
+}
+
+func NewSettingsRegistry(defs ...*SettingDef) *SettingsRegistry {
+	r := &SettingsRegistry{}
+	for _, d := range defs {
+		r.Register(d)
+	}
+	return r
+}
+
+// Register adds the definition, panics on duplicates as definitions are static
+func (r *SettingsRegistry) Register(d *SettingDef) {
+	if slices.ContainsFunc(r.defs, func(x *SettingDef) bool { return x.Key == d.Key }) {
+		panic("duplicate setting " + d.Key)
+	}
+	if d.Type == "" {
+		d.Type = SettingString
+	}
+	r.defs = append(r.defs, d)
+	slices.SortFunc(r.defs, func(a, b *SettingDef) int { return strings.Compare(a.Key, b.Key) })
+}
+
+// Lookup returns the definition of the key or of its prefix, nil for unknown keys
+func (r *SettingsRegistry) Lookup(key string) *SettingDef {
+	for _, d := range r.defs {
+		if d.IsPrefix() && strings.HasPrefix(key, d.Key) && len(key) > len(d.Key) || !d.IsPrefix() && d.Key == key {
+			return d
+		}
+	}
+	return nil
+}
+
+func (r *SettingsRegistry) Defs() []*SettingDef {
+	return slices.Clone(r.defs)
+}
+
+// Validate rejects unknown keys and values not matching the definition
+func (r *SettingsRegistry) Validate(s *Setting) error {
+	d := r.Lookup(s.Key)
+	if d == nil {
+		return fmt.Errorf("unknown setting %q", s.Key)
+	}
+	return d.Validate(s.value)
+}
+
+// ValueOrDefault returns the value of the setting or the default of its definition
+func (r *SettingsRegistry) ValueOrDefault(s *Setting) string {
+	if s.value != "" {
+		return s.value
+	}
+	if d := r.Lookup(s.Key); d != nil {
+		return d.Default
+	}
+	return ""
+}
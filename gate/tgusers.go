@@ -0,0 +1,107 @@
+package gate
+
+import (
+	"database/sql"
+)
+
+const createTGUsers string = `
+  CREATE TABLE IF NOT EXISTS tg_users (
+  chat_id INTEGER PRIMARY KEY,
+  phone TEXT NOT NULL,
+  linked_by TEXT NOT NULL,
+  linked_at_ms int NOT NULL
+  );`
+
+type TelegramUsers struct {
+	db *sql.DB
+}
+
+// TelegramUser is the private chat linked to the phone by TOTP or by the shared contact
+type TelegramUser struct {
+	ChatID      int64
+	Phone       string
+	LinkedBy    string // "totp" or "contact"
+	LinkedMilli int64
+}
+
+type TelegramUsersDAO interface {
+	Find(chatID int64) (*TelegramUser, error)
+	ListByPhone(phone string) ([]TelegramUser, error)
+	// Save inserts or replaces the link of the chat
+	Save(p *TelegramUser) error
+	Delete(chatID int64) error
+}
+
+func NewTelegramUsers(db *sql.DB) TelegramUsersDAO {
+	if db == nil {
+		return &NullTelegramUsers{}
+	}
+	if _, err := db.Exec(createTGUsers); err != nil {
+		Logger.Errorf("creating table tg_users %v", err)
+		return &NullTelegramUsers{}
+	}
+	return &TelegramUsers{
+		db: db,
+	}
+}
+
+func (s *TelegramUsers) Save(p *TelegramUser) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO tg_users (chat_id, phone, linked_by, linked_at_ms) VALUES(?,?,?,?);",
+		p.ChatID, p.Phone, p.LinkedBy, p.LinkedMilli)
+	return err
+}
+
+func (s *TelegramUsers) Delete(chatID int64) error {
+	_, err := s.db.Exec("DELETE FROM tg_users WHERE chat_id = ?;", chatID)
+	return err
+}
+
+func (s *TelegramUsers) Find(chatID int64) (*TelegramUser, error) {
+	users, err := s.query("SELECT chat_id, phone, linked_by, linked_at_ms FROM tg_users WHERE chat_id = ?", chatID)
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+func (s *TelegramUsers) ListByPhone(phone string) ([]TelegramUser, error) {
+	return s.query("SELECT chat_id, phone, linked_by, linked_at_ms FROM tg_users WHERE phone = ? ORDER BY chat_id", phone)
+}
+
+func (s *TelegramUsers) query(q string, args ...any) ([]TelegramUser, error) {
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []TelegramUser{}
+	for rows.Next() {
+		u := TelegramUser{}
+		err = rows.Scan(&u.ChatID, &u.Phone, &u.LinkedBy, &u.LinkedMilli)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+type NullTelegramUsers struct {
+}
+
+func (s *NullTelegramUsers) Find(chatID int64) (*TelegramUser, error) {
+	return nil, nil
+}
+
+func (s *NullTelegramUsers) ListByPhone(phone string) ([]TelegramUser, error) {
+	return nil, nil
+}
+
+func (s *NullTelegramUsers) Save(p *TelegramUser) error {
+	return nil
+}
+
+func (s *NullTelegramUsers) Delete(chatID int64) error {
+	return nil
+}
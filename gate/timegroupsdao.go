@@ -0,0 +1,116 @@
+package gate
+
+import (
+	"database/sql"
+)
+
+const createTimeGroups string = `
+  CREATE TABLE IF NOT EXISTS time_groups (
+  source TEXT NOT NULL,
+  id TEXT NOT NULL,
+  data TEXT NOT NULL,
+  updated INT NOT NULL,
+  PRIMARY KEY (source, id)
+  );`
+
+type TimeGroups struct {
+	db *sql.DB
+}
+
+// TimeGroup is a stored time group, Data is json. Source is "pales" for the cloud cache or "local"
+type TimeGroup struct {
+	Source  string
+	ID      string
+	Data    string
+	Updated int64
+}
+
+type TimeGroupsDAO interface {
+	List() ([]TimeGroup, error)
+	Upsert(p *TimeGroup) error
+	Delete(p *TimeGroup) error
+	// ReplaceSource replaces all groups of the source
+	ReplaceSource(source string, pp []TimeGroup) error
+}
+
+func NewTimeGroups(db *sql.DB) TimeGroupsDAO {
+	if db == nil {
+		return &NullTimeGroups{}
+	}
+	if _, err := db.Exec(createTimeGroups); err != nil {
+		Logger.Errorf("creating table time_groups %v", err)
+		return &NullTimeGroups{}
+	}
+	return &TimeGroups{
+		db: db,
+	}
+}
+
+func (s *TimeGroups) List() ([]TimeGroup, error) {
+	rows, err := s.db.Query("SELECT source, id, data, updated FROM time_groups ORDER BY source, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []TimeGroup{}
+	for rows.Next() {
+		g := TimeGroup{}
+		err = rows.Scan(&g.Source, &g.ID, &g.Data, &g.Updated)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func (s *TimeGroups) Upsert(p *TimeGroup) error {
+	_, err := s.db.Exec("INSERT INTO time_groups (source, id, data, updated) VALUES (?,?,?,?) "+
+		"ON CONFLICT(source, id) DO UPDATE SET data = excluded.data, updated = excluded.updated;",
+		p.Source, p.ID, p.Data, p.Updated)
+	return err
+}
+
+func (s *TimeGroups) Delete(p *TimeGroup) error {
+	_, err := s.db.Exec("DELETE FROM time_groups WHERE source = ? AND id = ?;", p.Source, p.ID)
+	return err
+}
+
+func (s *TimeGroups) ReplaceSource(source string, pp []TimeGroup) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM time_groups WHERE source = ?;", source); err != nil {
+		return err
+	}
+	for _, p := range pp {
+		_, err := tx.Exec("INSERT INTO time_groups (source, id, data, updated) VALUES (?,?,?,?);",
+			source, p.ID, p.Data, p.Updated)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type NullTimeGroups struct {
+}
+
+func (s *NullTimeGroups) List() ([]TimeGroup, error) {
+	return nil, nil
+}
+
+func (s *NullTimeGroups) Upsert(p *TimeGroup) error {
+	return nil
+}
+
+func (s *NullTimeGroups) Delete(p *TimeGroup) error {
+	return nil
+}
+
+func (s *NullTimeGroups) ReplaceSource(source string, pp []TimeGroup) error {
+	return nil
+}
@@ -2,6 +2,7 @@ package gate
 
 import (
 	"database/sql"
+	"strings"
 )
 
 const createTOTP string = `
@@ -10,18 +11,37 @@ const createTOTP string = `
   created_at_ms int NOT NULL
   );`
 
+// alterTOTP adds columns of per phone secrets, rows enrolled before have legacy derived secrets
+var alterTOTP = []string{
+	`ALTER TABLE totp ADD COLUMN secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE totp ADD COLUMN pending_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE totp ADD COLUMN last_step int NOT NULL DEFAULT 0`,
+	`ALTER TABLE totp ADD COLUMN legacy int NOT NULL DEFAULT 1`,
+	`ALTER TABLE totp ADD COLUMN activated_at_ms int NOT NULL DEFAULT 0`,
+	`ALTER TABLE totp ADD COLUMN pending_at_ms int NOT NULL DEFAULT 0`,
+}
+
 type TOTPPhones struct {
 	db *sql.DB
 }
 
+// TOTPPhone secrets are encrypted by the caller
 type TOTPPhone struct {
-	Phone          string
-	CreatedAtMilli int64
+	Phone            string
+	CreatedAtMilli   int64
+	Secret           string // active, confirmed by a code
+	PendingSecret    string // enrolled, waiting for the first code
+	LastStep         int64  // time step of the last accepted code, older and same codes are replays
+	Legacy           bool   // secret derived from the phone is accepted during migration
+	ActivatedAtMilli int64
+	PendingAtMilli   int64 // when the pending secret was generated
 }
 
 type TOTPPhonesDAO interface {
 	ListEndsWith(string) ([]TOTPPhone, error)
+	Find(phone string) (*TOTPPhone, error)
 	Insert(p *TOTPPhone) error
+	Update(p *TOTPPhone) error
 }
 
 func NewTOTPPhones(db *sql.DB) TOTPPhonesDAO {
@@ -32,23 +52,49 @@ func NewTOTPPhones(db *sql.DB) TOTPPhonesDAO {
 		Logger.Errorf("creating table totp %v", err)
 		return &NullTOTPPhones{}
 	}
+	for _, q := range alterTOTP {
+		if _, err := db.Exec(q); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			Logger.Errorf("altering table totp %v", err)
+			return &NullTOTPPhones{}
+		}
+	}
 	return &TOTPPhones{
 		db: db,
 	}
 }
 
+const totpColumns = "phone, created_at_ms, secret, pending_secret, last_step, legacy, activated_at_ms, pending_at_ms"
+
 func (s *TOTPPhones) Insert(p *TOTPPhone) error {
-	_, err := s.db.Exec("INSERT OR IGNORE INTO totp (phone, created_at_ms) VALUES(?,?);",
-		p.Phone, p.CreatedAtMilli)
+	_, err := s.db.Exec("INSERT OR IGNORE INTO totp ("+totpColumns+") VALUES(?,?,?,?,?,?,?,?);",
+		p.Phone, p.CreatedAtMilli, p.Secret, p.PendingSecret, p.LastStep, p.Legacy, p.ActivatedAtMilli, p.PendingAtMilli)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func (s *TOTPPhones) Update(p *TOTPPhone) error {
+	_, err := s.db.Exec("UPDATE totp SET secret = ?, pending_secret = ?, last_step = ?, legacy = ?, activated_at_ms = ?, pending_at_ms = ? WHERE phone = ?;",
+		p.Secret, p.PendingSecret, p.LastStep, p.Legacy, p.ActivatedAtMilli, p.PendingAtMilli, p.Phone)
+	return err
+}
+
+func (s *TOTPPhones) Find(phone string) (*TOTPPhone, error) {
+	phones, err := s.query("SELECT "+totpColumns+" FROM totp WHERE phone = ?", phone)
+	if err != nil || len(phones) == 0 {
+		return nil, err
+	}
+	return &phones[0], nil
+}
+
 func (s *TOTPPhones) ListEndsWith(postfix string) ([]TOTPPhone, error) {
 	postfix = "%" + postfix
-	rows, err := s.db.Query("SELECT phone, created_at_ms FROM totp WHERE phone LIKE ?", postfix)
+	return s.query("SELECT "+totpColumns+" FROM totp WHERE phone LIKE ? ORDER BY phone", postfix)
+}
+
+func (s *TOTPPhones) query(q string, args ...any) ([]TOTPPhone, error) {
+	rows, err := s.db.Query(q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -57,13 +103,14 @@ func (s *TOTPPhones) ListEndsWith(postfix string) ([]TOTPPhone, error) {
 	phones := []TOTPPhone{}
 	for rows.Next() {
 		phone := TOTPPhone{}
-		err = rows.Scan(&phone.Phone, &phone.CreatedAtMilli)
+		err = rows.Scan(&phone.Phone, &phone.CreatedAtMilli, &phone.Secret, &phone.PendingSecret,
+			&phone.LastStep, &phone.Legacy, &phone.ActivatedAtMilli, &phone.PendingAtMilli)
 		if err != nil {
 			return nil, err
 		}
 		phones = append(phones, phone)
 	}
-	return phones, nil
+	return phones, rows.Err()
 }
 
 type NullTOTPPhones struct {
@@ -73,6 +120,10 @@ func (s *NullTOTPPhones) ListEndsWith(postfix string) ([]TOTPPhone, error) {
 	return nil, nil
 }
 
+func (s *NullTOTPPhones) Find(phone string) (*TOTPPhone, error) {
+	return nil, nil
+}
+
 func (s *NullTOTPPhones) Insert(p *TOTPPhone) error {
 	return nil
 }
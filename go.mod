@@ -3,9 +3,8 @@ module 7stgbot
 go 1.25.0
 
 require (
+	github.com/AnthonyHewins/gotfy v0.0.11
 	github.com/BurntSushi/toml v1.6.0
-	// не обновлялась с 2021, Переходите на github.com/go-telegram/bot
-	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/gocarina/gocsv v0.0.0-20240520201108-78e41c74b4b1
 	// github.com/ncruces/go-sqlite3  избавиться от CGO, многие сейчас переходят на
 	github.com/mattn/go-sqlite3 v1.14.38
@@ -13,13 +12,13 @@ require (
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	go.uber.org/zap v1.27.1
 	golang.org/x/crypto v0.52.0
+	golang.org/x/text v0.37.0
 	// https://github.com/wneessen/go-mail
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
 require (
-	github.com/AnthonyHewins/gotfy v0.0.11 // indirect
 	github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc // indirect
 	github.com/fsnotify/fsnotify v1.9.0 // indirect
 	github.com/fxamacker/cbor/v2 v2.9.2 // indirect
@@ -47,7 +46,6 @@ require (
 	golang.org/x/net v0.54.0 // indirect
 	golang.org/x/sys v0.45.0 // indirect
 	golang.org/x/term v0.43.0 // indirect
-	golang.org/x/text v0.37.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
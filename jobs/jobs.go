@@ -0,0 +1,235 @@
+// Package jobs runs commands by cron expressions or once at a time. Jobs and their run history
+// are kept in the db, so jobs survive restarts. A job missed during downtime is run once or skipped.
+package jobs
+
+import (
+	"7stgbot/gate"
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Late is how late a job may run and still not be considered missed
+const Late = time.Minute
+
+// RunFunc runs the job and returns its result
+type RunFunc func(j *gate.Job) (string, error)
+
+type Scheduler struct {
+	store gate.JobsDAO
+	run   RunFunc
+	// Now is replaced in tests
+	Now func() time.Time
+
+	mu   sync.Mutex
+	jobs map[string]*gate.Job
+	wake chan struct{}
+}
+
+func New(store gate.JobsDAO, run RunFunc) *Scheduler {
+	return &Scheduler{
+		store: store,
+		run:   run,
+		Now:   time.Now,
+		jobs:  make(map[string]*gate.Job),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// ParseCron parses standard 5 fields expressions and descriptors like @daily, in the gate location
+func ParseCron(spec string) (cron.Schedule, error) {
+	return cron.ParseStandard("CRON_TZ=" + gate.Location.String() + " " + spec)
+}
+
+// Load reads jobs from the store
+func (s *Scheduler) Load() error {
+	jj, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.jobs)
+	for i := range jj {
+		s.jobs[jj[i].ID] = &jj[i]
+	}
+	s.signal()
+	return nil
+}
+
+// Add adds or replaces the job. NextRunMilli of cron jobs is calculated if it is not set.
+func (s *Scheduler) Add(j gate.Job) (*gate.Job, error) {
+	if j.ID == "" || j.Command == "" {
+		return nil, errors.New("job id and command expected")
+	}
+	now := s.Now()
+	if j.Cron != "" {
+		sch, err := ParseCron(j.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if j.NextRunMilli == 0 {
+			j.NextRunMilli = sch.Next(now).UnixMilli()
+		}
+	} else if j.NextRunMilli == 0 {
+		return nil, errors.New("cron or run time expected")
+	}
+	if j.CreatedAtMilli == 0 {
+		j.CreatedAtMilli = now.UnixMilli()
+	}
+	if err := s.store.Upsert(&j); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = &j
+	s.signal()
+	c := j
+	return &c, nil
+}
+
+// Cancel deletes the job, false if there is no such job
+func (s *Scheduler) Cancel(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return false, nil
+	}
+	if err := s.store.Delete(id); err != nil {
+		return false, err
+	}
+	delete(s.jobs, id)
+	return true, nil
+}
+
+// List returns copies of jobs ordered by the next run
+func (s *Scheduler) List() []gate.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]gate.Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		res = append(res, *j)
+	}
+	slices.SortFunc(res, func(a, b gate.Job) int {
+		return cmp.Or(cmp.Compare(a.NextRunMilli, b.NextRunMilli), cmp.Compare(a.ID, b.ID))
+	})
+	return res
+}
+
+func (s *Scheduler) History(jobID string, n int) ([]gate.JobRun, error) {
+	return s.store.ListRuns(jobID, n)
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs due jobs until abort
+func (s *Scheduler) Run(abort <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			s.RunDue()
+		case <-s.wake:
+		case <-abort:
+			return
+		}
+		wait := time.Minute
+		if next, ok := s.nextRun(); ok {
+			wait = min(wait, max(0, time.Until(next)))
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+func (s *Scheduler) nextRun() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next int64
+	for _, j := range s.jobs {
+		if next == 0 || j.NextRunMilli < next {
+			next = j.NextRunMilli
+		}
+	}
+	return time.UnixMilli(next), next != 0
+}
+
+// RunDue runs or skips jobs which are due, one after another
+func (s *Scheduler) RunDue() {
+	now := s.Now()
+	for _, j := range s.List() {
+		if j.NextRunMilli > now.UnixMilli() {
+			break
+		}
+		s.runJob(j, now)
+	}
+}
+
+func (s *Scheduler) runJob(j gate.Job, now time.Time) {
+	scheduled := time.UnixMilli(j.NextRunMilli)
+	r := gate.JobRun{JobID: j.ID, Command: j.Command, Args: j.Args, ScheduledAtMilli: j.NextRunMilli,
+		StartedAtMilli: now.UnixMilli()}
+	late := now.Sub(scheduled)
+	if late > Late && (!j.CatchUp || (j.CatchUpWithinMilli > 0 && late > time.Duration(j.CatchUpWithinMilli)*time.Millisecond)) {
+		r.Skipped = true
+		r.Error = fmt.Sprintf("missed by %s", late.Round(time.Second))
+	} else {
+		res, err := s.run(&j)
+		r.Result = res
+		if err != nil {
+			r.Error = err.Error()
+		}
+	}
+	r.FinishedAtMilli = s.Now().UnixMilli()
+	if err := s.store.InsertRun(&r); err != nil {
+		gate.Logger.Errorf("job %s run record: %v", j.ID, err)
+	}
+	if r.Error != "" {
+		gate.Logger.Warnf("job %s %s %s: %s", j.ID, j.Command, j.Args, r.Error)
+	} else {
+		gate.Logger.Infof("job %s %s %s: %s", j.ID, j.Command, j.Args, r.Result)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.jobs[j.ID]
+	if !ok || cur.NextRunMilli != j.NextRunMilli {
+		// cancelled or replaced while running
+		return
+	}
+	var sch cron.Schedule
+	if j.Cron != "" {
+		var err error
+		if sch, err = ParseCron(j.Cron); err != nil {
+			gate.Logger.Errorf("job %s cron %q: %v", j.ID, j.Cron, err)
+		}
+	}
+	if sch == nil {
+		if err := s.store.Delete(j.ID); err != nil {
+			gate.Logger.Errorf("job %s delete: %v", j.ID, err)
+		}
+		delete(s.jobs, j.ID)
+		return
+	}
+	// after downtime missed runs are not repeated, the next one is after now
+	cur.NextRunMilli = sch.Next(now).UnixMilli()
+	if err := s.store.Upsert(cur); err != nil {
+		gate.Logger.Errorf("job %s update: %v", j.ID, err)
+	}
+}
@@ -0,0 +1,140 @@
+package jobs
+
+import (
+	"7stgbot/gate"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+func newStore(t *testing.T) gate.JobsDAO {
+	gate.Logger = zap.NewNop().Sugar()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return gate.NewJobs(db)
+}
+
+func TestScheduler(t *testing.T) {
+	store := newStore(t)
+	var ran []string
+	run := func(j *gate.Job) (string, error) {
+		ran = append(ran, j.ID)
+		if j.Args == "fail" {
+			return "", errors.New("failed")
+		}
+		return "ok " + j.Args, nil
+	}
+	now := time.Date(2026, time.June, 1, 6, 0, 0, 0, gate.Location)
+	s := New(store, run)
+	s.Now = func() time.Time { return now }
+
+	if _, err := s.Add(gate.Job{ID: "daily", Command: "/7_timer", Args: "10", Cron: "0 7 * * *", CatchUp: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(gate.Job{ID: "skip", Command: "/7_timer", Args: "fail", Cron: "30 7 * * *"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(gate.Job{ID: "once", Command: "/7_open", NextRunMilli: now.Add(10 * time.Minute).UnixMilli()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(gate.Job{ID: "bad", Command: "/7_open", Cron: "61 * * * *"}); err == nil {
+		t.Error("bad cron error expected")
+	}
+
+	now = now.Add(10 * time.Minute)
+	s.RunDue()
+	if got, want := ran, []string{"once"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// restart after downtime 06:10 - 09:00, daily catches up, skip is skipped
+	s2 := New(store, run)
+	s2.Now = func() time.Time { return now }
+	if err := s2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(s2.List()), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	now = time.Date(2026, time.June, 1, 9, 0, 0, 0, gate.Location)
+	s2.RunDue()
+	if got, want := ran, []string{"once", "daily"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, j := range s2.List() {
+		next := time.UnixMilli(j.NextRunMilli).In(gate.Location)
+		if next.Day() != 2 {
+			t.Errorf("%s next run got %v, want June 2", j.ID, next)
+		}
+	}
+
+	// on time
+	now = time.Date(2026, time.June, 2, 7, 30, 20, 0, gate.Location)
+	s2.RunDue()
+	if got, want := ran, []string{"once", "daily", "daily", "skip"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	rr, err := s2.History("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(rr), 5; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if r := rr[0]; r.JobID != "skip" || r.Error != "failed" || r.Skipped {
+		t.Errorf("got %+v, want failed skip run", r)
+	}
+	if r := rr[2]; r.JobID != "skip" || !r.Skipped {
+		t.Errorf("got %+v, want skipped run", r)
+	}
+	if r := rr[4]; r.JobID != "once" || r.Result != "ok " {
+		t.Errorf("got %+v, want once run", r)
+	}
+
+	ok, err := s2.Cancel("daily")
+	if err != nil || !ok {
+		t.Fatalf("cancel got %v %v", ok, err)
+	}
+	if ok, _ := s2.Cancel("daily"); ok {
+		t.Error("cancelled twice")
+	}
+	jj, _ := store.List()
+	if len(jj) != 1 || jj[0].ID != "skip" {
+		t.Errorf("got %v, want skip only", jj)
+	}
+
+	// the window of 07:00 - 08:00 is over, a bounded catch-up is skipped
+	if _, err := s2.Add(gate.Job{ID: "window", Command: "/7_timer", Cron: "0 7 * * *", CatchUp: true,
+		CatchUpWithinMilli: time.Hour.Milliseconds()}); err != nil {
+		t.Fatal(err)
+	}
+	s3 := New(store, run)
+	s3.Now = func() time.Time { return now }
+	if err := s3.Load(); err != nil {
+		t.Fatal(err)
+	}
+	now = time.Date(2026, time.June, 3, 7, 50, 0, 0, gate.Location)
+	s3.RunDue()
+	if got, want := ran[len(ran)-1:], []string{"window"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	now = time.Date(2026, time.June, 4, 8, 30, 0, 0, gate.Location)
+	n := len(ran)
+	s3.RunDue()
+	if got := ran[n:]; len(got) != 0 {
+		t.Errorf("got %v, want the catch-up skipped", got)
+	}
+	if rr, _ := s3.History("window", 1); len(rr) != 1 || !rr[0].Skipped {
+		t.Errorf("got %+v, want the window run skipped", rr)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	config "7stgbot/config"
 	"7stgbot/gate"
+	"7stgbot/secrets"
 	"7stgbot/tgsrv"
 	"bufio"
 	"database/sql"
@@ -14,14 +15,12 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sort"
 	"strings"
 	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 
-	"github.com/BurntSushi/toml"
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -40,6 +39,13 @@ var (
 var db *sql.DB
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		if err := secrets.CLI(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.StringVar(&logfile, "logfile", "7stgbot.log", "log file")
 	flag.StringVar(&cfgDir, "cfg", "./", "Path to config dir containing config.toml and data files")
 	flag.BoolVar(&noTGBot, "notgbot", false, "Start telegram bot (must be configured in config)")
@@ -118,42 +124,41 @@ func main() {
 		}
 	}()
 
-	var cfg config.Config
+	if tgsrv.Secrets, err = secrets.Open(cfgDir); err != nil {
+		logger.Errorf("error loading secrets from %q: %v", cfgDir, err)
+		return
+	}
+	if err := tgsrv.CheckSecrets(); err != nil {
+		logger.Error(err)
+		return
+	}
+
 	cfgSub := &config.ConfigSubscription{}
 	cfgPath := filepath.Join(cfgDir, "config.toml")
-	if _, err := toml.DecodeFile(cfgPath, &cfg); err != nil {
-		logger.Errorf("error parsing toml config by path %q: %v", cfgPath, err)
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		logger.Errorf("error loading config by path %q: %v", cfgPath, err)
 		flag.PrintDefaults()
 		return
 	}
-	for k, v := range cfg.SMSRateLimiterCfg {
-		d, err := time.ParseDuration(k)
-		if err != nil {
-			logger.Errorf("error parsing config RateLimiterCfg, bad duration %s, %v", k, err)
-			return
-		}
-		cfg.SMSRateLimiter = append(cfg.SMSRateLimiter, config.Rate{Ticker: d, Cnt: v})
-	}
-	sort.Sort(config.ByRate(cfg.SMSRateLimiter))
+	tgsrv.ApplyConfigSecrets(cfg)
 
 	pinger := tgsrv.StartPinger(abort, cfg.DiscordAlertChannelURL)
 
-	var g tgsrv.Gate
-	g.CfgDir = cfgDir
-	g.Abort = abort
-	g.Phones = make(map[string]*tgsrv.PalESUser)
-	readCsv(filepath.Join(cfgDir, "pales_users.csv"), palgateUserFunc(g.Phones))
-	g.RestrictedPhones = make(map[string]bool)
-	readLines(filepath.Join(cfgDir, "gate-phones-restricted.txt"), func(s string, _ int) { g.RestrictedPhones[s] = true })
-	g.PalesTokenFilename = filepath.Join(cfgDir, "t.txt")
-	readLines(g.PalesTokenFilename, func(s string, i int) {
-		if i == 0 {
-			g.PalESPortalUserToken.Store(s)
+	var gates tgsrv.Gates
+	for _, gc := range cfg.GateConfigs() {
+		g, gateDB, err := newGate(gc, abort, emailClient)
+		if err != nil {
+			logger.Errorf("gate %s: %v", gc.GateID, err)
+			return
 		}
-	})
-	g.Init(&cfg, db)
+		if gateDB != db {
+			defer gateDB.Close()
+		}
+		gates = append(gates, g)
+	}
 
-	ws := tgsrv.StartWebServer(cfg.Port, cfg.StaticDir, cfgDir, cfg.QR, cfg.Price, cfg.Coef, abort, pinger, &g, &cfg, cfgSub)
+	ws := tgsrv.StartWebServer(cfg.Port, cfg.StaticDir, cfgDir, cfg.QR, cfg.Price, cfg.Coef, abort, pinger, gates, cfg, cfgSub)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -180,14 +185,8 @@ func main() {
 				logger.Errorf("fsnotify %s error: %v", cfgPath, err)
 
 			case <-timerCh:
-				cfg := new(config.Config)
-				if _, err := toml.DecodeFile(cfgPath, cfg); err != nil {
-					logger.Errorf("error parsing %q  fix error or next app start will fail: %v", cfgPath, err)
-					continue
-				}
-				logger.Infof("%q is reloaded", cfgPath)
-				for _, l := range cfgSub.Subscribers {
-					l <- cfg
+				if err := gates.ReloadConfig(cfgPath, cfgSub); err != nil {
+					logger.Errorf("error loading %q, config is not changed: %v", cfgPath, err)
 				}
 			}
 		}
@@ -209,6 +208,30 @@ func main() {
 	}
 }
 
+// newGate makes the gate of the config and returns its db, additional gates keep data in gates/<id> of the config dir
+func newGate(cfg *config.Config, abort chan struct{}, emailClient *tgsrv.EmailClient) (*tgsrv.Gate, *sql.DB, error) {
+	g := new(tgsrv.Gate)
+	g.CfgDir = cfgDir
+	g.Email = emailClient
+	gateDB := db
+	if cfg.GatePath != "" {
+		g.CfgDir = filepath.Join(cfgDir, "gates", cfg.GateID)
+		if err := os.MkdirAll(g.CfgDir, 0700); err != nil {
+			return nil, nil, err
+		}
+		var err error
+		if gateDB, err = sql.Open("sqlite3", filepath.Join(g.CfgDir, "gate.db")); err != nil {
+			return nil, nil, err
+		}
+	}
+	tgsrv.ApplyConfigSecrets(cfg)
+	g.Abort = abort
+	g.Phones = make(map[string]*tgsrv.PalESUser)
+	readCsv(filepath.Join(g.CfgDir, "pales_users.csv"), palgateUserFunc(g.Phones))
+	g.Init(cfg, gateDB)
+	return g, gateDB, nil
+}
+
 func stdinCredentials() (string, string) {
 	reader := bufio.NewReader(os.Stdin)
 
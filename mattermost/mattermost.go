@@ -0,0 +1,186 @@
+// Package mattermost is a client of Mattermost REST API v4 for a bot account and of incoming webhooks.
+package mattermost
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var ErrNotFound = errors.New("mattermost: not found")
+
+type Post struct {
+	ID        string         `json:"id,omitempty"`
+	ChannelID string         `json:"channel_id,omitempty"`
+	UserID    string         `json:"user_id,omitempty"`
+	Message   string         `json:"message"`
+	Props     map[string]any `json:"props,omitempty"`
+}
+
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type Channel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// WebhookPost is a message of an incoming webhook, empty Channel is the channel of the webhook
+type WebhookPost struct {
+	Channel     string `json:"channel,omitempty"`
+	Text        string `json:"text"`
+	Username    string `json:"username,omitempty"`
+	IconURL     string `json:"icon_url,omitempty"`
+	Attachments any    `json:"attachments,omitempty"`
+}
+
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	token   string
+
+	mu sync.Mutex
+	me *User
+}
+
+// NewClient makes a client of the bot with the access token, baseURL is like https://mattermost.example.com
+func NewClient(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTP: http.DefaultClient, token: token}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+"/api/v4"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", method, path, ErrNotFound)
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		return fmt.Errorf("mattermost %s %s: %s %s", method, path, resp.Status, e.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Me returns the bot user, it is cached
+func (c *Client) Me(ctx context.Context) (*User, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.me != nil {
+		return c.me, nil
+	}
+	var u User
+	if err := c.do(ctx, "GET", "/users/me", nil, &u); err != nil {
+		return nil, err
+	}
+	c.me = &u
+	return c.me, nil
+}
+
+func (c *Client) UserByUsername(ctx context.Context, username string) (*User, error) {
+	var u User
+	if err := c.do(ctx, "GET", "/users/username/"+strings.TrimPrefix(username, "@"), nil, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// DirectChannel returns the direct channel of the bot and the user, it is created if needed
+func (c *Client) DirectChannel(ctx context.Context, userID string) (string, error) {
+	me, err := c.Me(ctx)
+	if err != nil {
+		return "", err
+	}
+	var ch Channel
+	if err := c.do(ctx, "POST", "/channels/direct", []string{me.ID, userID}, &ch); err != nil {
+		return "", err
+	}
+	return ch.ID, nil
+}
+
+func (c *Client) CreatePost(ctx context.Context, p *Post) (*Post, error) {
+	var res Post
+	if err := c.do(ctx, "POST", "/posts", p, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UpdatePost replaces the message and props of the post
+func (c *Client) UpdatePost(ctx context.Context, p *Post) (*Post, error) {
+	patch := map[string]any{"message": p.Message}
+	if p.Props != nil {
+		patch["props"] = p.Props
+	}
+	var res Post
+	if err := c.do(ctx, "PUT", "/posts/"+p.ID+"/patch", patch, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// SendDM posts to the direct channel of the bot and the user
+func (c *Client) SendDM(ctx context.Context, userID string, p *Post) (*Post, error) {
+	ch, err := c.DirectChannel(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	dm := *p
+	dm.ChannelID = ch
+	return c.CreatePost(ctx, &dm)
+}
+
+// PostWebhook posts to the incoming webhook URL
+func PostWebhook(ctx context.Context, client *http.Client, url string, p *WebhookPost) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("mattermost webhook: %s %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
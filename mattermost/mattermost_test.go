@@ -0,0 +1,53 @@
+package mattermost_test
+
+import (
+	"7stgbot/mattermost"
+	"7stgbot/mattermost/mattermosttest"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	srv := mattermosttest.NewServer("tk")
+	defer srv.Close()
+	owner := srv.AddUser("owner")
+	c := mattermost.NewClient(srv.URL+"/", "tk")
+	ctx := t.Context()
+
+	me, err := c.Me(ctx)
+	if err != nil || me.ID != srv.BotID {
+		t.Fatalf("got %v %v, want bot", me, err)
+	}
+	u, err := c.UserByUsername(ctx, "@owner")
+	if err != nil || u.ID != owner.ID {
+		t.Fatalf("got %v %v, want owner", u, err)
+	}
+	if _, err := c.UserByUsername(ctx, "nobody"); !errors.Is(err, mattermost.ErrNotFound) {
+		t.Errorf("got %v, want not found", err)
+	}
+
+	p, err := c.SendDM(ctx, owner.ID, &mattermost.Post{Message: "guest", Props: map[string]any{"k": "v"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UpdatePost(ctx, &mattermost.Post{ID: p.ID, Message: "opened"}); err != nil {
+		t.Fatal(err)
+	}
+	posts := srv.DirectPosts(owner.ID)
+	if len(posts) != 1 || posts[0].Message != "opened" || posts[0].Props["k"] != "v" {
+		t.Errorf("got %+v, want updated post with props", posts)
+	}
+
+	if _, err := mattermost.NewClient(srv.URL, "bad").Me(ctx); err == nil {
+		t.Error("unauthorized error expected")
+	}
+
+	err = mattermost.PostWebhook(ctx, http.DefaultClient, srv.URL+"/hooks/x", &mattermost.WebhookPost{Channel: "board", Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Webhooks(); len(got) != 1 || got[0].Channel != "board" || got[0].Text != "hi" {
+		t.Errorf("got %+v, want webhook post", got)
+	}
+}
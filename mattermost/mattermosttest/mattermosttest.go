@@ -0,0 +1,202 @@
+// Package mattermosttest is an in-memory Mattermost server for tests: users, direct channels, posts and incoming webhooks.
+package mattermosttest
+
+import (
+	"7stgbot/mattermost"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Server struct {
+	*httptest.Server
+	Token string
+	BotID string
+
+	mu       sync.Mutex
+	users    map[string]*mattermost.User // by id
+	channels map[string][]string         // direct channel id -> member ids
+	posts    []*mattermost.Post
+	webhooks []*mattermost.WebhookPost
+	seq      int
+}
+
+// NewServer serves the bot of the token, its user is "bot"
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:    token,
+		BotID:    "bot",
+		users:    map[string]*mattermost.User{"bot": {ID: "bot", Username: "system-bot"}},
+		channels: make(map[string][]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v4/users/me", s.auth(s.handleMe))
+	mux.HandleFunc("GET /api/v4/users/username/{name}", s.auth(s.handleUserByName))
+	mux.HandleFunc("POST /api/v4/channels/direct", s.auth(s.handleDirect))
+	mux.HandleFunc("POST /api/v4/posts", s.auth(s.handleCreatePost))
+	mux.HandleFunc("PUT /api/v4/posts/{id}/patch", s.auth(s.handlePatchPost))
+	mux.HandleFunc("POST /hooks/{id}", s.handleWebhook)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddUser adds a user, its id is the username
+func (s *Server) AddUser(username string) *mattermost.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := &mattermost.User{ID: username, Username: username}
+	s.users[u.ID] = u
+	return u
+}
+
+// Posts returns copies of posts of the channel, of all channels if it is empty
+func (s *Server) Posts(channelID string) []mattermost.Post {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []mattermost.Post
+	for _, p := range s.posts {
+		if channelID == "" || p.ChannelID == channelID {
+			res = append(res, *p)
+		}
+	}
+	return res
+}
+
+// DirectPosts returns posts of the direct channel of the bot and the user
+func (s *Server) DirectPosts(userID string) []mattermost.Post {
+	return s.Posts(s.directID(s.BotID, userID))
+}
+
+// Webhooks returns posts of incoming webhooks
+func (s *Server) Webhooks() []mattermost.WebhookPost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []mattermost.WebhookPost
+	for _, p := range s.webhooks {
+		res = append(res, *p)
+	}
+	return res
+}
+
+func (s *Server) directID(a, b string) string {
+	ids := []string{a, b}
+	slices.Sort(ids)
+	return strings.Join(ids, "__")
+}
+
+func (s *Server) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+s.Token {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"message": msg, "status_code": status})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s.users[s.BotID])
+}
+
+func (s *Server) handleUserByName(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Username == r.PathValue("name") {
+			writeJSON(w, http.StatusOK, u)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "user not found")
+}
+
+func (s *Server) handleDirect(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil || len(ids) != 2 {
+		writeError(w, http.StatusBadRequest, "two user ids expected")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := s.users[id]; !ok {
+			writeError(w, http.StatusBadRequest, "unknown user "+id)
+			return
+		}
+	}
+	id := s.directID(ids[0], ids[1])
+	s.channels[id] = ids
+	writeJSON(w, http.StatusCreated, mattermost.Channel{ID: id, Name: id})
+}
+
+func (s *Server) handleCreatePost(w http.ResponseWriter, r *http.Request) {
+	var p mattermost.Post
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.ChannelID == "" {
+		writeError(w, http.StatusBadRequest, "channel_id expected")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	p.ID = fmt.Sprintf("post%d", s.seq)
+	p.UserID = s.BotID
+	s.posts = append(s.posts, &p)
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *Server) handlePatchPost(w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		Message *string        `json:"message"`
+		Props   map[string]any `json:"props"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.posts {
+		if p.ID != r.PathValue("id") {
+			continue
+		}
+		if patch.Message != nil {
+			p.Message = *patch.Message
+		}
+		if patch.Props != nil {
+			p.Props = patch.Props
+		}
+		writeJSON(w, http.StatusOK, p)
+		return
+	}
+	writeError(w, http.StatusNotFound, "post not found")
+}
+
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	var p mattermost.WebhookPost
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Text == "" && p.Attachments == nil {
+		writeError(w, http.StatusBadRequest, "text expected")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhooks = append(s.webhooks, &p)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,471 @@
+// Package notify routes events to sinks by rules. The first rule matching the event type and severity
+// renders the text by the template of each sink, holds the event during quiet hours, drops duplicates
+// and batches events. Deliveries which fail or overflow are kept in the db and retried with backoff.
+package notify
+
+import (
+	"7stgbot/gate"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type Severity int
+
+const (
+	Debug Severity = iota
+	Info
+	Warning
+	Critical
+)
+
+var severityNames = []string{"debug", "info", "warning", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// ParseSeverity parses a severity name, empty is debug
+func ParseSeverity(s string) (Severity, error) {
+	if s == "" {
+		return Debug, nil
+	}
+	for i, n := range severityNames {
+		if strings.EqualFold(s, n) {
+			return Severity(i), nil
+		}
+	}
+	return Debug, fmt.Errorf("unknown severity %q", s)
+}
+
+// Event is what happened at the gate. Type is a dotted name like "system.ble", Text is the message
+// as it was sent before rules.
+type Event struct {
+	Type     string
+	Severity Severity
+	Gate     string
+	Text     string
+	Key      string // dedup key, the type and the text if empty
+	To       string // recipient of a TargetSink like the phone of a resident, other sinks ignore it
+	Time     time.Time
+	Count    int // number of events in a batch
+}
+
+type Sink interface {
+	Send(ctx context.Context, text string) error
+}
+
+// TargetSink sends to the recipient of the event. Deliveries to it are named "<sink>:<recipient>"
+// to be retried from the queue.
+type TargetSink interface {
+	SendTo(ctx context.Context, to, text string) error
+}
+
+type SinkFunc func(ctx context.Context, text string) error
+
+func (f SinkFunc) Send(ctx context.Context, text string) error {
+	return f(ctx, text)
+}
+
+// Match is true if the pattern is the type, its parent like "system" for "system.ble" or "*"
+func Match(pattern, typ string) bool {
+	return pattern == "*" || pattern == typ || strings.HasPrefix(typ, pattern+".")
+}
+
+// QuietHours are minutes of the day in the gate location, From > To spans midnight
+type QuietHours struct {
+	From, To int
+}
+
+// ParseQuietHours parses "23:00-07:00", empty is nil
+func ParseQuietHours(s string) (*QuietHours, error) {
+	if s == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("bad quiet hours %q, hh:mm-hh:mm expected", s)
+	}
+	var q QuietHours
+	for _, p := range []struct {
+		s string
+		m *int
+	}{{from, &q.From}, {to, &q.To}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(p.s))
+		if err != nil {
+			return nil, fmt.Errorf("bad quiet hours %q, hh:mm-hh:mm expected", s)
+		}
+		*p.m = t.Hour()*60 + t.Minute()
+	}
+	return &q, nil
+}
+
+// End returns the end of quiet hours if t is within them
+func (q *QuietHours) End(t time.Time) (time.Time, bool) {
+	if q == nil || q.From == q.To {
+		return time.Time{}, false
+	}
+	t = t.In(gate.Location)
+	m := t.Hour()*60 + t.Minute()
+	in := q.From <= m && m < q.To
+	if q.From > q.To {
+		in = m >= q.From || m < q.To
+	}
+	if !in {
+		return time.Time{}, false
+	}
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.To/60, q.To%60, 0, 0, gate.Location)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end, true
+}
+
+// Rule routes matching events to sinks. Batch collects events for BatchFirst since the first one,
+// then for Batch while events keep coming, and sends them as one text.
+type Rule struct {
+	Events      []string
+	MinSeverity Severity
+	Sinks       []string
+	Templates   map[string]*template.Template // by sink, "" for all sinks of the rule
+	Quiet       *QuietHours                   // events below critical are held until the end
+	Dedup       time.Duration
+	Batch       time.Duration
+	BatchFirst  time.Duration
+}
+
+func (r *Rule) match(e *Event) bool {
+	if e.Severity < r.MinSeverity {
+		return false
+	}
+	for _, p := range r.Events {
+		if Match(p, e.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// Funcs are available in templates, ts formats the time in the gate location
+var Funcs = template.FuncMap{
+	"ts": func(t time.Time) string { return t.In(gate.Location).Format("2006-01-02 15:04:05") },
+}
+
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(Funcs).Parse(text)
+}
+
+type Config struct {
+	Rules []*Rule
+	Sinks map[string]Sink
+	// Templates are defaults by sink, the text of the event is sent as is without a template
+	Templates map[string]*template.Template
+}
+
+type batch struct {
+	events []Event
+	due    time.Time
+}
+
+type delivery struct {
+	sink string
+	text string
+}
+
+type dedupKey struct {
+	rule *Rule
+	key  string
+	to   string
+}
+
+// batchKey keeps events of different recipients apart
+type batchKey struct {
+	rule *Rule
+	to   string
+}
+
+type Router struct {
+	store gate.NotifyQueueDAO
+	// Now is replaced in tests
+	Now         func() time.Time
+	Timeout     time.Duration // of a send
+	MaxAttempts int
+	MaxAge      time.Duration // failed notifications older than that are dropped
+
+	mu         sync.Mutex
+	cfg        Config
+	seen       map[dedupKey]time.Time
+	batches    map[batchKey]*batch
+	deliveries chan delivery
+}
+
+func New(store gate.NotifyQueueDAO) *Router {
+	return &Router{
+		store:       store,
+		Now:         time.Now,
+		Timeout:     10 * time.Second,
+		MaxAttempts: 20,
+		MaxAge:      24 * time.Hour,
+		seen:        make(map[dedupKey]time.Time),
+		batches:     make(map[batchKey]*batch),
+		deliveries:  make(chan delivery, 128),
+	}
+}
+
+// Configure replaces rules and sinks, pending batches are sent by old rules
+func (r *Router) Configure(c Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, b := range r.batches {
+		r.flush(k.rule, b)
+	}
+	clear(r.batches)
+	clear(r.seen)
+	r.cfg = c
+}
+
+// Publish routes the event by the first matching rule, it does not block
+func (r *Router) Publish(e Event) {
+	now := r.Now()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	e.Count = max(e.Count, 1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rule := range r.cfg.Rules {
+		if !rule.match(&e) {
+			continue
+		}
+		if rule.Dedup > 0 && r.duplicate(rule, &e, now) {
+			return
+		}
+		if rule.Batch > 0 {
+			k := batchKey{rule, e.To}
+			b, ok := r.batches[k]
+			if !ok {
+				b = &batch{due: now.Add(cmp.Or(rule.BatchFirst, rule.Batch))}
+				r.batches[k] = b
+			}
+			b.events = append(b.events, e)
+			return
+		}
+		r.deliver(rule, &e)
+		return
+	}
+	gate.Logger.Debugf("notify: no rule for %s %s: %s", e.Type, e.Severity, e.Text)
+}
+
+func (r *Router) duplicate(rule *Rule, e *Event, now time.Time) bool {
+	for k, t := range r.seen {
+		if now.Sub(t) >= k.rule.Dedup {
+			delete(r.seen, k)
+		}
+	}
+	k := dedupKey{rule, cmp.Or(e.Key, e.Type+"\x00"+e.Text), e.To}
+	if _, ok := r.seen[k]; ok {
+		return true
+	}
+	r.seen[k] = now
+	return false
+}
+
+// flush sends collected events as one, the batch stays for the next Batch period if there were events
+func (r *Router) flush(rule *Rule, b *batch) {
+	if len(b.events) == 0 {
+		return
+	}
+	e := b.events[0]
+	texts := make([]string, 0, len(b.events))
+	e.Count = 0
+	for _, be := range b.events {
+		texts = append(texts, be.Text)
+		e.Severity = max(e.Severity, be.Severity)
+		e.Count += be.Count
+	}
+	e.Text = strings.Join(texts, "\n")
+	b.events = b.events[:0]
+	r.deliver(rule, &e)
+}
+
+func (r *Router) deliver(rule *Rule, e *Event) {
+	now := r.Now()
+	for _, sink := range rule.Sinks {
+		text, err := r.render(rule, sink, e)
+		if err != nil {
+			gate.Logger.Errorf("notify: %s template: %v", sink, err)
+			text = e.Text
+		}
+		if _, ok := r.cfg.Sinks[sink].(TargetSink); ok {
+			if e.To == "" {
+				gate.Logger.Errorf("notify: %s needs a recipient: %s", sink, e.Text)
+				continue
+			}
+			sink += ":" + e.To
+		}
+		if end, ok := rule.Quiet.End(now); ok && e.Severity < Critical {
+			r.enqueue(&gate.Notification{Sink: sink, Text: text, NextTryMilli: end.UnixMilli(),
+				CreatedAtMilli: now.UnixMilli(), LastError: "quiet hours"})
+			continue
+		}
+		select {
+		case r.deliveries <- delivery{sink: sink, text: text}:
+		default:
+			r.enqueue(&gate.Notification{Sink: sink, Text: text, NextTryMilli: now.UnixMilli(),
+				CreatedAtMilli: now.UnixMilli(), LastError: "overflow"})
+		}
+	}
+}
+
+func (r *Router) render(rule *Rule, sink string, e *Event) (string, error) {
+	t := rule.Templates[sink]
+	if t == nil {
+		t = rule.Templates[""]
+	}
+	if t == nil {
+		t = r.cfg.Templates[sink]
+	}
+	if t == nil {
+		return e.Text, nil
+	}
+	var sb strings.Builder
+	err := t.Execute(&sb, e)
+	return sb.String(), err
+}
+
+func (r *Router) enqueue(n *gate.Notification) {
+	if err := r.store.Insert(n); err != nil {
+		gate.Logger.Errorf("notify: %s is lost, %v: %s", n.Sink, err, n.Text)
+	}
+}
+
+// Run sends deliveries, batches and retries until abort
+func (r *Router) Run(abort <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case d := <-r.deliveries:
+			r.send(d)
+		case <-ticker.C:
+			r.RunDue()
+		case <-abort:
+			return
+		}
+	}
+}
+
+// RunDue sends due batches, pending deliveries and due notifications of the queue
+func (r *Router) RunDue() {
+	now := r.Now()
+	r.mu.Lock()
+	for k, b := range r.batches {
+		if now.Before(b.due) {
+			continue
+		}
+		if len(b.events) == 0 {
+			// no events during the period, the next one waits for BatchFirst again
+			delete(r.batches, k)
+			continue
+		}
+		r.flush(k.rule, b)
+		b.due = now.Add(k.rule.Batch)
+	}
+	r.mu.Unlock()
+	for {
+		select {
+		case d := <-r.deliveries:
+			r.send(d)
+			continue
+		default:
+		}
+		break
+	}
+	r.retry(now)
+}
+
+func (r *Router) sink(name string) Sink {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg.Sinks[name]
+}
+
+func (r *Router) sendTo(name, text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	if s := r.sink(name); s != nil {
+		return s.Send(ctx, text)
+	}
+	name, to, ok := strings.Cut(name, ":")
+	if s, isTarget := r.sink(name).(TargetSink); ok && isTarget {
+		return s.SendTo(ctx, to, text)
+	}
+	return errUnknownSink
+}
+
+var errUnknownSink = errors.New("unknown sink")
+
+func (r *Router) send(d delivery) {
+	err := r.sendTo(d.sink, d.text)
+	if err == nil {
+		gate.Logger.Infof("notify %s: %s", d.sink, d.text)
+		return
+	}
+	gate.Logger.Warnf("notify %s error %v, retrying: %s", d.sink, err, d.text)
+	now := r.Now()
+	r.enqueue(&gate.Notification{Sink: d.sink, Text: d.text, Attempts: 1, NextTryMilli: now.Add(backoff(1)).UnixMilli(),
+		CreatedAtMilli: now.UnixMilli(), LastError: err.Error()})
+}
+
+// backoff is 10s doubled each attempt up to an hour
+func backoff(attempts int) time.Duration {
+	return min(10*time.Second<<min(attempts-1, 10), time.Hour)
+}
+
+func (r *Router) retry(now time.Time) {
+	nn, err := r.store.ListDue(now.UnixMilli(), 32)
+	if err != nil {
+		gate.Logger.Errorf("notify queue: %v", err)
+		return
+	}
+	for _, n := range nn {
+		err := r.sendTo(n.Sink, n.Text)
+		if err == nil {
+			gate.Logger.Infof("notify %s (attempt %d): %s", n.Sink, n.Attempts+1, n.Text)
+			if err := r.store.Delete(n.ID); err != nil {
+				gate.Logger.Errorf("notify queue delete: %v", err)
+			}
+			continue
+		}
+		n.Attempts++
+		n.LastError = err.Error()
+		if n.Attempts >= r.MaxAttempts || now.Sub(time.UnixMilli(n.CreatedAtMilli)) > r.MaxAge || errors.Is(err, errUnknownSink) {
+			gate.Logger.Errorf("notify %s dropped after %d attempts, %v: %s", n.Sink, n.Attempts, err, n.Text)
+			if err := r.store.Delete(n.ID); err != nil {
+				gate.Logger.Errorf("notify queue delete: %v", err)
+			}
+			continue
+		}
+		n.NextTryMilli = now.Add(backoff(n.Attempts)).UnixMilli()
+		if err := r.store.Update(&n); err != nil {
+			gate.Logger.Errorf("notify queue update: %v", err)
+		}
+	}
+}
+
+// Pending is the number of notifications in the queue
+func (r *Router) Pending() int {
+	n, err := r.store.Count()
+	if err != nil {
+		gate.Logger.Errorf("notify queue: %v", err)
+	}
+	return n
+}
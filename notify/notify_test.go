@@ -0,0 +1,245 @@
+package notify
+
+import (
+	"7stgbot/gate"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"text/template"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+func newStore(t *testing.T) gate.NotifyQueueDAO {
+	gate.Logger = zap.NewNop().Sugar()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return gate.NewNotifyQueue(db)
+}
+
+type recorder struct {
+	sent []string
+	fail bool
+}
+
+func (r *recorder) Send(ctx context.Context, text string) error {
+	if r.fail {
+		return errors.New("down")
+	}
+	r.sent = append(r.sent, text)
+	return nil
+}
+
+func (r *recorder) take() []string {
+	res := r.sent
+	r.sent = nil
+	return res
+}
+
+// targets records texts by recipient
+type targets struct {
+	recorder
+}
+
+func (r *targets) SendTo(ctx context.Context, to, text string) error {
+	return r.Send(ctx, to+": "+text)
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, typ string
+		want         bool
+	}{
+		{"system", "system", true},
+		{"system", "system.ble", true},
+		{"system.ble", "system", false},
+		{"sys", "system", false},
+		{"*", "user", true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.typ); got != tt.want {
+			t.Errorf("%q %q: got %v, want %v", tt.pattern, tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	q, err := ParseQuietHours("23:00-07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, time.June, 1, 0, 0, 0, 0, gate.Location)
+	tests := []struct {
+		at   time.Duration
+		want time.Time
+	}{
+		{22 * time.Hour, time.Time{}},
+		{23*time.Hour + 30*time.Minute, day.Add(31 * time.Hour)},
+		{3 * time.Hour, day.Add(7 * time.Hour)},
+		{7 * time.Hour, time.Time{}},
+	}
+	for _, tt := range tests {
+		if got, _ := q.End(day.Add(tt.at)); !got.Equal(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.at, got, tt.want)
+		}
+	}
+	if _, err := ParseQuietHours("23-07"); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	now := time.Date(2026, time.June, 1, 12, 0, 0, 0, gate.Location)
+	tg, ntfy := &recorder{}, &recorder{}
+	tmpl := template.Must(ParseTemplate("tg", "[{{.Severity}}] {{.Text}}"))
+	r := New(newStore(t))
+	r.Now = func() time.Time { return now }
+	r.Configure(Config{
+		Rules: []*Rule{
+			{Events: []string{"system.ble"}, Sinks: []string{"tg"}, Batch: 30 * time.Second, BatchFirst: 3 * time.Second},
+			{Events: []string{"system.opened"}, Sinks: []string{"tg"}, Dedup: time.Minute},
+			{Events: []string{"system"}, MinSeverity: Warning, Sinks: []string{"tg", "ntfy"}, Quiet: &QuietHours{From: 23 * 60, To: 7 * 60}},
+		},
+		Sinks:     map[string]Sink{"tg": tg, "ntfy": ntfy},
+		Templates: map[string]*template.Template{"tg": tmpl},
+	})
+
+	r.Publish(Event{Type: "system", Severity: Info, Text: "below min severity"})
+	r.Publish(Event{Type: "system.lock", Severity: Warning, Text: "locked"})
+	r.Publish(Event{Type: "system.opened", Severity: Info, Text: "opened"})
+	r.Publish(Event{Type: "system.opened", Severity: Info, Text: "opened"})
+	r.RunDue()
+	if got, want := tg.take(), []string{"[warning] locked", "[info] opened"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := ntfy.take(), []string{"locked"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// batch: the first one after 3s, next ones every 30s while events come
+	r.Publish(Event{Type: "system.ble", Text: "a"})
+	r.Publish(Event{Type: "system.ble", Text: "b"})
+	r.RunDue()
+	if got := tg.take(); len(got) != 0 {
+		t.Errorf("got %q, want nothing before 3s", got)
+	}
+	now = now.Add(3 * time.Second)
+	r.RunDue()
+	if got, want := tg.take(), []string{"[debug] a\nb"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	r.Publish(Event{Type: "system.ble", Text: "c"})
+	now = now.Add(10 * time.Second)
+	r.RunDue()
+	if got := tg.take(); len(got) != 0 {
+		t.Errorf("got %q, want nothing before 30s", got)
+	}
+	now = now.Add(20 * time.Second)
+	r.RunDue()
+	if got, want := tg.take(), []string{"[debug] c"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// dedup window is over
+	now = now.Add(time.Minute)
+	r.Publish(Event{Type: "system.opened", Severity: Info, Text: "opened"})
+	r.RunDue()
+	if got, want := tg.take(), []string{"[info] opened"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// failed deliveries are retried with backoff
+	tg.fail = true
+	r.Publish(Event{Type: "system", Severity: Critical, Text: "fire"})
+	r.RunDue()
+	if got, want := r.Pending(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	tg.fail = false
+	r.RunDue()
+	if got := tg.take(); len(got) != 0 {
+		t.Errorf("got %q, want nothing before backoff", got)
+	}
+	now = now.Add(backoff(1))
+	r.RunDue()
+	if got, want := tg.take(), []string{"[critical] fire"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := ntfy.take(), []string{"fire"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := r.Pending(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// quiet hours hold warnings until 07:00, critical ones go through
+	now = time.Date(2026, time.June, 1, 23, 30, 0, 0, gate.Location)
+	r.Publish(Event{Type: "system", Severity: Warning, Text: "night"})
+	r.Publish(Event{Type: "system", Severity: Critical, Text: "night fire"})
+	r.RunDue()
+	if got, want := ntfy.take(), []string{"night fire"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	now = time.Date(2026, time.June, 2, 7, 0, 0, 0, gate.Location)
+	r.RunDue()
+	if got, want := ntfy.take(), []string{"night"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRouterOverflow(t *testing.T) {
+	tg := &recorder{}
+	r := New(newStore(t))
+	r.Configure(Config{
+		Rules: []*Rule{{Events: []string{"*"}, Sinks: []string{"tg"}}},
+		Sinks: map[string]Sink{"tg": tg},
+	})
+	n := cap(r.deliveries) + 5
+	for range n {
+		r.Publish(Event{Type: "user", Text: "x"})
+	}
+	if got, want := r.Pending(), 5; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	r.RunDue()
+	if got, want := len(tg.take()), n; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRouterTarget(t *testing.T) {
+	now := time.Date(2026, time.June, 1, 23, 30, 0, 0, gate.Location)
+	residents := &targets{}
+	r := New(newStore(t))
+	r.Now = func() time.Time { return now }
+	r.Configure(Config{
+		Rules: []*Rule{{Events: []string{"resident"}, Sinks: []string{"residents"}, Dedup: time.Hour,
+			Quiet: &QuietHours{From: 22 * 60, To: 9 * 60}}},
+		Sinks: map[string]Sink{"residents": residents},
+	})
+	r.Publish(Event{Type: "resident", Text: "no recipient"})
+	r.Publish(Event{Type: "resident", Text: "paid", To: "1"})
+	r.Publish(Event{Type: "resident", Text: "paid", To: "2"})
+	r.Publish(Event{Type: "resident", Text: "paid", To: "1"})
+	r.RunDue()
+	if got, want := r.Pending(), 2; len(residents.take()) != 0 || got != want {
+		t.Errorf("got %v, want %v held until 09:00", got, want)
+	}
+	residents.fail = true
+	now = time.Date(2026, time.June, 2, 9, 0, 0, 0, gate.Location)
+	r.RunDue()
+	residents.fail = false
+	now = now.Add(backoff(1))
+	r.RunDue()
+	if got, want := residents.take(), []string{"1: paid", "2: paid"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,420 @@
+package pales
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBaseURL  = "https://portal.pal-es.com/api1"
+	DefaultPageSize = 10
+	maxLogPages     = 50
+	// token is renewed when it expires sooner than this
+	tokenRenewMargin = 10 * time.Minute
+)
+
+var ErrUnauthorized = errors.New("pal-es unauthorized")
+
+type LogRecord struct {
+	UserId   string
+	Sn       string
+	Approved bool
+	Type     int // see tgsrv typeName()
+	Tm       int64
+	/*
+	   22 - Duplicated remote
+	   16 - Latch active
+	   12 - Time group restriction – date not allowed
+
+	   1 - Not in list (Nearby Only for dials too)
+	   3 - No response
+	   4 - User smartphone internet problem
+	   61 - Bluetooth repeated id
+	*/
+	Reason    int
+	Firstname string
+	Lastname  string
+}
+
+type User struct {
+	Id                  string `json:"_id"`
+	Firstname           string
+	Lastname            string
+	Admin               bool
+	Output1             bool
+	StartDate           string
+	EndDate             string
+	DialToOpen          bool
+	LocalOnly           bool
+	Output1Latch        bool
+	Output2Latch        bool
+	Output1LatchMaxTime int64
+	Output2LatchMaxTime int64
+	SecondaryDevice     bool
+	Notifications       bool
+	GuestInvitation     bool
+	TimeGroupName       string
+	TimeGroupId         string `json:"groupId"`
+	GeoFence1           struct {
+		Enabled             bool
+		Lat                 float64
+		Long                float64
+		Radius              int
+		Rssi                int
+		Key                 string
+		ConfirmNotification bool
+		RetrySeconds        int `json:"retry"`
+	}
+}
+
+type TimeGroup struct {
+	Id        string `json:"_id"`
+	GroupName string
+	StartTime int
+	EndTime   int
+	Days      string
+	StartDate int64
+	EndDate   int64
+	TimeArray []*TimeGroupDay
+}
+
+type TimeGroupDay struct {
+	StartMinute int `json:"s"`
+	EndMinute   int `json:"e"`
+	DayOfWeek   int `json:"d"`
+}
+
+type loginResp struct {
+	Msg  string
+	User struct {
+		Token string
+	}
+}
+
+type logResp struct {
+	Msg string
+	Log struct {
+		Count int
+		List  []*LogRecord
+	}
+}
+
+type usersResp struct {
+	Msg   string
+	Users struct {
+		Count int
+		List  []*User
+	}
+}
+
+type timeGroupsResp struct {
+	Msg    string
+	Groups struct {
+		List []*TimeGroup
+	}
+}
+
+// Client is a PalES portal API client bound to one device.
+// Token is kept in memory and in TokenFile, it is renewed before JWT expiry
+// and once more on http 401.
+type Client struct {
+	BaseURL    string
+	DeviceID   string
+	Username   string
+	Password   string
+	TokenFile  string
+	PageSize   int
+	HTTPClient *http.Client
+	Timeout    time.Duration
+
+	mu      sync.Mutex // guards token and expires
+	token   string
+	expires time.Time
+}
+
+func NewClient(baseURL, deviceID, username, password, tokenFile string) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		DeviceID:   deviceID,
+		Username:   username,
+		Password:   password,
+		TokenFile:  tokenFile,
+		PageSize:   DefaultPageSize,
+		HTTPClient: &http.Client{},
+		Timeout:    20 * time.Second,
+	}
+}
+
+// LoadToken reads previously saved token from TokenFile.
+func (c *Client) LoadToken() error {
+	if c.TokenFile == "" {
+		return nil
+	}
+	bb, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return err
+	}
+	token, _, _ := strings.Cut(string(bb), "\n")
+	c.SetToken(strings.TrimSpace(token))
+	return nil
+}
+
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+	c.expires = TokenExpiry(token)
+}
+
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Expires returns JWT expiry time, zero if unknown.
+func (c *Client) Expires() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expires
+}
+
+func (c *Client) tokenValid(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" {
+		return false
+	}
+	return c.expires.IsZero() || c.expires.Sub(now) > tokenRenewMargin
+}
+
+// Login logs in if forced, there is no token or the token is about to expire.
+func (c *Client) Login(ctx context.Context, force bool) error {
+	if !force && c.tokenValid(time.Now()) {
+		return nil
+	}
+	form := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		B        string `json:"b"`
+	}{Username: c.Username, Password: c.Password}
+	jsonData, err := json.Marshal(form)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/user/login1", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pal-es login http %d", resp.StatusCode)
+	}
+	var result loginResp
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("pal-es login response: %w", err)
+	}
+	if result.User.Token == "" {
+		return fmt.Errorf("pal-es login: %s", result.Msg)
+	}
+	c.SetToken(result.User.Token)
+	if c.TokenFile != "" {
+		if err := os.WriteFile(c.TokenFile, []byte(result.User.Token), 0600); err != nil {
+			return fmt.Errorf("writing %s: %w", c.TokenFile, err)
+		}
+	}
+	return nil
+}
+
+// Logs returns device log records with Tm >= since sorted by time.
+// Pages are requested until a record older than since is met, so bursts longer than one page are not lost.
+func (c *Client) Logs(ctx context.Context, since int64) ([]*LogRecord, error) {
+	pageSize := c.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	var res []*LogRecord
+	seen := make(map[LogRecord]bool)
+	for page := 0; page < maxLogPages; page++ {
+		q := url.Values{}
+		q.Set("skip", strconv.Itoa(page*pageSize))
+		q.Set("limit", strconv.Itoa(pageSize))
+		for _, k := range []string{"filter", "startDate", "endDate", "approved", "reasons", "rly", "type"} {
+			q.Set(k, "")
+		}
+		var result logResp
+		if err := c.get(ctx, c.devicePath("log"), q, &result); err != nil {
+			return nil, err
+		}
+		older := false
+		for _, l := range result.Log.List {
+			if l.Tm < since {
+				older = true
+				continue
+			}
+			// records are shifted between pages when new ones arrive
+			if seen[*l] {
+				continue
+			}
+			seen[*l] = true
+			res = append(res, l)
+		}
+		if older || len(result.Log.List) < pageSize {
+			break
+		}
+	}
+	slices.SortStableFunc(res, func(a, b *LogRecord) int {
+		return cmp.Compare(a.Tm, b.Tm)
+	})
+	return res, nil
+}
+
+func (c *Client) Users(ctx context.Context) ([]*User, error) {
+	q := url.Values{}
+	q.Set("skip", "0")
+	q.Set("limit", "10000")
+	q.Set("filter", "")
+	var result usersResp
+	if err := c.get(ctx, c.devicePath("users"), q, &result); err != nil {
+		return nil, err
+	}
+	return result.Users.List, nil
+}
+
+func (c *Client) TimeGroups(ctx context.Context) ([]*TimeGroup, error) {
+	var result timeGroupsResp
+	if err := c.get(ctx, c.devicePath("groups"), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Groups.List, nil
+}
+
+// AddUser creates user on the device, u.Id is a phone number
+func (c *Client) AddUser(ctx context.Context, u *User) error {
+	return c.do(ctx, "POST", c.devicePath("user"), nil, u, nil)
+}
+
+func (c *Client) UpdateUser(ctx context.Context, u *User) error {
+	return c.do(ctx, "PUT", c.devicePath("user/"+url.PathEscape(u.Id)), nil, u, nil)
+}
+
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", c.devicePath("user/"+url.PathEscape(id)), nil, nil, nil)
+}
+
+func (c *Client) devicePath(p string) string {
+	return "/device/" + url.PathEscape(c.DeviceID) + "/" + p
+}
+
+func (c *Client) get(ctx context.Context, path string, q url.Values, result any) error {
+	return c.do(ctx, "GET", path, q, nil, result)
+}
+
+// do logs in when needed and repeats the request once after a forced login on http 401.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, body, result any) error {
+	if err := c.Login(ctx, false); err != nil {
+		return err
+	}
+	err := c.doRequest(ctx, method, path, q, body, result)
+	if !errors.Is(err, ErrUnauthorized) {
+		return err
+	}
+	if err := c.Login(ctx, true); err != nil {
+		return err
+	}
+	return c.doRequest(ctx, method, path, q, body, result)
+}
+
+func (c *Client) doRequest(ctx context.Context, method, path string, q url.Values, body, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	u := c.BaseURL + path
+	if len(q) != 0 {
+		u += "?" + q.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		bb, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(bb)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("x-access-token", c.Token())
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		io.Copy(io.Discard, resp.Body)
+		return ErrUnauthorized
+	default:
+		return fmt.Errorf("pal-es %s %s http %d", method, path, resp.StatusCode)
+	}
+	if result == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("pal-es %s response: %w", path, err)
+	}
+	return nil
+}
+
+// TokenExpiry returns "exp" claim of JWT. PalES puts milliseconds there.
+func TokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	if claims.Exp > 1e11 {
+		return time.UnixMilli(claims.Exp)
+	}
+	return time.Unix(claims.Exp, 0)
+}
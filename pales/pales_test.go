@@ -0,0 +1,123 @@
+package pales_test
+
+import (
+	"7stgbot/pales"
+	"7stgbot/pales/palestest"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newClient(t *testing.T) (*palestest.Server, *pales.Client) {
+	srv := palestest.NewServer("DEV1", "u", "p")
+	t.Cleanup(srv.Close)
+	c := pales.NewClient(srv.URL, "DEV1", "u", "p", filepath.Join(t.TempDir(), "t.txt"))
+	return srv, c
+}
+
+func TestLogsPaging(t *testing.T) {
+	srv, c := newClient(t)
+	for i := range 25 {
+		srv.AddLogs(&pales.LogRecord{UserId: "9990010203", Tm: int64(1000 + i), Type: 1})
+	}
+	ll, err := c.Logs(context.Background(), 1003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ll), 22; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := ll[0].Tm, int64(1003); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ll[len(ll)-1].Tm, int64(1024); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := srv.LogQueries(), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	srv, c := newClient(t)
+	ctx := context.Background()
+	if _, err := c.Users(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.Logins(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	bb, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(bb), c.Token(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	fi, _ := os.Stat(c.TokenFile)
+	if got, want := fi.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// token is still valid, no new login
+	if _, err := c.TimeGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.Logins(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// revoked token is renewed on 401
+	srv.ExpireTokens()
+	if _, err := c.TimeGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.Logins(), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// token about to expire is renewed before the request
+	srv.TokenTTL = time.Minute
+	if err := c.Login(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Users(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.Logins(), 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLoadToken(t *testing.T) {
+	_, c := newClient(t)
+	exp := time.UnixMilli(1777555283616)
+	if err := os.WriteFile(c.TokenFile, []byte(palestest.Token(1, exp)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadToken(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Expires(), exp; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	tests := []struct {
+		token string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"a.b", time.Time{}},
+		{"e30.eyJleHAiOjE3Nzc1NTUyODN9.x", time.Unix(1777555283, 0)},
+		{"e30.eyJleHAiOjE3Nzc1NTUyODM2MTZ9.x", time.UnixMilli(1777555283616)},
+	}
+	for _, tt := range tests {
+		if got := pales.TokenExpiry(tt.token); !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.token, got, tt.want)
+		}
+	}
+}
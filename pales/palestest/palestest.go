@@ -0,0 +1,223 @@
+// Package palestest is an in-memory PalES portal for tests.
+package palestest
+
+import (
+	"7stgbot/pales"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	*httptest.Server
+	DeviceID string
+	Username string
+	Password string
+	// TokenTTL is a lifetime of issued tokens
+	TokenTTL time.Duration
+
+	mu         sync.Mutex
+	users      []*pales.User
+	groups     []*pales.TimeGroup
+	logs       []*pales.LogRecord
+	tokens     map[string]time.Time
+	logins     int
+	logQueries int
+}
+
+func NewServer(deviceID, username, password string) *Server {
+	s := &Server{
+		DeviceID: deviceID,
+		Username: username,
+		Password: password,
+		TokenTTL: time.Hour,
+		tokens:   make(map[string]time.Time),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /user/login1", s.handleLogin)
+	mux.HandleFunc("GET /device/{device}/log", s.auth(s.handleLog))
+	mux.HandleFunc("GET /device/{device}/users", s.auth(s.handleUsers))
+	mux.HandleFunc("GET /device/{device}/groups", s.auth(s.handleGroups))
+	mux.HandleFunc("POST /device/{device}/user", s.auth(s.handleAddUser))
+	mux.HandleFunc("PUT /device/{device}/user/{id}", s.auth(s.handleUpdateUser))
+	mux.HandleFunc("DELETE /device/{device}/user/{id}", s.auth(s.handleDeleteUser))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddLogs appends records to the device log
+func (s *Server) AddLogs(ll ...*pales.LogRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs = append(s.logs, ll...)
+}
+
+func (s *Server) SetUsers(uu ...*pales.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = uu
+}
+
+func (s *Server) Users() []*pales.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.users)
+}
+
+func (s *Server) SetGroups(gg ...*pales.TimeGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups = gg
+}
+
+// ExpireTokens makes all issued tokens invalid
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.tokens)
+}
+
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func (s *Server) LogQueries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logQueries
+}
+
+// Token returns JWT-like token with exp claim in milliseconds as the portal does
+func Token(id int, exp time.Time) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"HS512"}`))
+	payload := enc.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d,"id":"%d"}`, exp.UnixMilli(), id)))
+	return header + "." + payload + ".sig"
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var form struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if form.Username != s.Username || form.Password != s.Password {
+		writeJSON(w, map[string]any{"msg": "wrong credentials", "user": map[string]any{}})
+		return
+	}
+	s.logins++
+	exp := time.Now().Add(s.TokenTTL)
+	token := Token(s.logins, exp)
+	s.tokens[token] = exp
+	writeJSON(w, map[string]any{"msg": "ok", "user": map[string]any{"token": token}})
+}
+
+func (s *Server) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("device") != s.DeviceID {
+			http.NotFound(w, r)
+			return
+		}
+		s.mu.Lock()
+		exp, ok := s.tokens[r.Header.Get("x-access-token")]
+		s.mu.Unlock()
+		if !ok || time.Now().After(exp) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) handleLog(w http.ResponseWriter, r *http.Request) {
+	skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logQueries++
+	// newest first
+	ll := slices.Clone(s.logs)
+	slices.SortStableFunc(ll, func(a, b *pales.LogRecord) int {
+		return cmp.Compare(b.Tm, a.Tm)
+	})
+	total := len(ll)
+	ll = ll[min(skip, len(ll)):]
+	ll = ll[:min(limit, len(ll))]
+	writeJSON(w, map[string]any{"msg": "ok", "log": map[string]any{"count": total, "list": ll}})
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, map[string]any{"msg": "ok", "users": map[string]any{"count": len(s.users), "list": s.users}})
+}
+
+func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	var u pales.User
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.users, func(x *pales.User) bool { return x.Id == u.Id }) {
+		http.Error(w, "user exists", http.StatusConflict)
+		return
+	}
+	s.users = append(s.users, &u)
+	writeJSON(w, map[string]any{"msg": "ok"})
+}
+
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var u pales.User
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.users, func(x *pales.User) bool { return x.Id == r.PathValue("id") })
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	s.users[i] = &u
+	writeJSON(w, map[string]any{"msg": "ok"})
+}
+
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.users)
+	s.users = slices.DeleteFunc(s.users, func(x *pales.User) bool { return x.Id == r.PathValue("id") })
+	if len(s.users) == n {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, map[string]any{"msg": "ok"})
+}
+
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, map[string]any{"msg": "ok", "groups": map[string]any{"list": s.groups}})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,141 @@
+package pales
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Op string
+
+const (
+	OpAdd       Op = "add"
+	OpUpdate    Op = "update"
+	OpTimeGroup Op = "timegroup"
+	OpRemove    Op = "remove"
+)
+
+var opOrder = map[Op]int{OpAdd: 0, OpUpdate: 1, OpTimeGroup: 2, OpRemove: 3}
+
+// Change is one step of a synchronisation plan. Old is nil for OpAdd, New is nil for OpRemove.
+type Change struct {
+	Op  Op
+	Old *User
+	New *User
+}
+
+func (c *Change) Phone() string {
+	if c.New != nil {
+		return c.New.Id
+	}
+	return c.Old.Id
+}
+
+func (c *Change) String() string {
+	switch c.Op {
+	case OpAdd:
+		return fmt.Sprintf("+ %s %s %s%s", c.New.Id, c.New.Firstname, c.New.Lastname, access(c.New))
+	case OpRemove:
+		return fmt.Sprintf("- %s %s %s", c.Old.Id, c.Old.Firstname, c.Old.Lastname)
+	case OpTimeGroup:
+		return fmt.Sprintf("~ %s %s %s group %q -> %q", c.New.Id, c.New.Firstname, c.New.Lastname,
+			c.Old.TimeGroupName, c.New.TimeGroupName)
+	}
+	return fmt.Sprintf("~ %s %s %s%s ->%s", c.New.Id, c.New.Firstname, c.New.Lastname, access(c.Old), access(c.New))
+}
+
+func access(u *User) string {
+	var sb strings.Builder
+	if u.Output1 {
+		sb.WriteString(" output1")
+	}
+	if u.DialToOpen {
+		sb.WriteString(" dial")
+	}
+	if u.TimeGroupName != "" {
+		sb.WriteString(" group=" + u.TimeGroupName)
+	}
+	if sb.Len() == 0 {
+		return " no access"
+	}
+	return sb.String()
+}
+
+// Plan is a set of changes waiting for approval
+type Plan struct {
+	ID      string
+	Created time.Time
+	Changes []*Change
+}
+
+func (p *Plan) String() string {
+	if len(p.Changes) == 0 {
+		return "pal-es users are in sync"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "plan %s, %d changes:", p.ID, len(p.Changes))
+	for _, c := range p.Changes {
+		sb.WriteString("\n")
+		sb.WriteString(c.String())
+	}
+	return sb.String()
+}
+
+// Diff returns changes turning actual device users into desired ones.
+// Only access fields (Output1, DialToOpen, time group) of existing users are managed, names are kept.
+// Users missing in desired are removed unless keep returns true, admins are never removed.
+func Diff(desired, actual []*User, keep func(*User) bool) []*Change {
+	actualMap := make(map[string]*User, len(actual))
+	for _, u := range actual {
+		actualMap[u.Id] = u
+	}
+	desiredMap := make(map[string]*User, len(desired))
+	var res []*Change
+	for _, d := range desired {
+		desiredMap[d.Id] = d
+		a := actualMap[d.Id]
+		if a == nil {
+			res = append(res, &Change{Op: OpAdd, New: d})
+			continue
+		}
+		n := *a
+		n.Output1 = d.Output1
+		n.DialToOpen = d.DialToOpen
+		n.TimeGroupId = d.TimeGroupId
+		n.TimeGroupName = d.TimeGroupName
+		accessChanged := n.Output1 != a.Output1 || n.DialToOpen != a.DialToOpen
+		groupChanged := n.TimeGroupId != a.TimeGroupId || n.TimeGroupName != a.TimeGroupName
+		switch {
+		case accessChanged:
+			res = append(res, &Change{Op: OpUpdate, Old: a, New: &n})
+		case groupChanged:
+			res = append(res, &Change{Op: OpTimeGroup, Old: a, New: &n})
+		}
+	}
+	for _, a := range actual {
+		if desiredMap[a.Id] != nil || a.Admin || (keep != nil && keep(a)) {
+			continue
+		}
+		res = append(res, &Change{Op: OpRemove, Old: a})
+	}
+	slices.SortStableFunc(res, func(a, b *Change) int {
+		return cmp.Or(cmp.Compare(opOrder[a.Op], opOrder[b.Op]), cmp.Compare(a.Phone(), b.Phone()))
+	})
+	return res
+}
+
+// Apply performs the change through the portal API
+func (c *Client) Apply(ctx context.Context, ch *Change) error {
+	switch ch.Op {
+	case OpAdd:
+		return c.AddUser(ctx, ch.New)
+	case OpUpdate, OpTimeGroup:
+		return c.UpdateUser(ctx, ch.New)
+	case OpRemove:
+		return c.DeleteUser(ctx, ch.Old.Id)
+	}
+	return fmt.Errorf("unknown op %q", ch.Op)
+}
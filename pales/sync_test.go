@@ -0,0 +1,74 @@
+package pales_test
+
+import (
+	"7stgbot/pales"
+	"context"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	desired := []*pales.User{
+		{Id: "79990000001", Output1: true, DialToOpen: true},
+		{Id: "79990000002", Output1: true, DialToOpen: true},
+		{Id: "79990000003", Output1: false, DialToOpen: false},
+		{Id: "79990000004", Output1: true, DialToOpen: true, TimeGroupName: "day", TimeGroupId: "g1"},
+	}
+	actual := []*pales.User{
+		{Id: "79990000002", Firstname: "Иван", Lastname: "12", Output1: true, DialToOpen: true},
+		{Id: "79990000003", Firstname: "Петр", Lastname: "13", Output1: true, DialToOpen: true},
+		{Id: "79990000004", Output1: true, DialToOpen: true},
+		{Id: "79990000005"},
+		{Id: "79990000006", Admin: true},
+		{Id: "79990000007", Lastname: "12"},
+	}
+	keep := func(u *pales.User) bool { return u.Lastname == "12" }
+	changes := pales.Diff(desired, actual, keep)
+	want := []struct {
+		op    pales.Op
+		phone string
+	}{
+		{pales.OpAdd, "79990000001"},
+		{pales.OpUpdate, "79990000003"},
+		{pales.OpTimeGroup, "79990000004"},
+		{pales.OpRemove, "79990000005"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %v, want %v", changes, want)
+	}
+	for i, w := range want {
+		if changes[i].Op != w.op || changes[i].Phone() != w.phone {
+			t.Errorf("%d: got %v %v, want %v %v", i, changes[i].Op, changes[i].Phone(), w.op, w.phone)
+		}
+	}
+	// names are kept
+	if got, want := changes[1].New.Firstname, "Петр"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestApply(t *testing.T) {
+	srv, c := newClient(t)
+	srv.SetUsers(&pales.User{Id: "79990000002", Output1: true}, &pales.User{Id: "79990000005"})
+	changes := pales.Diff([]*pales.User{
+		{Id: "79990000001", Output1: true},
+		{Id: "79990000002", Output1: false},
+	}, srv.Users(), nil)
+	for _, ch := range changes {
+		if err := c.Apply(context.Background(), ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := make(map[string]*pales.User)
+	for _, u := range srv.Users() {
+		users[u.Id] = u
+	}
+	if got, want := len(users), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if u := users["79990000001"]; u == nil || !u.Output1 {
+		t.Errorf("got %v, want added user with output1", u)
+	}
+	if u := users["79990000002"]; u == nil || u.Output1 {
+		t.Errorf("got %v, want updated user without output1", u)
+	}
+}
@@ -0,0 +1,296 @@
+// Package paymentqr encodes and decodes payment QR codes of ГОСТ Р 56042-2014: the header ST0001 with
+// the encoding digit, then "|Name=value" requisites. Payee requisites are required, the rest are optional.
+package paymentqr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encoding is the digit after ST0001 in the header
+type Encoding byte
+
+const (
+	CP1251 Encoding = '1' // ST00011
+	UTF8   Encoding = '2' // ST00012
+	KOI8R  Encoding = '3' // ST00013, decoded only
+)
+
+const (
+	formatID  = "ST0001"
+	separator = '|'
+	maxSum    = 999999999999999999 // 18 digits
+)
+
+func (e Encoding) String() string { return formatID + string(e) }
+
+// ParseEncoding accepts the header ST00011 or ST00012, UTF-8 if empty
+func ParseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "", UTF8.String():
+		return UTF8, nil
+	case CP1251.String():
+		return CP1251, nil
+	}
+	return 0, fmt.Errorf("unknown QR encoding %q, %s or %s expected", s, CP1251, UTF8)
+}
+
+// Payment are requisites of the QR code encoded in the order of the standard. The qr tag is the name,
+// the max length in characters, 0 - not limited, and options: required, digits - only digits, not truncated,
+// exact - of the max length.
+type Payment struct {
+	// payee
+	Name        string `qr:"Name,160,required"`
+	PersonalAcc string `qr:"PersonalAcc,20,required,digits,exact"`
+	BankName    string `qr:"BankName,45,required"`
+	BIC         string `qr:"BIC,9,required,digits,exact"`
+	CorrespAcc  string `qr:"CorrespAcc,20,required,digits"`
+
+	Sum          int64  `qr:"Sum,18"` // kopecks, 0 - not set
+	Purpose      string `qr:"Purpose,210"`
+	PayeeINN     string `qr:"PayeeINN,12,digits"`
+	PayerINN     string `qr:"PayerINN,12,digits"`
+	DrawerStatus string `qr:"DrawerStatus,2"`
+	KPP          string `qr:"KPP,9"`
+	CBC          string `qr:"CBC,20"`
+	OKTMO        string `qr:"OKTMO,11,digits"`
+	PaytReason   string `qr:"PaytReason,2"`
+	TaxPeriod    string `qr:"TaxPeriod,10"`
+	DocNo        string `qr:"DocNo,15"`
+	DocDate      string `qr:"DocDate,10"`
+	TaxPaytKind  string `qr:"TaxPaytKind,2"`
+
+	LastName        string `qr:"LastName,18"`
+	FirstName       string `qr:"FirstName"`
+	MiddleName      string `qr:"MiddleName"`
+	PayerAddress    string `qr:"PayerAddress"`
+	PersonalAccount string `qr:"PersonalAccount"`
+	DocIdx          string `qr:"DocIdx"`
+	PensAcc         string `qr:"PensAcc"`
+	Contract        string `qr:"Contract"`
+	PersAcc         string `qr:"PersAcc"`
+	Flat            string `qr:"Flat"`
+	Phone           string `qr:"Phone"`
+	PayerIdType     string `qr:"PayerIdType"`
+	PayerIdNum      string `qr:"PayerIdNum"`
+	ChildFio        string `qr:"ChildFio"`
+	BirthDate       string `qr:"BirthDate"`
+	PaymTerm        string `qr:"PaymTerm"`
+	PaymPeriod      string `qr:"PaymPeriod"`
+	Category        string `qr:"Category"`
+	ServiceName     string `qr:"ServiceName"`
+	CounterId       string `qr:"CounterId"`
+	CounterVal      string `qr:"CounterVal"`
+	QuittId         string `qr:"QuittId"`
+	QuittDate       string `qr:"QuittDate"`
+	InstNum         string `qr:"InstNum"`
+	ClassNum        string `qr:"ClassNum"`
+	SpecFio         string `qr:"SpecFio"`
+	AddAmount       string `qr:"AddAmount"`
+	RuleId          string `qr:"RuleId"`
+	ExecId          string `qr:"ExecId"`
+	RegType         string `qr:"RegType"`
+	UIN             string `qr:"UIN"`
+	TechCode        string `qr:"TechCode"`
+}
+
+type field struct {
+	name     string
+	index    int
+	max      int
+	required bool
+	digits   bool
+	exact    bool
+}
+
+var fields, fieldsByName = parseFields()
+
+func parseFields() ([]field, map[string]field) {
+	t := reflect.TypeFor[Payment]()
+	ff := make([]field, t.NumField())
+	byName := make(map[string]field, len(ff))
+	for i := range ff {
+		opts := strings.Split(t.Field(i).Tag.Get("qr"), ",")
+		f := field{name: opts[0], index: i}
+		if len(opts) > 1 {
+			f.max, _ = strconv.Atoi(opts[1])
+		}
+		for _, o := range opts[min(len(opts), 2):] {
+			switch o {
+			case "required":
+				f.required = true
+			case "digits":
+				f.digits = true
+			case "exact":
+				f.exact = true
+			}
+		}
+		ff[i] = f
+		byName[f.name] = f
+	}
+	return ff, byName
+}
+
+// Get returns the requisite by the name of the standard, "" if it is not set
+func (p *Payment) Get(name string) string {
+	f, ok := fieldsByName[name]
+	if !ok {
+		return ""
+	}
+	v := reflect.ValueOf(p).Elem().Field(f.index)
+	if v.Kind() == reflect.Int64 {
+		if v.Int() == 0 {
+			return ""
+		}
+		return strconv.FormatInt(v.Int(), 10)
+	}
+	return v.String()
+}
+
+// Set sets the requisite by the name of the standard
+func (p *Payment) Set(name, value string) error {
+	f, ok := fieldsByName[name]
+	if !ok {
+		return fmt.Errorf("unknown requisite %q", name)
+	}
+	v := reflect.ValueOf(p).Elem().Field(f.index)
+	if v.Kind() == reflect.Int64 {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil && value != "" {
+			return fmt.Errorf("%s: %q is not a number", name, value)
+		}
+		v.SetInt(n)
+		return nil
+	}
+	v.SetString(value)
+	return nil
+}
+
+// FromMap sets requisites of the map, the QR section of the config
+func FromMap(m map[string]string) (Payment, error) {
+	var p Payment
+	var errs []error
+	for k, v := range m {
+		errs = append(errs, p.Set(k, v))
+	}
+	return p, errors.Join(errs...)
+}
+
+// Validate checks required requisites and digit ones, text is checked by length
+func (p *Payment) Validate() error {
+	var errs []error
+	if p.Sum < 0 || p.Sum > maxSum {
+		errs = append(errs, fmt.Errorf("Sum: bad amount %d", p.Sum))
+	}
+	for _, f := range fields {
+		v := p.Get(f.name)
+		n := utf8.RuneCountInString(v)
+		switch {
+		case v == "":
+			if f.required {
+				errs = append(errs, fmt.Errorf("%s: required", f.name))
+			}
+		case f.digits && strings.Trim(v, "0123456789") != "":
+			errs = append(errs, fmt.Errorf("%s: %q is not a number", f.name, v))
+		case f.exact && n != f.max:
+			errs = append(errs, fmt.Errorf("%s: %q is not of %d digits", f.name, v, f.max))
+		case f.max > 0 && n > f.max:
+			errs = append(errs, fmt.Errorf("%s: longer than %d", f.name, f.max))
+		case strings.ContainsAny(v, "|\r\n"):
+			errs = append(errs, fmt.Errorf("%s: | or a line break", f.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Normalize makes text requisites valid: line breaks are replaced by spaces and the separator | by /,
+// characters out of cp1251 by ? for CP1251, text longer than the max is truncated. Digit requisites are
+// not changed.
+func (p *Payment) Normalize(enc Encoding) {
+	for _, f := range fields {
+		v := reflect.ValueOf(p).Elem().Field(f.index)
+		if v.Kind() != reflect.String || f.digits {
+			continue
+		}
+		s := strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ", "\t", " ", string(separator), "/").
+			Replace(v.String())
+		if enc == CP1251 {
+			s = strings.Map(func(r rune) rune {
+				if _, ok := charmap.Windows1251.EncodeRune(r); !ok {
+					return '?'
+				}
+				return r
+			}, s)
+		}
+		s = strings.TrimSpace(s)
+		if rr := []rune(s); f.max > 0 && len(rr) > f.max {
+			s = strings.TrimSpace(string(rr[:f.max]))
+		}
+		v.SetString(s)
+	}
+}
+
+// Encode normalizes and validates requisites and returns the content of the QR code
+func (p Payment) Encode(enc Encoding) ([]byte, error) {
+	if enc != UTF8 && enc != CP1251 {
+		return nil, fmt.Errorf("encoding %s is not supported", enc)
+	}
+	p.Normalize(enc)
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	sb.WriteString(enc.String())
+	for _, f := range fields {
+		if v := p.Get(f.name); v != "" {
+			sb.WriteByte(separator)
+			sb.WriteString(f.name + "=" + v)
+		}
+	}
+	if enc == CP1251 {
+		return charmap.Windows1251.NewEncoder().Bytes([]byte(sb.String()))
+	}
+	return []byte(sb.String()), nil
+}
+
+// Decode parses the content of the QR code, the separator is the character after the header
+func Decode(data []byte) (Payment, Encoding, error) {
+	var p Payment
+	if len(data) < len(formatID)+2 || !bytes.HasPrefix(data, []byte(formatID)) {
+		return p, 0, errors.New("not a payment QR code")
+	}
+	enc, sep := Encoding(data[len(formatID)]), data[len(formatID)+1]
+	body := data[len(formatID)+2:]
+	var err error
+	switch enc {
+	case CP1251:
+		body, err = charmap.Windows1251.NewDecoder().Bytes(body)
+	case KOI8R:
+		body, err = charmap.KOI8R.NewDecoder().Bytes(body)
+	case UTF8:
+		if !utf8.Valid(body) {
+			err = errors.New("not valid UTF-8")
+		}
+	default:
+		err = fmt.Errorf("unknown encoding %q", enc)
+	}
+	if err != nil {
+		return p, enc, err
+	}
+	var errs []error
+	for _, s := range strings.Split(string(body), string(sep)) {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("bad requisite %q", s))
+			continue
+		}
+		errs = append(errs, p.Set(name, value))
+	}
+	return p, enc, errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package paymentqr
+
+import (
+	"strings"
+	"testing"
+)
+
+var payee = map[string]string{
+	"Name":        "СНТ \"Семиславка\"",
+	"PersonalAcc": "40703810000000000001",
+	"BankName":    "ПАО Сбербанк",
+	"BIC":         "044525225",
+	"CorrespAcc":  "30101810400000000225",
+	"PayeeINN":    "5000000000",
+}
+
+func TestEncode(t *testing.T) {
+	p, err := FromMap(payee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Purpose, p.Sum, p.PaymPeriod = "За эл-энергию, мар 2024, участок 12", 65000, "03.2024"
+	got, err := p.Encode(UTF8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `ST00012|Name=СНТ "Семиславка"|PersonalAcc=40703810000000000001|BankName=ПАО Сбербанк|BIC=044525225|` +
+		`CorrespAcc=30101810400000000225|Sum=65000|Purpose=За эл-энергию, мар 2024, участок 12|PayeeINN=5000000000|` +
+		`PaymPeriod=03.2024`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, enc := range []Encoding{UTF8, CP1251} {
+		data, err := p.Encode(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, gotEnc, err := Decode(data)
+		if err != nil || gotEnc != enc || d != p {
+			t.Errorf("%s: got %+v %s %v, want %+v", enc, d, gotEnc, err, p)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	p, _ := FromMap(payee)
+	p.Purpose = "Взносы | пени\nза 2024 ₽ " + strings.Repeat("я", 300)
+	p.LastName = "Константинопольский-Иванов"
+	data, err := p.Encode(CP1251)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _, _ := Decode(data)
+	if !strings.HasPrefix(d.Purpose, "Взносы / пени за 2024 ? яя") || len([]rune(d.Purpose)) != 210 {
+		t.Errorf("got %q, want the purpose escaped and truncated", d.Purpose)
+	}
+	if d.LastName != "Константинопольски" {
+		t.Errorf("got %q, want the last name of 18 characters", d.LastName)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        string
+	}{
+		{"BIC", "04452522", "BIC: \"04452522\" is not of 9 digits"},
+		{"PersonalAcc", "4070381000000000000X", "PersonalAcc: \"4070381000000000000X\" is not a number"},
+		{"Name", "", "Name: required"},
+		{"PayeeINN", "5000000000123", "PayeeINN: longer than 12"},
+	}
+	for _, tt := range tests {
+		p, _ := FromMap(payee)
+		p.Set(tt.name, tt.value)
+		if _, err := p.Encode(UTF8); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := FromMap(map[string]string{"Nmae": "x"}); err == nil {
+		t.Error("got no error for an unknown requisite")
+	}
+	if _, _, err := Decode([]byte("ST00012|Name=x|Sum=abc")); err == nil {
+		t.Error("got no error for a bad sum")
+	}
+	if p, _, err := Decode([]byte("ST00012#Name=a|b#Sum=100")); err != nil || p.Name != "a|b" || p.Sum != 100 {
+		t.Errorf("got %+v %v, want the separator #", p, err)
+	}
+}
@@ -0,0 +1,176 @@
+package secrets
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: 7stgbot secrets [-cfg dir] <command>
+  init                       create the key file and an empty store
+  list                       names and versions, values are not shown
+  get <name>                 print the current value
+  set <name> [value]         replace all versions, value is read from stdin if omitted
+  rotate <name> [value]      add a new current version, old ones are still accepted
+  retire <name> <version>    remove an old version
+  delete <name>              remove the secret
+  rekey                      encrypt the store with a new key
+value "random:<n>" generates n random characters`
+
+// CLI runs "7stgbot secrets" command
+func CLI(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("secrets", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	dir := fs.String("cfg", "./", "Path to config dir")
+	fs.Usage = func() { fmt.Fprintln(stdout, usage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	aa := fs.Args()
+	if len(aa) == 0 {
+		fs.Usage()
+		return errors.New("command expected")
+	}
+	cmd, aa := aa[0], aa[1:]
+	if cmd == "init" {
+		return initStore(*dir, stdout)
+	}
+	key, err := LoadKey(*dir)
+	if err != nil {
+		return err
+	}
+	s, err := Open(*dir)
+	if err != nil {
+		return err
+	}
+	value := func(i int) (string, error) {
+		v := ""
+		if len(aa) > i {
+			v = aa[i]
+		} else {
+			fmt.Fprint(stdout, "value: ")
+			line, err := bufio.NewReader(stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return "", err
+			}
+			v = strings.TrimRight(line, "\r\n")
+		}
+		if n, ok := strings.CutPrefix(v, "random:"); ok {
+			var size int
+			if _, err := fmt.Sscan(n, &size); err != nil || size <= 0 {
+				return "", fmt.Errorf("bad size %q", n)
+			}
+			return RandomValue(size)
+		}
+		if v == "" {
+			return "", errors.New("empty value")
+		}
+		return v, nil
+	}
+	switch {
+	case cmd == "list" && len(aa) == 0:
+		for _, name := range s.Names() {
+			var ids []string
+			for _, v := range s.Versions(name) {
+				ids = append(ids, v.ID)
+			}
+			fmt.Fprintf(stdout, "%s %s\n", name, strings.Join(ids, ","))
+		}
+		return nil
+	case cmd == "get" && len(aa) == 1:
+		fmt.Fprintln(stdout, s.Get(aa[0]))
+		return nil
+	case (cmd == "set" || cmd == "rotate") && (len(aa) == 1 || len(aa) == 2):
+		v, err := value(1)
+		if err != nil {
+			return err
+		}
+		var ver Version
+		if cmd == "set" {
+			ver = s.Set(aa[0], v)
+		} else {
+			ver = s.Rotate(aa[0], v)
+		}
+		if err := s.Save(*dir, key); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s version %s is current\n", aa[0], ver.ID)
+		return nil
+	case cmd == "retire" && len(aa) == 2:
+		if err := s.Retire(aa[0], aa[1]); err != nil {
+			return err
+		}
+		return s.Save(*dir, key)
+	case cmd == "delete" && len(aa) == 1:
+		if !s.Delete(aa[0]) {
+			return fmt.Errorf("%s not found", aa[0])
+		}
+		return s.Save(*dir, key)
+	case cmd == "rekey" && len(aa) == 0:
+		if os.Getenv(KeyEnv) != "" {
+			return fmt.Errorf("key is set by %s, unset it to rekey the key file", KeyEnv)
+		}
+		newKey, encoded, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		// the new key is in place before the store is encrypted by it, the old one is kept
+		// until the store is saved, so a failure at any step leaves a key that opens the store
+		path := filepath.Join(*dir, KeyFileName)
+		if err := os.Rename(path, path+".old"); err != nil {
+			return err
+		}
+		if err := writeKey(*dir, encoded); err != nil {
+			return errors.Join(err, os.Rename(path+".old", path))
+		}
+		if err := s.Save(*dir, newKey); err != nil {
+			return errors.Join(err, os.Rename(path+".old", path))
+		}
+		return os.Remove(path + ".old")
+	}
+	fs.Usage()
+	return fmt.Errorf("bad command %q", strings.Join(fs.Args(), " "))
+}
+
+func initStore(dir string, stdout io.Writer) error {
+	if _, err := os.Stat(filepath.Join(dir, FileName)); err == nil {
+		return fmt.Errorf("%s already exists", FileName)
+	}
+	key, err := LoadKey(dir)
+	if errors.Is(err, ErrNoKey) {
+		var encoded string
+		if key, encoded, err = GenerateKey(); err != nil {
+			return err
+		}
+		if err := writeKey(dir, encoded); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "key is written to %s, keep a copy out of the server\n", KeyFileName)
+	} else if err != nil {
+		return err
+	}
+	return NewStore().Save(dir, key)
+}
+
+// writeKey replaces the key file atomically
+func writeKey(dir, encoded string) error {
+	path := filepath.Join(dir, KeyFileName)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(encoded + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if err := errors.Join(err, f.Close()); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,278 @@
+// Package secrets keeps secrets in a NaCl secretbox encrypted file, environment variables override it.
+// A secret has versions, the last one is current. Older versions are still accepted while rotating,
+// so links and hashes made with them keep working until the version is retired.
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// KeyEnv is base64 of the 32 bytes master key, secrets.key file in the config dir is used if it is not set
+	KeyEnv = "STGBOT_SECRETS_KEY"
+	// EnvPrefix + upper case name with "-" and "." replaced by "_" overrides the secret
+	EnvPrefix   = "STGBOT_SECRET_"
+	FileName    = "secrets.enc"
+	KeyFileName = "secrets.key"
+	envID       = "env"
+)
+
+var ErrNoKey = errors.New("secrets key is not set")
+
+type Version struct {
+	ID      string
+	Value   string
+	Created int64
+}
+
+type Store struct {
+	mu      sync.RWMutex
+	secrets map[string][]Version // oldest first
+	env     map[string]string
+}
+
+func NewStore() *Store {
+	return &Store{secrets: make(map[string][]Version), env: make(map[string]string)}
+}
+
+func envName(name string) string {
+	return EnvPrefix + strings.NewReplacer("-", "_", ".", "_", "/", "_").Replace(strings.ToUpper(name))
+}
+
+// Get returns the current value, empty if there is no secret
+func (s *Store) Get(name string) string {
+	vv := s.Versions(name)
+	if len(vv) == 0 {
+		return ""
+	}
+	return vv[0].Value
+}
+
+// Versions returns values newest first, the environment one is the newest
+func (s *Store) Versions(name string) []Version {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var res []Version
+	if v, ok := s.env[envName(name)]; ok {
+		res = append(res, Version{ID: envID, Value: v})
+	}
+	vv := s.secrets[name]
+	for i := len(vv) - 1; i >= 0; i-- {
+		res = append(res, vv[i])
+	}
+	return res
+}
+
+// Values returns values newest first
+func (s *Store) Values(name string) []string {
+	var res []string
+	for _, v := range s.Versions(name) {
+		res = append(res, v.Value)
+	}
+	return res
+}
+
+func (s *Store) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var res []string
+	for k := range s.secrets {
+		res = append(res, k)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// Set replaces all versions of the secret
+func (s *Store) Set(name, value string) Version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.secrets, name)
+	return s.add(name, value)
+}
+
+// Rotate adds a new current version, previous ones are kept until retired
+func (s *Store) Rotate(name, value string) Version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(name, value)
+}
+
+func (s *Store) add(name, value string) Version {
+	id := 1
+	if vv := s.secrets[name]; len(vv) != 0 {
+		last, _ := strconv.Atoi(vv[len(vv)-1].ID)
+		id = last + 1
+	}
+	v := Version{ID: strconv.Itoa(id), Value: value, Created: time.Now().Unix()}
+	s.secrets[name] = append(s.secrets[name], v)
+	return v
+}
+
+// Retire removes the version, the current one can not be retired
+func (s *Store) Retire(name, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vv := s.secrets[name]
+	i := slices.IndexFunc(vv, func(v Version) bool { return v.ID == id })
+	switch {
+	case i < 0:
+		return fmt.Errorf("%s version %s not found", name, id)
+	case i == len(vv)-1:
+		return fmt.Errorf("%s version %s is current", name, id)
+	}
+	s.secrets[name] = slices.Delete(vv, i, i+1)
+	return nil
+}
+
+// Delete removes all versions of the secret
+func (s *Store) Delete(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.secrets[name]
+	delete(s.secrets, name)
+	return ok
+}
+
+// LoadEnv takes overrides from environ, os.Environ() format
+func (s *Store) LoadEnv(environ []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, EnvPrefix) {
+			s.env[k] = v
+		}
+	}
+}
+
+// Open loads the store of the dir and environment overrides. Without the file the store has overrides only.
+func Open(dir string) (*Store, error) {
+	s := NewStore()
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		key, err := LoadKey(dir)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.decrypt(data, key); err != nil {
+			// rekey stopped after writing the new key, the store is still encrypted by the old one
+			old, oldErr := readKeyFile(filepath.Join(dir, KeyFileName+".old"))
+			if oldErr != nil || s.decrypt(data, old) != nil {
+				return nil, fmt.Errorf("%s: %w", FileName, err)
+			}
+		}
+	}
+	s.LoadEnv(os.Environ())
+	return s, nil
+}
+
+// Save writes the store encrypted, environment overrides are not saved
+func (s *Store) Save(dir string, key *[32]byte) error {
+	s.mu.RLock()
+	plain, err := json.Marshal(s.secrets)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	box := secretbox.Seal(nonce[:], plain, &nonce, key)
+	path := filepath.Join(dir, FileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(base64.StdEncoding.EncodeToString(box)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Store) decrypt(data []byte, key *[32]byte) error {
+	box, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	if len(box) < 24 {
+		return errors.New("file is too short")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box)
+	plain, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return errors.New("wrong key or corrupted file")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(plain, &s.secrets)
+}
+
+// LoadKey returns the master key from KeyEnv or from the key file of the dir
+func LoadKey(dir string) (*[32]byte, error) {
+	if s := os.Getenv(KeyEnv); s != "" {
+		return ParseKey(s)
+	}
+	return readKeyFile(filepath.Join(dir, KeyFileName))
+}
+
+func readKeyFile(path string) (*[32]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(strings.TrimSpace(string(data)))
+}
+
+func ParseKey(s string) (*[32]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("key length is %d, 32 bytes expected", len(b))
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+func GenerateKey() (*[32]byte, string, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, "", err
+	}
+	return &key, encodeKey(&key), nil
+}
+
+func encodeKey(key *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// RandomValue returns n random url safe characters
+func RandomValue(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:n], nil
+}
@@ -0,0 +1,133 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveOpen(t *testing.T) {
+	dir := t.TempDir()
+	key, _, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore()
+	s.Set("qr-salt", "a")
+	s.Rotate("qr-salt", "b")
+	if err := s.Save(dir, key); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, FileName))
+	if bytes.Contains(data, []byte("qr-salt")) {
+		t.Errorf("got plain text %s", data)
+	}
+
+	if _, err := Open(dir); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v, want %v", err, ErrNoKey)
+	}
+	_, other, _ := GenerateKey()
+	t.Setenv(KeyEnv, other)
+	if _, err := Open(dir); err == nil {
+		t.Errorf("got nil, want wrong key error")
+	}
+
+	os.Unsetenv(KeyEnv)
+	os.WriteFile(filepath.Join(dir, KeyFileName), []byte(encodeKey(key)+"\n"), 0600)
+	t.Setenv(EnvPrefix+"QR_SALT", "env")
+	got, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := strings.Join(got.Values("qr-salt"), ","); v != "env,b,a" {
+		t.Errorf("got %v, want %v", v, "env,b,a")
+	}
+}
+
+func TestRotateRetire(t *testing.T) {
+	s := NewStore()
+	s.Rotate("k", "a")
+	s.Rotate("k", "b")
+	s.Rotate("k", "c")
+	if err := s.Retire("k", "3"); err == nil {
+		t.Errorf("got nil, want current version error")
+	}
+	if err := s.Retire("k", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Retire("k", "1"); err == nil {
+		t.Errorf("got nil, want not found error")
+	}
+	if v := s.Rotate("k", "d"); v.ID != "4" {
+		t.Errorf("got %v, want %v", v.ID, "4")
+	}
+	if got, want := strings.Join(s.Values("k"), ","), "d,c,b"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if v := s.Set("k", "e"); v.ID != "1" || s.Get("k") != "e" || len(s.Versions("k")) != 1 {
+		t.Errorf("got %v, want single version", s.Versions("k"))
+	}
+}
+
+func TestCLI(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(KeyEnv, "")
+	run := func(stdin string, args ...string) string {
+		var out bytes.Buffer
+		if err := CLI(append([]string{"-cfg", dir}, args...), strings.NewReader(stdin), &out); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out.String()
+	}
+	run("", "init")
+	run("", "set", "qr-salt", "a")
+	run("b\n", "rotate", "qr-salt")
+	run("", "rotate", "totp-salt", "random:16")
+	if got, want := run("", "list"), "qr-salt 2,1\ntotp-salt 1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	oldKey, _ := os.ReadFile(filepath.Join(dir, KeyFileName))
+	run("", "rekey")
+	if newKey, _ := os.ReadFile(filepath.Join(dir, KeyFileName)); bytes.Equal(newKey, oldKey) {
+		t.Errorf("got the old key, want a new one")
+	}
+	if _, err := os.Stat(filepath.Join(dir, KeyFileName+".old")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want the old key removed", err)
+	}
+	run("", "retire", "qr-salt", "1")
+	if got, want := run("", "get", "qr-salt"), "b\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(s.Get("totp-salt")); got != 16 {
+		t.Errorf("got %v, want %v", got, 16)
+	}
+}
+
+func TestOpenInterruptedRekey(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(KeyEnv, "")
+	key, encoded, _ := GenerateKey()
+	s := NewStore()
+	s.Set("qr-salt", "a")
+	if err := s.Save(dir, key); err != nil {
+		t.Fatal(err)
+	}
+	// the new key is written, the store is not saved yet
+	os.WriteFile(filepath.Join(dir, KeyFileName+".old"), []byte(encoded+"\n"), 0600)
+	_, newEncoded, _ := GenerateKey()
+	os.WriteFile(filepath.Join(dir, KeyFileName), []byte(newEncoded+"\n"), 0600)
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get("qr-salt"); got != "a" {
+		t.Errorf("got %v, want %v", got, "a")
+	}
+}
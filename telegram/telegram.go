@@ -0,0 +1,298 @@
+// Package telegram is a client of Telegram Bot API with long polling and webhook receivers of updates.
+// The bot needs eight methods, they are kept here instead of github.com/go-telegram/bot: the client takes
+// the http.Client of the gate with its proxy, the webhook is served by the mux of the web server, and
+// telegramtest fakes the API for tests of the bot. A method is added with its types as the bot needs it.
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultBaseURL = "https://api.telegram.org"
+
+type User struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Username  string `json:"username,omitempty"`
+}
+
+type Chat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type,omitempty"`
+}
+
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Contact is shared by the keyboard button with RequestContact
+type Contact struct {
+	PhoneNumber string `json:"phone_number"`
+	FirstName   string `json:"first_name,omitempty"`
+	UserID      int64  `json:"user_id,omitempty"`
+}
+
+// PhotoSize is one of sizes of a photo, the largest one is the last
+type PhotoSize struct {
+	FileID   string `json:"file_id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FileSize int64  `json:"file_size,omitempty"`
+}
+
+// File is a file ready to be downloaded by FilePath
+type File struct {
+	FileID   string `json:"file_id"`
+	FileSize int64  `json:"file_size,omitempty"`
+	FilePath string `json:"file_path,omitempty"`
+}
+
+type Message struct {
+	MessageID int64       `json:"message_id"`
+	From      *User       `json:"from,omitempty"`
+	Chat      Chat        `json:"chat"`
+	Date      int64       `json:"date,omitempty"`
+	Text      string      `json:"text,omitempty"`
+	Location  *Location   `json:"location,omitempty"`
+	Contact   *Contact    `json:"contact,omitempty"`
+	Photo     []PhotoSize `json:"photo,omitempty"`
+	Caption   string      `json:"caption,omitempty"`
+
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// text is the text of the message or the caption of the photo
+func (m *Message) text() string {
+	if m.Text == "" {
+		return m.Caption
+	}
+	return m.Text
+}
+
+// Command returns the command without "/" and "@bot", empty if the text is not a command.
+// The caption of a photo may be a command too.
+func (m *Message) Command() string {
+	text := m.text()
+	if !strings.HasPrefix(text, "/") {
+		return ""
+	}
+	cmd, _, _ := strings.Cut(text[1:], " ")
+	cmd, _, _ = strings.Cut(cmd, "@")
+	return cmd
+}
+
+// CommandArgs returns the text after the command
+func (m *Message) CommandArgs() string {
+	if m.Command() == "" {
+		return ""
+	}
+	_, args, _ := strings.Cut(m.text(), " ")
+	return strings.TrimSpace(args)
+}
+
+type CallbackQuery struct {
+	ID      string   `json:"id"`
+	From    User     `json:"from"`
+	Message *Message `json:"message,omitempty"`
+	Data    string   `json:"data,omitempty"`
+}
+
+type Update struct {
+	UpdateID      int64          `json:"update_id"`
+	Message       *Message       `json:"message,omitempty"`
+	CallbackQuery *CallbackQuery `json:"callback_query,omitempty"`
+}
+
+type InlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data,omitempty"`
+	URL          string `json:"url,omitempty"`
+}
+
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type KeyboardButton struct {
+	Text           string `json:"text"`
+	RequestContact bool   `json:"request_contact,omitempty"`
+}
+
+type ReplyKeyboardMarkup struct {
+	Keyboard        [][]KeyboardButton `json:"keyboard"`
+	ResizeKeyboard  bool               `json:"resize_keyboard,omitempty"`
+	OneTimeKeyboard bool               `json:"one_time_keyboard,omitempty"`
+}
+
+type ReplyKeyboardRemove struct {
+	RemoveKeyboard bool `json:"remove_keyboard"`
+}
+
+// SendMessageParams, ReplyMarkup is one of *InlineKeyboardMarkup, *ReplyKeyboardMarkup or *ReplyKeyboardRemove
+type SendMessageParams struct {
+	ChatID      int64  `json:"chat_id"`
+	Text        string `json:"text"`
+	ParseMode   string `json:"parse_mode,omitempty"`
+	ReplyMarkup any    `json:"reply_markup,omitempty"`
+}
+
+type EditMessageTextParams struct {
+	ChatID      int64                 `json:"chat_id"`
+	MessageID   int64                 `json:"message_id"`
+	Text        string                `json:"text"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// Bot is the part of Bot API used by handlers
+type Bot interface {
+	SendMessage(ctx context.Context, p *SendMessageParams) (*Message, error)
+	EditMessageText(ctx context.Context, p *EditMessageTextParams) (*Message, error)
+	AnswerCallbackQuery(ctx context.Context, id, text string) error
+	DownloadFile(ctx context.Context, fileID string, maxSize int64) ([]byte, error)
+}
+
+// Error is an unsuccessful response of Bot API
+type Error struct {
+	Method      string
+	Code        int
+	Description string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("telegram %s: %d %s", e.Method, e.Code, e.Description)
+}
+
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	token   string
+}
+
+func NewClient(token string) *Client {
+	return &Client{BaseURL: DefaultBaseURL, HTTP: http.DefaultClient, token: token}
+}
+
+func (c *Client) call(ctx context.Context, method string, in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(c.BaseURL, "/")+"/bot"+c.token+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		// the URL has the token
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&res); err != nil {
+		return fmt.Errorf("telegram %s: %s %w", method, resp.Status, err)
+	}
+	if !res.OK {
+		return &Error{Method: method, Code: res.ErrorCode, Description: res.Description}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, out)
+}
+
+func (c *Client) GetMe(ctx context.Context) (*User, error) {
+	var u User
+	return &u, c.call(ctx, "getMe", struct{}{}, &u)
+}
+
+func (c *Client) SendMessage(ctx context.Context, p *SendMessageParams) (*Message, error) {
+	var m Message
+	return &m, c.call(ctx, "sendMessage", p, &m)
+}
+
+func (c *Client) EditMessageText(ctx context.Context, p *EditMessageTextParams) (*Message, error) {
+	var m Message
+	return &m, c.call(ctx, "editMessageText", p, &m)
+}
+
+// AnswerCallbackQuery stops the progress of the button, not empty text is shown to the user
+func (c *Client) AnswerCallbackQuery(ctx context.Context, id, text string) error {
+	return c.call(ctx, "answerCallbackQuery", map[string]string{"callback_query_id": id, "text": text}, nil)
+}
+
+var ErrFileTooBig = errors.New("file is too big")
+
+// DownloadFile gets the path of the file and downloads it, a file above maxSize bytes is refused
+func (c *Client) DownloadFile(ctx context.Context, fileID string, maxSize int64) ([]byte, error) {
+	var f File
+	if err := c.call(ctx, "getFile", map[string]string{"file_id": fileID}, &f); err != nil {
+		return nil, err
+	}
+	if f.FileSize > maxSize {
+		return nil, ErrFileTooBig
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(c.BaseURL, "/")+"/file/bot"+c.token+"/"+f.FilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, fmt.Errorf("telegram file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Error{Method: "file", Code: resp.StatusCode, Description: resp.Status}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("telegram file: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, ErrFileTooBig
+	}
+	return data, nil
+}
+
+// GetUpdates waits up to timeout for updates after offset
+func (c *Client) GetUpdates(ctx context.Context, offset int64, timeout time.Duration) ([]Update, error) {
+	var uu []Update
+	p := map[string]any{"offset": offset, "timeout": int(timeout.Seconds()), "allowed_updates": []string{"message", "callback_query"}}
+	err := c.call(ctx, "getUpdates", p, &uu)
+	return uu, err
+}
+
+// SetWebhook makes Telegram post updates to the URL with the secret in X-Telegram-Bot-Api-Secret-Token
+func (c *Client) SetWebhook(ctx context.Context, webhookURL, secret string) error {
+	p := map[string]any{"url": webhookURL, "secret_token": secret, "allowed_updates": []string{"message", "callback_query"}}
+	return c.call(ctx, "setWebhook", p, nil)
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context) error {
+	return c.call(ctx, "deleteWebhook", struct{}{}, nil)
+}
@@ -0,0 +1,156 @@
+package telegram_test
+
+import (
+	"7stgbot/telegram"
+	"7stgbot/telegram/telegramtest"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		text, cmd, args string
+	}{
+		{"/start abc", "start", "abc"},
+		{"/qr@snt7s_bot", "qr", ""},
+		{"/sms  79990010203 hello ", "sms", "79990010203 hello"},
+		{"hello", "", ""},
+	}
+	for _, tt := range tests {
+		m := &telegram.Message{Text: tt.text}
+		if got := m.Command(); got != tt.cmd {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.cmd)
+		}
+		if got := m.CommandArgs(); got != tt.args {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.args)
+		}
+	}
+	m := &telegram.Message{Caption: "/reading 1234", Photo: []telegram.PhotoSize{{FileID: "f"}}}
+	if m.Command() != "reading" || m.CommandArgs() != "1234" {
+		t.Errorf("got %q %q, want the command of the caption", m.Command(), m.CommandArgs())
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := telegramtest.NewServer("123:tk")
+	defer srv.Close()
+	c := srv.Client()
+	ctx := t.Context()
+
+	kb := &telegram.InlineKeyboardMarkup{InlineKeyboard: [][]telegram.InlineKeyboardButton{{{Text: "Open", CallbackData: "open"}}}}
+	m, err := c.SendMessage(ctx, &telegram.SendMessageParams{ChatID: 7, Text: "gate?", ReplyMarkup: kb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EditMessageText(ctx, &telegram.EditMessageTextParams{ChatID: 7, MessageID: m.MessageID, Text: "opened"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Messages(7); len(got) != 1 || got[0].Text != "opened" || got[0].ReplyMarkup != nil {
+		t.Errorf("got %+v, want edited message without buttons", got)
+	}
+	_, err = c.SendMessage(ctx, &telegram.SendMessageParams{ChatID: 7})
+	var apiErr *telegram.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		t.Errorf("got %v, want bad request", err)
+	}
+	srv.AddFile("photo", []byte("jpeg"))
+	if data, err := c.DownloadFile(ctx, "photo", 100); err != nil || string(data) != "jpeg" {
+		t.Errorf("got %q %v, want the file", data, err)
+	}
+	if _, err := c.DownloadFile(ctx, "photo", 3); !errors.Is(err, telegram.ErrFileTooBig) {
+		t.Errorf("got %v, want %v", err, telegram.ErrFileTooBig)
+	}
+	bad := telegram.NewClient("bad")
+	bad.BaseURL = srv.URL
+	if _, err := bad.GetMe(ctx); err == nil {
+		t.Error("unauthorized error expected")
+	}
+}
+
+func TestPoller(t *testing.T) {
+	srv := telegramtest.NewServer("123:tk")
+	defer srv.Close()
+	srv.Client().SetWebhook(t.Context(), "https://example.com/tg", "s")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	texts := make(chan string)
+	done := make(chan error)
+	go func() {
+		p := &telegram.Poller{Client: srv.Client(), Timeout: time.Second, Retry: 10 * time.Millisecond}
+		done <- p.Run(ctx, func(ctx context.Context, u *telegram.Update) { texts <- u.Message.Text })
+	}()
+	srv.Push(telegramtest.TextUpdate(7, "a"))
+	srv.Push(telegramtest.TextUpdate(7, "b"))
+	for _, want := range []string{"a", "b"} {
+		if got := <-texts; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if got := srv.Webhook(); got != "" {
+		t.Errorf("got %q, want webhook deleted", got)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("poller is not stopped")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	w := &telegram.Webhook{Secret: "s"}
+	post := func(secret string, u telegram.Update) int {
+		data, _ := json.Marshal(u)
+		r := httptest.NewRequest("POST", "/tg/webhook", bytes.NewReader(data))
+		r.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	u := telegramtest.TextUpdate(7, "hi")
+	if got, want := post("s", u), http.StatusServiceUnavailable; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	got := make(chan string)
+	running := make(chan error)
+	go func() {
+		running <- w.Run(ctx, func(ctx context.Context, u *telegram.Update) { got <- u.Message.Text })
+	}()
+	for i := 0; post("s", u) == http.StatusServiceUnavailable; i++ {
+		if i == 100 {
+			t.Fatal("webhook is not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the answer does not wait for the handler, updates are handled in order
+	if code := post("s", telegramtest.TextUpdate(7, "again")); code != http.StatusOK {
+		t.Errorf("got %v, want queued", code)
+	}
+	for _, want := range []string{"hi", "again"} {
+		if text := <-got; text != want {
+			t.Errorf("got %q, want %q", text, want)
+		}
+	}
+	if code, want := post("bad", u), http.StatusForbidden; code != want {
+		t.Errorf("got %v, want %v", code, want)
+	}
+	w.SetSecret("s2")
+	if code, want := post("s", u), http.StatusForbidden; code != want {
+		t.Errorf("got %v, want the old secret refused", code)
+	}
+	cancel()
+	if err := <-running; err != nil {
+		t.Error(err)
+	}
+}
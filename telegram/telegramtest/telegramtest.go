@@ -0,0 +1,265 @@
+// Package telegramtest is an in-memory Telegram Bot API server for tests: sent messages, edits, callback answers,
+// updates and files.
+package telegramtest
+
+import (
+	"7stgbot/telegram"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	*httptest.Server
+	Token string
+
+	mu       sync.Mutex
+	updates  []telegram.Update
+	arrived  chan struct{} // closed and replaced when an update is pushed
+	sent     []*telegram.Message
+	answers  []string
+	webhook  string
+	updateID int64
+	msgID    int64
+	files    map[string][]byte
+}
+
+func NewServer(token string) *Server {
+	s := &Server{Token: token, arrived: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{token}/{method}", s.handle)
+	mux.HandleFunc("GET /file/{token}/{id}", s.handleFile)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns a client of the server
+func (s *Server) Client() *telegram.Client {
+	c := telegram.NewClient(s.Token)
+	c.BaseURL = s.URL
+	return c
+}
+
+// Push queues the update for getUpdates, UpdateID is assigned
+func (s *Server) Push(u telegram.Update) telegram.Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateID++
+	u.UpdateID = s.updateID
+	s.updates = append(s.updates, u)
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+	return u
+}
+
+// TextUpdate is a message of the user in the private chat of the same id
+func TextUpdate(chatID int64, text string) telegram.Update {
+	return telegram.Update{Message: &telegram.Message{
+		MessageID: time.Now().UnixNano(),
+		From:      &telegram.User{ID: chatID},
+		Chat:      telegram.Chat{ID: chatID, Type: "private"},
+		Date:      time.Now().Unix(),
+		Text:      text,
+	}}
+}
+
+// CallbackUpdate is a click on the inline button of the message
+func CallbackUpdate(m *telegram.Message, data string) telegram.Update {
+	return telegram.Update{CallbackQuery: &telegram.CallbackQuery{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 10),
+		From:    telegram.User{ID: m.Chat.ID},
+		Message: m,
+		Data:    data,
+	}}
+}
+
+// AddFile makes the file available to getFile and the download
+func (s *Server) AddFile(fileID string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string][]byte)
+	}
+	s.files[fileID] = data
+}
+
+// PhotoUpdate is a photo of the file with the caption in the private chat of the same id
+func PhotoUpdate(chatID int64, fileID, caption string) telegram.Update {
+	u := TextUpdate(chatID, "")
+	u.Message.Photo = []telegram.PhotoSize{{FileID: fileID + "-small", Width: 90, Height: 90}, {FileID: fileID, Width: 800, Height: 600}}
+	u.Message.Caption = caption
+	return u
+}
+
+// Messages returns copies of messages sent to the chat with edits applied
+func (s *Server) Messages(chatID int64) []telegram.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []telegram.Message
+	for _, m := range s.sent {
+		if m.Chat.ID == chatID {
+			res = append(res, *m)
+		}
+	}
+	return res
+}
+
+// Answers returns texts of answered callback queries
+func (s *Server) Answers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.answers...)
+}
+
+// Webhook returns the URL set by setWebhook
+func (s *Server) Webhook() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.webhook
+}
+
+func reply(w http.ResponseWriter, result any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+func replyError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"ok": false, "error_code": code, "description": description})
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("token") != "bot"+s.Token {
+		replyError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	var p struct {
+		telegram.SendMessageParams
+		MessageID       int64  `json:"message_id"`
+		CallbackQueryID string `json:"callback_query_id"`
+		Offset          int64  `json:"offset"`
+		Timeout         int    `json:"timeout"`
+		URL             string `json:"url"`
+		FileID          string `json:"file_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		replyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch r.PathValue("method") {
+	case "getMe":
+		reply(w, telegram.User{ID: 1, IsBot: true, Username: "test_bot"})
+	case "sendMessage":
+		if p.Text == "" {
+			replyError(w, http.StatusBadRequest, "Bad Request: message text is empty")
+			return
+		}
+		m := &telegram.Message{Chat: telegram.Chat{ID: p.ChatID}, Date: time.Now().Unix(), Text: p.Text, ReplyMarkup: inlineKeyboard(p.ReplyMarkup)}
+		s.mu.Lock()
+		s.msgID++
+		m.MessageID = s.msgID
+		s.sent = append(s.sent, m)
+		s.mu.Unlock()
+		reply(w, m)
+	case "editMessageText":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, m := range s.sent {
+			if m.Chat.ID == p.ChatID && m.MessageID == p.MessageID {
+				m.Text = p.Text
+				m.ReplyMarkup = inlineKeyboard(p.ReplyMarkup)
+				reply(w, m)
+				return
+			}
+		}
+		replyError(w, http.StatusBadRequest, "Bad Request: message to edit not found")
+	case "answerCallbackQuery":
+		s.mu.Lock()
+		s.answers = append(s.answers, p.Text)
+		s.mu.Unlock()
+		reply(w, true)
+	case "setWebhook":
+		s.mu.Lock()
+		s.webhook = p.URL
+		s.mu.Unlock()
+		reply(w, true)
+	case "deleteWebhook":
+		s.mu.Lock()
+		s.webhook = ""
+		s.mu.Unlock()
+		reply(w, true)
+	case "getFile":
+		s.mu.Lock()
+		data, ok := s.files[p.FileID]
+		s.mu.Unlock()
+		if !ok {
+			replyError(w, http.StatusBadRequest, "Bad Request: invalid file_id")
+			return
+		}
+		reply(w, telegram.File{FileID: p.FileID, FileSize: int64(len(data)), FilePath: p.FileID})
+	case "getUpdates":
+		s.getUpdates(w, r, p.Offset, time.Duration(p.Timeout)*time.Second)
+	default:
+		replyError(w, http.StatusNotFound, "Not Found: method not found")
+	}
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, ok := s.files[r.PathValue("id")]
+	s.mu.Unlock()
+	if r.PathValue("token") != "bot"+s.Token || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// inlineKeyboard returns the markup if it is an inline keyboard, reply keyboards are not kept
+func inlineKeyboard(markup any) *telegram.InlineKeyboardMarkup {
+	if markup == nil {
+		return nil
+	}
+	data, _ := json.Marshal(markup)
+	var kb telegram.InlineKeyboardMarkup
+	if json.Unmarshal(data, &kb) != nil || kb.InlineKeyboard == nil {
+		return nil
+	}
+	return &kb
+}
+
+func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request, offset int64, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		if s.webhook != "" {
+			s.mu.Unlock()
+			replyError(w, http.StatusConflict, "Conflict: can't use getUpdates method while webhook is active")
+			return
+		}
+		var res []telegram.Update
+		for _, u := range s.updates {
+			if u.UpdateID >= offset {
+				res = append(res, u)
+			}
+		}
+		arrived := s.arrived
+		s.mu.Unlock()
+		if len(res) != 0 {
+			reply(w, res)
+			return
+		}
+		select {
+		case <-arrived:
+		case <-deadline:
+			reply(w, []telegram.Update{})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
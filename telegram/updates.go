@@ -0,0 +1,132 @@
+package telegram
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HandlerFunc handles an update, updates are handled one by one
+type HandlerFunc func(ctx context.Context, u *Update)
+
+// Updater receives updates until the context is done
+type Updater interface {
+	Run(ctx context.Context, handle HandlerFunc) error
+}
+
+// Poller receives updates by long polling, a webhook of the bot is deleted on start
+type Poller struct {
+	Client  *Client
+	Timeout time.Duration // of getUpdates, 60s if zero
+	Retry   time.Duration // after an error, 5s if zero
+}
+
+func (p *Poller) Run(ctx context.Context, handle HandlerFunc) error {
+	if err := p.Client.DeleteWebhook(ctx); err != nil {
+		return err
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 60 * time.Second
+	}
+	retry := p.Retry
+	if retry == 0 {
+		retry = 5 * time.Second
+	}
+	var offset int64
+	for {
+		uu, err := p.Client.GetUpdates(ctx, offset, timeout)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			select {
+			case <-time.After(retry):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		for i := range uu {
+			offset = uu[i].UpdateID + 1
+			handle(ctx, &uu[i])
+		}
+	}
+}
+
+// Webhook receives updates posted by Telegram, it serves 503 while Run is not running. Updates are queued
+// and handled one by one by Run, Telegram gets the answer without waiting for the handler and retries
+// an update refused when the queue is full.
+type Webhook struct {
+	Secret string // X-Telegram-Bot-Api-Secret-Token, SetSecret changes it while serving
+	Queue  int    // of updates waiting for the handler, 100 if zero
+
+	mu      sync.Mutex
+	updates chan *Update
+}
+
+var errWebhookRunning = errors.New("telegram: webhook is already running")
+
+// Run handles updates until the context is done
+func (w *Webhook) Run(ctx context.Context, handle HandlerFunc) error {
+	w.mu.Lock()
+	if w.updates != nil {
+		w.mu.Unlock()
+		return errWebhookRunning
+	}
+	updates := make(chan *Update, cmp.Or(w.Queue, 100))
+	w.updates = updates
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.updates = nil
+		w.mu.Unlock()
+	}()
+	for {
+		select {
+		case u := <-updates:
+			handle(ctx, u)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// SetSecret sets the secret token passed to SetWebhook
+func (w *Webhook) SetSecret(secret string) {
+	w.mu.Lock()
+	w.Secret = secret
+	w.mu.Unlock()
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	secret := w.Secret
+	w.mu.Unlock()
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(secret)) != 1 {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+	var u Update
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 1<<20)).Decode(&u); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.mu.Lock()
+	updates := w.updates
+	w.mu.Unlock()
+	if updates == nil {
+		http.Error(rw, "bot is not running", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case updates <- &u:
+	default:
+		http.Error(rw, "too many updates", http.StatusServiceUnavailable)
+	}
+}
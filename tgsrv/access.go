@@ -0,0 +1,365 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Access entries replace MAC maps of config.toml and restrictedPhonesFile, they are imported on the first
+// start. Residents add their devices by the web app, such entries are pending until an admin approves them.
+
+const (
+	accessBTAutoOpen   = "bt-auto-open"   // MAC -> owner phone, BTMacAutoOpenGate
+	accessBTIgnore     = "bt-ignore"      // MAC, BTMacIgnore
+	accessBTName       = "bt-name"        // MAC -> label, BTMacNames
+	accessBTSystem     = "bt-system"      // MAC -> label, BTMacSystem
+	accessWiFiAutoOpen = "wifi-auto-open" // MAC or hostname -> owner phone, WiFiMACAutoOpenGate
+	accessWiFiName     = "wifi-name"      // MAC or hostname -> label, WiFiMacNames
+	accessMaskedPhone  = "masked-phone"   // keypad code -> phone, MaskedPhones
+	accessRestricted   = "restricted"     // phone of the register which is not allowed to open
+)
+
+// restrictedPhonesFile lists restricted phones one per line, it is imported once
+const restrictedPhonesFile = "gate-phones-restricted.txt"
+
+var accessKinds = []string{accessBTAutoOpen, accessBTIgnore, accessBTName, accessBTSystem,
+	accessWiFiAutoOpen, accessWiFiName, accessMaskedPhone, accessRestricted}
+
+var macAddrRE = regexp.MustCompile(`^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$`)
+
+type AccessEntry struct {
+	Kind         string
+	Key          string // MAC, WiFi hostname, keypad code or phone of the restricted kind
+	Phone        string `json:",omitempty"` // owner
+	Label        string `json:",omitempty"`
+	CreatedBy    string
+	CreatedMilli int64
+	ExpiresMilli int64 `json:",omitempty"` // 0 - never expires
+	Pending      bool  `json:",omitempty"` // added by the owner, waits for an approval
+}
+
+func (e *AccessEntry) Type() string { return "Access" }
+func (e *AccessEntry) ID() string   { return e.Kind + "/" + e.Key }
+func (e *AccessEntry) MarshalData() (string, error) {
+	bb, err := json.Marshal(e)
+	return string(bb), err
+}
+func (e *AccessEntry) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), e)
+}
+
+func (e *AccessEntry) active(now time.Time) bool {
+	return !e.Pending && (e.ExpiresMilli == 0 || now.UnixMilli() < e.ExpiresMilli)
+}
+
+func (e *AccessEntry) String() string {
+	s := e.Kind + " " + e.Key
+	for _, v := range []string{e.Phone, e.Label} {
+		if v != "" {
+			s += " " + v
+		}
+	}
+	if e.ExpiresMilli != 0 {
+		s += " until " + time.UnixMilli(e.ExpiresMilli).In(Location).Format("2006-01-02")
+	}
+	return s
+}
+
+// accessEntries is kind -> key -> entry, it is replaced on a change
+type accessEntries map[string]map[string]*AccessEntry
+
+// get returns the active entry or nil
+func (a accessEntries) get(kind, key string) *AccessEntry {
+	if e, ok := a[kind][key]; ok && e.active(time.Now()) {
+		return e
+	}
+	return nil
+}
+
+func (a accessEntries) phone(kind, key string) string {
+	if e := a.get(kind, key); e != nil {
+		return e.Phone
+	}
+	return ""
+}
+
+func (a accessEntries) label(kind, key string) (string, bool) {
+	if e := a.get(kind, key); e != nil {
+		return e.Label, true
+	}
+	return "", false
+}
+
+// bleAutoOpen returns the active auto-open entry of the MAC or of the stable identity of a rotating address
+func (a accessEntries) bleAutoOpen(bt *BLETracking) *AccessEntry {
+	if e := a.get(accessBTAutoOpen, bt.MAC); e != nil {
+		return e
+	}
+	if key, _ := bleKey(bt); key != strings.ToUpper(bt.MAC) {
+		return a.get(accessBTAutoOpen, key)
+	}
+	return nil
+}
+
+// active returns keys of active entries of the kind with labels
+func (a accessEntries) active(kind string) map[string]string {
+	now := time.Now()
+	res := make(map[string]string)
+	for k, e := range a[kind] {
+		if e.active(now) {
+			res[k] = e.Label
+		}
+	}
+	return res
+}
+
+// list returns entries sorted by kind and key, all kinds if kind is empty
+func (a accessEntries) list(kind string) []*AccessEntry {
+	var ee []*AccessEntry
+	for _, k := range accessKinds {
+		if kind != "" && k != kind {
+			continue
+		}
+		for _, key := range slices.Sorted(maps.Keys(a[k])) {
+			ee = append(ee, a[k][key])
+		}
+	}
+	return ee
+}
+
+func (g *Gate) access() accessEntries {
+	if a := g.accessEntries.Load(); a != nil {
+		return *a
+	}
+	return nil
+}
+
+func (g *Gate) loadAccess() {
+	a := make(accessEntries)
+	data, err := g.Entities.List((&AccessEntry{}).Type())
+	if err != nil {
+		Logger.Errorf("loading access entries: %v", err)
+	}
+	for id, d := range data {
+		var e AccessEntry
+		if err := e.UnmarshalData(d); err != nil {
+			Logger.Errorf("access entry %s: %v", id, err)
+			continue
+		}
+		if a[e.Kind] == nil {
+			a[e.Kind] = make(map[string]*AccessEntry)
+		}
+		a[e.Kind][e.Key] = &e
+	}
+	g.accessEntries.Store(&a)
+}
+
+// saveAccess inserts or replaces the entry
+func (g *Gate) saveAccess(e *AccessEntry) error {
+	return g.putAccess(e, false)
+}
+
+// insertAccess saves a new entry, an existing one is not replaced
+func (g *Gate) insertAccess(e *AccessEntry) error {
+	return g.putAccess(e, true)
+}
+
+func (g *Gate) putAccess(e *AccessEntry, insertOnly bool) error {
+	if !slices.Contains(accessKinds, e.Kind) {
+		return fmt.Errorf("unknown kind %q", e.Kind)
+	}
+	if e.Key == "" {
+		return fmt.Errorf("empty key of %s", e.Kind)
+	}
+	g.accessMu.Lock()
+	defer g.accessMu.Unlock()
+	old := g.access()
+	var err error
+	if x, ok := old[e.Kind][e.Key]; ok && insertOnly {
+		return fmt.Errorf("%w: %s is already added by %s", errAccessExists, e.Key, cmp.Or(x.Phone, x.CreatedBy))
+	} else if ok {
+		err = g.Entities.Update(e)
+	} else {
+		err = g.Entities.Insert(e)
+	}
+	if err != nil {
+		return err
+	}
+	a := maps.Clone(old)
+	if a == nil {
+		a = make(accessEntries)
+	}
+	a[e.Kind] = maps.Clone(a[e.Kind])
+	if a[e.Kind] == nil {
+		a[e.Kind] = make(map[string]*AccessEntry)
+	}
+	a[e.Kind][e.Key] = e
+	g.accessEntries.Store(&a)
+	return nil
+}
+
+func (g *Gate) deleteAccess(kind, key string) error {
+	g.accessMu.Lock()
+	defer g.accessMu.Unlock()
+	old := g.access()
+	e, ok := old[kind][key]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := g.Entities.Delete(e); err != nil {
+		return err
+	}
+	a := maps.Clone(old)
+	a[kind] = maps.Clone(a[kind])
+	delete(a[kind], key)
+	g.accessEntries.Store(&a)
+	return nil
+}
+
+// importAccess adds maps of the config and restrictedPhonesFile once, existing entries are kept
+func (g *Gate) importAccess(cfg *config.Config) {
+	defer g.warnAccessConfig(cfg)
+	if s, err := g.Settings.Find(accessImportedKey); err != nil || s.ValueBool(false) {
+		return
+	}
+	now := time.Now().UnixMilli()
+	n := 0
+	add := func(kind, key, phone, label string) {
+		if macAddrRE.MatchString(key) {
+			key = normalizeMAC(kind, key)
+		}
+		e := &AccessEntry{Kind: kind, Key: key, Phone: phone, Label: label, CreatedBy: "import", CreatedMilli: now}
+		if err := g.insertAccess(e); errors.Is(err, errAccessExists) {
+			return
+		} else if err != nil {
+			Logger.Errorf("importing access entry %s: %v", e, err)
+			return
+		}
+		n++
+	}
+	for _, m := range []struct {
+		kind  string
+		m     map[string]string
+		phone bool
+	}{
+		{accessBTAutoOpen, cfg.BTMacAutoOpenGate, true},
+		{accessBTIgnore, cfg.BTMacIgnore, false},
+		{accessBTName, cfg.BTMacNames, false},
+		{accessBTSystem, cfg.BTMacSystem, false},
+		{accessWiFiAutoOpen, cfg.WiFiMACAutoOpenGate, true},
+		{accessWiFiName, cfg.WiFiMacNames, false},
+		{accessMaskedPhone, cfg.MaskedPhones, true},
+	} {
+		for k, v := range m.m {
+			add(m.kind, k, If(m.phone, v, ""), If(m.phone, "", v))
+		}
+	}
+	if f, err := os.Open(filepath.Join(g.CfgDir, restrictedPhonesFile)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if phone := strings.TrimSpace(scanner.Text()); phone != "" {
+				add(accessRestricted, phone, phone, "")
+			}
+		}
+		f.Close()
+	}
+	s := gate.Setting{Key: accessImportedKey}
+	s.SetBool(true)
+	if err := g.Settings.Update(&s); err != nil {
+		Logger.Errorf("error saving to db %q: %v", s.Key, err)
+	}
+	Logger.Infof("gate %s: %d access entries are imported", g.ID, n)
+}
+
+// warnAccessConfig logs maps of the config which are imported already, changes of them are ignored
+func (g *Gate) warnAccessConfig(cfg *config.Config) {
+	var names []string
+	for _, m := range []struct {
+		name string
+		m    map[string]string
+	}{
+		{"BTMacAutoOpenGate", cfg.BTMacAutoOpenGate}, {"BTMacIgnore", cfg.BTMacIgnore}, {"BTMacNames", cfg.BTMacNames},
+		{"BTMacSystem", cfg.BTMacSystem}, {"WiFiMACAutoOpenGate", cfg.WiFiMACAutoOpenGate},
+		{"WiFiMacNames", cfg.WiFiMacNames}, {"MaskedPhones", cfg.MaskedPhones},
+	} {
+		if len(m.m) != 0 {
+			names = append(names, m.name)
+		}
+	}
+	if len(names) != 0 {
+		Logger.Warnf("gate %s: %s of the config are deprecated and ignored after the import, "+
+			"edit access entries in /gate/admin/access and remove them from the config", g.ID, strings.Join(names, ", "))
+	}
+}
+
+func (g *Gate) isRestricted(phone string) bool {
+	return g.access().get(accessRestricted, phone) != nil
+}
+
+func (g *Gate) restrictedPhones() map[string]bool {
+	res := make(map[string]bool)
+	for phone := range g.access().active(accessRestricted) {
+		res[phone] = true
+	}
+	return res
+}
+
+func (g *Gate) setRestricted(phone string, restricted bool, actor string) error {
+	if !restricted {
+		if err := g.deleteAccess(accessRestricted, phone); err != ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	return g.saveAccess(&AccessEntry{Kind: accessRestricted, Key: phone, Phone: phone, CreatedBy: actor,
+		CreatedMilli: time.Now().UnixMilli()})
+}
+
+// ownDeviceKind is the kind of the device a resident adds by the web app, "bt" or "wifi"
+func ownDeviceKind(s string) (string, bool) {
+	switch s {
+	case "bt":
+		return accessBTAutoOpen, true
+	case "wifi":
+		return accessWiFiAutoOpen, true
+	}
+	return "", false
+}
+
+// normalizeMAC is upper case for BLE trackers and lower case for the DHCP log of the router
+func normalizeMAC(kind, mac string) string {
+	return If(strings.HasPrefix(kind, "bt-"), strings.ToUpper(mac), strings.ToLower(mac))
+}
+
+// addOwnDevice adds the pending auto-open entry of the phone
+func (g *Gate) addOwnDevice(phone, kind, mac, label string) (*AccessEntry, error) {
+	if !macAddrRE.MatchString(mac) && !(kind == accessBTAutoOpen && bleIdentityRE.MatchString(mac)) {
+		return nil, fmt.Errorf("%w: MAC XX:XX:XX:XX:XX:XX expected", errAdminBadRequest)
+	}
+	mac = normalizeMAC(kind, mac)
+	e := &AccessEntry{Kind: kind, Key: mac, Phone: phone, Label: label, CreatedBy: "web app " + phone,
+		CreatedMilli: time.Now().UnixMilli(), Pending: true}
+	if err := g.insertAccess(e); err != nil {
+		return nil, err
+	}
+	owner := phone
+	if u, ok := g.Phones[phone]; ok {
+		owner = u.name()
+	}
+	g.sendSystemNotification(fmt.Sprintf("%s waits for approval, added by %s, see /gate/admin/access", e, owner))
+	return e, nil
+}
+
+var errAccessExists = errors.New("exists")
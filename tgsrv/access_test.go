@@ -0,0 +1,176 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAccessImport(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	os.WriteFile(filepath.Join(dir, restrictedPhonesFile), []byte("79990000002\n\n"), 0600)
+	cfg := &config.Config{
+		BTMacAutoOpenGate:   map[string]string{"5B:BB:2D:AD:B1:01": "79990000001"},
+		BTMacIgnore:         map[string]string{"5B:BB:2D:AD:B1:02": ""},
+		BTMacNames:          map[string]string{"5B:BB:2D:AD:B1:03": "Ritsa: 1"},
+		BTMacSystem:         map[string]string{"5b:bb:2d:ad:b1:04": "ESP32"},
+		WiFiMACAutoOpenGate: map[string]string{"phone-ivan": "79990000001"},
+		WiFiMacNames:        map[string]string{"ce:09:55:75:33:1b": "Сергей"},
+		MaskedPhones:        map[string]string{"0000000001": "79990000001"},
+	}
+	g := &Gate{CfgDir: dir}
+	g.Init(cfg, db)
+	a := g.access()
+	tests := []struct {
+		got, want string
+	}{
+		{a.phone(accessBTAutoOpen, "5B:BB:2D:AD:B1:01"), "79990000001"},
+		{a.phone(accessMaskedPhone, "0000000001"), "79990000001"},
+		{a.list(accessBTName)[0].Label, "Ritsa: 1"},
+		{a.list(accessRestricted)[0].Phone, "79990000002"},
+		{a.list(accessBTIgnore)[0].CreatedBy, "import"},
+		{a.list(accessBTSystem)[0].Key, "5B:BB:2D:AD:B1:04"},
+	}
+	for i, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%d: got %q, want %q", i, tt.got, tt.want)
+		}
+	}
+	if phone, name := phoneAndName(a, &NetworkClientInfo{MAC: "ce:09:55:75:33:1b", Hostname: "phone-ivan"}); phone != "79990000001" || name != "Сергей" {
+		t.Errorf("got %q %q, want the phone by the hostname and the name by MAC", phone, name)
+	}
+	if !g.isRestricted("79990000002") {
+		t.Error("restricted phone is not imported")
+	}
+
+	if err := g.setRestricted("79990000002", false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	g2 := &Gate{CfgDir: dir}
+	g2.Init(cfg, db)
+	if g2.isRestricted("79990000002") || len(g2.access().list("")) != 7 {
+		t.Errorf("got %v, want config imported once", g2.access().list(""))
+	}
+}
+
+func TestAccessExpiry(t *testing.T) {
+	var g Gate
+	g.Init(&config.Config{}, nil)
+	now := time.Now()
+	for _, e := range []*AccessEntry{
+		{Kind: accessBTIgnore, Key: "5B:BB:2D:AD:B1:01", ExpiresMilli: now.Add(-time.Minute).UnixMilli()},
+		{Kind: accessBTIgnore, Key: "5B:BB:2D:AD:B1:02", ExpiresMilli: now.Add(time.Minute).UnixMilli()},
+		{Kind: accessBTIgnore, Key: "5B:BB:2D:AD:B1:03", Pending: true},
+	} {
+		if err := g.saveAccess(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := g.access().active(accessBTIgnore)
+	if _, ok := got["5B:BB:2D:AD:B1:02"]; len(got) != 1 || !ok {
+		t.Errorf("got %v, want only not expired and approved", got)
+	}
+	if err := g.saveAccess(&AccessEntry{Kind: "bt", Key: "x"}); err == nil {
+		t.Error("unknown kind is saved")
+	}
+}
+
+func TestOwnDevices(t *testing.T) {
+	g, h := newAdminGate(t)
+	br := &ChatBroker{g: g}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /gate/app/devices", br.handleDevices)
+	mux.HandleFunc("POST /gate/app/devices", br.handleDeviceAdd)
+	mux.HandleFunc("DELETE /gate/app/devices/{kind}/{mac}", br.handleDeviceDelete)
+
+	tests := []struct {
+		session, body string
+		want          int
+	}{
+		{"", `{"kind":"bt","mac":"5b:bb:2d:ad:b1:01"}`, http.StatusForbidden},
+		{"resident", `{"kind":"car","mac":"5b:bb:2d:ad:b1:01"}`, http.StatusBadRequest},
+		{"resident", `{"kind":"bt","mac":"5b:bb:2d"}`, http.StatusBadRequest},
+		{"resident", `{"kind":"bt","mac":"5b:bb:2d:ad:b1:01","label":"машина"}`, http.StatusOK},
+		{"admin", `{"kind":"bt","mac":"5B:BB:2D:AD:B1:01"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if got := adminRequest(mux, "POST", "/gate/app/devices", tt.session, "", tt.body).Code; got != tt.want {
+			t.Errorf("%q %s: got %v, want %v", tt.session, tt.body, got, tt.want)
+		}
+	}
+	// only one of concurrent self-adds saves the device
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := g.addOwnDevice("79990000001", accessBTAutoOpen, "5b:bb:2d:ad:b1:02", "race"); err == nil {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := added.Load(); got != 1 {
+		t.Errorf("got %v, want one device added", got)
+	}
+	g.deleteAccess(accessBTAutoOpen, "5B:BB:2D:AD:B1:02")
+	const mac = "5B:BB:2D:AD:B1:01"
+	if g.access().phone(accessBTAutoOpen, mac) != "" {
+		t.Error("pending device opens the gate")
+	}
+	w := adminRequest(h, "POST", "/gate/admin/api/access/"+accessBTAutoOpen+"/"+mac+"/approve", "admin", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want approved", w.Code, w.Body)
+	}
+	if got := g.access().phone(accessBTAutoOpen, mac); got != "79990000001" {
+		t.Errorf("got %q, want the owner", got)
+	}
+	var ee []AccessEntry
+	w = adminRequest(mux, "GET", "/gate/app/devices", "resident", "", "")
+	if err := json.NewDecoder(w.Body).Decode(&ee); err != nil || len(ee) != 1 || ee[0].Label != "машина" || ee[0].Pending {
+		t.Errorf("got %+v %v, want the approved device", ee, err)
+	}
+	if got := adminRequest(mux, "DELETE", "/gate/app/devices/"+accessBTAutoOpen+"/"+mac, "admin", "", "").Code; got != http.StatusNotFound {
+		t.Errorf("got %v, want a device of another phone not found", got)
+	}
+	if got := adminRequest(mux, "DELETE", "/gate/app/devices/"+accessBTAutoOpen+"/"+mac, "resident", "", "").Code; got != http.StatusOK {
+		t.Errorf("got %v, want deleted", got)
+	}
+
+	w = adminRequest(h, "POST", "/gate/admin/api/access", "admin", "application/x-www-form-urlencoded",
+		"kind=masked-phone&key=0000000001&phone=79990000001&expires=2020-01-01")
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("got %v %s, want saved", w.Code, w.Body)
+	}
+	if e := g.access()[accessMaskedPhone]["0000000001"]; e == nil || e.active(time.Now()) || !strings.HasPrefix(e.CreatedBy, "web admin") {
+		t.Errorf("got %+v, want expired entry of web admin", e)
+	}
+	// the expired masked phone opens by the keypad
+	if err := g.phoneAsCodeEntered("79990000001", KeypadCode{Code: "79990000001"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if ee, _ := g.journal.list("", 1); len(ee) != 1 || !strings.HasPrefix(ee[0].Text, "OPENED by keypad code") {
+		t.Errorf("got %+v, want opened", ee)
+	}
+	w = adminRequest(h, "POST", "/gate/admin/api/access", "admin", "application/x-www-form-urlencoded", "kind=bt-ignore&key=5b:bb:2d:ad:b1:09")
+	if e := g.access().get(accessBTIgnore, "5B:BB:2D:AD:B1:09"); w.Code != http.StatusSeeOther || e == nil {
+		t.Errorf("got %v %s, want the MAC in upper case", w.Code, w.Body)
+	}
+	if got := adminRequest(h, "POST", "/gate/admin/api/access", "admin", "", `{"kind":"bt-name","key":"x"}`).Code; got != http.StatusBadRequest {
+		t.Errorf("got %v, want %v", got, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,949 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/gate"
+	"7stgbot/notify"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Админка шлагбаума /gate/admin: страницы рендерит сервер, те же данные и действия есть в JSON API
+// /gate/admin/api. Доступ по сессии ключа доступа (passkey) с правом admin, каждое действие публикуется
+// системным уведомлением.
+
+const (
+	journalRetention    = 90 * 24 * time.Hour
+	journalDefaultLimit = 100
+	adminActionTimeout  = 10 * time.Second
+)
+
+// devices reporting to the server, the health list shows when they were seen last
+const (
+	deviceRelay  = "relay"
+	deviceOpened = "opened sensor"
+	deviceKeypad = "keypad"
+	devicePhone  = "phone"  // Automate of the gate phone, calls and SMS
+	deviceRouter = "router" // syslog of DHCP
+	deviceBLE    = "ble"    // "ble <location>"
+)
+
+var adminPages = []string{"state", "journal", "phones", "access", "codes", "schedules", "settings", "devices", "readings", "payments"}
+
+// adminPagePerms are pages open to others than admins
+var adminPagePerms = map[string]Permission{"readings": PermRegistry, "payments": PermRegistry}
+
+// eventJournal keeps events of the gate as they are published, before rules, in the db for journalRetention
+type eventJournal struct {
+	store gate.EventsDAO
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+func (j *eventJournal) add(e notify.Event) {
+	if j.store == nil {
+		return
+	}
+	err := j.store.Insert(&gate.Event{Type: e.Type, Severity: int(e.Severity), Gate: e.Gate, Text: e.Text,
+		CreatedAtMilli: e.Time.UnixMilli()})
+	if err != nil {
+		Logger.Errorf("journal %s: %v", e.Type, err)
+	}
+	j.mu.Lock()
+	prune := e.Time.Sub(j.pruned) > time.Hour
+	if prune {
+		j.pruned = e.Time
+	}
+	j.mu.Unlock()
+	if prune {
+		if _, err := j.store.DeleteBefore(e.Time.Add(-journalRetention).UnixMilli()); err != nil {
+			Logger.Errorf("journal retention: %v", err)
+		}
+	}
+}
+
+// list returns the last events of the type and its children, newest first, empty type matches all
+func (j *eventJournal) list(typ string, limit int) ([]notify.Event, error) {
+	if j.store == nil {
+		return nil, nil
+	}
+	ee, err := j.store.List(typ, limit)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]notify.Event, len(ee))
+	for i, e := range ee {
+		res[i] = notify.Event{Type: e.Type, Severity: notify.Severity(e.Severity), Gate: e.Gate, Text: e.Text,
+			Time: time.UnixMilli(e.CreatedAtMilli).In(Location)}
+	}
+	return res, nil
+}
+
+type DeviceHealth struct {
+	Name      string
+	LastSeen  time.Time `json:",omitzero"`
+	LastError string    `json:",omitempty"`
+	ErrorTime time.Time `json:",omitzero"`
+	OK        bool      // no error since it was seen
+}
+
+// deviceSeen records a request from the device or the result of a request to it
+func (g *Gate) deviceSeen(name string, err error) {
+	now := time.Now()
+	g.devicesMu.Lock()
+	defer g.devicesMu.Unlock()
+	if g.devices == nil {
+		g.devices = make(map[string]*DeviceHealth)
+	}
+	d, ok := g.devices[name]
+	if !ok {
+		d = &DeviceHealth{Name: name}
+		g.devices[name] = d
+	}
+	if err != nil {
+		d.LastError, d.ErrorTime = err.Error(), now
+	} else {
+		d.LastSeen = now
+	}
+	d.OK = d.ErrorTime.IsZero() || d.LastSeen.After(d.ErrorTime)
+}
+
+func (g *Gate) deviceHealth() []DeviceHealth {
+	g.devicesMu.Lock()
+	defer g.devicesMu.Unlock()
+	dd := make([]DeviceHealth, 0, len(g.devices))
+	for _, name := range slices.Sorted(maps.Keys(g.devices)) {
+		dd = append(dd, *g.devices[name])
+	}
+	return dd
+}
+
+type AdminGateState struct {
+	Gate        string
+	KeptOpen    bool
+	LockedUntil time.Time `json:",omitzero"`
+	LastOpened  time.Time `json:",omitzero"`
+}
+
+type AdminPhone struct {
+	Phone      string
+	Name       string
+	DialToOpen bool
+	LocalOnly  bool
+	Admin      bool
+	Restricted bool
+	AllowedNow bool
+}
+
+type AdminCode struct {
+	ID             int
+	Code           string
+	RequesterPhone string
+	Created        time.Time
+	End            time.Time `json:",omitzero"` // zero for codes valid TTLMinutes since the first use
+	TTLMinutes     int       `json:",omitempty"`
+}
+
+type AdminSchedules struct {
+	Timer           map[string]int
+	TimerFromConfig bool // Timer is open_schedule of the config, /7_timer is not set
+	BLETimer        map[string]int
+}
+
+type AdminReadings struct {
+	Period  billing.Period
+	Pending []AdminReading
+	Missing []string
+	Waiting []string // pending readings of the month
+}
+
+type AdminReading struct {
+	*ReadingSubmission
+	Prev string `json:",omitempty"` // billed reading before the month
+}
+
+type AdminSetting struct {
+	Key         string
+	Type        gate.SettingType
+	Default     string `json:",omitempty"`
+	Value       string
+	Description string
+	HotApply    bool
+}
+
+// RegisterAdminHTTP registers the admin console, links and redirects are relative as the gate is also
+// served under /g/<id>
+func (g *Gate) RegisterAdminHTTP(mux *http.ServeMux) {
+	mux.HandleFunc("GET /gate/admin", func(w http.ResponseWriter, r *http.Request) {
+		adminRedirect(w, r, adminPages[0])
+	})
+	mux.HandleFunc("GET /gate/admin/{page}", g.handleAdminPage)
+	mux.HandleFunc("GET /gate/admin/api/{page}", g.handleAdminData)
+	mux.HandleFunc("POST /gate/admin/api/gate/{action}", g.handleAdminGate)
+	mux.HandleFunc("POST /gate/admin/api/phones/{phone}", g.handleAdminPhone)
+	mux.HandleFunc("POST /gate/admin/api/access", g.handleAdminAccessSave)
+	mux.HandleFunc("POST /gate/admin/api/access/{kind}/{key}/{action}", g.handleAdminAccess)
+	mux.HandleFunc("POST /gate/admin/api/codes", g.handleAdminCodeCreate)
+	mux.HandleFunc("POST /gate/admin/api/codes/{id}/revoke", g.handleAdminCodeRevoke)
+	mux.HandleFunc("POST /gate/admin/api/schedules", g.handleAdminSchedule)
+	mux.HandleFunc("POST /gate/admin/api/settings", g.handleAdminSetting)
+	mux.HandleFunc("POST /gate/admin/api/readings/{plot}/{period}/{action}", g.handleAdminReading)
+	mux.HandleFunc("GET /gate/admin/api/readings/{plot}/{period}/photo", g.handleAdminReadingPhoto)
+	mux.HandleFunc("POST /gate/admin/api/payments", g.handleAdminStatement)
+	mux.HandleFunc("POST /gate/admin/api/payments/{id}/assign", g.handleAdminPaymentAssign)
+	mux.HandleFunc("POST /gate/admin/api/payments/{id}/charge", g.handleAdminChargeAssign)
+}
+
+// adminPrincipal returns the admin of the passkey session, the denial is written to w
+func (g *Gate) adminPrincipal(w http.ResponseWriter, r *http.Request, what string) *Principal {
+	return g.consolePrincipal(w, r, PermAdmin, what)
+}
+
+// consolePrincipal returns the principal of the passkey session with the permission
+func (g *Gate) consolePrincipal(w http.ResponseWriter, r *http.Request, perm Permission, what string) *Principal {
+	s := g.webSession(r)
+	if s == nil || !s.WebAuthn {
+		http.Error(w, "Доступ запрещен. Войдите по ключу доступа.", http.StatusForbidden)
+		return nil
+	}
+	p := g.resolvePrincipal(&Principal{Phone: normalizePhone(s.Phone)[1:]})
+	if !g.authorize(p, perm, "web admin: "+what) {
+		http.Error(w, "Недостаточно прав.", http.StatusForbidden)
+		return nil
+	}
+	return p
+}
+
+// adminRedirect redirects to the page of the console by a relative location
+func adminRedirect(w http.ResponseWriter, r *http.Request, page string) {
+	_, rest, _ := strings.Cut(r.URL.Path, "/gate/admin")
+	w.Header().Set("Location", strings.Repeat("../", max(strings.Count(rest, "/")-1, 0))+If(rest == "", "admin/", "")+page)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func isFormRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
+
+// adminArgs returns values of the form or of the JSON object, the body may be empty
+func adminArgs(w http.ResponseWriter, r *http.Request) (map[string]string, error) {
+	args := make(map[string]string)
+	if isFormRequest(r) {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		for k := range r.PostForm {
+			args[k] = r.PostForm.Get(k)
+		}
+		return args, nil
+	}
+	var m map[string]any
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1048576)).Decode(&m); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			args[k] = v
+		case nil:
+		default:
+			args[k] = fmt.Sprint(v)
+		}
+	}
+	return args, nil
+}
+
+// adminReply writes the result of the action, the form of a page is redirected back to the page
+func adminReply(w http.ResponseWriter, r *http.Request, page string, result any, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errAdminBadRequest):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrNotFound):
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if isFormRequest(r) {
+		adminRedirect(w, r, page)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+var errAdminBadRequest = errors.New("bad request")
+
+func adminBadRequest(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", errAdminBadRequest, fmt.Sprintf(format, a...))
+}
+
+func (g *Gate) handleAdminData(w http.ResponseWriter, r *http.Request) {
+	page := r.PathValue("page")
+	if !slices.Contains(adminPages, page) {
+		http.NotFound(w, r)
+		return
+	}
+	if g.consolePrincipal(w, r, cmp.Or(adminPagePerms[page], PermAdmin), page) == nil {
+		return
+	}
+	data, err := g.adminData(page, r)
+	if err != nil {
+		Logger.Errorf("web admin %s: %v", page, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (g *Gate) handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	page := r.PathValue("page")
+	if !slices.Contains(adminPages, page) {
+		http.NotFound(w, r)
+		return
+	}
+	p := g.consolePrincipal(w, r, cmp.Or(adminPagePerms[page], PermAdmin), page)
+	if p == nil {
+		return
+	}
+	data, err := g.adminData(page, r)
+	if err != nil {
+		Logger.Errorf("web admin %s: %v", page, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = adminTemplate.ExecuteTemplate(w, "layout", map[string]any{
+		"Gate": g.ID, "Page": page, "Pages": adminPages, "Admin": p.String(), "Data": data,
+		"Journal": r.URL.Query().Get("type"), "Kinds": accessKinds,
+	})
+	if err != nil {
+		Logger.Errorf("web admin %s template: %v", page, err)
+	}
+}
+
+func (g *Gate) adminData(page string, r *http.Request) (any, error) {
+	switch page {
+	case "state":
+		s := AdminGateState{Gate: g.ID, KeptOpen: g.keptOpen.Load()}
+		if ms := g.lockedUntil.Load(); ms > time.Now().UnixMilli() {
+			s.LockedUntil = time.UnixMilli(ms).In(Location)
+		}
+		if ns := g.lastOpenedTime.Load(); ns != 0 {
+			s.LastOpened = time.Unix(0, ns).In(Location)
+		}
+		return s, nil
+
+	case "journal":
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = journalDefaultLimit
+		}
+		return g.journal.list(r.URL.Query().Get("type"), limit)
+
+	case "phones":
+		restricted := g.restrictedPhones()
+		pp := make([]AdminPhone, 0, len(g.Phones))
+		for _, phone := range slices.Sorted(maps.Keys(g.Phones)) {
+			u := g.Phones[phone]
+			pp = append(pp, AdminPhone{Phone: phone, Name: strings.TrimSpace(u.Firstname + " " + u.Lastname),
+				DialToOpen: u.DialToOpen, LocalOnly: u.LocalOnly, Admin: u.Admin, Restricted: restricted[phone],
+				AllowedNow: g.allowedNow(phone)})
+		}
+		return pp, nil
+
+	case "access":
+		return g.access().list(""), nil
+
+	case "codes":
+		cc, err := g.KeypadCodes.ListActive()
+		if err != nil {
+			return nil, err
+		}
+		codes := make([]AdminCode, len(cc))
+		for i, c := range cc {
+			codes[i] = AdminCode{ID: c.ID, Code: c.Code, RequesterPhone: c.RequesterPhone,
+				Created: time.UnixMilli(c.CreatedTimeMilli).In(Location), TTLMinutes: c.TTLMinutes}
+			if c.EndTimeMilli != 0 {
+				codes[i].End = time.UnixMilli(c.EndTimeMilli).In(Location)
+			}
+		}
+		return codes, nil
+
+	case "schedules":
+		var s AdminSchedules
+		for _, sch := range []struct {
+			key string
+			m   *map[string]int
+		}{{scheduleKey, &s.Timer}, {bleScheduleKey, &s.BLETimer}} {
+			set, err := g.Settings.Find(sch.key)
+			if err != nil {
+				return nil, err
+			}
+			if v := set.ValueString(); v != "" {
+				if err := json.Unmarshal([]byte(v), sch.m); err != nil {
+					return nil, fmt.Errorf("%s: %w", sch.key, err)
+				}
+			}
+		}
+		if s.Timer == nil {
+			s.Timer, s.TimerFromConfig = g.config().OpenSchedule, true
+		}
+		return s, nil
+
+	case "settings":
+		var ss []AdminSetting
+		for _, d := range settingsRegistry.Defs() {
+			if d.IsPrefix() {
+				found, err := g.Settings.FindN(d.Key)
+				if err != nil {
+					return nil, err
+				}
+				for _, set := range *found {
+					ss = append(ss, AdminSetting{Key: set.Key, Type: d.Type, Value: set.ValueString(),
+						Description: d.Description, HotApply: d.HotApply})
+				}
+				continue
+			}
+			set, err := g.Settings.Find(d.Key)
+			if err != nil {
+				return nil, err
+			}
+			ss = append(ss, AdminSetting{Key: d.Key, Type: d.Type, Default: d.Default, Value: set.ValueString(),
+				Description: d.Description, HotApply: d.HotApply})
+		}
+		return ss, nil
+
+	case "devices":
+		return g.deviceHealth(), nil
+
+	case "readings":
+		rr := AdminReadings{Period: readingPeriod(time.Now()), Pending: []AdminReading{}}
+		if v := r.URL.Query().Get("month"); v != "" {
+			p, err := billing.ParsePeriod(v)
+			if err != nil {
+				return nil, adminBadRequest("%v", err)
+			}
+			rr.Period = p
+		}
+		l := g.ledger()
+		for _, s := range g.readingSubmissions(submissionPending) {
+			ar := AdminReading{ReadingSubmission: s}
+			if prev, ok := l.LastReading(s.Plot, s.Period); ok {
+				ar.Prev = fmt.Sprintf("%s (%s)", billing.FormatKWh(prev.Value), prev.Period)
+			}
+			rr.Pending = append(rr.Pending, ar)
+		}
+		rr.Missing, rr.Waiting = g.missingReadings(rr.Period)
+		return rr, nil
+
+	case "payments":
+		ss := g.bankStatements()
+		return ss[:min(len(ss), adminStatementsLimit)], nil
+	}
+	return nil, ErrNotFound
+}
+
+// handleAdminGate runs open, keep_open, keep_open_cancel and lock with minutes, 0 - unlock
+func (g *Gate) handleAdminGate(w http.ResponseWriter, r *http.Request) {
+	action := r.PathValue("action")
+	p := g.adminPrincipal(w, r, action)
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg string
+	switch action {
+	case "open":
+		ctx, cancel := context.WithTimeout(r.Context(), adminActionTimeout)
+		defer cancel()
+		msg = "opened by web admin " + p.String()
+		// the gate loop publishes the result
+		if err = g.openGateWait(ctx, p.Phone+" web admin", msg); err != nil {
+			adminReply(w, r, "state", nil, err)
+			return
+		}
+		adminReply(w, r, "state", map[string]string{"result": msg}, nil)
+		return
+	case "keep_open":
+		g.keepOpenGate()
+		msg = "KEEP OPEN by web admin " + p.String()
+	case "keep_open_cancel":
+		g.endKeepOpenGate()
+		msg = "keep open is canceled by web admin " + p.String()
+	case "lock":
+		minutes, err := strconv.Atoi(cmp.Or(args["minutes"], "0"))
+		if err != nil || minutes < 0 {
+			adminReply(w, r, "state", nil, adminBadRequest("number of minutes expected, 0 - unlock"))
+			return
+		}
+		g.lock(time.Duration(minutes) * time.Minute)
+		msg = If(minutes == 0, "unlocked", fmt.Sprintf("locked for %d min", minutes)) + " by web admin " + p.String()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	g.sendSystemNotification(msg)
+	adminReply(w, r, "state", map[string]string{"result": msg}, nil)
+}
+
+// handleAdminPhone sets restricted=true|false of the phone of the register
+func (g *Gate) handleAdminPhone(w http.ResponseWriter, r *http.Request) {
+	phone := r.PathValue("phone")
+	p := g.adminPrincipal(w, r, "restrict "+phone)
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, ok := g.Phones[phone]
+	if !ok {
+		adminReply(w, r, "phones", nil, ErrNotFound)
+		return
+	}
+	restricted, err := strconv.ParseBool(args["restricted"])
+	if err != nil {
+		adminReply(w, r, "phones", nil, adminBadRequest("restricted=true|false expected"))
+		return
+	}
+	if err := g.setRestricted(phone, restricted, "web admin "+p.String()); err != nil {
+		adminReply(w, r, "phones", nil, err)
+		return
+	}
+	msg := fmt.Sprintf("%s %s by web admin %s", u.name(), If(restricted, "restricted", "unrestricted"), p)
+	g.sendSystemNotification(msg)
+	adminReply(w, r, "phones", map[string]string{"result": msg}, nil)
+}
+
+// handleAdminAccessSave adds or replaces the approved access entry of kind, key, phone, label and
+// expires yyyy-mm-dd, empty - never
+func (g *Gate) handleAdminAccessSave(w http.ResponseWriter, r *http.Request) {
+	p := g.adminPrincipal(w, r, "access")
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e := &AccessEntry{Kind: args["kind"], Key: strings.TrimSpace(args["key"]), Phone: strings.TrimSpace(args["phone"]),
+		Label: strings.TrimSpace(args["label"]), CreatedBy: "web admin " + p.String(), CreatedMilli: time.Now().UnixMilli()}
+	if err := checkAccessEntry(e); err != nil {
+		adminReply(w, r, "access", nil, err)
+		return
+	}
+	if v := args["expires"]; v != "" {
+		d, err := time.ParseInLocation("2006-01-02", v, Location)
+		if err != nil {
+			adminReply(w, r, "access", nil, adminBadRequest("expires yyyy-mm-dd expected"))
+			return
+		}
+		e.ExpiresMilli = d.UnixMilli()
+	}
+	if err := g.saveAccess(e); err != nil {
+		adminReply(w, r, "access", nil, err)
+		return
+	}
+	msg := fmt.Sprintf("access %s is saved by web admin %s", e, p)
+	g.sendSystemNotification(msg)
+	adminReply(w, r, "access", e, nil)
+}
+
+func checkAccessEntry(e *AccessEntry) error {
+	if !slices.Contains(accessKinds, e.Kind) {
+		return adminBadRequest("kind %s expected", strings.Join(accessKinds, "|"))
+	}
+	switch {
+	case e.Key == "":
+		return adminBadRequest("empty key")
+	case strings.HasPrefix(e.Kind, "bt-") && !macAddrRE.MatchString(e.Key) &&
+		!(e.Kind == accessBTAutoOpen && bleIdentityRE.MatchString(e.Key)):
+		return adminBadRequest("MAC XX:XX:XX:XX:XX:XX expected")
+	case strings.HasPrefix(e.Kind, "bt-") || macAddrRE.MatchString(e.Key):
+		e.Key = normalizeMAC(e.Kind, e.Key)
+	case e.Kind == accessRestricted:
+		e.Phone = e.Key
+	}
+	if e.Kind == accessBTAutoOpen || e.Kind == accessWiFiAutoOpen || e.Kind == accessMaskedPhone || e.Kind == accessRestricted {
+		if !digits(e.Phone) {
+			return adminBadRequest("phone 7XXXXXXXXXX expected")
+		}
+	}
+	return nil
+}
+
+// handleAdminAccess approves or deletes the entry
+func (g *Gate) handleAdminAccess(w http.ResponseWriter, r *http.Request) {
+	kind, key, action := r.PathValue("kind"), r.PathValue("key"), r.PathValue("action")
+	p := g.adminPrincipal(w, r, action+" access "+kind+" "+key)
+	if p == nil {
+		return
+	}
+	var msg string
+	switch action {
+	case "approve":
+		e, ok := g.access()[kind][key]
+		if !ok {
+			adminReply(w, r, "access", nil, ErrNotFound)
+			return
+		}
+		approved := *e
+		approved.Pending = false
+		if err := g.saveAccess(&approved); err != nil {
+			adminReply(w, r, "access", nil, err)
+			return
+		}
+		msg = fmt.Sprintf("access %s is approved by web admin %s", &approved, p)
+	case "delete":
+		if err := g.deleteAccess(kind, key); err != nil {
+			adminReply(w, r, "access", nil, err)
+			return
+		}
+		msg = fmt.Sprintf("access %s %s is deleted by web admin %s", kind, key, p)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	g.sendSystemNotification(msg)
+	adminReply(w, r, "access", map[string]string{"result": msg}, nil)
+}
+
+// handleAdminCodeCreate generates a keypad code of ttl 30m, 16h or 48h requested by the admin
+func (g *Gate) handleAdminCodeCreate(w http.ResponseWriter, r *http.Request) {
+	p := g.adminPrincipal(w, r, "keypad code")
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := cmp.Or(args["ttl"], "30m")
+	text, ok := tgGuestCodes[ttl]
+	if !ok {
+		adminReply(w, r, "codes", nil, adminBadRequest("ttl 30m, 16h or 48h expected"))
+		return
+	}
+	type codeReply struct {
+		text string
+		err  error
+	}
+	replies := make(chan codeReply, 1)
+	sms := &PhoneSms{Phone: p.Phone, Sms: text, reply: func(text string, err error) { replies <- codeReply{text, err} }}
+	ctx, cancel := context.WithTimeout(r.Context(), adminActionTimeout)
+	defer cancel()
+	select {
+	case g.KeypadCodesRequests <- sms:
+	case <-ctx.Done():
+		adminReply(w, r, "codes", nil, ctx.Err())
+		return
+	}
+	select {
+	case reply := <-replies:
+		if reply.err != nil {
+			adminReply(w, r, "codes", nil, reply.err)
+			return
+		}
+		g.sendSystemNotification(fmt.Sprintf("guest code %s requested by web admin %s", ttl, p))
+		adminReply(w, r, "codes", map[string]string{"result": reply.text}, nil)
+	case <-ctx.Done():
+		adminReply(w, r, "codes", nil, ctx.Err())
+	}
+}
+
+func (g *Gate) handleAdminCodeRevoke(w http.ResponseWriter, r *http.Request) {
+	p := g.adminPrincipal(w, r, "revoke keypad code")
+	if p == nil {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		adminReply(w, r, "codes", nil, adminBadRequest("bad id %q", r.PathValue("id")))
+		return
+	}
+	cc, err := g.KeypadCodes.ListActive()
+	if err != nil {
+		adminReply(w, r, "codes", nil, err)
+		return
+	}
+	i := slices.IndexFunc(cc, func(c gate.KeypadCode) bool { return c.ID == id })
+	if i < 0 {
+		adminReply(w, r, "codes", nil, ErrNotFound)
+		return
+	}
+	c := cc[i]
+	c.EndTimeMilli = time.Now().UnixMilli()
+	if err := g.KeypadCodes.Update(&c); err != nil {
+		adminReply(w, r, "codes", nil, err)
+		return
+	}
+	msg := fmt.Sprintf("keypad code %d of %s revoked by web admin %s", c.ID, c.RequesterPhone, p)
+	g.sendSystemNotification(msg)
+	adminReply(w, r, "codes", map[string]string{"result": msg}, nil)
+}
+
+// handleAdminSchedule sets the schedule {"07:00":10,...} of the timer or of the BLE timer, empty cancels it
+func (g *Gate) handleAdminSchedule(w http.ResponseWriter, r *http.Request) {
+	p := g.adminPrincipal(w, r, "schedule")
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ch chan map[string]int
+	switch args["kind"] {
+	case "", "timer":
+		ch = g.schedule
+	case "ble":
+		ch = g.bleSchedule
+	default:
+		adminReply(w, r, "schedules", nil, adminBadRequest("kind timer or ble expected"))
+		return
+	}
+	var sch map[string]int
+	if v := strings.TrimSpace(args["schedule"]); v != "" {
+		if err := checkSchedule(v); err != nil {
+			adminReply(w, r, "schedules", nil, adminBadRequest("%v", err))
+			return
+		}
+		json.Unmarshal([]byte(v), &sch)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminActionTimeout)
+	defer cancel()
+	select {
+	case ch <- sch:
+	case <-ctx.Done():
+		adminReply(w, r, "schedules", nil, ctx.Err())
+		return
+	}
+	bb, _ := json.Marshal(sch)
+	msg := fmt.Sprintf("%s schedule %s is set by web admin %s", cmp.Or(args["kind"], "timer"), If(sch == nil, "{}", string(bb)), p)
+	g.sendSystemNotification(msg)
+	adminReply(w, r, "schedules", map[string]string{"result": msg}, nil)
+}
+
+// handleAdminSetting sets key to value as /7_set does, empty value deletes the setting
+func (g *Gate) handleAdminSetting(w http.ResponseWriter, r *http.Request) {
+	p := g.adminPrincipal(w, r, "settings")
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, value := args["key"], args["value"]
+	def, err := g.setSetting(key, value, "web admin "+p.String())
+	if def == nil || err != nil && def.Validate(value) != nil {
+		adminReply(w, r, "settings", nil, adminBadRequest("%v", err))
+		return
+	}
+	if err != nil {
+		adminReply(w, r, "settings", nil, err)
+		return
+	}
+	msg := fmt.Sprintf("setting %s = %q by web admin %s", key, value, p)
+	if !def.HotApply {
+		msg += ", applied after restart"
+	}
+	g.sendSystemNotification(msg)
+	adminReply(w, r, "settings", map[string]string{"result": msg}, nil)
+}
+
+// handleAdminReading accepts or rejects the reading of the plot for yyyy-mm with the comment
+func (g *Gate) handleAdminReading(w http.ResponseWriter, r *http.Request) {
+	plot, action := r.PathValue("plot"), r.PathValue("action")
+	p := g.consolePrincipal(w, r, PermRegistry, action+" reading "+plot)
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if action != "accept" && action != "reject" {
+		http.NotFound(w, r)
+		return
+	}
+	period, err := billing.ParsePeriod(r.PathValue("period"))
+	if err != nil {
+		adminReply(w, r, "readings", nil, adminBadRequest("%v", err))
+		return
+	}
+	s, err := g.reviewReading(plot, period, action == "accept", strings.TrimSpace(args["comment"]), "web admin "+p.String())
+	adminReply(w, r, "readings", s, err)
+}
+
+func (g *Gate) handleAdminReadingPhoto(w http.ResponseWriter, r *http.Request) {
+	plot := r.PathValue("plot")
+	if g.consolePrincipal(w, r, PermRegistry, "reading photo "+plot) == nil {
+		return
+	}
+	period, err := billing.ParsePeriod(r.PathValue("period"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := &ReadingSubmission{Reading: billing.Reading{Plot: plot, Period: period}}
+	if ok, _ := g.Entities.Load(s); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Has("rejected") {
+		i, err := strconv.Atoi(r.URL.Query().Get("rejected"))
+		if err != nil || i < 0 || i >= len(s.Rejected) {
+			http.NotFound(w, r)
+			return
+		}
+		s = &s.Rejected[i]
+	}
+	if s.Photo == "" {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, g.readingPhotoPath(s.Photo))
+}
+
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"ts": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.In(Location).Format("2006-01-02 15:04:05")
+	},
+	"ms": func(ms int64) string {
+		if ms == 0 {
+			return ""
+		}
+		return time.UnixMilli(ms).In(Location).Format("2006-01-02 15:04")
+	},
+	"json": func(m map[string]int) string {
+		if len(m) == 0 {
+			return ""
+		}
+		bb, _ := json.Marshal(m)
+		return string(bb)
+	},
+}).Parse(`{{define "layout"}}<!DOCTYPE html>
+<html lang="ru"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Gate}}: {{.Page}}</title>
+<style>body{font-family:sans-serif;margin:1em}nav a{margin-right:1em}table{border-collapse:collapse}
+td,th{border:1px solid #ccc;padding:.2em .5em;text-align:left}form{display:inline}.err{color:#b00}</style>
+</head><body>
+<nav>{{range .Pages}}<a href="{{.}}">{{.}}</a>{{end}}<span>{{.Admin}}</span></nav>
+<h1>{{.Gate}}: {{.Page}}</h1>
+{{if eq .Page "state"}}{{template "state" .}}{{else if eq .Page "journal"}}{{template "journal" .}}{{else if eq .Page "phones"}}{{template "phones" .}}{{else if eq .Page "access"}}{{template "access" .}}{{else if eq .Page "codes"}}{{template "codes" .}}{{else if eq .Page "schedules"}}{{template "schedules" .}}{{else if eq .Page "settings"}}{{template "settings" .}}{{else if eq .Page "devices"}}{{template "devices" .}}{{else if eq .Page "readings"}}{{template "readings" .}}{{else if eq .Page "payments"}}{{template "payments" .}}{{end}}
+</body></html>{{end}}
+
+{{define "state"}}{{with .Data}}<p>kept open: {{.KeptOpen}}</p>
+<p>locked until: {{ts .LockedUntil}}</p>
+<p>last opened: {{ts .LastOpened}}</p>{{end}}
+<form method="post" action="api/gate/open"><button>open</button></form>
+<form method="post" action="api/gate/keep_open"><button>keep open</button></form>
+<form method="post" action="api/gate/keep_open_cancel"><button>cancel keep open</button></form>
+<form method="post" action="api/gate/lock"><input name="minutes" type="number" min="0" value="0" size="4"> min <button>lock</button></form>
+{{end}}
+
+{{define "journal"}}<form method="get" action="journal"><input name="type" value="{{.Journal}}" placeholder="system.command"> <button>filter</button></form>
+<table><tr><th>time</th><th>type</th><th>severity</th><th>text</th></tr>
+{{range .Data}}<tr><td>{{ts .Time}}</td><td>{{.Type}}</td><td>{{.Severity}}</td><td>{{.Text}}</td></tr>{{end}}
+</table>{{end}}
+
+{{define "phones"}}<table><tr><th>phone</th><th>name</th><th>dial</th><th>local</th><th>admin</th><th>allowed now</th><th>restricted</th></tr>
+{{range .Data}}<tr><td>{{.Phone}}</td><td>{{.Name}}</td><td>{{.DialToOpen}}</td><td>{{.LocalOnly}}</td><td>{{.Admin}}</td><td>{{.AllowedNow}}</td>
+<td><form method="post" action="api/phones/{{.Phone}}"><input type="hidden" name="restricted" value="{{not .Restricted}}">
+<button>{{if .Restricted}}unrestrict{{else}}restrict{{end}}</button></form></td></tr>{{end}}
+</table>{{end}}
+
+{{define "access"}}<form method="post" action="api/access"><select name="kind">{{range .Kinds}}<option>{{.}}</option>{{end}}</select>
+<input name="key" placeholder="MAC, hostname, code, phone"> <input name="phone" placeholder="phone"> <input name="label" placeholder="label">
+<input name="expires" type="date"> <button>add</button></form>
+<table><tr><th>kind</th><th>key</th><th>phone</th><th>label</th><th>created by</th><th>created</th><th>expires</th><th></th></tr>
+{{range .Data}}<tr><td>{{.Kind}}</td><td>{{.Key}}</td><td>{{.Phone}}</td><td>{{.Label}}</td><td>{{.CreatedBy}}</td><td>{{ms .CreatedMilli}}</td><td>{{ms .ExpiresMilli}}</td>
+<td>{{if .Pending}}<form method="post" action="api/access/{{.Kind}}/{{.Key}}/approve"><button>approve</button></form> {{end}}<form method="post" action="api/access/{{.Kind}}/{{.Key}}/delete"><button>delete</button></form></td></tr>{{end}}
+</table>{{end}}
+
+{{define "codes"}}<form method="post" action="api/codes"><select name="ttl"><option>30m</option><option>16h</option><option>48h</option></select> <button>new code</button></form>
+<table><tr><th>id</th><th>code</th><th>requester</th><th>created</th><th>end</th><th>ttl, min</th><th></th></tr>
+{{range .Data}}<tr><td>{{.ID}}</td><td>{{.Code}}</td><td>{{.RequesterPhone}}</td><td>{{ts .Created}}</td><td>{{ts .End}}</td><td>{{.TTLMinutes}}</td>
+<td><form method="post" action="api/codes/{{.ID}}/revoke"><button>revoke</button></form></td></tr>{{end}}
+</table>{{end}}
+
+{{define "schedules"}}{{with .Data}}<form method="post" action="api/schedules"><input type="hidden" name="kind" value="timer">
+timer{{if .TimerFromConfig}} (config){{end}}: <input name="schedule" value='{{json .Timer}}' size="60"> <button>set</button></form><br>
+<form method="post" action="api/schedules"><input type="hidden" name="kind" value="ble">
+BLE timer: <input name="schedule" value='{{json .BLETimer}}' size="60"> <button>set</button></form>{{end}}
+{{end}}
+
+{{define "settings"}}<table><tr><th>key</th><th>type</th><th>value</th><th>description</th></tr>
+{{range .Data}}<tr><td>{{.Key}}</td><td>{{.Type}}</td>
+<td><form method="post" action="api/settings"><input type="hidden" name="key" value="{{.Key}}"><input name="value" value="{{.Value}}" placeholder="{{.Default}}"> <button>set</button></form></td>
+<td>{{.Description}}{{if not .HotApply}}, applied after restart{{end}}</td></tr>{{end}}
+</table>{{end}}
+
+{{define "readings"}}{{with .Data}}<form method="get" action="readings"><input name="month" value="{{.Period}}" placeholder="yyyy-mm"> <button>show</button></form>
+<table><tr><th>month</th><th>plot</th><th>reading</th><th>previous</th><th>by</th><th>sent</th><th>photo</th><th>warning</th><th></th></tr>
+{{range .Pending}}<tr><td>{{.Period}}</td><td>{{.Plot}}</td><td>{{.Value}}</td><td>{{.Prev}}</td><td>{{.By}}</td><td>{{ms .Time}}</td>
+<td>{{if .Photo}}<a href="api/readings/{{.Plot}}/{{.Period}}/photo" target="_blank">photo</a>{{end}}</td><td>{{.Warning}}
+{{range $i, $r := .Rejected}}<br>rejected {{$r.Value}} by {{$r.ReviewedBy}}{{if $r.Comment}}: {{$r.Comment}}{{end}}{{if $r.Photo}} <a href="api/readings/{{$r.Plot}}/{{$r.Period}}/photo?rejected={{$i}}" target="_blank">photo</a>{{end}}{{end}}</td>
+<td><form method="post" action="api/readings/{{.Plot}}/{{.Period}}/accept"><button>accept</button></form>
+<form method="post" action="api/readings/{{.Plot}}/{{.Period}}/reject"><input name="comment" placeholder="reason"> <button>reject</button></form></td></tr>{{end}}
+</table>
+<p>{{.Period}}: no readings of {{len .Missing}} plots{{range $i, $p := .Missing}}{{if $i}},{{else}}:{{end}} {{$p}}{{end}}</p>
+{{if .Waiting}}<p>waiting for review:{{range .Waiting}} {{.}}{{end}}</p>{{end}}{{end}}
+{{end}}
+
+{{define "payments"}}<form method="post" action="api/payments" enctype="multipart/form-data">bank statement (1C, CSV, CAMT.053):
+<input type="file" name="statement"> <button>import</button></form>
+{{range .Data}}<h3>{{.Name}}, {{.Format}}, {{ms .TimeMilli}} by {{.By}}</h3>
+<p>{{.Credits}} credits, {{len .Matched}} payments added, {{len .Known}} known, {{len .Charges}} charges paid, {{len .Unmatched}} unmatched{{if .Duplicates}}, <span class="err">{{len .Duplicates}} possible duplicates</span>{{end}}{{if .Errors}}<br><span class="err">{{.Errors}}</span>{{end}}</p>
+{{if .Matched}}<table><tr><th>month</th><th>plot</th><th>amount</th><th>date</th><th>purpose</th></tr>
+{{range .Matched}}<tr><td>{{.Period}}</td><td>{{.Plot}}</td><td>{{.Amount}}</td><td>{{.Date}}</td><td>{{.Purpose}}</td></tr>{{end}}
+</table>{{end}}
+{{if .Charges}}<table><tr><th>charge</th><th>due</th><th>plot</th><th>amount</th><th>date</th><th>purpose</th></tr>
+{{range .Charges}}<tr><td>{{.Charge}}</td><td>{{.Due}}</td><td>{{.Plot}}</td><td>{{.Amount}}</td><td>{{.Date}}</td><td>{{.Purpose}}</td></tr>{{end}}
+</table>{{end}}
+{{if .Unmatched}}<table><tr><th>date</th><th>amount</th><th>payer</th><th>purpose</th><th>reason</th><th></th></tr>
+{{range .Unmatched}}<tr><td>{{.Date}}</td><td>{{.Amount}}</td><td>{{.Payer}}</td><td>{{.Purpose}}</td><td>{{.Reason}}</td>
+<td><form method="post" action="api/payments/{{.ID}}/assign"><input name="plot" placeholder="plot" size="4"> <input name="month" placeholder="yyyy-mm" size="7"> <button>assign</button></form>
+<form method="post" action="api/payments/{{.ID}}/charge"><input name="plot" placeholder="plot" size="4"> <input name="charge" placeholder="charge" size="10"> <input name="due" placeholder="yyyy-mm-dd" size="10"> <button>charge</button></form></td></tr>{{end}}
+</table>{{end}}
+{{if .Duplicates}}<p>possible duplicates, not added:</p><table><tr><th>date</th><th>amount</th><th>payer</th><th>purpose</th><th>reason</th></tr>
+{{range .Duplicates}}<tr class="err"><td>{{.Date}}</td><td>{{.Amount}}</td><td>{{.Payer}}</td><td>{{.Purpose}}</td><td>{{.Reason}}</td></tr>{{end}}
+</table>{{end}}{{end}}
+{{end}}
+
+{{define "devices"}}<table><tr><th>device</th><th>last seen</th><th>error</th><th>error time</th></tr>
+{{range .Data}}<tr{{if not .OK}} class="err"{{end}}><td>{{.Name}}</td><td>{{ts .LastSeen}}</td><td>{{.LastError}}</td><td>{{ts .ErrorTime}}</td></tr>{{end}}
+</table>{{end}}
+`))
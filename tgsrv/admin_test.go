@@ -0,0 +1,265 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"7stgbot/notify"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func newAdminGate(t *testing.T) (*Gate, http.Handler) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	g := &Gate{CfgDir: t.TempDir()}
+	g.Init(&config.Config{AdminPhone: "79990000009"}, db)
+	g.Phones = map[string]*PalESUser{
+		"79990000001": {Id: "79990000001", Firstname: "Иван", Lastname: "12", DialToOpen: true},
+	}
+	g.Entities.Insert(&HTTPSession{Token: "admin", Phone: "+79990000009", WebAuthn: true})
+	g.Entities.Insert(&HTTPSession{Token: "admin-sms", Phone: "+79990000009"})
+	g.Entities.Insert(&HTTPSession{Token: "resident", Phone: "+79990000001", WebAuthn: true})
+	mux := http.NewServeMux()
+	g.RegisterAdminHTTP(mux)
+	return g, mux
+}
+
+// failingCodes fails to store keypad codes
+type failingCodes struct {
+	gate.KeypadCodesDAO
+}
+
+func (failingCodes) Insert(*gate.KeypadCode) error { return errors.New("disk I/O error") }
+
+func adminRequest(h http.Handler, method, path, session, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	_, h := newAdminGate(t)
+	tests := []struct {
+		session string
+		want    int
+	}{
+		{"", http.StatusForbidden},
+		{"admin-sms", http.StatusForbidden},
+		{"resident", http.StatusForbidden},
+		{"admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/gate/admin/state", "/gate/admin/api/phones"} {
+			if got := adminRequest(h, "GET", path, tt.session, "", "").Code; got != tt.want {
+				t.Errorf("%q %s: got %v, want %v", tt.session, path, got, tt.want)
+			}
+		}
+	}
+	if got := adminRequest(h, "GET", "/gate/admin/unknown", "admin", "", "").Code; got != http.StatusNotFound {
+		t.Errorf("got %v, want %v", got, http.StatusNotFound)
+	}
+	w := adminRequest(h, "GET", "/gate/admin", "", "", "")
+	if got, want := w.Header().Get("Location"), "admin/state"; w.Code != http.StatusSeeOther || got != want {
+		t.Errorf("got %v %q, want %q", w.Code, got, want)
+	}
+}
+
+// TestPasskeyAfterSMS logs in the same session by SMS and then by a passkey of a software authenticator
+func TestPasskeyAfterSMS(t *testing.T) {
+	g, admin := newAdminGate(t)
+	wa, err := g.newWebAuthn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := &ChatBroker{g: g, webAuthn: wa}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /gate/app/sms/verify", br.handleSmsVerify)
+	mux.HandleFunc("POST /gate/app/login/begin", br.handleLoginBegin)
+	mux.HandleFunc("POST /gate/app/login/finish", br.handleLoginFinish)
+
+	const phone = "+79990000009"
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cose, _ := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         int64(webauthncose.P256), XCoord: key.X.FillBytes(make([]byte, 32)), YCoord: key.Y.FillBytes(make([]byte, 32)),
+	})
+	credID := []byte("passkey-1")
+	g.Entities.Insert(&WebUser{Phone: phone, Credentials: []webauthn.Credential{{ID: credID, PublicKey: cose, AttestationType: "none"}}})
+	g.Entities.Insert(&CodeSMS{Phone: phone, Code: "1234"})
+
+	if w := adminRequest(mux, "POST", "/gate/app/sms/verify", "s1", "", `{"phone":"79990000009","code":"1234"}`); w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want the SMS login", w.Code, w.Body)
+	}
+	if got := adminRequest(admin, "GET", "/gate/admin/state", "s1", "", "").Code; got != http.StatusForbidden {
+		t.Errorf("got %v, want the SMS session forbidden", got)
+	}
+
+	w := adminRequest(mux, "POST", "/gate/app/login/begin", "s1", "", `{"phone":"79990000009"}`)
+	var options struct {
+		PublicKey struct{ Challenge string } `json:"publicKey"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want login options", w.Code, w.Body)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	clientData, _ := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": options.PublicKey.Challenge,
+		"origin": "https://" + g.appDomain()})
+	rpID := sha256.Sum256([]byte(g.siteDomain()))
+	authData := binary.BigEndian.AppendUint32(append(rpID[:], 0x05), 1) // user present and verified, sign count 1
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientHash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	body, _ := json.Marshal(map[string]any{"id": b64(credID), "rawId": b64(credID), "type": "public-key",
+		"response": map[string]string{"clientDataJSON": b64(clientData), "authenticatorData": b64(authData),
+			"signature": b64(sig), "userHandle": b64([]byte(phone))}})
+	r := httptest.NewRequest("POST", "/gate/app/login/finish", strings.NewReader(string(body)))
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "s1"})
+	r.Header.Set("X-Login-State", w.Header().Get("X-Login-State"))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want the passkey login", w.Code, w.Body)
+	}
+	s := HTTPSession{Token: "s1"}
+	if ok, err := g.Entities.Load(&s); !ok || err != nil || !s.WebAuthn || s.Phone != phone {
+		t.Errorf("got %+v %v, want the passkey session", s, err)
+	}
+	if got := adminRequest(admin, "GET", "/gate/admin/state", "s1", "", "").Code; got != http.StatusOK {
+		t.Errorf("got %v, want the passkey admin allowed", got)
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	g, h := newAdminGate(t)
+	opened := serveGateCommands(t, g, nil)
+	w := adminRequest(h, "POST", "/gate/admin/api/gate/open", "admin", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want opened", w.Code, w.Body)
+	}
+	if got := opened(); len(got) != 1 || !strings.HasPrefix(got[0], "79990000009 web admin") {
+		t.Errorf("got %q, want open by web admin", got)
+	}
+	if w := adminRequest(h, "POST", "/gate/admin/api/gate/lock", "admin", "", `{"minutes": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	w = adminRequest(h, "POST", "/gate/admin/api/phones/79990000001", "admin", "application/x-www-form-urlencoded", "restricted=true")
+	if got, want := w.Header().Get("Location"), "../../phones"; w.Code != http.StatusSeeOther || got != want {
+		t.Errorf("got %v %q, want %q", w.Code, got, want)
+	}
+	if g.allowedNow("79990000001") {
+		t.Error("restricted phone is allowed")
+	}
+	if e := g.access().get(accessRestricted, "79990000001"); e == nil || !strings.HasPrefix(e.CreatedBy, "web admin") {
+		t.Errorf("got %+v, want restricted by web admin", e)
+	}
+	var phones []AdminPhone
+	w = adminRequest(h, "GET", "/gate/admin/api/phones", "admin", "", "")
+	if err := json.NewDecoder(w.Body).Decode(&phones); err != nil || len(phones) != 1 || !phones[0].Restricted || phones[0].Name != "Иван 12" {
+		t.Errorf("got %+v %v, want restricted Иван", phones, err)
+	}
+
+	abort := make(chan struct{})
+	defer close(abort)
+	go g.handlingKeypadRequests(abort)
+	w = adminRequest(h, "POST", "/gate/admin/api/codes", "admin", "", `{"ttl": "16h"}`)
+	if !strings.Contains(w.Body.String(), "действителен 16 ч") {
+		t.Fatalf("got %v %s, want a code", w.Code, w.Body)
+	}
+	cc, _ := g.KeypadCodes.ListActive()
+	if len(cc) != 1 || cc[0].RequesterPhone != "79990000009" {
+		t.Fatalf("got %+v, want code of the admin", cc)
+	}
+	if w := adminRequest(h, "POST", fmt.Sprintf("/gate/admin/api/codes/%d/revoke", cc[0].ID), "admin", "", ""); w.Code != http.StatusOK {
+		t.Errorf("got %v %s, want revoked", w.Code, w.Body)
+	}
+	codes := g.KeypadCodes
+	g.KeypadCodes = failingCodes{codes}
+	if w := adminRequest(h, "POST", "/gate/admin/api/codes", "admin", "", `{"ttl": "30m"}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("got %v %s, want the db error", w.Code, w.Body)
+	}
+	g.KeypadCodes = codes
+	if cc, _ := g.KeypadCodes.ListActive(); len(cc) != 0 {
+		t.Errorf("got %+v, want no active codes", cc)
+	}
+
+	if w := adminRequest(h, "POST", "/gate/admin/api/settings", "admin", "", `{"key": "g.minCodeLen.i", "value": "x"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %v %s, want %v", w.Code, w.Body, http.StatusBadRequest)
+	}
+
+	var events []notify.Event
+	w = adminRequest(h, "GET", "/gate/admin/api/journal?type=system", "admin", "", "")
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, e := range events {
+		texts = append(texts, e.Text)
+	}
+	for _, want := range []string{"Иван 12 restricted by web admin", "guest code 16h requested by web admin", "revoked by web admin"} {
+		if !strings.Contains(strings.Join(texts, "\n"), want) {
+			t.Errorf("got %q, want %q audited", texts, want)
+		}
+	}
+	if w := adminRequest(h, "GET", "/gate/admin/phones", "admin", "", ""); !strings.Contains(w.Body.String(), "unrestrict") {
+		t.Errorf("got %s, want the phones page", w.Body)
+	}
+}
+
+func TestEventJournal(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	j := eventJournal{store: gate.NewEvents(db)}
+	start := time.Now().Add(-journalRetention)
+	for i := range 6 {
+		j.add(notify.Event{Type: If(i%2 == 0, "system.ble", "user"), Text: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Hour)})
+	}
+	ee, err := j.list("", 2)
+	if err != nil || len(ee) != 2 || ee[0].Text != "5" || ee[1].Text != "4" {
+		t.Errorf("got %+v %v, want the last events first", ee, err)
+	}
+	if ee, _ := j.list("system", 10); len(ee) != 3 || ee[0].Type != "system.ble" {
+		t.Errorf("got %+v, want system events", ee)
+	}
+	if ee, _ := j.list("sys", 10); len(ee) != 0 {
+		t.Errorf("got %+v, want no events of a type prefix", ee)
+	}
+
+	// the journal survives a restart, events older than the retention are removed
+	j = eventJournal{store: gate.NewEvents(db)}
+	j.add(notify.Event{Type: "user", Text: "6", Time: start.Add(journalRetention + 2*time.Hour)})
+	if ee, _ := j.list("", 10); len(ee) != 5 || ee[4].Text != "2" {
+		t.Errorf("got %+v, want events of the retention", ee)
+	}
+}
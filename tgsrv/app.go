@@ -1,9 +1,11 @@
 package tgsrv
 
 import (
+	"cmp"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc64"
 	"net"
@@ -20,19 +22,16 @@ import (
 
 const (
 	sessionCookieName = "gate_session"
-	appDomain         = "gate.7slavka.ru"
-	siteDomain        = "7slavka.ru"
 	msgKindCliCnt     = "cli_cnt"
 	msgKindMsgPer     = "msg_per"
 	msgKindGateOpened = "sys_event"
 )
 
 var (
-	webAuthnConfig *webauthn.WebAuthn
-	webauthnCtxDB  = make(map[string]*webauthn.SessionData) // Сессии WebAuthn: token -> data
-	mu             sync.Mutex
-	notDigitRE     = regexp.MustCompile(`[^0-9]`)
-	ipv4Regex      = regexp.MustCompile(`^(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)$`)
+	webauthnCtxDB = make(map[string]*webauthn.SessionData) // Сессии WebAuthn: token -> data
+	mu            sync.Mutex
+	notDigitRE    = regexp.MustCompile(`[^0-9]`)
+	ipv4Regex     = regexp.MustCompile(`^(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)$`)
 )
 
 type Pair[K, V any] struct {
@@ -56,14 +55,25 @@ func (u *WebUser) UnmarshalData(data string) error {
 }
 
 type HTTPSession struct {
-	Token string
-	Phone string
+	Token    string
+	Phone    string
+	WebAuthn bool // logged in by a passkey, not by SMS
 }
 
-func (s *HTTPSession) Type() string                    { return "HTTPSession" }
-func (s *HTTPSession) ID() string                      { return s.Token }
-func (s *HTTPSession) MarshalData() (string, error)    { return s.Phone, nil }
-func (s *HTTPSession) UnmarshalData(data string) error { s.Phone = data; return nil }
+func (s *HTTPSession) Type() string { return "HTTPSession" }
+func (s *HTTPSession) ID() string   { return s.Token }
+func (s *HTTPSession) MarshalData() (string, error) {
+	if s.WebAuthn {
+		return s.Phone + " webauthn", nil
+	}
+	return s.Phone, nil
+}
+func (s *HTTPSession) UnmarshalData(data string) error {
+	var method string
+	s.Phone, method, _ = strings.Cut(data, " ")
+	s.WebAuthn = method == "webauthn"
+	return nil
+}
 
 type CodeSMS struct {
 	Phone   string
@@ -95,6 +105,29 @@ type ChatBroker struct {
 	messageHistory []Message // Хранилище сообщений за последний час
 	g              *Gate
 	ipReq          chan Pair[string, chan string]
+	webAuthn       *webauthn.WebAuthn
+}
+
+func (g *Gate) newWebAuthn() (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPDisplayName: cmp.Or(g.config().GateName, "Gate"),
+		RPID:          g.siteDomain(),
+		RPOrigins: []string{
+			"https://" + g.siteDomain(),
+			"https://" + g.appDomain(),
+		},
+	})
+}
+
+// saveSession replaces the phone and the login method of the session of the cookie
+func (g *Gate) saveSession(s *HTTPSession) error {
+	old := HTTPSession{Token: s.Token}
+	if ok, err := g.Entities.Load(&old); err != nil {
+		return err
+	} else if ok {
+		return g.Entities.Update(s)
+	}
+	return g.Entities.Insert(s)
 }
 
 func (g *Gate) RegisterGateAppHTTP(mux *http.ServeMux, staticDir string, ipReq chan Pair[string, chan string]) {
@@ -108,18 +141,11 @@ func (g *Gate) RegisterGateAppHTTP(mux *http.ServeMux, staticDir string, ipReq c
 		ipReq:          ipReq,
 	}
 
-	mux.Handle("GET /gate/app/{$}", InitSession(http.StripPrefix("/gate/app", http.FileServer(http.Dir(staticDir)))))
+	mux.Handle("GET /gate/app/{$}", InitSession(g.appDomain(), http.StripPrefix("/gate/app", http.FileServer(http.Dir(staticDir)))))
 	mux.Handle("GET /gate/app/", http.StripPrefix("/gate/app", http.FileServer(http.Dir(staticDir))))
 
 	var err error
-	webAuthnConfig, err = webauthn.New(&webauthn.Config{
-		RPDisplayName: "Gate",
-		RPID:          siteDomain,
-		RPOrigins: []string{
-			"https://" + siteDomain,
-			"https://" + appDomain,
-		},
-	})
+	br.webAuthn, err = g.newWebAuthn()
 	if err != nil {
 		Logger.Fatalf("Ошибка инициализации WebAuthn: %v", err)
 		return
@@ -140,13 +166,38 @@ func (g *Gate) RegisterGateAppHTTP(mux *http.ServeMux, staticDir string, ipReq c
 	// Главное исполнительное действие
 	mux.HandleFunc("POST /gate/app/open", br.handleGateOpen)
 
+	// Временные группы
+	mux.HandleFunc("GET /gate/app/timegroups", br.handleTimeGroups)
+	mux.HandleFunc("PUT /gate/app/timegroups", br.handleTimeGroupPut)
+	mux.HandleFunc("DELETE /gate/app/timegroups/{name}", br.handleTimeGroupDelete)
+
+	// Свои устройства для автооткрытия, ждут подтверждения админа
+	mux.HandleFunc("GET /gate/app/devices", br.handleDevices)
+	mux.HandleFunc("POST /gate/app/devices", br.handleDeviceAdd)
+	mux.HandleFunc("DELETE /gate/app/devices/{kind}/{mac}", br.handleDeviceDelete)
+
+	// Регистрация своего устройства, стоя у шлагбаума
+	mux.HandleFunc("POST /gate/app/enroll", br.handleEnrollStart)
+	mux.HandleFunc("GET /gate/app/enroll", br.handleEnrollCandidates)
+	mux.HandleFunc("POST /gate/app/enroll/confirm", br.handleEnrollConfirm)
+
+	// показания счётчиков
+	mux.HandleFunc("GET /gate/app/readings", br.handleReadings)
+	mux.HandleFunc("POST /gate/app/readings", br.handleReadingSubmit)
+	mux.HandleFunc("GET /gate/app/charges", br.handleCharges)
+
+	// Web Push
+	mux.HandleFunc("GET /gate/app/push/key", br.handlePushKey)
+	mux.HandleFunc("POST /gate/app/push/subscribe", br.handlePushSubscribe)
+	mux.HandleFunc("POST /gate/app/push/unsubscribe", br.handlePushUnsubscribe)
+
 	go br.run(g.Abort)
 
 	mux.HandleFunc("POST /gate/app/chat/send", br.handleChatSend)
 	mux.HandleFunc("GET /gate/app/chat/stream", br.handleChatStream)
 }
 
-func InitSession(h http.Handler) http.Handler {
+func InitSession(appDomain string, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, err := r.Cookie(sessionCookieName); err == nil {
 			h.ServeHTTP(w, r)
@@ -195,7 +246,7 @@ func (b *ChatBroker) handleSmsSend(w http.ResponseWriter, r *http.Request) {
 		sms.Code = generateSMSCode()
 		sms.Updated = now.Unix()
 	}
-	b.g.sendSMS(req.Phone, fmt.Sprintf("%s: введите код подтверждения %s", appDomain, sms.Code), time.Now().Add(time.Minute))
+	b.g.sendSMS(req.Phone, fmt.Sprintf("%s: введите код подтверждения %s", b.g.appDomain(), sms.Code), time.Now().Add(time.Minute))
 	w.WriteHeader(http.StatusOK)
 	if exists {
 		b.g.Entities.Update(&sms)
@@ -236,7 +287,11 @@ func (b *ChatBroker) handleSmsVerify(w http.ResponseWriter, r *http.Request) {
 		b.g.Entities.Insert(&u)
 	}
 	s := HTTPSession{Token: cookie.Value, Phone: normalizePhone(phone)}
-	b.g.Entities.Insert(&s)
+	if err := b.g.saveSession(&s); err != nil {
+		Logger.Errorf("saving session of %s: %v", phone, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -261,7 +316,7 @@ func (b *ChatBroker) handleRegisterBegin(w http.ResponseWriter, r *http.Request)
 	}
 	u := WebUser{Phone: phone}
 	b.g.Entities.Load(&u)
-	options, sessionData, err := webAuthnConfig.BeginRegistration(&u)
+	options, sessionData, err := b.webAuthn.BeginRegistration(&u)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -295,7 +350,7 @@ func (b *ChatBroker) handleRegisterFinish(w http.ResponseWriter, r *http.Request
 	}
 	u := WebUser{Phone: phone}
 	exists, _ := b.g.Entities.Load(&u)
-	credential, err := webAuthnConfig.CreateCredential(&u, *sessionData, parsedCredential)
+	credential, err := b.webAuthn.CreateCredential(&u, *sessionData, parsedCredential)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -327,7 +382,7 @@ func (b *ChatBroker) handleLoginBegin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Пользователь не найден или не настроил Passkey", http.StatusNotFound)
 		return
 	}
-	options, sessionData, err := webAuthnConfig.BeginLogin(&targetUser)
+	options, sessionData, err := b.webAuthn.BeginLogin(&targetUser)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -370,13 +425,18 @@ func (b *ChatBroker) handleLoginFinish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Криптографически проверяем подпись устройства на основе открытого ключа пользователя
-	_, err = webAuthnConfig.ValidateLogin(&targetUser, *sessionData, parsedCredential)
+	_, err = b.webAuthn.ValidateLogin(&targetUser, *sessionData, parsedCredential)
 	if err != nil {
 		http.Error(w, "Криптографическая проверка подписи провалена", http.StatusUnauthorized)
 		return
 	}
-	s := HTTPSession{Token: cookie.Value, Phone: targetUser.Phone}
-	b.g.Entities.Insert(&s)
+	// the session of SMS login becomes a passkey one
+	s := HTTPSession{Token: cookie.Value, Phone: targetUser.Phone, WebAuthn: true}
+	if err := b.g.saveSession(&s); err != nil {
+		Logger.Errorf("saving session of %s: %v", targetUser.Phone, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
 
 	// Подчищаем временные контексты входа
 	mu.Lock()
@@ -388,14 +448,14 @@ func (b *ChatBroker) handleLoginFinish(w http.ResponseWriter, r *http.Request) {
 }
 
 func (b *ChatBroker) handleGateOpen(w http.ResponseWriter, r *http.Request) {
-	_, phone, authorized := b.getSessionInfo(r)
-	if !authorized {
+	p := b.g.webPrincipal(r)
+	if p == nil {
 		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
 		return
 	}
-	phone = normalizePhone(phone)[1:]
+	phone := p.Phone
 	u, ok := b.g.Phones[phone]
-	if !ok {
+	if !ok || !b.g.authorize(p, PermOpen, "web app: open") {
 		http.Error(w, "Вы не зарегестрированы в реестре шлагбаума. Обратитесь в правление.", http.StatusForbidden)
 		return
 	}
@@ -409,6 +469,162 @@ func (b *ChatBroker) handleGateOpen(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (b *ChatBroker) handleTimeGroups(w http.ResponseWriter, r *http.Request) {
+	_, _, authorized := b.getSessionInfo(r)
+	if !authorized {
+		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.g.timeGroups().Groups.List)
+}
+
+// timeGroupEditor returns phone of the authorized admin, admins of pal-es included
+func (b *ChatBroker) timeGroupEditor(w http.ResponseWriter, r *http.Request) (string, bool) {
+	p := b.g.webPrincipal(r)
+	if p == nil {
+		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
+		return "", false
+	}
+	if !b.g.authorize(p, PermAdmin, "web app: time groups") {
+		http.Error(w, "Недостаточно прав.", http.StatusForbidden)
+		return "", false
+	}
+	return p.Phone, true
+}
+
+func (b *ChatBroker) handleTimeGroupPut(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.timeGroupEditor(w, r)
+	if !ok {
+		return
+	}
+	var spec TimeGroupSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tg, err := spec.toTimeGroup()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := b.g.upsertLocalTimeGroup(tg); err != nil {
+		Logger.Errorf("saving time group %s: %v", tg.GroupName, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
+	b.g.sendSystemNotification(fmt.Sprintf("time group saved by web app %s: %s", phone, tg))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tg)
+}
+
+func (b *ChatBroker) handleTimeGroupDelete(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.timeGroupEditor(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	err := b.g.deleteLocalTimeGroup(name)
+	if err == ErrNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Logger.Errorf("deleting time group %s: %v", name, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
+	b.g.sendSystemNotification(fmt.Sprintf("time group %s deleted by web app %s", name, phone))
+	w.WriteHeader(http.StatusOK)
+}
+
+// devicesOwner returns the phone of the session of a resident
+func (b *ChatBroker) devicesOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	p := b.g.webPrincipal(r)
+	if p == nil {
+		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
+		return "", false
+	}
+	if !b.g.authorize(p, PermOpen, "web app: devices") {
+		http.Error(w, "Вы не зарегестрированы в реестре шлагбаума. Обратитесь в правление.", http.StatusForbidden)
+		return "", false
+	}
+	return p.Phone, true
+}
+
+func (b *ChatBroker) handleDevices(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.devicesOwner(w, r)
+	if !ok {
+		return
+	}
+	ee := []*AccessEntry{}
+	for _, kind := range []string{accessBTAutoOpen, accessWiFiAutoOpen} {
+		for _, e := range b.g.access().list(kind) {
+			if e.Phone == phone {
+				ee = append(ee, e)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ee)
+}
+
+func (b *ChatBroker) handleDeviceAdd(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.devicesOwner(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Kind  string `json:"kind"` // bt или wifi
+		MAC   string `json:"mac"`
+		Label string `json:"label"`
+	}
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	kind, ok := ownDeviceKind(req.Kind)
+	if !ok {
+		http.Error(w, "тип устройства bt или wifi", http.StatusBadRequest)
+		return
+	}
+	e, err := b.g.addOwnDevice(phone, kind, strings.TrimSpace(req.MAC), strings.TrimSpace(req.Label))
+	switch {
+	case errors.Is(err, errAdminBadRequest):
+		http.Error(w, "неверный MAC адрес", http.StatusBadRequest)
+		return
+	case errors.Is(err, errAccessExists):
+		http.Error(w, "устройство уже добавлено", http.StatusConflict)
+		return
+	case err != nil:
+		Logger.Errorf("adding device %s %s: %v", phone, req.MAC, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+func (b *ChatBroker) handleDeviceDelete(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.devicesOwner(w, r)
+	if !ok {
+		return
+	}
+	kind, key := r.PathValue("kind"), r.PathValue("mac")
+	e, ok := b.g.access()[kind][key]
+	if !ok || e.Phone != phone || kind != accessBTAutoOpen && kind != accessWiFiAutoOpen {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := b.g.deleteAccess(kind, key); err != nil {
+		Logger.Errorf("deleting device %s %s: %v", phone, key, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
+	b.g.sendSystemNotification(fmt.Sprintf("access %s is deleted by web app %s", e, phone))
+	w.WriteHeader(http.StatusOK)
+}
+
 func normalizePhone(phone string) string {
 	phone = notDigitRE.ReplaceAllString(phone, "")
 	if strings.HasPrefix(phone, "8") {
@@ -0,0 +1,435 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/gate"
+	"7stgbot/notify"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The billing ledger of the default gate is the source of electricity bills and QR codes,
+// electr_YYYY-MM.csv of ElectrDir are imported on the first request of the month or by /7_billing import,
+// bank statements of statements/ in the config dir by /7_billing statement or on the payments page of the admin console.
+
+type MeterReading struct {
+	billing.Reading
+}
+
+func (e *MeterReading) Type() string { return "Reading" }
+func (e *MeterReading) ID() string   { return e.Plot + "/" + e.Period.String() }
+func (e *MeterReading) MarshalData() (string, error) {
+	bb, err := json.Marshal(&e.Reading)
+	return string(bb), err
+}
+func (e *MeterReading) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), &e.Reading)
+}
+
+type BillingPayment struct {
+	billing.Payment
+}
+
+func (e *BillingPayment) Type() string { return "Payment" }
+func (e *BillingPayment) ID() string   { return e.Payment.ID }
+func (e *BillingPayment) MarshalData() (string, error) {
+	bb, err := json.Marshal(&e.Payment)
+	return string(bb), err
+}
+func (e *BillingPayment) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), &e.Payment)
+}
+
+type BillingOpening struct {
+	billing.Opening
+}
+
+func (e *BillingOpening) Type() string { return "Opening" }
+func (e *BillingOpening) ID() string   { return e.Plot }
+func (e *BillingOpening) MarshalData() (string, error) {
+	bb, err := json.Marshal(&e.Opening)
+	return string(bb), err
+}
+func (e *BillingOpening) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), &e.Opening)
+}
+
+// BillingImport is the log of the import of a month
+type BillingImport struct {
+	Period     billing.Period
+	TimeMilli  int64
+	Rows       int
+	Mismatches []billing.Mismatch `json:",omitempty"`
+}
+
+func (e *BillingImport) Type() string { return "BillingImport" }
+func (e *BillingImport) ID() string   { return e.Period.String() }
+func (e *BillingImport) MarshalData() (string, error) {
+	bb, err := json.Marshal(e)
+	return string(bb), err
+}
+func (e *BillingImport) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), e)
+}
+
+// mismatch is true if the import of the month found a difference for the plot
+func (e *BillingImport) mismatch(plot string) bool {
+	return slices.ContainsFunc(e.Mismatches, func(m billing.Mismatch) bool { return m.Plot == plot })
+}
+
+// saveEntity inserts or replaces the entity
+func saveEntity(dao gate.EntitiesDAO, e gate.Entity) error {
+	if err := dao.Insert(e); err != nil {
+		return err
+	}
+	return dao.Update(e)
+}
+
+func electrFileName(p billing.Period) string {
+	return fmt.Sprintf("electr_%d-%02d.csv", p.Year, p.Month)
+}
+
+func (g *Gate) loadBilling() {
+	l := &billing.Ledger{}
+	load := func(e gate.Entity, put func() error) {
+		data, err := g.Entities.List(e.Type())
+		if err != nil {
+			Logger.Errorf("loading %s: %v", e.Type(), err)
+		}
+		for id, d := range data {
+			if err := e.UnmarshalData(d); err != nil {
+				Logger.Errorf("%s %s: %v", e.Type(), id, err)
+				continue
+			}
+			if err := put(); err != nil {
+				Logger.Errorf("%s %s: %v", e.Type(), id, err)
+			}
+		}
+	}
+	var r MeterReading
+	load(&r, func() error { return l.PutReading(r.Reading) })
+	var p BillingPayment
+	load(&p, func() error { return l.PutPayment(p.Payment) })
+	var o BillingOpening
+	load(&o, func() error { return l.PutOpening(o.Opening) })
+	g.billing.Store(l)
+}
+
+// ledger returns the ledger with rates of the config
+func (g *Gate) ledger() *billing.Ledger {
+	l := g.billing.Load().Clone()
+	cfg := g.config()
+	l.Price, _ = billing.RatesFromMap(cfg.Price)
+	l.Coef, _ = billing.RatesFromMap(cfg.Coef)
+	return l
+}
+
+// updateLedger changes a copy of the ledger, saves entities returned by update and stores the copy
+func (g *Gate) updateLedger(update func(l *billing.Ledger) ([]gate.Entity, error)) error {
+	g.billingMu.Lock()
+	defer g.billingMu.Unlock()
+	l := g.ledger()
+	ee, err := update(l)
+	if err != nil {
+		return err
+	}
+	for _, e := range ee {
+		if err := saveEntity(g.Entities, e); err != nil {
+			return err
+		}
+	}
+	g.billing.Store(l)
+	return nil
+}
+
+func (g *Gate) billingImport(p billing.Period) (*BillingImport, bool) {
+	imp := &BillingImport{Period: p}
+	ok, err := g.Entities.Load(imp)
+	if err != nil {
+		Logger.Errorf("loading import %s: %v", p, err)
+	}
+	return imp, ok
+}
+
+// importElectr imports electr_YYYY-MM.csv of the month, a month is imported once unless forced
+func (g *Gate) importElectr(p billing.Period, force bool) (*BillingImport, error) {
+	if imp, ok := g.billingImport(p); ok && !force {
+		return imp, nil
+	}
+	fp := filepath.Join(g.ElectrDir, electrFileName(p))
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, err := billing.ReadCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fp, err)
+	}
+	imp := &BillingImport{Period: p, TimeMilli: time.Now().UnixMilli()}
+	var importErr error
+	err = g.updateLedger(func(l *billing.Ledger) ([]gate.Entity, error) {
+		imp.Mismatches, importErr = l.Import(p, rows)
+		var ee []gate.Entity
+		for _, row := range rows {
+			plot := row.PlotNumber
+			if plot == "" {
+				continue
+			}
+			imp.Rows++
+			for _, m := range []billing.Period{p.Prev(), p} {
+				if r, ok := l.Reading(plot, m); ok {
+					ee = append(ee, &MeterReading{r})
+				}
+			}
+			for _, pm := range l.Payments(plot) {
+				if pm.ID == billing.CSVPaymentID(p, plot) {
+					ee = append(ee, &BillingPayment{pm})
+				}
+			}
+			if o, ok := l.Opening(plot); ok {
+				ee = append(ee, &BillingOpening{o})
+			}
+		}
+		return append(ee, imp), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	Logger.Infof("%s imported: %d rows, %d mismatches", fp, imp.Rows, len(imp.Mismatches))
+	if len(imp.Mismatches) != 0 {
+		g.sendSystemNotification(fmt.Sprintf("%s: %d rows, computed bills differ:\n%s", electrFileName(p), imp.Rows,
+			mismatchesText(imp.Mismatches)))
+	}
+	if importErr != nil {
+		Logger.Errorf("%s: %v", fp, importErr)
+	}
+	return imp, importErr
+}
+
+func mismatchesText(mm []billing.Mismatch) string {
+	ss := make([]string, len(mm))
+	for i, m := range mm {
+		ss[i] = m.String()
+	}
+	return strings.Join(ss, "\n")
+}
+
+// electrBill returns the bill of the plot with a reading of the month, the month is imported if needed.
+// mismatch is true if the imported file differs from the computed bill.
+func (g *Gate) electrBill(p billing.Period, plot string) (b *billing.Bill, mismatch bool, ok bool) {
+	imp, err := g.importElectr(p, false)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		Logger.Errorf("importing %s: %v", p, err)
+	}
+	b, ok = g.ledger().Bill(plot, p)
+	if !ok || !b.HasReading {
+		return nil, false, false
+	}
+	return b, imp != nil && imp.mismatch(plot), true
+}
+
+func (g *Gate) handleBillingCommand(cmd, args, actor string) (string, error) {
+	usage := fmt.Sprintf("usage: %s [bill <plot> [yyyy-mm] | import <yyyy-mm> | readings | accept <plot> <yyyy-mm> | "+
+		"reject <plot> <yyyy-mm> [comment] | missing [yyyy-mm] | remind [yyyy-mm] | report [yyyy-mm] | statement <file> | statements | "+
+		"assign <payment> <plot> <yyyy-mm> | assign_charge <payment> <charge> <yyyy-mm-dd> <plot> | charges [plot] | "+
+		"remind_charges]", cmd)
+	aa := strings.Fields(args)
+	if len(aa) == 0 {
+		return usage, nil
+	}
+	// month of readings is the current one or the previous one on the first days
+	period := func(i int) (billing.Period, error) {
+		if len(aa) <= i {
+			return readingPeriod(time.Now()), nil
+		}
+		return billing.ParsePeriod(aa[i])
+	}
+	switch aa[0] {
+	case "bill":
+		if len(aa) < 2 || len(aa) > 3 {
+			return usage, nil
+		}
+		now := time.Now().In(Location)
+		p := billing.Period{Year: now.Year(), Month: int(now.Month())}.Prev()
+		if len(aa) == 3 {
+			var err error
+			if p, err = billing.ParsePeriod(aa[2]); err != nil {
+				return usage, err
+			}
+		}
+		b, ok := g.ledger().Bill(aa[1], p)
+		if !ok {
+			return "", ErrNotFound
+		}
+		return billText(b), nil
+
+	case "import":
+		if len(aa) != 2 {
+			return usage, nil
+		}
+		p, err := billing.ParsePeriod(aa[1])
+		if err != nil {
+			return usage, err
+		}
+		imp, err := g.importElectr(p, true)
+		if imp == nil {
+			return "", err
+		}
+		res := fmt.Sprintf("imported %d rows of %s", imp.Rows, electrFileName(p))
+		if len(imp.Mismatches) != 0 {
+			res += ", computed bills differ:\n" + mismatchesText(imp.Mismatches)
+		}
+		if err != nil {
+			res += "\n" + err.Error()
+		}
+		return res, nil
+
+	case "readings":
+		ss := g.readingSubmissions(submissionPending)
+		if len(ss) == 0 {
+			return "no readings to review", nil
+		}
+		lines := make([]string, len(ss))
+		for i, s := range ss {
+			lines[i] = submissionText(s)
+		}
+		return strings.Join(lines, "\n"), nil
+
+	case "accept", "reject":
+		if len(aa) < 3 || aa[0] == "accept" && len(aa) != 3 {
+			return usage, nil
+		}
+		p, err := billing.ParsePeriod(aa[2])
+		if err != nil {
+			return usage, err
+		}
+		s, err := g.reviewReading(aa[1], p, aa[0] == "accept", strings.Join(aa[3:], " "), actor)
+		if err != nil {
+			return "", err
+		}
+		return submissionText(s), nil
+
+	case "missing", "remind":
+		if len(aa) > 2 {
+			return usage, nil
+		}
+		p, err := period(1)
+		if err != nil {
+			return usage, err
+		}
+		if aa[0] == "missing" {
+			missing, pending := g.missingReadings(p)
+			return missingReadingsText(p, missing, pending), nil
+		}
+		return g.remindReadings(p), nil
+
+	case "report":
+		if len(aa) > 2 {
+			return usage, nil
+		}
+		// the month before by default, readings of it are sent by readingLateDays
+		now := time.Now().In(Location)
+		p := billing.Period{Year: now.Year(), Month: int(now.Month())}.Prev()
+		if len(aa) == 2 {
+			var err error
+			if p, err = billing.ParsePeriod(aa[1]); err != nil {
+				return usage, err
+			}
+		}
+		missing, pending := g.missingReadings(p)
+		res := missingReadingsText(p, missing, pending)
+		g.notify(eventReadings, notify.Info, "monthly report, "+res)
+		return res, nil
+
+	case "statement":
+		if len(aa) != 2 {
+			return usage, nil
+		}
+		s, err := g.importStatementFile(aa[1], actor)
+		if err != nil {
+			return "", err
+		}
+		return statementText(s, g.ledger()), nil
+
+	case "statements":
+		ss := g.bankStatements()
+		if len(ss) == 0 {
+			return "no bank statements", nil
+		}
+		l := g.ledger()
+		lines := make([]string, 0, len(ss))
+		for _, s := range ss[:min(len(ss), adminStatementsLimit)] {
+			lines = append(lines, statementText(s, l))
+		}
+		return strings.Join(lines, "\n\n"), nil
+
+	case "assign":
+		if len(aa) != 4 {
+			return usage, nil
+		}
+		p, err := billing.ParsePeriod(aa[3])
+		if err != nil {
+			return usage, err
+		}
+		pm, err := g.assignPayment(aa[1], aa[2], p, actor)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("payment %s %s of %s is assigned to plot %s for %s", pm.ID, pm.Amount, pm.Date, pm.Plot,
+			pm.Period), nil
+
+	case "assign_charge":
+		if len(aa) != 5 {
+			return usage, nil
+		}
+		pm, err := g.assignCharge(aa[1], aa[2], aa[3], aa[4], actor)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("payment %s %s of %s is assigned to %s due %s of plot %s", pm.PaymentID, pm.Amount, pm.Date,
+			pm.Charge, pm.Due, pm.Plot), nil
+
+	case "charges":
+		if len(aa) == 1 {
+			return g.chargesConfigText(), nil
+		}
+		if len(aa) != 2 {
+			return usage, nil
+		}
+		cc := g.plotPayments(aa[1], time.Now())
+		if len(cc) == 0 {
+			return "no payments of plot " + aa[1], nil
+		}
+		return chargesText(cc), nil
+
+	case "remind_charges":
+		return g.remindCharges(time.Now()), nil
+	}
+	return usage, nil
+}
+
+func billText(b *billing.Bill) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s plot %s", b.Period, b.Plot)
+	if b.HasReading {
+		fmt.Fprintf(&sb, ": %s - %s = %s kWh, losses %s kWh, price %.2f, coef %.2f%%, total %s",
+			billing.FormatKWh(b.Curr), billing.FormatKWh(b.Prev), billing.FormatKWh(b.Spent),
+			billing.FormatKWh(b.Losses), b.Price, b.Coef, b.Total)
+	} else {
+		sb.WriteString(": no reading")
+	}
+	fmt.Fprintf(&sb, "\nprevious debt %s, paid %s", b.PrevDebt, b.Paid)
+	if b.Debt < 0 {
+		fmt.Fprintf(&sb, ", prepaid %s", b.Prepayment())
+	} else {
+		fmt.Fprintf(&sb, ", debt %s", b.Debt)
+	}
+	return sb.String()
+}
@@ -0,0 +1,97 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/config"
+	"7stgbot/gate"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const electr202403 = `N,FIO,prepaid,last_payment_date,plot_number,curr_evidence,curr_evidence2,prev_evidence,spent,losses,spent_amount,losses_amount,total,prev_debt,curr_debt,qr_url,bot_url
+1,Иванов,100,2024-03-03,12,1100,,1000,100,10,500,50,550,200,650,,
+2,Петров,,,7,510,,500,10,1,50,5,55,,999,,
+`
+
+func TestImportElectr(t *testing.T) {
+	g, _ := newAdminGate(t)
+	g.ElectrDir = t.TempDir()
+	g.cfg.Store(&config.Config{AdminPhone: "79990000009",
+		Price: map[string]float64{"202401": 5}, Coef: map[string]float64{"202401": 10}})
+	p := billing.Period{Year: 2024, Month: 3}
+	if _, _, ok := g.electrBill(p, "12"); ok {
+		t.Fatal("got a bill without the file")
+	}
+	if err := os.WriteFile(filepath.Join(g.ElectrDir, "electr_2024-03.csv"), []byte(electr202403), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		plot     string
+		debt     billing.Money
+		mismatch bool
+	}{
+		{"12", 65000, false},
+		{"7", 5500, true},
+	}
+	for _, tt := range tests {
+		b, mismatch, ok := g.electrBill(p, tt.plot)
+		if !ok || b.Debt != tt.debt || mismatch != tt.mismatch {
+			t.Errorf("plot %s: got %+v %v %v, want debt %v mismatch %v", tt.plot, b, mismatch, ok, tt.debt, tt.mismatch)
+		}
+	}
+
+	// readings and payments survive a restart
+	g.loadBilling()
+	got, err := g.handleBillingCommand("/7_billing", "bill 12 2024-03", "test")
+	if err != nil || !strings.Contains(got, "1100 - 1000 = 100 kWh") || !strings.Contains(got, "debt 650.00") {
+		t.Errorf("got %q %v, want the bill of plot 12", got, err)
+	}
+	got, err = g.handleBillingCommand("/7_billing", "import 2024-03", "test")
+	if err != nil || !strings.Contains(got, "imported 2 rows") || !strings.Contains(got, "plot 7 curr_debt") {
+		t.Errorf("got %q %v, want the re-import with the mismatch", got, err)
+	}
+}
+
+func TestPurposeNoDebt(t *testing.T) {
+	g, _ := newAdminGate(t)
+	g.ElectrDir = t.TempDir()
+	g.cfg.Store(&config.Config{AdminPhone: "79990000009", Price: map[string]float64{"202401": 5}})
+	march := billing.Period{Year: 2024, Month: 3}
+	g.updateLedger(func(l *billing.Ledger) ([]gate.Entity, error) {
+		for _, r := range []billing.Reading{
+			{Plot: "12", Period: march.Prev(), Value: 1000}, {Plot: "12", Period: march, Value: 1100},
+			{Plot: "7", Period: march.Prev(), Value: 500}, {Plot: "7", Period: march, Value: 500},
+		} {
+			l.PutReading(r)
+		}
+		return nil, l.PutPayment(billing.Payment{ID: "p1", Plot: "12", Period: march, Amount: 60000})
+	})
+	ws := &webSrv{gate: g}
+	ws.webCfg.Store(newWebConfig(testQR, "", nil, nil))
+	tests := []struct {
+		plot, want string
+	}{
+		{"12", "нет задолженности, переплата 100.00"},
+		{"7", "нет задолженности"},
+	}
+	for _, tt := range tests {
+		if purpose, sum, ok := ws.purpose("2024", "03", tt.plot); ok || sum != 0 || string(purpose) != tt.want {
+			t.Errorf("plot %s: got %q %v %v, want %q", tt.plot, purpose, sum, ok, tt.want)
+		}
+	}
+	rec := httptest.NewRecorder()
+	ws.handleQRCImg(rec, httptest.NewRequest("GET", qrcImgPath+"?yyyy=2024&mm=03&n=12&h="+sha1Hash("2024", "03", "12"), nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("got %v %d bytes, want no QR of the prepaid bill", rec.Code, rec.Body.Len())
+	}
+	rec = httptest.NewRecorder()
+	ws.handleQRImg(rec, httptest.NewRequest("GET", "/qr?sum=-100", nil))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got %v, want a negative sum refused", rec.Code)
+	}
+}
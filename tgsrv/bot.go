@@ -2,13 +2,16 @@ package tgsrv
 
 import (
 	cfg "7stgbot/config"
+	"7stgbot/telegram"
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"go.uber.org/zap"
 )
 
@@ -19,26 +22,14 @@ const (
 	tgBotCommandSearch             = "7s_search"
 	tgBotCommandQR                 = "qr"
 	tgBotCommandSMS                = "sms"
+	tgBotCommandRole               = "role"
 )
 
 var Logger *zap.SugaredLogger
 var AtomicLevel zap.AtomicLevel
 
-var numericKeyboard = tgbotapi.NewReplyKeyboard(
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton("1"),
-		tgbotapi.NewKeyboardButton("2"),
-		tgbotapi.NewKeyboardButton("3"),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton("4"),
-		tgbotapi.NewKeyboardButton("5"),
-		tgbotapi.NewKeyboardButton("6"),
-	),
-)
-
 type TGBot struct {
-	bot            *tgbotapi.BotAPI
+	bot            telegram.Bot
 	abort          chan struct{}
 	ws             *webSrv
 	emailClient    *EmailClient
@@ -50,6 +41,9 @@ type TGBot struct {
 	adminPhone     string
 }
 
+// tgCallbacks handle clicks on inline buttons by the prefix of the data "<prefix>:<args>"
+var tgCallbacks = map[string]func(b *TGBot, ctx context.Context, q *telegram.CallbackQuery, args string){}
+
 func RunBot(token string, abort chan struct{}, ws *webSrv, emailClient *EmailClient, iftttKey string,
 	adminPhone string, adminEmails []string, SMSRateLimiter []cfg.Rate, db *sql.DB) error {
 
@@ -65,12 +59,28 @@ func RunBot(token string, abort chan struct{}, ws *webSrv, emailClient *EmailCli
 	if err != nil {
 		return err
 	}
-	b.bot, err = tgbotapi.NewBotAPI(token)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-abort
+		cancel()
+	}()
+	client := telegram.NewClient(token)
+	if client.HTTP, err = ws.gate.telegramHTTP(); err != nil {
+		return err
+	}
+	b.bot = client
+	ws.gate.setTelegram(client)
+	me, err := client.GetMe(ctx)
+	if err != nil {
+		return err
+	}
+	Logger.Infof("authorized on account %s", me.Username)
+
+	updater, err := b.updater(ctx, client)
 	if err != nil {
 		return err
 	}
-	b.bot.Debug = true
-	Logger.Infof("authorized on account %s", b.bot.Self.UserName)
 
 	go b.smsSenderLoop()
 
@@ -81,74 +91,115 @@ func RunBot(token string, abort chan struct{}, ws *webSrv, emailClient *EmailCli
 	}
 	b.sms(adminPhone, startedMsg)
 
-	b.run()
-	return nil
+	return updater.Run(ctx, b.handleUpdate)
 }
 
-func (b *TGBot) run() {
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := b.bot.GetUpdatesChan(u)
-Loop:
-	for {
-		select {
-		case update, ok := <-updates:
-			if !ok {
-				break Loop
-			}
-			if update.Message == nil { // ignore non-Message updates
-				continue
-			}
-			Logger.Debugf("BOT: chatID=%d cmd=%q %q", update.Message.Chat.ID, update.Message.Command(),
-				update.Message.Text)
+// updater receives updates by the webhook of config TgWebhookURL on the web server, by long polling otherwise
+func (b *TGBot) updater(ctx context.Context, client *telegram.Client) (telegram.Updater, error) {
+	c := b.ws.gate.config()
+	if c.TgWebhookURL == "" {
+		return &telegram.Poller{Client: client}, nil
+	}
+	secret := c.TgWebhookSecret
+	if secret == "" {
+		key := make([]byte, 16)
+		rand.Read(key)
+		secret = hex.EncodeToString(key)
+	}
+	b.ws.tgWebhook.SetSecret(secret)
+	if err := client.SetWebhook(ctx, c.TgWebhookURL, secret); err != nil {
+		return nil, err
+	}
+	Logger.Infof("tg bot webhook %s", c.TgWebhookURL)
+	return &b.ws.tgWebhook, nil
+}
 
-			if update.Message.Location != nil {
-				l := update.Message.Location
-				Logger.Debugf("BOT: chatID=%d %.7f %.7f", update.Message.Chat.ID, l.Latitude, l.Longitude)
-			}
+func (b *TGBot) handleUpdate(ctx context.Context, u *telegram.Update) {
+	if q := u.CallbackQuery; q != nil {
+		b.handleCallback(ctx, q)
+		return
+	}
+	m := u.Message
+	if m == nil {
+		return
+	}
+	Logger.Debugf("BOT: chatID=%d cmd=%q %q", m.Chat.ID, m.Command(), m.Text)
+	if l := m.Location; l != nil {
+		Logger.Debugf("BOT: chatID=%d %.7f %.7f", m.Chat.ID, l.Latitude, l.Longitude)
+	}
 
-			command := update.Message.Command()
-			text := ""
-			i := strings.Index(update.Message.Text, " ")
-			if i > 0 {
-				text = strings.TrimSpace(update.Message.Text[i+1:])
-			}
-			switch command {
-			case "7s_electr":
-				b.handleElectr(update)
-			case "open":
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, update.Message.Text)
-				msg.ReplyMarkup = numericKeyboard
-				b.sendMessage(msg)
-			case "close":
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, update.Message.Text)
-				msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-				b.sendMessage(msg)
-			case "start":
-				b.handleStart(update)
-			case tgBotCommandQR:
-				b.handleQR(update)
-			case tgBotCommandSMS:
-				{
-					b.handleSMS(text)
-				}
-			case tgBotCommandAllSendElectr:
-				b.handleSendElectrToAllTGSub(update)
-			case tgBotCommandSmsAllWithoutEmail:
-				b.smsAllWithoutEmail(update, text)
-			case tgBotCommandSearch:
-				b.search(update, text)
-			default:
-				Logger.Debugf("BOT: unknown command %s  %q", command, update.Message.Text)
+	if m.Contact != nil {
+		b.handleContact(ctx, m)
+		return
+	}
+	command := m.Command()
+	text := m.CommandArgs()
+	switch command {
+	case "7s_electr":
+		b.handleElectr(ctx, m)
+	case "open":
+		b.handleOpen(ctx, m)
+	case "close":
+		b.sendMessage(ctx, m.Chat.ID, m.Text, &telegram.ReplyKeyboardRemove{RemoveKeyboard: true})
+	case "code":
+		b.handleCode(ctx, m)
+	case "link":
+		b.handleLink(ctx, m)
+	case "unlink":
+		b.handleUnlink(ctx, m)
+	case "reading":
+		b.handleReading(ctx, m)
+	case "pay":
+		b.handlePay(ctx, m)
+	case "totp_auth":
+		b.handleTOTPAuth(ctx, m, text)
+	case tgBotCommandRole:
+		if b.authorizedActor(ctx, m.Chat.ID, PermAdmin, tgBotCommandRole) {
+			res, err := b.ws.gate.handleRoleCommand("/"+tgBotCommandRole, text, fmt.Sprintf("tg:%d", m.Chat.ID))
+			if err != nil {
+				res = strings.TrimSpace(fmt.Sprintf("%s\nerror: %v", res, err))
 			}
-		case <-b.abort:
-			break Loop
+			b.sendMessage(ctx, m.Chat.ID, res, nil)
+		}
+	case "start":
+		b.handleStart(ctx, m)
+	case tgBotCommandQR:
+		b.handleQR(ctx, m)
+	case tgBotCommandSMS:
+		if b.authorizedActor(ctx, m.Chat.ID, PermAdmin, tgBotCommandSMS) {
+			b.handleSMS(text)
 		}
+	case tgBotCommandAllSendElectr:
+		b.handleSendElectrToAllTGSub(ctx, m)
+	case tgBotCommandSmsAllWithoutEmail:
+		b.smsAllWithoutEmail(ctx, m, text)
+	case tgBotCommandSearch:
+		b.search(ctx, m, text)
+	default:
+		Logger.Debugf("BOT: unknown command %s  %q", command, m.Text)
 	}
 }
 
-func (b *TGBot) handleElectr(update tgbotapi.Update) {
-	args := strings.Fields(update.Message.Text)
+func (b *TGBot) handleCallback(ctx context.Context, q *telegram.CallbackQuery) {
+	Logger.Debugf("BOT: callback userID=%d %q", q.From.ID, q.Data)
+	prefix, args, _ := strings.Cut(q.Data, ":")
+	h := tgCallbacks[prefix]
+	if h == nil || q.Message == nil {
+		b.answer(ctx, q, "кнопка устарела")
+		return
+	}
+	h(b, ctx, q, args)
+}
+
+// answer stops the progress of the button, the text is shown if not empty
+func (b *TGBot) answer(ctx context.Context, q *telegram.CallbackQuery, text string) {
+	if err := b.bot.AnswerCallbackQuery(ctx, q.ID, text); err != nil {
+		Logger.Errorf("error answering callback %q %v", q.Data, err)
+	}
+}
+
+func (b *TGBot) handleElectr(ctx context.Context, m *telegram.Message) {
+	args := strings.Fields(m.Text)
 	i := 0
 	var d, n string
 	for _, arg := range args {
@@ -165,60 +216,52 @@ func (b *TGBot) handleElectr(update tgbotapi.Update) {
 		i++
 	}
 	if i != 3 {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"передайте дату в формате ггггмм и номер уч-ка")
-		b.sendMessage(msg)
+		b.sendMessage(ctx, m.Chat.ID, "передайте дату в формате ггггмм и номер уч-ка", nil)
 		return
 	}
 	if len(d) < 6 {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			"передайте дату в формате ггггмм и номер уч-ка")
-		b.sendMessage(msg)
+		b.sendMessage(ctx, m.Chat.ID, "передайте дату в формате ггггмм и номер уч-ка", nil)
 		return
 	}
 	d = d[:6]
 	if d < "202201" || d > "2055012" {
 		mtxt := fmt.Sprintf("%s не является датой", d)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, mtxt)
-		b.sendMessage(msg)
+		b.sendMessage(ctx, m.Chat.ID, mtxt, nil)
 		return
 	}
 	email := b.ws.registry.Load().(*Registry).getEmailByPlotNumber(n)
 	if len(email) == 0 {
 		mtxt := "email не найден. Сообщите email для внесения в реестр садоводов."
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, mtxt)
-		b.sendMessage(msg)
+		b.sendMessage(ctx, m.Chat.ID, mtxt, nil)
 		return
 	}
 	y, err := strconv.Atoi(d[:4])
 	if err != nil {
 		mtxt := fmt.Sprintf("%s %v", d[:4], err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, mtxt)
-		b.sendMessage(msg)
+		b.sendMessage(ctx, m.Chat.ID, mtxt, nil)
 		return
 	}
-	m, err := strconv.Atoi(d[4:6])
+	mon, err := strconv.Atoi(d[4:6])
 	if err != nil {
 		mtxt := fmt.Sprintf("%s %v", d[4:6], err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, mtxt)
-		b.sendMessage(msg)
+		b.sendMessage(ctx, m.Chat.ID, mtxt, nil)
 		return
 	}
 	if b.emailClient != nil {
-		qrurl := QRURLInt(y, m, n)
+		qrurl := QRURLInt(y, mon, n)
 		b.emailClient.sendEmail(email, "QR link", qrurl)
 		Logger.Infof("sent email: %s %s", email, qrurl)
 		mtxt := "ссылка на QR-код вам отправлена в письме"
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, mtxt)
-		b.sendMessage(msg)
+		b.sendMessage(ctx, m.Chat.ID, mtxt, nil)
 	}
 }
 
 // https://t.me/snt7s_bot?start=xxxxxxxx
-func (b *TGBot) handleStart(u tgbotapi.Update) {
-	Logger.Debugf("/START chatID: %d %q", u.Message.Chat.ID, u.Message.Text)
-	args := strings.Fields(u.Message.Text)
+func (b *TGBot) handleStart(ctx context.Context, m *telegram.Message) {
+	Logger.Debugf("/START chatID: %d %q", m.Chat.ID, m.Text)
+	args := strings.Fields(m.Text)
 	if len(args) < 2 {
+		b.sendMessage(ctx, m.Chat.ID, tgHelp, nil)
 		return
 	}
 	key := args[1]
@@ -232,48 +275,52 @@ func (b *TGBot) handleStart(u tgbotapi.Update) {
 	}
 	user := User{
 		Email:     email,
-		ChatID:    u.Message.Chat.ID,
+		ChatID:    m.Chat.ID,
 		CreatedAt: time.Now().Unix()}
 
 	err = b.users.Insert(user)
 	if err != nil {
 		Logger.Errorf("error inserting user %s %d %v", user.Email, user.ChatID, err)
 	}
-	msg := tgbotapi.NewMessage(u.Message.Chat.ID, "Вы успешно подписаны!\n/qr - QR-код для оплаты электричества за предыдущий месяц")
-	b.sendMessage(msg)
+	b.sendMessage(ctx, m.Chat.ID, "Вы успешно подписаны!\n/qr - QR-код для оплаты электричества за предыдущий месяц", nil)
 }
 
-func (b *TGBot) sendMessage(msg tgbotapi.MessageConfig) {
-	if _, err := b.bot.Send(msg); err != nil {
-		Logger.Errorf("error sending to chat %d %q %v", msg.ChatID, msg.Text, err)
+// sendMessage sends the text, markup is one of telegram keyboards or nil
+func (b *TGBot) sendMessage(ctx context.Context, chatID int64, text string, markup any) *telegram.Message {
+	m, err := b.bot.SendMessage(ctx, &telegram.SendMessageParams{ChatID: chatID, Text: text, ReplyMarkup: markup})
+	if err != nil {
+		Logger.Errorf("error sending to chat %d %q %v", chatID, text, err)
+		return nil
 	}
+	return m
 }
 
-func (b *TGBot) handleSendElectrToAllTGSub(u tgbotapi.Update) {
-	if !b.authorizedActor(u.Message.Chat.ID, tgBotCommandAllSendElectr) {
+func (b *TGBot) handleSendElectrToAllTGSub(ctx context.Context, m *telegram.Message) {
+	if !b.authorizedActor(ctx, m.Chat.ID, PermRegistry, tgBotCommandAllSendElectr) {
 		return
 	}
 	users, err := b.users.List()
 	if err != nil {
 		Logger.Errorf("users.List(): %v", err)
 	}
-	y, m, _ := time.Now().In(Location).AddDate(0, -1, 0).Date()
-	mtxt := ([]string{"янв", "фев", "мар", "апр", "май", "июн", "июл", "авг", "мен", "окт", "ноя", "дек"})[m-1]
+	y, mon, _ := time.Now().In(Location).AddDate(0, -1, 0).Date()
+	mtxt := ([]string{"янв", "фев", "мар", "апр", "май", "июн", "июл", "авг", "мен", "окт", "ноя", "дек"})[mon-1]
 	for _, user := range users {
 		//Logger.Infof("%s %d", u.Email, u.ChatID)
 		plotNumbers := b.ws.FindByEmailPrefix(user.Email)
 		for pn := range plotNumbers {
-			url := QRURL(fmt.Sprintf("%d", y), fmt.Sprintf("%02d", int(m)), pn)
-			msg := tgbotapi.NewMessage(user.ChatID,
-				fmt.Sprintf("Ссылка на QR-кол для оплаты эл-ва за %s %d\n%s", mtxt, y, url))
+			url := QRURL(fmt.Sprintf("%d", y), fmt.Sprintf("%02d", int(mon)), pn)
 			Logger.Debugf("SEND: email: %s chatID: %d %q", user.Email, user.ChatID, url)
-			b.sendMessage(msg)
+			b.sendMessage(ctx, user.ChatID, fmt.Sprintf("Ссылка на QR-кол для оплаты эл-ва за %s %d\n%s", mtxt, y, url), nil)
+			if cc := b.ws.gate.plotCharges(pn, time.Now()); len(cc) != 0 {
+				b.sendMessage(ctx, user.ChatID, "Взносы к оплате:\n"+chargesText(cc), nil)
+			}
 		}
 	}
 }
 
-func (b *TGBot) smsAllWithoutEmail(u tgbotapi.Update, text string) {
-	if !b.authorizedActor(u.Message.Chat.ID, tgBotCommandSmsAllWithoutEmail) {
+func (b *TGBot) smsAllWithoutEmail(ctx context.Context, m *telegram.Message, text string) {
+	if !b.authorizedActor(ctx, m.Chat.ID, PermRegistry, tgBotCommandSmsAllWithoutEmail) {
 		return
 	}
 	if len(text) == 0 {
@@ -302,8 +349,8 @@ func (b *TGBot) smsAllWithoutEmail(u tgbotapi.Update, text string) {
 	}
 }
 
-func (b *TGBot) search(u tgbotapi.Update, text string) {
-	if !b.authorizedActor(u.Message.Chat.ID, tgBotCommandSearch) {
+func (b *TGBot) search(ctx context.Context, m *telegram.Message, text string) {
+	if !b.authorizedActor(ctx, m.Chat.ID, PermRegistry, tgBotCommandSearch) {
 		return
 	}
 	var rr []string
@@ -342,43 +389,48 @@ func (b *TGBot) search(u tgbotapi.Update, text string) {
 	if more > 0 {
 		mtxt += fmt.Sprintf("\n"+"  and %d more ...", more)
 	}
-	msg := tgbotapi.NewMessage(u.Message.Chat.ID, mtxt)
-	b.sendMessage(msg)
+	b.sendMessage(ctx, m.Chat.ID, mtxt, nil)
 }
 
-func (b *TGBot) authorizedActor(chatID int64, cmd string) bool {
-	actor := b.users.user(chatID)
-	if actor == nil {
-		Logger.Warnw("ACCESS DENIED: %s chatID %d", cmd, chatID)
-		msg := tgbotapi.NewMessage(chatID, "У вас нет прав")
-		b.sendMessage(msg)
-		return false
-	}
-	for _, email := range b.adminEmails {
-		if email == actor.Email {
-			return true
+// principal of the chat, the email is of the subscription by /start
+func (b *TGBot) principal(chatID int64) *Principal {
+	p := &Principal{ChatID: chatID}
+	if b.users != nil {
+		if u := b.users.user(chatID); u != nil {
+			p.Email = u.Email
 		}
 	}
+	return b.ws.gate.resolvePrincipal(p)
+}
+
+func (b *TGBot) authorizedActor(ctx context.Context, chatID int64, perm Permission, cmd string) bool {
+	if b.ws.gate.authorize(b.principal(chatID), perm, "telegram: "+cmd) {
+		return true
+	}
+	Logger.Warnf("ACCESS DENIED: %s chatID %d", cmd, chatID)
+	b.sendMessage(ctx, chatID, "У вас нет прав", nil)
 	return false
 }
 
-func (b *TGBot) handleQR(u tgbotapi.Update) {
+func (b *TGBot) handleQR(ctx context.Context, m *telegram.Message) {
 	users, err := b.users.List()
 	if err != nil {
 		Logger.Errorf("users.List(): %v", err)
 	}
-	chatID := u.Message.Chat.ID
-	y, m, _ := time.Now().In(Location).AddDate(0, -1, 0).Date()
+	chatID := m.Chat.ID
+	y, mon, _ := time.Now().In(Location).AddDate(0, -1, 0).Date()
 	for _, user := range users {
 		if user.ChatID == chatID {
 			plotNumbers := b.ws.FindByEmailPrefix(user.Email)
 			var urls []string
 			for pn := range plotNumbers {
-				urls = append(urls, QRURL(fmt.Sprintf("%d", y), fmt.Sprintf("%02d", int(m)), pn))
+				urls = append(urls, QRURL(fmt.Sprintf("%d", y), fmt.Sprintf("%02d", int(mon)), pn))
+				if cc := b.ws.gate.plotCharges(pn, time.Now()); len(cc) != 0 {
+					urls = append(urls, chargesText(cc))
+				}
 			}
-			msg := tgbotapi.NewMessage(chatID, strings.Join(urls, "\n"))
 			Logger.Debugf("QR: %s chatID: %d %s", user.Email, chatID, strings.Join(urls, " "))
-			b.sendMessage(msg)
+			b.sendMessage(ctx, chatID, strings.Join(urls, "\n"), nil)
 			return
 		}
 	}
@@ -1,7 +1,17 @@
 package tgsrv
 
 import (
+	"7stgbot/config"
+	"7stgbot/telegram"
+	"7stgbot/telegram/telegramtest"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPhoneRE(t *testing.T) {
@@ -22,3 +32,119 @@ func TestPhoneRE(t *testing.T) {
 		}
 	}
 }
+
+// waitMessages waits for n messages in the chat of the fake server
+func waitMessages(t *testing.T, srv *telegramtest.Server, chatID int64, n int) []telegram.Message {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if mm := srv.Messages(chatID); len(mm) >= n {
+			return mm
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got %d messages, want %d", len(srv.Messages(chatID)), n)
+	return nil
+}
+
+func TestBotUpdates(t *testing.T) {
+	t.Chdir(t.TempDir())
+	users, err := NewUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := telegramtest.NewServer("123:tk")
+	defer srv.Close()
+	var g Gate
+	g.Init(&config.Config{}, nil)
+	b := &TGBot{bot: srv.Client(), users: users, ws: &webSrv{gate: &g}}
+
+	tgCallbacks["test"] = func(b *TGBot, ctx context.Context, q *telegram.CallbackQuery, args string) {
+		b.bot.EditMessageText(ctx, &telegram.EditMessageTextParams{ChatID: q.Message.Chat.ID, MessageID: q.Message.MessageID, Text: "done " + args})
+		b.answer(ctx, q, "")
+	}
+	defer delete(tgCallbacks, "test")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() {
+		p := &telegram.Poller{Client: srv.Client(), Timeout: time.Second}
+		done <- p.Run(ctx, b.handleUpdate)
+	}()
+
+	srv.Push(telegramtest.TextUpdate(7, "/start "+encodeEmailAndMD5("ivan@example.com")))
+	if got, want := waitMessages(t, srv, 7, 1)[0].Text, "Вы успешно подписаны!"; !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if u := users.user(7); u == nil || u.Email != "ivan@example.com" {
+		t.Errorf("got %+v, want subscribed user", u)
+	}
+	srv.Push(telegramtest.TextUpdate(8, "/7s_search ivan"))
+	if got, want := waitMessages(t, srv, 8, 1)[0].Text, "У вас нет прав"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	m := b.sendMessage(ctx, 7, "?", &telegram.InlineKeyboardMarkup{InlineKeyboard: [][]telegram.InlineKeyboardButton{
+		{{Text: "ok", CallbackData: "test:1"}, {Text: "old", CallbackData: "gone:1"}},
+	}})
+	srv.Push(telegramtest.CallbackUpdate(m, "gone:1"))
+	srv.Push(telegramtest.CallbackUpdate(m, "test:1"))
+	for i := 0; len(srv.Answers()) < 2; i++ {
+		if i == 200 {
+			t.Fatal("callbacks are not answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.Answers(); got[0] != "кнопка устарела" || got[1] != "" {
+		t.Errorf("got %q, want [кнопка устарела, \"\"]", got)
+	}
+	if got := srv.Messages(7); got[1].Text != "done 1" || got[1].ReplyMarkup != nil {
+		t.Errorf("got %+v, want edited message", got[1])
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBotWebhook(t *testing.T) {
+	srv := telegramtest.NewServer("123:tk")
+	defer srv.Close()
+	var g Gate
+	g.Init(&config.Config{TgWebhookURL: "https://example.com/tg/webhook", TgWebhookSecret: "s"}, nil)
+	ws := &webSrv{gate: &g}
+	b := &TGBot{bot: srv.Client(), ws: ws}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	updater, err := b.updater(ctx, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.Webhook(), "https://example.com/tg/webhook"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	done := make(chan error)
+	go func() { done <- updater.Run(ctx, b.handleUpdate) }()
+
+	data, _ := json.Marshal(telegramtest.TextUpdate(7, "/close"))
+	for i := 0; ; i++ {
+		r := httptest.NewRequest("POST", "/tg/webhook", bytes.NewReader(data))
+		r.Header.Set("X-Telegram-Bot-Api-Secret-Token", "s")
+		rec := httptest.NewRecorder()
+		ws.tgWebhook.ServeHTTP(rec, r)
+		if rec.Code == http.StatusOK {
+			break
+		}
+		if i == 200 {
+			t.Fatalf("got %v, want %v", rec.Code, http.StatusOK)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := waitMessages(t, srv, 7, 1)[0].Text; got != "/close" {
+		t.Errorf("got %q, want /close", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,246 @@
+package tgsrv
+
+import (
+	"7stgbot/calendar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const calendarKeepOpenKey = "g.calendarKeepOpen.b"
+
+// calendarKeepOpenState follows keep open exceptions of the calendar. The gate is kept open at the start
+// of an exception unless it is kept open already, only the keep open started by the calendar ends with it.
+type calendarKeepOpenState struct {
+	window bool // an exception was active on the last tick
+	owned  bool // the keep open is started by the calendar, calendarKeepOpenKey
+}
+
+// tick returns whether to begin or to end the keep open by the exception active now
+func (c *calendarKeepOpenState) tick(active, inOpenedState bool) (begin, end bool) {
+	if active == c.window {
+		return false, false
+	}
+	c.window = active
+	switch {
+	case active && !inOpenedState:
+		c.owned = true
+		return true, false
+	case !active && c.owned:
+		c.owned = false
+		return false, inOpenedState
+	}
+	return false, false
+}
+
+// GateCalendar stores the calendar as one entity
+type GateCalendar struct {
+	calendar.Calendar
+}
+
+func (c *GateCalendar) Type() string { return "Calendar" }
+func (c *GateCalendar) ID() string   { return "gate" }
+func (c *GateCalendar) MarshalData() (string, error) {
+	bb, err := json.Marshal(&c.Calendar)
+	return string(bb), err
+}
+func (c *GateCalendar) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), &c.Calendar)
+}
+
+func (g *Gate) loadCalendar() {
+	var c GateCalendar
+	if _, err := g.Entities.Load(&c); err != nil {
+		Logger.Errorf("loading calendar: %v", err)
+	}
+	g.cal.Store(&c.Calendar)
+}
+
+func (g *Gate) calendar() *calendar.Calendar {
+	if c := g.cal.Load(); c != nil {
+		return c
+	}
+	return &calendar.Calendar{}
+}
+
+// updateCalendar changes a copy of the calendar and stores it
+func (g *Gate) updateCalendar(update func(c *calendar.Calendar) error) error {
+	g.calMu.Lock()
+	defer g.calMu.Unlock()
+	c := GateCalendar{Calendar: *g.calendar().Clone()}
+	if err := update(&c.Calendar); err != nil {
+		return err
+	}
+	if ok, _ := g.Entities.Load(&GateCalendar{}); ok {
+		if err := g.Entities.Update(&c); err != nil {
+			return err
+		}
+	} else if err := g.Entities.Insert(&c); err != nil {
+		return err
+	}
+	g.cal.Store(&c.Calendar)
+	return nil
+}
+
+// calendarPeriod returns minutes of the timer or BLE schedule, calendar exceptions override sch
+func (g *Gate) calendarPeriod(sch *OpenSchedule, t time.Time, ble bool) int {
+	day := g.calendar().On(t)
+	m := day.Schedule
+	if ble {
+		m = day.BLESchedule
+	}
+	if len(m) != 0 {
+		return NewOpenSchedule(m).period(t)
+	}
+	return sch.period(t)
+}
+
+func (g *Gate) handleCalendarCommand(cmd string, args string) (string, error) {
+	usage := fmt.Sprintf("usage: %s [add <%s> <2006-01-02>[/<2006-01-02>] [08:00-18:00] <name> | "+
+		"timer <id> [\"07:00\":10,...] | ble_timer <id> [\"07:00\":10,...] | del <id> | import <ics url> | ical]",
+		cmd, strings.Join(kindNames(), "|"))
+	aa := strings.Fields(args)
+	if len(aa) == 0 {
+		var sb strings.Builder
+		for i, e := range g.calendar().Upcoming(time.Now()) {
+			if i != 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(e.String())
+		}
+		if sb.Len() == 0 {
+			return "no upcoming exceptions", nil
+		}
+		return sb.String(), nil
+	}
+	switch aa[0] {
+	case "add":
+		if len(aa) < 4 {
+			return usage, nil
+		}
+		e := &calendar.Exception{ID: generateRandomID(6), Kind: calendar.Kind(aa[1])}
+		e.Start, e.End, _ = strings.Cut(aa[2], "/")
+		name := aa[3:]
+		if from, to, ok := strings.Cut(name[0], "-"); ok && strings.Contains(from, ":") {
+			e.TimeFrom, e.TimeTo = from, to
+			name = name[1:]
+		}
+		e.Name = strings.Join(name, " ")
+		if e.Name == "" {
+			return usage, nil
+		}
+		if err := g.updateCalendar(func(c *calendar.Calendar) error { return c.Put(e) }); err != nil {
+			return "", err
+		}
+		return "added " + e.String(), nil
+
+	case "timer", "ble_timer":
+		if len(aa) < 2 {
+			return usage, nil
+		}
+		var sch map[string]int
+		if s := strings.TrimSpace(strings.Join(aa[2:], "")); s != "" {
+			if err := json.Unmarshal([]byte("{"+s+"}"), &sch); err != nil {
+				return usage, err
+			}
+		}
+		var res string
+		err := g.updateCalendar(func(c *calendar.Calendar) error {
+			old := c.Get(aa[1])
+			if old == nil {
+				return ErrNotFound
+			}
+			e := *old
+			if aa[0] == "timer" {
+				e.Schedule = sch
+			} else {
+				e.BLESchedule = sch
+			}
+			res = e.String()
+			return c.Put(&e)
+		})
+		if err != nil {
+			return "", err
+		}
+		return "updated " + res, nil
+
+	case "del":
+		if len(aa) != 2 {
+			return usage, nil
+		}
+		err := g.updateCalendar(func(c *calendar.Calendar) error {
+			if !c.Delete(aa[1]) {
+				return ErrNotFound
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		return "deleted", nil
+
+	case "import":
+		if len(aa) != 2 {
+			return usage, nil
+		}
+		n, err := g.importCalendar(aa[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("imported %d exceptions", n), nil
+
+	case "ical":
+		return g.url("/gate/calendar.ics"), nil
+	}
+	return usage, nil
+}
+
+func kindNames() []string {
+	var res []string
+	for _, k := range calendar.Kinds {
+		res = append(res, string(k))
+	}
+	return res
+}
+
+// importCalendar adds events of iCalendar by url, events with the same UID are replaced
+func (g *Gate) importCalendar(url string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s http %d", url, resp.StatusCode)
+	}
+	ee, err := calendar.ReadICal(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	err = g.updateCalendar(func(c *calendar.Calendar) error {
+		for _, e := range ee {
+			if err := c.Put(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(ee), err
+}
+
+func (ws *webSrv) handleCalendarICS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="gate.ics"`)
+	if err := ws.gateOf(r).calendar().WriteICal(w); err != nil {
+		Logger.Errorf("writing calendar: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/notify"
+	"7stgbot/paymentqr"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+func (g *Gate) config() *config.Config {
+	if c := g.cfg.Load(); c != nil {
+		return c
+	}
+	return &config.Config{}
+}
+
+// ReloadConfig loads the config and applies it to every gate, the site part is published to cfgSub.
+// A bad config is rejected, everything keeps running with the current one. Gates added or removed are applied after restart.
+func (gg Gates) ReloadConfig(path string, cfgSub *config.ConfigSubscription) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		gg[0].notify(eventConfig, notify.Warning, fmt.Sprintf("%s is rejected, fix it or next start will fail:\n%v", path, err))
+		return err
+	}
+	// additional gates inherit top level secrets as in main
+	ApplyConfigSecrets(cfg)
+	var ids []string
+	for _, c := range cfg.GateConfigs() {
+		ids = append(ids, c.GateID)
+		ApplyConfigSecrets(c)
+		if g := gg.Find(c.GateID); g != nil {
+			g.applyConfig(path, c)
+		} else if c.GatePath == "" {
+			// the top level gate is renamed
+			gg[0].applyConfig(path, c)
+		}
+	}
+	for _, g := range gg {
+		if !slices.Contains(ids, g.ID) && g.config().GatePath != "" {
+			g.sendSystemNotification(fmt.Sprintf("gate %s is removed from %s, it is stopped after restart", g.ID, path))
+		}
+	}
+	cfgSub.Publish(gg[0].config())
+	return nil
+}
+
+// applyConfig publishes the config to the loops of the gate with the diff sent to the system channel
+func (g *Gate) applyConfig(path string, cfg *config.Config) {
+	old := g.config()
+	diff := config.Diff(old, cfg)
+	if cfg.GateID != old.GateID && old.GateID != "" {
+		diff = append(diff, "GateID is applied after restart")
+		cfg.GateID, cfg.GatePath = old.GateID, old.GatePath
+	}
+	g.cfg.Store(cfg)
+	g.cfgSub.Publish(cfg)
+	g.configureNotify(cfg)
+	g.warnAccessConfig(cfg)
+	if len(diff) == 0 {
+		Logger.Infof("%s is reloaded, no changes", path)
+		return
+	}
+	msg := fmt.Sprintf("%s is reloaded:\n%s", path, strings.Join(diff, "\n"))
+	Logger.Info(msg)
+	g.notify(eventConfig, notify.Info, msg)
+}
+
+// webConfig is a part of config used by web handlers, replaced on config reload
+type webConfig struct {
+	priceHist  valueDates
+	coefHist   valueDates
+	qr         paymentqr.Payment // requisites of the payee
+	qrEncoding paymentqr.Encoding
+}
+
+func newWebConfig(qr map[string]string, qrEncoding string, price, coef map[string]float64) *webConfig {
+	c := &webConfig{}
+	var err1, err2 error
+	c.qr, err1 = paymentqr.FromMap(qr)
+	c.qrEncoding, err2 = paymentqr.ParseEncoding(qrEncoding)
+	if err := errors.Join(err1, err2); err != nil {
+		Logger.Errorf("QR config: %v", err)
+	}
+	(&c.priceHist).fromMap(price)
+	(&c.coefHist).fromMap(coef)
+	return c
+}
+
+func (s *webSrv) followConfig(abort <-chan struct{}, cfgSub <-chan *config.Config) {
+	for {
+		select {
+		case cfg := <-cfgSub:
+			s.webCfg.Store(newWebConfig(cfg.QR, cfg.QREncoding, cfg.Price, cfg.Coef))
+		case <-abort:
+			return
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/config"
+	"7stgbot/gate"
+	"7stgbot/notify"
+	"7stgbot/telegram"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Взносы, целевые сборы, штрафы и пропуска настраиваются в [Charges] конфига: сумма участка, сроки и шаблон
+// назначения платежа. Ссылки на QR-коды подписаны так же, как ссылки на счета за электроэнергию.
+
+const (
+	paramNameCharge = "c"
+	paramNameDue    = "d"
+
+	chargeElectricity = "electricity"
+	chargeGraceDays   = 30 // a charge is shown the days after the due date
+	chargeRemindDays  = 14 // owners are reminded the days before the due date
+)
+
+// PlotCharge is a payment of the plot due by the date with the signed link to the QR code
+type PlotCharge struct {
+	Charge  string // id of the charge of the config or electricity
+	Name    string
+	Plot    string
+	Due     string        `json:",omitempty"` // 2006-01-02
+	Amount  billing.Money // left to pay
+	Paid    billing.Money `json:",omitempty"`
+	Purpose string        `json:",omitempty"`
+	URL     string
+}
+
+// ChargePayment is a credit of a bank statement paying the charge of the plot due by the date,
+// the ID is the payment id of the credit
+type ChargePayment struct {
+	PaymentID string
+	Charge    string
+	Due       string
+	Plot      string
+	Date      string
+	Amount    billing.Money
+	Payer     string `json:",omitempty"`
+	Purpose   string `json:",omitempty"`
+	By        string `json:",omitempty"` // assigned by hand
+}
+
+func (e *ChargePayment) Type() string { return "ChargePayment" }
+func (e *ChargePayment) ID() string   { return e.PaymentID }
+func (e *ChargePayment) MarshalData() (string, error) {
+	bb, err := json.Marshal(e)
+	return string(bb), err
+}
+func (e *ChargePayment) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), e)
+}
+
+func newChargePayment(u *billing.Unmatched, c *PlotCharge, by string) *ChargePayment {
+	return &ChargePayment{PaymentID: u.ID, Charge: c.Charge, Due: c.Due, Plot: c.Plot, Date: u.Date, Amount: u.Amount,
+		Payer: u.Payer, Purpose: u.Purpose, By: by}
+}
+
+func chargeKey(charge, due, plot string) string { return charge + "/" + due + "/" + plot }
+
+// chargesPaid returns sums paid by charge/due/plot and purposes of charge payments by ids
+func (g *Gate) chargesPaid() (map[string]billing.Money, map[string]string) {
+	data, err := g.Entities.List((&ChargePayment{}).Type())
+	if err != nil {
+		Logger.Errorf("loading charge payments: %v", err)
+	}
+	paid, ids := make(map[string]billing.Money), make(map[string]string)
+	for id, d := range data {
+		var pm ChargePayment
+		if err := pm.UnmarshalData(d); err != nil {
+			Logger.Errorf("charge payment %s: %v", id, err)
+			continue
+		}
+		paid[chargeKey(pm.Charge, pm.Due, pm.Plot)] += pm.Amount
+		ids[id] = pm.Purpose
+	}
+	return paid, ids
+}
+
+func ChargeURL(charge, due, plotNumber string) string {
+	params := url.Values{}
+	params.Add(paramNameCharge, charge)
+	params.Add(paramNameDue, due)
+	params.Add(paramNameNumber, plotNumber)
+	params.Add(paramNameHash, sha1Hash("charge", charge, due, plotNumber))
+	return site + qrPath + "?" + params.Encode()
+}
+
+func checkChargeHash(charge, due, plotNumber, hash string) bool {
+	if charge == "" || due == "" || plotNumber == "" || hash == "" {
+		return false
+	}
+	for _, salt := range Secrets.Values(secretQRSalt) {
+		if hash == sha1HashSalt(salt, "charge", charge, due, plotNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+// plotCharge returns the charge of the plot due by the date, false if the plot is not charged.
+// The amount of a paid charge is 0.
+func (g *Gate) plotCharge(id, due, plot string) (*PlotCharge, bool) {
+	paid, _ := g.chargesPaid()
+	return g.plotChargePaid(id, due, plot, paid)
+}
+
+func (g *Gate) plotChargePaid(id, due, plot string, paid map[string]billing.Money) (*PlotCharge, bool) {
+	ch, ok := g.config().Charges[id]
+	if !ok || !slices.Contains(ch.Due, due) {
+		return nil, false
+	}
+	amount := billing.Rubles(ch.PlotAmount(plot))
+	d, err := time.Parse(time.DateOnly, due)
+	if amount <= 0 || err != nil {
+		return nil, false
+	}
+	purpose := strings.NewReplacer(
+		"{name}", ch.Name,
+		"{plot}", plot,
+		"{due}", d.Format("02.01.2006"),
+		"{year}", strconv.Itoa(d.Year()),
+		"{sum}", amount.String(),
+	).Replace(cmp.Or(ch.Purpose, config.DefaultChargePurpose))
+	c := &PlotCharge{Charge: id, Name: ch.Name, Plot: plot, Due: due, Amount: amount, Purpose: purpose,
+		URL: ChargeURL(id, due, plot)}
+	c.Paid = min(paid[chargeKey(id, due, plot)], amount)
+	c.Amount -= c.Paid
+	return c, true
+}
+
+// plotCharges returns unpaid charges of the plot by the nearest due date passed not more than chargeGraceDays ago
+func (g *Gate) plotCharges(plot string, now time.Time) []PlotCharge {
+	paid, _ := g.chargesPaid()
+	return g.plotChargesPaid(plot, now, paid)
+}
+
+func (g *Gate) plotChargesPaid(plot string, now time.Time, paid map[string]billing.Money) []PlotCharge {
+	cc := g.config().Charges
+	since := now.In(Location).AddDate(0, 0, -chargeGraceDays).Format(time.DateOnly)
+	var res []PlotCharge
+	for _, id := range slices.Sorted(maps.Keys(cc)) {
+		for _, due := range slices.Sorted(slices.Values(cc[id].Due)) {
+			if due < since {
+				continue
+			}
+			if c, ok := g.plotChargePaid(id, due, plot, paid); ok && c.Amount > 0 {
+				res = append(res, *c)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// normalizePurpose makes purposes of QR codes and of bank statements comparable
+func normalizePurpose(s string) string {
+	s = strings.NewReplacer("|", "/", "ё", "е").Replace(strings.ToLower(s))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// containsPurpose is true if s contains the purpose not followed by a digit, участок 1 is not участок 12
+func containsPurpose(s, purpose string) bool {
+	for i := strings.Index(s, purpose); i >= 0; {
+		rest := s[i+len(purpose):]
+		if rest == "" || rest[0] < '0' || rest[0] > '9' {
+			return true
+		}
+		j := strings.Index(rest, purpose)
+		if j < 0 {
+			break
+		}
+		i += len(purpose) + j
+	}
+	return false
+}
+
+// matchCharges returns charge payments of credits with the purpose of a charge of a plot
+func (g *Gate) matchCharges(uu []billing.Unmatched) map[string]*PlotCharge {
+	res := make(map[string]*PlotCharge)
+	if len(g.config().Charges) == 0 || len(uu) == 0 {
+		return res
+	}
+	purposes := make(map[string]*PlotCharge)
+	for _, plot := range g.billingPlots() {
+		for id, ch := range g.config().Charges {
+			for _, due := range ch.Due {
+				if c, ok := g.plotChargePaid(id, due, plot, nil); ok {
+					purposes[normalizePurpose(c.Purpose)] = c
+				}
+			}
+		}
+	}
+	for _, u := range uu {
+		purpose := normalizePurpose(u.Purpose)
+		for p, c := range purposes {
+			if containsPurpose(purpose, p) {
+				res[u.ID] = c
+				break
+			}
+		}
+	}
+	return res
+}
+
+// reconcileCharges moves credits of the statement with purposes of charges from unmatched to charges,
+// credits added before are known
+func (g *Gate) reconcileCharges(s *BankStatement) []gate.Entity {
+	_, ids := g.chargesPaid()
+	matched := g.matchCharges(s.Unmatched)
+	var ee []gate.Entity
+	s.Unmatched = slices.DeleteFunc(s.Unmatched, func(u billing.Unmatched) bool {
+		if purpose, ok := ids[u.ID]; ok {
+			if purpose == u.Purpose {
+				s.KnownCharges++
+			} else {
+				s.Duplicates = append(s.Duplicates, billing.Unmatched{Transaction: u.Transaction, ID: u.ID,
+					Reason: "same reference, date and amount as the charge payment: " + purpose})
+			}
+			return true
+		}
+		c, ok := matched[u.ID]
+		if ok {
+			pm := newChargePayment(&u, c, "")
+			s.Charges = append(s.Charges, *pm)
+			ee = append(ee, pm)
+		}
+		return ok
+	})
+	return ee
+}
+
+// assignCharge adds the unmatched credit of a statement as the payment of the charge of the plot
+func (g *Gate) assignCharge(id, charge, due, plot, by string) (*ChargePayment, error) {
+	c, ok := g.plotCharge(charge, due, plot)
+	if !ok {
+		return nil, adminBadRequest("plot %s is not charged %s due %s", plot, charge, due)
+	}
+	for _, s := range g.bankStatements() {
+		i := slices.IndexFunc(s.Unmatched, func(u billing.Unmatched) bool { return u.ID == id })
+		if i < 0 {
+			continue
+		}
+		pm := newChargePayment(&s.Unmatched[i], c, by)
+		err := g.updateLedger(func(*billing.Ledger) ([]gate.Entity, error) {
+			s.Unmatched = slices.Delete(s.Unmatched, i, i+1)
+			s.Charges = append(s.Charges, *pm)
+			return []gate.Entity{pm, s}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		g.sendSystemNotification(fmt.Sprintf("payment %s %s of %s assigned to %s of plot %s due %s by %s", pm.PaymentID,
+			pm.Amount, pm.Date, charge, plot, due, by))
+		g.notifyChargePayment(pm)
+		return pm, nil
+	}
+	return nil, ErrNotFound
+}
+
+// notifyChargePayment sends owners of the plot the payment received and the amount left
+func (g *Gate) notifyChargePayment(pm *ChargePayment) {
+	c, ok := g.plotCharge(pm.Charge, pm.Due, pm.Plot)
+	if !ok {
+		return
+	}
+	text := fmt.Sprintf("Получен платёж %s ₽: %s участка %s", pm.Amount, c.Name, pm.Plot)
+	text += If(c.Amount > 0, ", осталось оплатить "+c.Amount.String()+" ₽.", ", оплачено полностью.")
+	for _, phone := range g.plotOwners(pm.Plot) {
+		g.notifyResident(phone, text)
+	}
+}
+
+// plotPayments returns the electricity debt of the previous month and charges of the plot
+func (g *Gate) plotPayments(plot string, now time.Time) []PlotCharge {
+	now = now.In(Location)
+	p := billing.Period{Year: now.Year(), Month: int(now.Month())}.Prev()
+	var res []PlotCharge
+	if b, _, ok := g.electrBill(p, plot); ok && b.Debt > 0 {
+		res = append(res, PlotCharge{Charge: chargeElectricity, Name: "Электроэнергия за " + p.String(), Plot: plot,
+			Amount: b.Debt, URL: QRURLInt(p.Year, p.Month, plot)})
+	}
+	return append(res, g.plotCharges(plot, now)...)
+}
+
+// billingPlots returns plots of the ledger and of the register
+func (g *Gate) billingPlots() []string {
+	plots := make(map[string]bool)
+	for _, plot := range g.ledger().Plots() {
+		plots[plot] = true
+	}
+	for phone := range g.Phones {
+		for _, plot := range g.phonePlots(phone) {
+			plots[plot] = true
+		}
+	}
+	return slices.SortedFunc(maps.Keys(plots), billing.ComparePlots)
+}
+
+// chargesText is the list of payments for residents
+func chargesText(cc []PlotCharge) string {
+	lines := make([]string, 0, len(cc))
+	for _, c := range cc {
+		line := fmt.Sprintf("Участок %s: %s %s ₽", c.Plot, c.Name, c.Amount)
+		if c.Due != "" {
+			d, _ := time.Parse(time.DateOnly, c.Due)
+			line += " до " + d.Format("02.01.2006")
+		}
+		lines = append(lines, line+"\n"+c.URL)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// remindCharges sends owners of plots links of charges due in chargeRemindDays or overdue, the report is published
+func (g *Gate) remindCharges(now time.Time) string {
+	until := now.In(Location).AddDate(0, 0, chargeRemindDays).Format(time.DateOnly)
+	paid, _ := g.chargesPaid()
+	plots, reminded := 0, 0
+	for _, plot := range g.billingPlots() {
+		cc := slices.DeleteFunc(g.plotChargesPaid(plot, now, paid), func(c PlotCharge) bool { return c.Due > until })
+		if len(cc) == 0 {
+			continue
+		}
+		plots++
+		text := "Напоминание об оплате:\n" + chargesText(cc)
+		for _, phone := range g.plotOwners(plot) {
+			g.notifyResident(phone, text)
+			reminded++
+		}
+	}
+	res := fmt.Sprintf("charges due by %s of %d plots, %d owners reminded", until, plots, reminded)
+	g.notify(eventReadings, notify.Info, res)
+	return res
+}
+
+// chargesConfigText lists charges of the config for the board
+func (g *Gate) chargesConfigText() string {
+	cc := g.config().Charges
+	if len(cc) == 0 {
+		return "no charges configured"
+	}
+	var lines []string
+	for _, id := range slices.Sorted(maps.Keys(cc)) {
+		ch := cc[id]
+		line := fmt.Sprintf("%s %s: %s, due %s", id, ch.Name, billing.Rubles(ch.Amount), strings.Join(ch.Due, ", "))
+		if len(ch.Plots) != 0 {
+			line += fmt.Sprintf(", %d plots differ", len(ch.Plots))
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// queryCharge returns the charge of the signed link
+func (s *webSrv) queryCharge(query url.Values) (*PlotCharge, bool) {
+	charge, due, number := query.Get(paramNameCharge), query.Get(paramNameDue), query.Get(paramNameNumber)
+	if !checkChargeHash(charge, due, number, query.Get(paramNameHash)) {
+		return nil, false
+	}
+	return s.gate.plotCharge(charge, due, number)
+}
+
+func chargePurpose(c *PlotCharge) template.HTML {
+	return template.HTML(template.HTMLEscapeString(c.Purpose + " :: " + c.Amount.String()))
+}
+
+func (b *ChatBroker) handleCharges(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.ownerPhone(w, r)
+	if !ok {
+		return
+	}
+	cc := []PlotCharge{}
+	for _, plot := range b.g.phonePlots(phone) {
+		cc = append(cc, b.g.plotPayments(plot, time.Now())...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cc)
+}
+
+// handlePay sends links of payments of plots of the linked phone
+func (b *TGBot) handlePay(ctx context.Context, m *telegram.Message) {
+	if !b.privateChat(ctx, m) {
+		return
+	}
+	g := b.ws.gate
+	u, err := g.TelegramUsers.Find(m.Chat.ID)
+	if err != nil {
+		Logger.Errorf("error finding telegram chat %d: %v", m.Chat.ID, err)
+		b.sendMessage(ctx, m.Chat.ID, "внутренняя ошибка", nil)
+		return
+	}
+	if u == nil {
+		b.sendMessage(ctx, m.Chat.ID, tgLinkHint, nil)
+		return
+	}
+	plots := g.phonePlots(u.Phone)
+	if len(plots) == 0 {
+		b.sendMessage(ctx, m.Chat.ID, "Участки не найдены в реестре. Обратитесь в правление.", nil)
+		return
+	}
+	var cc []PlotCharge
+	for _, plot := range plots {
+		cc = append(cc, g.plotPayments(plot, time.Now())...)
+	}
+	if len(cc) == 0 {
+		b.sendMessage(ctx, m.Chat.ID, "Начислений к оплате нет.", nil)
+		return
+	}
+	b.sendMessage(ctx, m.Chat.ID, chargesText(cc), nil)
+}
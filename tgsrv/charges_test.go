@@ -0,0 +1,193 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/config"
+	"7stgbot/telegram"
+	"7stgbot/telegram/telegramtest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func storeCharges(g *Gate, cc map[string]config.ChargeConfig) {
+	cfg := *g.config()
+	cfg.Charges = cc
+	g.cfg.Store(&cfg)
+}
+
+func TestPlotCharges(t *testing.T) {
+	g, _ := newAdminGate(t)
+	storeCharges(g, map[string]config.ChargeConfig{
+		"membership": {Name: "Членский взнос", Amount: 6000, Due: []string{"2024-12-31", "2024-06-30"}},
+		"road": {Name: "Целевой взнос", Amount: 1500, Plots: map[string]float64{"7": 0}, Due: []string{"2024-05-01"},
+			Purpose: "Целевой взнос на дорогу {year}, участок {plot}, {sum}"},
+	})
+	tests := []struct {
+		plot string
+		now  time.Time
+		want []string
+	}{
+		{"12", time.Date(2024, 4, 20, 12, 0, 0, 0, Location), []string{"membership 2024-06-30", "road 2024-05-01"}},
+		{"12", time.Date(2024, 5, 31, 12, 0, 0, 0, Location), []string{"membership 2024-06-30", "road 2024-05-01"}},
+		{"12", time.Date(2024, 6, 1, 12, 0, 0, 0, Location), []string{"membership 2024-06-30"}},
+		{"12", time.Date(2024, 8, 1, 12, 0, 0, 0, Location), []string{"membership 2024-12-31"}},
+		{"12", time.Date(2025, 2, 1, 12, 0, 0, 0, Location), nil},
+		{"7", time.Date(2024, 4, 20, 12, 0, 0, 0, Location), []string{"membership 2024-06-30"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, c := range g.plotCharges(tt.plot, tt.now) {
+			got = append(got, c.Charge+" "+c.Due)
+		}
+		if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("%s %s: got %v, want %v", tt.plot, tt.now.Format(time.DateOnly), got, tt.want)
+		}
+	}
+
+	c, ok := g.plotCharge("road", "2024-05-01", "12")
+	if !ok || c.Amount != 150000 || c.Purpose != "Целевой взнос на дорогу 2024, участок 12, 1500.00" {
+		t.Fatalf("got %+v, want the road charge of plot 12", c)
+	}
+	if c, _ := g.plotCharge("membership", "2024-06-30", "12"); c.Purpose != "Членский взнос, срок 30.06.2024, участок 12" {
+		t.Errorf("got %q, want the default purpose", c.Purpose)
+	}
+
+	s := &webSrv{gate: g}
+	u, _ := url.Parse(c.URL)
+	if got, ok := s.queryCharge(u.Query()); !ok || *got != *c {
+		t.Errorf("got %+v, want %+v", got, c)
+	}
+	for _, k := range []string{paramNameCharge, paramNameDue, paramNameNumber} {
+		q := u.Query()
+		q.Set(k, q.Get(k)+"1")
+		if _, ok := s.queryCharge(q); ok {
+			t.Errorf("%s: got the charge of a tampered link", k)
+		}
+	}
+	if _, ok := g.plotCharge("road", "2024-05-01", "7"); ok {
+		t.Error("got the road charge of plot 7, want not charged")
+	}
+}
+
+func TestChargesHTTP(t *testing.T) {
+	g, _ := newAdminGate(t)
+	due := time.Now().In(Location).AddDate(0, 0, 10).Format(time.DateOnly)
+	storeCharges(g, map[string]config.ChargeConfig{"pass": {Name: "Пропуск", Amount: 300, Due: []string{due}}})
+	br := &ChatBroker{g: g}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /gate/app/charges", br.handleCharges)
+
+	if w := adminRequest(mux, "GET", "/gate/app/charges", "admin", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("got %v, want forbidden without plots", w.Code)
+	}
+	w := adminRequest(mux, "GET", "/gate/app/charges", "resident", "", "")
+	if !strings.Contains(w.Body.String(), `"Charge":"pass"`) || !strings.Contains(w.Body.String(), `"Amount":30000`) {
+		t.Fatalf("got %v %s, want the pass charge of plot 12", w.Code, w.Body)
+	}
+
+	c, _ := g.plotCharge("pass", due, "12")
+	u, _ := url.Parse(c.URL)
+	s := &webSrv{gate: g}
+	s.webCfg.Store(newWebConfig(testQR, "", nil, nil))
+	rec := httptest.NewRecorder()
+	s.handleQRCImg(rec, httptest.NewRequest("GET", qrcImgPath+"?"+u.RawQuery, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("got %v %s, want the QR image", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	s.handleQRCImg(rec, httptest.NewRequest("GET", qrcImgPath+"?"+strings.Replace(u.RawQuery, "n=12", "n=13", 1), nil))
+	if rec.Body.Len() != 0 {
+		t.Errorf("got %d bytes, want no image of a tampered link", rec.Body.Len())
+	}
+}
+
+func TestTelegramCharges(t *testing.T) {
+	g, b, srv := newTelegramGate(t)
+	ctx := t.Context()
+	send := func(u telegram.Update) {
+		b.handleUpdate(ctx, &u)
+	}
+	now := time.Now().In(Location)
+	soon, later := now.AddDate(0, 0, 7).Format(time.DateOnly), now.AddDate(0, 2, 0).Format(time.DateOnly)
+	storeCharges(g, map[string]config.ChargeConfig{
+		"membership": {Name: "Членский взнос", Amount: 6000, Due: []string{soon}},
+		"fine":       {Name: "Штраф", Amount: 1000, Due: []string{later}},
+	})
+
+	send(telegramtest.TextUpdate(7, "/pay"))
+	waitText(t, srv, 7, 0, tgLinkHint)
+	g.linkTelegram(7, "79990000001", "test")
+	send(telegramtest.TextUpdate(7, "/pay"))
+	waitText(t, srv, 7, 1, "Участок 12: Штраф 1000.00 ₽")
+
+	got, err := g.handleBillingCommand("/7_billing", "remind_charges", "test")
+	if err != nil || !strings.Contains(got, "of 1 plots, 2 owners reminded") {
+		t.Errorf("got %q %v, want plot 12 reminded", got, err)
+	}
+	waitText(t, srv, 7, 2, "Напоминание об оплате:\nУчасток 12: Членский взнос 6000.00 ₽")
+
+	got, _ = g.handleBillingCommand("/7_billing", "charges", "test")
+	if got != "fine Штраф: 1000.00, due "+later+"\nmembership Членский взнос: 6000.00, due "+soon {
+		t.Errorf("got %q, want both charges", got)
+	}
+}
+
+const chargesCSV = `Дата;Номер;Плательщик;Приход;Расход;Назначение платежа
+03.06.2024;21;Иванов;6000,00;;Членский взнос, срок 30.06.2024, участок 12 НДС не облагается
+03.06.2024;22;Иванов;1000,00;;Взнос на дорогу
+03.06.2024;23;Петров;6000,00;;Членский взнос, срок 30.06.2024, участок 1
+`
+
+func TestChargePayments(t *testing.T) {
+	g, admin := newAdminGate(t)
+	storeCharges(g, map[string]config.ChargeConfig{
+		"membership": {Name: "Членский взнос", Amount: 6000, Due: []string{"2024-06-30"}},
+		"road":       {Name: "Целевой взнос", Amount: 1500, Due: []string{"2024-06-30"}},
+	})
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, Location)
+	if got := g.plotCharges("12", now); len(got) != 2 {
+		t.Fatalf("got %+v, want both charges", got)
+	}
+
+	s, err := g.importStatement("june.csv", []byte(chargesCSV), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Charges) != 1 || s.Charges[0].Plot != "12" || s.Charges[0].Charge != "membership" || len(s.Unmatched) != 2 {
+		t.Fatalf("got %+v, want the membership of plot 12 paid, plot 1 is unknown", s)
+	}
+	i := slices.IndexFunc(s.Unmatched, func(u billing.Unmatched) bool { return u.Purpose == "Взнос на дорогу" })
+	w := adminRequest(admin, "POST", "/gate/admin/api/payments/"+s.Unmatched[i].ID+"/charge", "admin",
+		"application/x-www-form-urlencoded", "plot=12&charge=road&due=2024-06-30")
+	if w.Code != http.StatusOK && w.Code != http.StatusSeeOther {
+		t.Fatalf("got %v %s, want assigned", w.Code, w.Body)
+	}
+
+	got := g.plotCharges("12", now)
+	if len(got) != 1 || got[0].Charge != "road" || got[0].Amount != 50000 || got[0].Paid != 100000 {
+		t.Errorf("got %+v, want 500.00 of the road left", got)
+	}
+	if res := g.remindCharges(now.AddDate(0, 0, 20)); !strings.Contains(res, "of 1 plots") {
+		t.Errorf("got %q, want the road reminded only", res)
+	}
+	c, _ := g.plotCharge("membership", "2024-06-30", "12")
+	u, _ := url.Parse(c.URL)
+	rec := httptest.NewRecorder()
+	(&webSrv{gate: g}).handleQRCImg(rec, httptest.NewRequest("GET", qrcImgPath+"?"+u.RawQuery, nil))
+	if c.Amount != 0 || rec.Body.Len() != 0 {
+		t.Errorf("got %+v %d bytes, want no QR of a paid charge", c, rec.Body.Len())
+	}
+
+	s, _ = g.importStatement("june-again.csv", []byte(chargesCSV+"\n"), "test")
+	if len(s.Charges) != 0 || s.KnownCharges != 2 || len(s.Unmatched) != 1 {
+		t.Errorf("got %+v, want charge payments known", s)
+	}
+	if got := containsPurpose("членский взнос, участок 12", "членский взнос, участок 1"); got {
+		t.Errorf("got %v, want plot 1 not matching plot 12", got)
+	}
+}
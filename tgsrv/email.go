@@ -16,6 +16,13 @@ func NewEmailClient(username string, password string, from string) *EmailClient
 }
 
 func (c *EmailClient) sendEmail(email string, subject string, body string) {
+	if err := c.send(email, subject, body); err != nil {
+		log.Printf("error sending email smtp.gmail.com:587 phone: %q sms: %q username: %q, %v",
+			subject, body, c.username, err)
+	}
+}
+
+func (c *EmailClient) send(email string, subject string, body string) error {
 	msg := gomail.NewMessage()
 	//msg.SetHeader("From", "mizzgan+ifttt@gmail.com")
 	msg.SetHeader("From", c.from)
@@ -29,8 +36,5 @@ func (c *EmailClient) sendEmail(email string, subject string, body string) {
 	n := gomail.NewDialer("smtp.gmail.com", 587, c.username, c.password)
 
 	// Send the email
-	if err := n.DialAndSend(msg); err != nil {
-		log.Printf("error sending email smtp.gmail.com:587 phone: %q sms: %q username: %q, %v",
-			subject, body, c.username, err)
-	}
+	return n.DialAndSend(msg)
 }
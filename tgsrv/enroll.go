@@ -0,0 +1,271 @@
+package tgsrv
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enrolment: a resident taps "register my device" at the gate, the devices seen by the gate ESP32 and the router
+// in the window are the candidates, the chosen one is added as a pending auto-open entry of the resident.
+
+const (
+	enrollWindow   = 3 * time.Minute  // sightings after the start which are candidates
+	enrollTTL      = 10 * time.Minute // the enrolment is forgotten after
+	sightingMaxAge = 10 * time.Minute
+)
+
+const (
+	sightingBT   = "bt"
+	sightingWiFi = "wifi"
+)
+
+// A stable identity of a BLE device with a resolvable private address, see bleKey. A service UUID is shared
+// by all devices of a make or of an app and is never an identity.
+var bleIdentityRE = regexp.MustCompile(`^IBEACON:[0-9A-F]{32}:\d+:\d+$`)
+
+// deviceSighting is a BLE advertisement or a WiFi join seen at the gate
+type deviceSighting struct {
+	Kind     string // bt or wifi
+	Key      string // MAC or the stable identity of a rotating BLE address
+	MAC      string
+	Name     string `json:",omitempty"` // BLE name or WiFi hostname
+	RSSI     int    `json:",omitempty"`
+	Rotating bool   `json:",omitempty"` // rotating BLE address without a stable identity, it is not enrolled
+	New      bool   `json:",omitempty"` // was not seen before the enrolment started
+	First    time.Time
+	Last     time.Time
+}
+
+// signal is RSSI, WiFi joins have no RSSI and go after BLE devices
+func (d *deviceSighting) signal() int {
+	return If(d.RSSI == 0, math.MinInt, d.RSSI)
+}
+
+type deviceSightings struct {
+	mu         sync.Mutex
+	m          map[string]*deviceSighting // kind/key
+	enrolments map[string]time.Time       // phone -> start
+}
+
+func (s *deviceSightings) add(d deviceSighting) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]*deviceSighting)
+	}
+	id := d.Kind + "/" + d.Key
+	if old, ok := s.m[id]; ok && d.Last.Sub(old.Last) < sightingMaxAge {
+		d.First = old.First
+		d.Name = cmp.Or(d.Name, old.Name)
+	}
+	s.m[id] = &d
+	for k, v := range s.m {
+		if d.Last.Sub(v.Last) >= sightingMaxAge {
+			delete(s.m, k)
+		}
+	}
+}
+
+func (s *deviceSightings) addBLE(tt []*BLETracking, now time.Time) {
+	for _, bt := range tt {
+		key, rotating := bleKey(bt)
+		s.add(deviceSighting{Kind: sightingBT, Key: key, MAC: bt.MAC, Name: strings.TrimSpace(bt.Name), RSSI: bt.RSSI,
+			Rotating: rotating, First: now, Last: now})
+	}
+}
+
+func (s *deviceSightings) addWiFi(ci *NetworkClientInfo, now time.Time) {
+	mac := strings.ToLower(ci.MAC)
+	s.add(deviceSighting{Kind: sightingWiFi, Key: mac, MAC: mac, Name: ci.Hostname, First: now, Last: now})
+}
+
+// startEnrolment returns the end of the window
+func (s *deviceSightings) startEnrolment(phone string, now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enrolments == nil {
+		s.enrolments = make(map[string]time.Time)
+	}
+	for p, start := range s.enrolments {
+		if now.Sub(start) >= enrollTTL {
+			delete(s.enrolments, p)
+		}
+	}
+	s.enrolments[phone] = now
+	return now.Add(enrollWindow)
+}
+
+func (s *deviceSightings) endEnrolment(phone string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.enrolments, phone)
+}
+
+// candidates returns sightings of the window of the enrolment of the phone, new and near ones first
+func (s *deviceSightings) candidates(phone string, now time.Time) (time.Time, []deviceSighting, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start, ok := s.enrolments[phone]
+	if !ok || now.Sub(start) >= enrollTTL {
+		return time.Time{}, nil, false
+	}
+	until := start.Add(enrollWindow)
+	var res []deviceSighting
+	for _, d := range s.m {
+		if d.Last.Before(start) || d.Last.After(until) && d.First.After(until) {
+			continue
+		}
+		c := *d
+		c.New = !c.First.Before(start)
+		res = append(res, c)
+	}
+	slices.SortFunc(res, func(a, b deviceSighting) int {
+		if a.New != b.New {
+			return If(a.New, -1, 1)
+		}
+		return cmp.Or(cmp.Compare(b.signal(), a.signal()), cmp.Compare(a.Kind+a.Key, b.Kind+b.Key))
+	})
+	return until, res, true
+}
+
+// isRPA is true for a resolvable private address, phones rotate it every 15 minutes or so
+func isRPA(mac string) bool {
+	if !macAddrRE.MatchString(mac) {
+		return false
+	}
+	b, err := strconv.ParseUint(mac[:2], 16, 8)
+	return err == nil && b>>6 == 1
+}
+
+// bleKey is the upper case MAC or, for a resolvable private address, the iBeacon UUID, major and minor advertised
+// by the device. rotating is true if the address is private and no iBeacon is advertised.
+func bleKey(bt *BLETracking) (key string, rotating bool) {
+	if !isRPA(bt.MAC) {
+		return strings.ToUpper(bt.MAC), false
+	}
+	bt.initRawData()
+	if bt.RawData != nil && bt.RawData.IBeacon != nil {
+		b := bt.RawData.IBeacon
+		return strings.ToUpper(fmt.Sprintf("IBEACON:%s:%d:%d", b.UUID, b.Major, b.Minor)), false
+	}
+	return strings.ToUpper(bt.MAC), true
+}
+
+// enrollCandidates skips devices which already have access entries
+func (g *Gate) enrollCandidates(phone string, now time.Time) (time.Time, []deviceSighting, bool) {
+	until, dd, ok := g.sightings.candidates(phone, now)
+	a := g.access()
+	dd = slices.DeleteFunc(dd, func(d deviceSighting) bool {
+		kind, _ := ownDeviceKind(d.Kind)
+		_, own := a[kind][d.Key]
+		_, system := a[accessBTSystem][d.MAC]
+		return own || system || a.get(accessBTIgnore, d.MAC) != nil
+	})
+	return until, dd, ok
+}
+
+// enrollDevice adds the candidate as the pending device of the phone
+func (g *Gate) enrollDevice(phone, kind, key, label string) (*AccessEntry, error) {
+	_, dd, ok := g.enrollCandidates(phone, time.Now())
+	if !ok {
+		return nil, errEnrolmentNotStarted
+	}
+	i := slices.IndexFunc(dd, func(d deviceSighting) bool { return d.Kind == kind && d.Key == key })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	if dd[i].Rotating {
+		return nil, errRotatingAddress
+	}
+	accessKind, _ := ownDeviceKind(kind)
+	e, err := g.addOwnDevice(phone, accessKind, key, cmp.Or(label, dd[i].Name))
+	if err != nil {
+		return nil, err
+	}
+	g.sightings.endEnrolment(phone)
+	return e, nil
+}
+
+var (
+	errEnrolmentNotStarted = errors.New("enrolment is not started")
+	errRotatingAddress     = errors.New("rotating BLE address without a stable identity")
+)
+
+type EnrollState struct {
+	UntilMilli int64
+	Candidates []deviceSighting
+}
+
+func (b *ChatBroker) handleEnrollStart(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.devicesOwner(w, r)
+	if !ok {
+		return
+	}
+	until := b.g.sightings.startEnrolment(phone, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollState{UntilMilli: until.UnixMilli(), Candidates: []deviceSighting{}})
+}
+
+func (b *ChatBroker) handleEnrollCandidates(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.devicesOwner(w, r)
+	if !ok {
+		return
+	}
+	until, dd, ok := b.g.enrollCandidates(phone, time.Now())
+	if !ok {
+		http.Error(w, "регистрация устройства не начата", http.StatusNotFound)
+		return
+	}
+	if dd == nil {
+		dd = []deviceSighting{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnrollState{UntilMilli: until.UnixMilli(), Candidates: dd})
+}
+
+func (b *ChatBroker) handleEnrollConfirm(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.devicesOwner(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Kind  string `json:"kind"`
+		Key   string `json:"key"`
+		Label string `json:"label"`
+	}
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	e, err := b.g.enrollDevice(phone, req.Kind, req.Key, strings.TrimSpace(req.Label))
+	switch {
+	case errors.Is(err, errEnrolmentNotStarted):
+		http.Error(w, "регистрация устройства не начата", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "устройство не найдено, начните регистрацию заново", http.StatusNotFound)
+		return
+	case errors.Is(err, errRotatingAddress):
+		http.Error(w, "адрес устройства меняется, его нельзя добавить для автооткрытия", http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, errAccessExists):
+		http.Error(w, "устройство уже добавлено", http.StatusConflict)
+		return
+	case err != nil:
+		Logger.Errorf("enrolling device %s %s: %v", phone, req.Key, err)
+		http.Error(w, "внутренняя ошибка", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,119 @@
+package tgsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const iBeaconRaw = "0201061aff4c000215e2c56db5dffb48d2b060d0f5a71096e000010002c5"
+
+func TestBLEKey(t *testing.T) {
+	tests := []struct {
+		bt       BLETracking
+		want     string
+		rotating bool
+	}{
+		{BLETracking{MAC: "c4:7c:8d:6a:11:02"}, "C4:7C:8D:6A:11:02", false},
+		{BLETracking{MAC: "5B:00:DF:94:DD:1C"}, "5B:00:DF:94:DD:1C", true},
+		{BLETracking{MAC: "5B:00:DF:94:DD:1C", Raw: iBeaconRaw}, "IBEACON:E2C56DB5DFFB48D2B060D0F5A71096E0:1:2", false},
+		{BLETracking{MAC: "7A:00:DF:94:DD:1C", UUID: "0xfe2c"}, "7A:00:DF:94:DD:1C", true},
+	}
+	for _, tt := range tests {
+		got, rotating := bleKey(&tt.bt)
+		if got != tt.want || rotating != tt.rotating {
+			t.Errorf("%s: got %v %v, want %v %v", tt.bt.MAC, got, rotating, tt.want, tt.rotating)
+		}
+		if got != strings.ToUpper(tt.bt.MAC) && !bleIdentityRE.MatchString(got) {
+			t.Errorf("%s: identity %s is not accepted", tt.bt.MAC, got)
+		}
+	}
+}
+
+func TestEnrollCandidates(t *testing.T) {
+	var s deviceSightings
+	start := time.Now()
+	s.addBLE([]*BLETracking{{MAC: "C4:7C:8D:6A:11:01", RSSI: -80}}, start.Add(-time.Minute))
+	s.addBLE([]*BLETracking{{MAC: "C4:7C:8D:6A:11:01", RSSI: -80}}, start.Add(time.Second))
+	s.addBLE([]*BLETracking{{MAC: "C4:7C:8D:6A:11:02", RSSI: -90}}, start.Add(-time.Second))
+	if _, _, ok := s.candidates("79990000001", start); ok {
+		t.Error("got candidates, want not started")
+	}
+	s.startEnrolment("79990000001", start)
+	s.addBLE([]*BLETracking{{MAC: "C4:7C:8D:6A:11:03", RSSI: -95}, {MAC: "C4:7C:8D:6A:11:04", RSSI: -60}},
+		start.Add(time.Minute))
+	s.addWiFi(&NetworkClientInfo{MAC: "CE:09:55:75:33:1B", Hostname: "phone-ivan"}, start.Add(2*time.Minute))
+	s.addBLE([]*BLETracking{{MAC: "C4:7C:8D:6A:11:05", RSSI: -50}}, start.Add(enrollWindow+time.Second))
+
+	_, dd, ok := s.candidates("79990000001", start.Add(enrollWindow+time.Minute))
+	var got []string
+	for _, d := range dd {
+		got = append(got, d.Key)
+	}
+	want := []string{"C4:7C:8D:6A:11:04", "C4:7C:8D:6A:11:03", "ce:09:55:75:33:1b", "C4:7C:8D:6A:11:01"}
+	if !ok || len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+	if _, _, ok := s.candidates("79990000001", start.Add(enrollTTL)); ok {
+		t.Error("got candidates, want the enrolment forgotten")
+	}
+}
+
+func TestEnrollDevice(t *testing.T) {
+	g, _ := newAdminGate(t)
+	br := &ChatBroker{g: g}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /gate/app/enroll", br.handleEnrollStart)
+	mux.HandleFunc("GET /gate/app/enroll", br.handleEnrollCandidates)
+	mux.HandleFunc("POST /gate/app/enroll/confirm", br.handleEnrollConfirm)
+
+	if got := adminRequest(mux, "GET", "/gate/app/enroll", "resident", "", "").Code; got != http.StatusNotFound {
+		t.Errorf("got %v, want %v", got, http.StatusNotFound)
+	}
+	if got := adminRequest(mux, "POST", "/gate/app/enroll", "resident", "", "").Code; got != http.StatusOK {
+		t.Fatalf("got %v, want started", got)
+	}
+	g.saveAccess(&AccessEntry{Kind: accessBTIgnore, Key: "C4:7C:8D:6A:11:09"})
+	g.sightings.addBLE([]*BLETracking{{MAC: "5B:00:DF:94:DD:1C", Name: "iPhone", Raw: iBeaconRaw, RSSI: -50},
+		{MAC: "C4:7C:8D:6A:11:09"}, {MAC: "7A:00:DF:94:DD:1C", UUID: "0xfe2c", RSSI: -60}}, time.Now())
+
+	var state EnrollState
+	w := adminRequest(mux, "GET", "/gate/app/enroll", "resident", "", "")
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil || len(state.Candidates) != 2 || !state.Candidates[1].Rotating {
+		t.Fatalf("got %+v %v, want the beacon and the rotating address", state, err)
+	}
+	c := state.Candidates[0]
+	// a service UUID is shared by devices of a make, a rotating address is refused
+	if got := adminRequest(mux, "POST", "/gate/app/enroll/confirm", "resident", "",
+		`{"kind":"bt","key":"7A:00:DF:94:DD:1C"}`).Code; got != http.StatusUnprocessableEntity {
+		t.Errorf("got %v, want the rotating address refused", got)
+	}
+	if got := adminRequest(mux, "POST", "/gate/app/enroll/confirm", "resident", "",
+		`{"kind":"bt","key":"C4:7C:8D:6A:11:09"}`).Code; got != http.StatusNotFound {
+		t.Errorf("got %v, want an ignored device not found", got)
+	}
+	body, _ := json.Marshal(map[string]string{"kind": c.Kind, "key": c.Key})
+	if w := adminRequest(mux, "POST", "/gate/app/enroll/confirm", "resident", "", string(body)); w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want enrolled", w.Code, w.Body)
+	}
+	e := g.access()[accessBTAutoOpen][c.Key]
+	if e == nil || !e.Pending || e.Phone != "79990000001" || e.Label != "iPhone" {
+		t.Fatalf("got %+v, want pending device of the resident", e)
+	}
+	e.Pending = false
+	// the address rotates, the iBeacon stays
+	if got := g.access().bleAutoOpen(&BLETracking{MAC: "6D:11:22:33:44:55", Raw: iBeaconRaw}); got != e {
+		t.Errorf("got %+v, want the entry by the iBeacon", got)
+	}
+	if got := adminRequest(mux, "GET", "/gate/app/enroll", "resident", "", "").Code; got != http.StatusNotFound {
+		t.Errorf("got %v, want the enrolment ended", got)
+	}
+}
@@ -236,6 +236,9 @@ func ParseRawBLE(p string) (*BLEData, error) {
 				// Первые 2 байта — ID компании (Apple, Microsoft, Xiaomi и т.д.)
 				data.ManufacturerID = binary.LittleEndian.Uint16(adData[0:2])
 				data.ManufacturerData = adData[2:]
+				if data.ManufacturerID == 0x004C {
+					data.IBeacon = ParseIBeacon(data.ManufacturerData)
+				}
 			}
 
 		case DataTypeFlags:
@@ -1,21 +1,22 @@
 package tgsrv
 
 import (
+	"7stgbot/billing"
+	"7stgbot/calendar"
 	"7stgbot/config"
 	"7stgbot/gate"
-	"bytes"
+	"7stgbot/jobs"
+	"7stgbot/notify"
+	"7stgbot/pales"
 	"cmp"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	crand "crypto/rand"
-	"crypto/sha1"
 	"database/sql"
-	"encoding/base32"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/csv"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,10 +34,6 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/AnthonyHewins/gotfy"
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
 )
 
 const (
@@ -46,6 +43,9 @@ const (
 	bleScheduleKey     = "g.bleSchedule"
 	badKeysKey         = "g.badKeys"
 	minCodeLenKey      = "g.minCodeLen.i"
+	accessImportedKey  = "g.accessImported.b"
+
+	defaultPalesDeviceID = "4G600215575"
 )
 
 type GateCommand int
@@ -65,12 +65,30 @@ type GateCommandAndText struct {
 	text               string
 	systemNotification string
 	args               any
+	done               chan error // result of Open if not nil: nil if opened, errGateKeptOpen, errGateLocked or relay error
+}
+
+var (
+	errGateKeptOpen = errors.New("gate is kept open")
+	errGateLocked   = errors.New("gate is locked")
+)
+
+// reply sends the result to the waiting sender, it never blocks the gate loop
+func (c *GateCommandAndText) reply(err error) {
+	if c.done == nil {
+		return
+	}
+	select {
+	case c.done <- err:
+	default:
+	}
 }
 
 type Gate struct {
+	ID                     string
 	Phones                 map[string]*PalESUser
-	RestrictedPhones       map[string]bool
-	Cfg                    *config.Config
+	cfg                    atomic.Pointer[config.Config] // replaced on config reload
+	cfgSub                 config.ConfigSubscription     // loops of the gate follow its config
 	TelegramUrl            string
 	TelegramChatId         string
 	TelegramTimeoutSec     int
@@ -80,18 +98,32 @@ type Gate struct {
 	bleTrackings           chan []*BLETracking
 	wifiClients            chan any
 	openedEvets            chan OpenTime
-	PalesPortalUser        string
-	PalesPortalPwd         string
-	PalesTokenFilename     string
-	PalESPortalUserToken   atomic.Value
+	Pales                  *pales.Client
+	palesPlan              atomic.Pointer[pales.Plan]
 	CfgDir                 string
 	palesLastLog           *PalesLogUser
 	lastOpenedNotification time.Time
 	lastOpenCommandTime    atomic.Int64
 	lastOpenedTime         atomic.Int64
+	keptOpen               atomic.Bool  // state of the gate loop for the admin console
+	lockedUntil            atomic.Int64 // unix milli, 0 - not locked
+	journal                eventJournal
+	accessEntries          atomic.Pointer[accessEntries]
+	accessMu               sync.Mutex // serializes changes of access entries
+	sightings              deviceSightings
+	billing                atomic.Pointer[billing.Ledger]
+	billingMu              sync.Mutex // serializes changes of the ledger
+	readingsMu             sync.Mutex // serializes submissions and reviews of readings, taken before billingMu
+	ElectrDir              string     // electr_YYYY-MM.csv are imported from
+	devicesMu              sync.Mutex
+	devices                map[string]*DeviceHealth
 	GateOpenNumber         string
 	GateInfoNumber         string
-	palEsTimeGroups        *PalEsTimeGroups
+	palEsTimeGroups        atomic.Pointer[PalEsTimeGroups]
+	timeGroupsMu           sync.Mutex // guards timeGroupsBySource
+	timeGroupsBySource     map[string][]*PalEsTimeGroup
+	cal                    atomic.Pointer[calendar.Calendar]
+	calMu                  sync.Mutex // serializes calendar updates
 	RateWatcher            *RateWatcher
 	PendingCalls           chan *gate.Call
 	PendingSMSes           chan *gate.SMS
@@ -99,14 +131,26 @@ type Gate struct {
 	SMSes                  gate.SMSesDAO
 	KeypadCodes            gate.KeypadCodesDAO
 	TOTPPhones             gate.TOTPPhonesDAO
+	totpMu                 sync.Mutex // serializes TOTP checks, guards last used steps
+	totpFails              totpFails  // failed codes of /totp_auth by chat and by phone
 	MattermostUsers        gate.MattermostUsersDAO
+	TelegramUsers          gate.TelegramUsersDAO
 	Entities               gate.EntitiesDAO
 	Settings               gate.SettingsDAO
+	SettingsHistory        gate.SettingsHistoryDAO
+	PalesChanges           gate.PalesChangesDAO
+	TimeGroups             gate.TimeGroupsDAO
+	Jobs                   *jobs.Scheduler
 	SMSSession             map[int]*gate.SMS
 	Stored                 chan struct{}
-	TelegramNotification   chan *Notification
+	Notify                 *notify.Router
+	Email                  *EmailClient // nil without credentials
+	mm                     atomic.Pointer[mmBot]
+	tg                     atomic.Pointer[tgBot]
+	rolesMu                sync.Mutex
+	mmActionsMu            sync.Mutex
+	mmActions              map[string]int64 // used refs of one-time buttons -> expiration
 	GateCommands           chan *GateCommandAndText
-	NtfyNotification       chan *Notification
 	NtfyURL                string
 	NtfyToken              string
 	schedule               chan map[string]int
@@ -114,47 +158,7 @@ type Gate struct {
 	Abort                  chan struct{}
 }
 
-type Notification struct {
-	msg    string
-	system bool
-	user   bool
-}
-
-type PalesLoginResp struct {
-	Msg  string
-	User struct {
-		Token string
-	}
-}
-
-type PalESLog struct {
-	Msg string
-	Log struct {
-		Count int
-		List  []*PalesLogUser
-	}
-}
-
-type PalesLogUser struct {
-	UserId   string
-	Sn       string
-	Approved bool
-	Type     int // see typeName()
-	Tm       int64
-	/*
-	   22 - Duplicated remote
-	   16 - Latch active
-	   12 - Time group restriction – date not allowed
-
-	   1 - Not in list (Nearby Only for dials too)
-	   3 - No response
-	   4 - User smartphone internet problem
-	   61 - Bluetooth repeated id
-	*/
-	Reason    int
-	Firstname string
-	Lastname  string
-}
+type PalesLogUser pales.LogRecord
 
 func (l *PalesLogUser) Time() time.Time {
 	return time.Unix(l.Tm, 0)
@@ -218,44 +222,7 @@ func (u *PalesLogUser) Phone() string {
 	return u.UserId
 }
 
-type PalesUsers struct {
-	Msg   string
-	Users struct {
-		Count int
-		List  []*PalESUser
-	}
-}
-
-type PalESUser struct {
-	Id                  string `json:"_id"`
-	Firstname           string
-	Lastname            string
-	Admin               bool
-	Output1             bool
-	StartDate           string
-	EndDate             string
-	DialToOpen          bool
-	LocalOnly           bool
-	Output1Latch        bool
-	Output2Latch        bool
-	Output1LatchMaxTime int64
-	Output2LatchMaxTime int64
-	SecondaryDevice     bool
-	Notifications       bool
-	GuestInvitation     bool
-	TimeGroupName       string
-	TimeGroupId         string `json:"groupId"`
-	GeoFence1           struct {
-		Enabled             bool
-		Lat                 float64
-		Long                float64
-		Radius              int
-		Rssi                int
-		Key                 string
-		ConfirmNotification bool
-		RetrySeconds        int `json:"retry"`
-	}
-}
+type PalESUser pales.User
 
 func (u *PalESUser) name() string {
 	return fmt.Sprintf("%s %s %s", u.Id, u.Firstname, u.Lastname)
@@ -301,13 +268,17 @@ func PalesUserFromCsv(row []string, cols map[string]int) *PalESUser {
 }
 
 func (g *Gate) Init(cfg *config.Config, db *sql.DB) {
-	g.Cfg = cfg
+	g.cfg.Store(cfg)
+	g.ID = cmp.Or(cfg.GateID, config.DefaultGateID)
 	g.TelegramUrl = cfg.TelegramUrl
 	g.TelegramChatId = cfg.TelegramChatId
 	g.TelegramTimeoutSec = cfg.TelegramTimeoutSec
 	g.ProxyUrl = cfg.ProxyUrl
-	g.PalesPortalUser = cfg.PalesPortalUser
-	g.PalesPortalPwd = cfg.PalesPortalPwd
+	g.Pales = pales.NewClient(cfg.PalesPortalURL, cmp.Or(cfg.PalesDeviceID, defaultPalesDeviceID),
+		cfg.PalesPortalUser, cfg.PalesPortalPwd, filepath.Join(g.CfgDir, "t.txt"))
+	if err := g.Pales.LoadToken(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		Logger.Errorf("pal-es token: %v", err)
+	}
 	g.GateOpenNumber = cfg.GateOpenNumber
 	g.GateInfoNumber = cfg.GateInfoNumber
 	g.NtfyURL = cfg.NtfyURL
@@ -323,12 +294,23 @@ func (g *Gate) Init(cfg *config.Config, db *sql.DB) {
 	g.KeypadCodes = gate.NewKeypadCodes(db)
 	g.TOTPPhones = gate.NewTOTPPhones(db)
 	g.MattermostUsers = gate.NewMattermostUsers(db)
+	g.TelegramUsers = gate.NewTelegramUsers(db)
 	g.Entities = gate.NewEntities(db)
 	g.Settings = gate.NewSettings(db)
+	g.SettingsHistory = gate.NewSettingsHistory(db)
+	g.journal.store = gate.NewEvents(db)
+	g.PalesChanges = gate.NewPalesChanges(db)
+	g.TimeGroups = gate.NewTimeGroups(db)
+	g.loadTimeGroupsCache()
+	g.loadCalendar()
+	g.loadAccess()
+	g.importAccess(cfg)
+	g.loadBilling()
+	g.initJobs(gate.NewJobs(db))
+	g.Notify = notify.New(gate.NewNotifyQueue(db))
+	g.configureNotify(cfg)
 	g.Stored = make(chan struct{}, 8)
-	g.TelegramNotification = make(chan *Notification, 128)
 	g.GateCommands = make(chan *GateCommandAndText, 4)
-	g.NtfyNotification = make(chan *Notification, 128)
 	g.KeypadCodesRequests = make(chan *PhoneSms, 32)
 	g.phoneCalls = make(chan *PhoneCall)
 	g.phoneSmses = make(chan *PhoneSms)
@@ -352,7 +334,6 @@ func (g *Gate) Init(cfg *config.Config, db *sql.DB) {
 }
 
 type PalEsTimeGroups struct {
-	Msg    string
 	Groups struct {
 		List []*PalEsTimeGroup
 	}
@@ -372,33 +353,46 @@ func (tg *PalEsTimeGroups) toTimeGroupMap() map[string]*PalEsTimeGroup {
 	return res
 }
 
-func (tg *PalEsTimeGroups) containsNow(groupId string, groupName string) bool {
-	return tg.contains(groupId, groupName, time.Now())
+func (tg *PalEsTimeGroups) contains(groupId string, groupName string, t time.Time) bool {
+	return tg.containsOn(groupId, groupName, t, t.In(Location).Weekday())
 }
 
-func (tg *PalEsTimeGroups) contains(groupId string, groupName string, t time.Time) bool {
-	g := tg.get(groupId, groupName)
-	if g != nil {
-		return g.contains(t)
+// containsOn checks t as if it is the weekday, so calendar holidays may be checked as Sunday.
+// No group is all time, an unknown one is no time.
+func (tg *PalEsTimeGroups) containsOn(groupId string, groupName string, t time.Time, weekday time.Weekday) bool {
+	g, err := tg.get(groupId, groupName)
+	if err != nil {
+		return false
 	}
-	// group not found, so have to use all time
-	return true
+	return g == nil || g.containsOn(t, weekday)
 }
 
-func (tg *PalEsTimeGroups) get(groupId string, groupName string) *PalEsTimeGroup {
+var errUnknownTimeGroup = errors.New("unknown time group")
+
+// get returns the group of the user, nil if the user has none. A local group overrides
+// the pal-es one with the same name, even if the user has the id of the pal-es one.
+func (tg *PalEsTimeGroups) get(groupId string, groupName string) (*PalEsTimeGroup, error) {
 	if len(groupId) == 0 && len(groupName) == 0 {
-		return nil
+		return nil, nil
+	}
+	if len(groupName) != 0 {
+		for _, g := range slices.Backward(tg.Groups.List) {
+			if g.Source == timeGroupSourceLocal && g.GroupName == groupName {
+				return g, nil
+			}
+		}
 	}
-	g := tg.groupMap[groupId]
-	if g != nil {
-		return g
+	if g := tg.groupMap[groupId]; g != nil && len(groupId) != 0 {
+		return g, nil
 	}
-	for _, g := range tg.groupMap {
-		if g.GroupName == groupName {
-			return g
+	if len(groupName) != 0 {
+		for _, g := range slices.Backward(tg.Groups.List) {
+			if g.GroupName == groupName {
+				return g, nil
+			}
 		}
 	}
-	return nil
+	return nil, fmt.Errorf("%w %q (id %q)", errUnknownTimeGroup, groupName, groupId)
 }
 
 type PalEsTimeGroup struct {
@@ -410,14 +404,12 @@ type PalEsTimeGroup struct {
 	StartDate int64
 	EndDate   int64
 	TimeArray []*PalEsTimeGroupDay
+	Source    string   `json:",omitempty"`
+	Holidays  []string `json:",omitempty"` // 2006-01-02 local dates when the group does not allow access
 	daysArray []*PalEsTimeGroupDay
 }
 
-type PalEsTimeGroupDay struct {
-	StartMinute int `json:"s"`
-	EndMinute   int `json:"e"`
-	DayOfWeek   int `json:"d"`
-}
+type PalEsTimeGroupDay pales.TimeGroupDay
 
 func (d *PalEsTimeGroupDay) contains(t time.Time) bool {
 	minuteOfDay := t.Hour()*60 + t.Minute()
@@ -438,13 +430,16 @@ func (g *PalEsTimeGroup) init() {
 	}
 }
 
-func (g *PalEsTimeGroup) contains(t time.Time) bool {
+func (g *PalEsTimeGroup) containsOn(t time.Time, weekday time.Weekday) bool {
 	unix := t.Unix()
-	if unix < g.StartDate || unix > g.EndDate {
+	if unix < g.StartDate || (g.EndDate != 0 && unix > g.EndDate) {
 		return false
 	}
 	localTime := t.In(Location)
-	d := g.daysArray[localTime.Weekday()]
+	if slices.Contains(g.Holidays, localTime.Format(time.DateOnly)) {
+		return false
+	}
+	d := g.daysArray[weekday]
 	return d.contains(localTime)
 }
 
@@ -542,8 +537,14 @@ func (g *Gate) allowedNow(phone string) bool {
 	if !ok {
 		return false
 	}
-	return (u.DialToOpen || u.LocalOnly) && !g.RestrictedPhones[phone] &&
-		g.palEsTimeGroups.containsNow(u.TimeGroupId, u.TimeGroupName)
+	tg, err := g.timeGroups().get(u.TimeGroupId, u.TimeGroupName)
+	if err != nil {
+		Logger.Errorf("%s: %v, access denied", u.name(), err)
+		return false
+	}
+	now := time.Now()
+	return (u.DialToOpen || u.LocalOnly) && !g.isRestricted(phone) &&
+		(tg == nil || tg.containsOn(now, g.calendar().Weekday(now)))
 }
 
 func (g *Gate) allowedAllTime(phone string) bool {
@@ -551,8 +552,8 @@ func (g *Gate) allowedAllTime(phone string) bool {
 	if !ok {
 		return false
 	}
-	return (u.DialToOpen || u.LocalOnly) && !g.RestrictedPhones[phone] &&
-		g.palEsTimeGroups.get(u.TimeGroupId, u.TimeGroupName) == nil
+	tg, err := g.timeGroups().get(u.TimeGroupId, u.TimeGroupName)
+	return (u.DialToOpen || u.LocalOnly) && !g.isRestricted(phone) && tg == nil && err == nil
 }
 
 func (g *Gate) userName(phone, defaultName string) string {
@@ -580,7 +581,7 @@ Loop:
 					Logger.Errorf("Encrypt(%s, now): %v", phone, err)
 					continue
 				}
-				msg := fmt.Sprintf("https://7slavka.ru/totp/%s/ откройте ссылку, добавьте QR код в Google Authenticator", secret)
+				msg := fmt.Sprintf("https://7slavka.ru/totp/%s/ откройте ссылку, добавьте QR код в Google Authenticator, новый код действует после первого ввода", secret)
 				g.sendSMS(sms.Phone, msg, time.Now().Add(24*time.Hour))
 				continue
 			}
@@ -696,35 +697,26 @@ func maskPhone(s string) string {
 	return strings.Repeat("*", length-4) + string(rs[length-4:])
 }
 
-func (g *Gate) sendSystemNotification(msg string) {
-	g.sendNotification(msg, true, false)
-}
-
-func (g *Gate) sendUserNotification(msg string) {
-	g.sendNotification(msg, false, true)
+func (g *Gate) openGate(text, systemNotification string) {
+	g.GateCommands <- &GateCommandAndText{command: Open, text: text, systemNotification: systemNotification}
 }
 
-func (g *Gate) sendNotification(msg string, system, user bool) {
-	if system {
-		select {
-		case g.TelegramNotification <- &Notification{msg: msg, system: system, user: user}:
-		default:
-			Logger.Warn("channel overflow - telegram: %s", msg)
-		}
+// openGateWait sends the open command and waits for the result of the relay
+func (g *Gate) openGateWait(ctx context.Context, text, systemNotification string) error {
+	done := make(chan error, 1)
+	select {
+	case g.GateCommands <- &GateCommandAndText{command: Open, text: text, systemNotification: systemNotification, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	if system || user {
-		select {
-		case g.NtfyNotification <- &Notification{msg: msg, system: system, user: user}:
-		default:
-			Logger.Warn("channel overflow - ntfy: %s", msg)
-		}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (g *Gate) openGate(text, systemNotification string) {
-	g.GateCommands <- &GateCommandAndText{command: Open, text: text, systemNotification: systemNotification}
-}
-
 func (g *Gate) keepOpenGate() {
 	g.GateCommands <- &GateCommandAndText{command: KeepOpenBegin}
 }
@@ -784,6 +776,7 @@ func (g *Gate) handlingGateState(abort <-chan struct{}, cfg *config.Config, cfgS
 			inOpenedState = s.ValueBool(false)
 		}
 	}
+	g.keptOpen.Store(inOpenedState)
 	sch := NewOpenSchedule(cfg.OpenSchedule)
 	nonCfgSch := false
 	{
@@ -801,6 +794,24 @@ func (g *Gate) handlingGateState(abort <-chan struct{}, cfg *config.Config, cfgS
 			}
 		}
 	}
+	// gate is kept open by calendar exception
+	var calendarKeepOpen calendarKeepOpenState
+	{
+		s, err := g.Settings.Find(calendarKeepOpenKey)
+		if err != nil {
+			Logger.Errorf("read setting %q error: %v", calendarKeepOpenKey, err)
+		} else {
+			calendarKeepOpen.owned = s.ValueBool(false)
+			calendarKeepOpen.window = calendarKeepOpen.owned
+		}
+	}
+	saveCalendarKeepOpen := func() {
+		s := gate.Setting{Key: calendarKeepOpenKey}
+		s.SetBool(calendarKeepOpen.owned)
+		if err := g.Settings.Update(&s); err != nil {
+			Logger.Errorf("error saving to db %q: %v", s.Key, err)
+		}
+	}
 	minuteTicker := time.NewTicker(time.Minute)
 	var tenSecAfterErrorChan <-chan time.Time
 	reset := false
@@ -822,10 +833,12 @@ Loop:
 					if cmd.systemNotification == "" {
 						Logger.Infof("ignoring open command in opened state for: %q", cmd.text)
 					}
+					cmd.reply(errGateKeptOpen)
 					continue
 				}
 				if now.Before(lockedUntil) {
 					g.sendSystemNotification(fmt.Sprintf("IGNORED open command %q %q", cmd.systemNotification, cmd.text))
+					cmd.reply(errGateLocked)
 					continue
 				}
 				lastGateOpenCommand = cmd
@@ -835,9 +848,10 @@ Loop:
 				if err != nil {
 					tenSecAfterErrorChan = time.NewTicker(10 * time.Second).C
 				}
+				cmd.reply(err)
 				if cmd.systemNotification != "" {
 					if err != nil {
-						g.sendSystemNotification(fmt.Sprintf("%s error: %v", cmd.systemNotification, err))
+						g.notify(eventGateCommand, notify.Warning, fmt.Sprintf("%s error: %v", cmd.systemNotification, err))
 					} else {
 						g.sendSystemNotification(cmd.systemNotification)
 					}
@@ -850,6 +864,7 @@ Loop:
 					continue
 				}
 				inOpenedState = true
+				g.keptOpen.Store(true)
 				s := gate.Setting{Key: gateInOpenStateKey}
 				s.SetBool(true)
 				err := g.Settings.Update(&s)
@@ -864,20 +879,28 @@ Loop:
 					continue
 				}
 				inOpenedState = false
+				g.keptOpen.Store(false)
 				s := gate.Setting{Key: gateInOpenStateKey}
 				s.SetBool(false)
 				err := g.Settings.Update(&s)
 				if err != nil {
 					Logger.Errorf("error saving to db %q: %v", s.Key, err)
 				}
+				if calendarKeepOpen.owned {
+					// ended before the exception, a later keep open is not the calendar one
+					calendarKeepOpen.owned = false
+					saveCalendarKeepOpen()
+				}
 				g.sendCommandToGate(cmd.text, now, cmd.command)
 
 			case Lock:
 				minutes := cmd.args.(time.Duration)
 				if minutes == 0 {
 					lockedUntil = time.Time{}
+					g.lockedUntil.Store(0)
 				} else {
 					lockedUntil = time.Now().Add(minutes)
+					g.lockedUntil.Store(lockedUntil.UnixMilli())
 				}
 
 			case OpenedEvent:
@@ -921,12 +944,25 @@ Loop:
 				s.SetString(strconv.Itoa(int(lastOpenedTimeNano)))
 				g.Settings.Update(&s)
 			}
+			ko := g.calendar().KeepOpenAt(now)
+			owned := calendarKeepOpen.owned
+			switch begin, end := calendarKeepOpen.tick(ko != nil, inOpenedState); {
+			case begin:
+				g.keepOpenGate()
+				g.sendSystemNotification(fmt.Sprintf("KEEP OPEN by calendar %s", ko.Name))
+			case end:
+				g.endKeepOpenGate()
+				g.sendSystemNotification("KEEP OPEN by calendar is over")
+			}
+			if calendarKeepOpen.owned != owned {
+				saveCalendarKeepOpen()
+			}
 			if !inOpenedState {
 				if openMonitor.isDoublingBefore(now.Add(-time.Minute)) {
 					g.openGate("freeze-prevention", "")
 					g.sendSystemNotification(fmt.Sprintf("OPENED by freeze-prevention %s", time.Now().In(Location).Format("15:04:05")))
 				} else {
-					minutes := sch.period(time.Now())
+					minutes := g.calendarPeriod(sch, now, false)
 					remaining := time.Duration(minutes)*time.Minute - now.Sub(lot)
 					if remaining < time.Minute {
 						if remaining >= 5*time.Second {
@@ -969,67 +1005,6 @@ Loop:
 	}
 }
 
-func (g *Gate) handlingScheduledJobs(abort <-chan struct{}, cfg *config.Config) {
-	g.findAndApplyScheduledJobs()
-	minuteTicker := time.NewTicker(time.Minute)
-Loop:
-	for {
-		select {
-		case <-minuteTicker.C:
-			g.findAndApplyScheduledJobs()
-		case <-abort:
-			break Loop
-		}
-	}
-}
-
-func (g *Gate) findAndApplyScheduledJobs() error {
-	ss, err := g.Settings.FindN(gate.ScheduledSettingsKeyPrefix)
-	if err != nil {
-		return err
-	}
-	for i := range *ss {
-		s := &(*ss)[i]
-		sch, err := s.Schedule()
-		if err != nil {
-			Logger.Errorf("parse %s %s setting error: %v", s.Key, s.ValueString(), err)
-			continue
-		}
-		if !sch.IsValid() {
-			Logger.Warnf("invalid setting %s %s", s.Key, s.ValueString())
-			continue
-		}
-		now := time.Now()
-		if !sch.IsTime(now) {
-			continue
-		}
-		cmd := "/" + s.Key[len(gate.ScheduledSettingsKeyPrefix):]
-		res, err := g.doHandleMattermostSysCommand(cmd, sch.Args)
-		sch.ExecTimeMilli = now.UnixMilli()
-		sch.ExecError = ""
-		if err != nil {
-			sch.ExecError = fmt.Sprintf("%v", err)
-		}
-		msg, ok := res.(string)
-		if !ok && res != nil {
-			var sb strings.Builder
-			encoder := json.NewEncoder(&sb)
-			encoder.Encode(res)
-			msg = sb.String()
-		}
-		sch.ExecResult = msg
-		yamlStr := gate.MarshalYAMLOneLine(&sch)
-		s.SetString(yamlStr)
-		if err != nil {
-			Logger.Error(yamlStr)
-		} else {
-			Logger.Info(yamlStr)
-		}
-		g.Settings.Update(s)
-	}
-	return nil
-}
-
 func (g *Gate) syncGateRelayState(inOpenedState bool) error {
 	value, err := g.getGateSwitchValue()
 	if err != nil {
@@ -1038,7 +1013,7 @@ func (g *Gate) syncGateRelayState(inOpenedState bool) error {
 	if value == inOpenedState {
 		return nil
 	}
-	Logger.Warnf("relay state out of sync  %q", g.Cfg.GateRelaySwitchGetURL(g.Cfg.Gate.Relay.SwitchName))
+	Logger.Warnf("relay state out of sync  %q", g.config().GateRelaySwitchGetURL(g.config().Gate.Relay.SwitchName))
 	now := time.Now()
 	if inOpenedState {
 		g.sendCommandToGate(fmt.Sprintf("%s resynced", now.In(Location).Format("2006-01-02 15:04:05")), now, KeepOpenBegin)
@@ -1049,7 +1024,7 @@ func (g *Gate) syncGateRelayState(inOpenedState bool) error {
 }
 
 func (g *Gate) getGateSwitchValue() (bool, error) {
-	getURL := g.Cfg.GateRelaySwitchGetURL(g.Cfg.Gate.Relay.SwitchName)
+	getURL := g.config().GateRelaySwitchGetURL(g.config().Gate.Relay.SwitchName)
 	var result ESPHomeRelayResp
 	err := g.doGateGet(getURL, &result)
 	if err != nil {
@@ -1067,7 +1042,7 @@ func (g *Gate) doGateGet(getURL string, result any) error {
 		Logger.Errorf("%v", err)
 		return err
 	}
-	req.SetBasicAuth(g.Cfg.Gate.User, g.Cfg.Gate.Pwd)
+	req.SetBasicAuth(g.config().Gate.User, g.config().Gate.Pwd)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -1092,14 +1067,14 @@ func (g *Gate) sendCommandToGate(text string, now time.Time, cmd GateCommand) er
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	postURL := g.Cfg.GateRelayTextPostURL(g.gateESP32TextSensorName(cmd), url.QueryEscape(text))
+	postURL := g.config().GateRelayTextPostURL(g.gateESP32TextSensorName(cmd), url.QueryEscape(text))
 	req, err := http.NewRequestWithContext(ctx, "POST", postURL, strings.NewReader(""))
 	if err != nil {
 		Logger.Errorf("%q: %v", postURL, err)
 		return err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(g.Cfg.Gate.User, g.Cfg.Gate.Pwd)
+	req.SetBasicAuth(g.config().Gate.User, g.config().Gate.Pwd)
 
 	g.lastOpenCommandTime.Store(now.Unix())
 
@@ -1107,19 +1082,23 @@ func (g *Gate) sendCommandToGate(text string, now time.Time, cmd GateCommand) er
 	resp, err := client.Do(req)
 	if err != nil {
 		Logger.Errorf("error calling gate %q: %v", postURL, err)
+		g.deviceSeen(deviceRelay, err)
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		Logger.Errorf("error calling gate %q: %d", postURL, resp.StatusCode)
-		return fmt.Errorf("http %d", resp.StatusCode)
+		err = fmt.Errorf("http %d", resp.StatusCode)
+		g.deviceSeen(deviceRelay, err)
+		return err
 	}
 	Logger.Debugf("%q http %d", text, resp.StatusCode)
+	g.deviceSeen(deviceRelay, nil)
 	return err
 }
 
 func (g *Gate) getGateTextValue(cmd GateCommand) (string, error) {
-	getURL := g.Cfg.GateRelayTextGetURL(g.gateESP32TextSensorName(cmd))
+	getURL := g.config().GateRelayTextGetURL(g.gateESP32TextSensorName(cmd))
 	var result ESPHomeTextResp
 	err := g.doGateGet(getURL, &result)
 	if err != nil {
@@ -1132,42 +1111,25 @@ func (g *Gate) gateESP32TextSensorName(cmd GateCommand) string {
 	textName := ""
 	switch cmd {
 	case Open:
-		textName = g.Cfg.Gate.Relay.OnOffTextName
+		textName = g.config().Gate.Relay.OnOffTextName
 	case KeepOpenBegin:
-		textName = g.Cfg.Gate.Relay.OnTextName
+		textName = g.config().Gate.Relay.OnTextName
 	case KeepOpenEnd:
-		textName = g.Cfg.Gate.Relay.OffTextName
+		textName = g.config().Gate.Relay.OffTextName
 	}
 	return textName
 }
 
-type BLETrackingAggregator struct {
-	g  *Gate
-	tt []*BLETracking
-}
-
-func (a *BLETrackingAggregator) sendSystemNotification(p []*BLETracking) (empty bool) {
-	for _, t := range p {
-		a.tt = append(a.tt, t)
-	}
-	if len(a.tt) == 0 {
-		return true
-	}
+// notifyBLETrackings publishes trackings one by one, the rule of system.ble batches them
+func (g *Gate) notifyBLETrackings(tt []*BLETracking) {
 	now := time.Now()
-	var sb strings.Builder
-	for i, t := range a.tt {
-		if i != 0 {
-			sb.WriteString("\n")
-		}
-		sb.WriteString(t.StringNow(now))
-		if s, ok := a.g.Cfg.BTMacNames[t.MAC]; ok {
-			sb.WriteString(" ")
-			sb.WriteString(s)
+	for _, t := range tt {
+		text := t.StringNow(now)
+		if s, ok := g.access().label(accessBTName, t.MAC); ok {
+			text += " " + s
 		}
+		g.notify(eventBLE, notify.Info, text)
 	}
-	a.tt = a.tt[:0]
-	a.g.sendSystemNotification(sb.String())
-	return false
 }
 
 type BLEGatekeeper struct {
@@ -1185,11 +1147,12 @@ func (k *BLEGatekeeper) checkAndOpen(p []*BLETracking, cfg *config.Config) {
 		if _, ok := k.RecentlyOpened[bt.MAC]; ok {
 			continue
 		}
-		phone, ok := cfg.BTMacAutoOpenGate[bt.MAC]
-		if !ok {
+		g := k.g
+		e := g.access().bleAutoOpen(bt)
+		if e == nil {
 			continue
 		}
-		g := k.g
+		phone := e.Phone
 		u, ok := g.Phones[phone]
 		if !ok {
 			continue
@@ -1231,10 +1194,10 @@ type BLETrackingTimer struct {
 func (a *BLETrackingTimer) openAfterPeriodOfActivity(p []*BLETracking, prolongedPresence time.Duration) {
 	open := false
 	for _, bt := range p {
-		if _, ok := a.g.Cfg.BTMacAutoOpenGate[bt.MAC]; ok {
+		if a.g.access().bleAutoOpen(bt) != nil {
 			continue
 		}
-		if s, ok := a.g.Cfg.BTMacNames[bt.MAC]; ok && strings.HasPrefix(s, "Ritsa:") {
+		if s, ok := a.g.access().label(accessBTName, bt.MAC); ok && strings.HasPrefix(s, "Ritsa:") {
 			continue
 		}
 		tm := bt.AsTime()
@@ -1286,12 +1249,6 @@ func (c *bleCount) age() time.Duration {
 func (g *Gate) handlingBLETracking(abort chan struct{}, cfg *config.Config, cfgSub chan *config.Config,
 	ipReq chan Pair[string, chan string]) {
 
-	var firstWaitIsOver <-chan time.Time
-	var nextWaitIsOver <-chan time.Time
-	const firstDuration = 3 * time.Second
-	const nextDuration = 30 * time.Second
-	ticker := time.NewTicker(firstDuration)
-	aggr := BLETrackingAggregator{g: g}
 	bleGatekeeper := BLEGatekeeper{g: g}
 	bleGatekeeper.init()
 	bleTimer := BLETrackingTimer{g: g}
@@ -1325,20 +1282,17 @@ Loop:
 				g.logBLETrackings(btbt)
 			}
 			// ignore if system location is unknown or not from system location
-			if btbt[0].Location != 100 {
+			if btbt[0].Location != g.bleLocation() {
 				continue
 			}
-			btbt = filterOut(btbt, cfg.BTMacIgnore)
+			btbt = filterOut(btbt, g.access().active(accessBTIgnore))
 			if len(btbt) == 0 {
 				continue
 			}
+			g.sightings.addBLE(btbt, time.Now())
 			bleGatekeeper.checkAndOpen(btbt, cfg)
-			if firstWaitIsOver == nil && nextWaitIsOver == nil {
-				ticker.Reset(firstDuration)
-				firstWaitIsOver = ticker.C
-			}
-			aggr.sendSystemNotification(btbt)
-			bleTimer.openAfterPeriodOfActivity(btbt, time.Duration(sch.period(time.Now()))*time.Minute)
+			g.notifyBLETrackings(btbt)
+			bleTimer.openAfterPeriodOfActivity(btbt, time.Duration(g.calendarPeriod(sch, time.Now(), true))*time.Minute)
 
 		case v := <-g.wifiClients:
 			switch ci := v.(type) {
@@ -1373,7 +1327,7 @@ Loop:
 					sb.WriteString(" connected ")
 					sb.WriteString(now.Sub(c.Time).Round(time.Second).String())
 					sb.WriteString(" ago")
-					phone, name := phoneAndName(cfg, c)
+					phone, name := phoneAndName(g.access(), c)
 					if phone != "" {
 						sb.WriteString(" ")
 						sb.WriteString(phone)
@@ -1398,7 +1352,8 @@ Loop:
 					}
 				}
 				wifiConnections[ci.MAC] = ci
-				phone, name := phoneAndName(cfg, ci)
+				g.sightings.addWiFi(ci, time.Now())
+				phone, name := phoneAndName(g.access(), ci)
 				g.sendSystemNotification(fmt.Sprintf("WiFi: %s %s %s (%s) %s", ci.MAC, ci.IP, ci.Hostname, ci.Time, name))
 				if phone == "" {
 					continue
@@ -1427,17 +1382,6 @@ Loop:
 				Logger.Errorf("error saving to db %q: %v", s.Key, err)
 			}
 
-		case <-firstWaitIsOver:
-			ticker.Reset(nextDuration)
-			firstWaitIsOver = nil
-			nextWaitIsOver = ticker.C
-			aggr.sendSystemNotification(nil)
-
-		case <-nextWaitIsOver:
-			if aggr.sendSystemNotification(nil) {
-				nextWaitIsOver = nil
-			}
-
 		case t := <-g.openedEvets:
 			//g.openCommandTime.Store(time.Now().Unix())
 			if time.Since(g.lastOpenedNotification) < 71*time.Second {
@@ -1448,7 +1392,7 @@ Loop:
 			g.lastOpenedNotification = now
 			g.updateLastOpenedTime(now)
 			Logger.Infof("gate opened %s", t.timestampSent())
-			g.sendSystemNotification(fmt.Sprintf("gate opened %s", t.timestampSent()))
+			g.notify(eventOpened, notify.Info, fmt.Sprintf("gate opened %s", t.timestampSent()))
 
 		case cfg = <-cfgSub:
 
@@ -1471,16 +1415,14 @@ Loop:
 	}
 }
 
-func phoneAndName(cfg *config.Config, nci *NetworkClientInfo) (string, string) {
-	name, ok := cfg.WiFiMacNames[nci.MAC]
+func phoneAndName(a accessEntries, nci *NetworkClientInfo) (string, string) {
+	name, ok := a.label(accessWiFiName, nci.MAC)
 	if !ok && nci.Hostname != "" {
-		name, _ = cfg.WiFiMacNames[nci.Hostname]
+		name, _ = a.label(accessWiFiName, nci.Hostname)
 	}
-	phone, ok := cfg.WiFiMACAutoOpenGate[nci.MAC]
-	if !ok {
-		if nci.Hostname != "" {
-			phone, ok = cfg.WiFiMACAutoOpenGate[nci.Hostname]
-		}
+	phone := a.phone(accessWiFiAutoOpen, nci.MAC)
+	if phone == "" && nci.Hostname != "" {
+		phone = a.phone(accessWiFiAutoOpen, nci.Hostname)
 	}
 	return phone, name
 }
@@ -1588,6 +1530,10 @@ Loop:
 				err = g.KeypadCodes.Insert(kpCode)
 				if err != nil {
 					Logger.Errorf("error saving to db kpcodes: %v", err)
+					smsText = "не удалось создать код для шлагбаума, повторите позже"
+				}
+				if sms.reply != nil {
+					sms.reply(smsText, err)
 					continue
 				}
 				g.sendSMS(sms.Phone, smsText, now.Add(20*time.Minute))
@@ -1651,18 +1597,12 @@ func IntToBaseCustom(n int64, alphabet string) string {
 }
 
 func (g *Gate) palesLoginAndLoadLoop(abort chan struct{}, topicEvents <-chan string, cfg *config.Config, cfgSub chan *config.Config) {
-	g.login(false)
-	{
-		st := g.loadPalesTimeGroups()
-		if st == http.StatusUnauthorized {
-			g.login(true)
-			g.loadPalesTimeGroups()
-		}
-	}
+	g.login()
+	g.loadPalesTimeGroups()
 	g.loadPalesUsers()
 
 	g.palesLastLog.Tm = time.Now().Unix()
-	g.loadPalESLogs(20 * time.Second)
+	g.loadPalESLogs()
 
 	minuteLoginTicker := time.NewTicker(time.Minute)
 	logsTikerMinutes := cfg.LogsTikerMinutes
@@ -1673,15 +1613,15 @@ Loop:
 	for {
 		select {
 		case <-minuteLoginTicker.C:
-			g.login(false)
+			g.login()
 		case <-logsTicker.C:
-			g.loadPalESLogsOrLogin()
+			g.loadPalESLogs()
 		case topic := <-topicEvents:
 			if topic == "MQTT_ERROR" {
 				continue
 			}
 			if strings.HasSuffix(topic, "/log") {
-				g.loadPalESLogsOrLogin()
+				g.loadPalESLogs()
 			}
 		case <-thirtyMinuteTicker.C:
 			g.loadPalesUsers()
@@ -1700,113 +1640,29 @@ Loop:
 	}
 }
 
-func (g *Gate) loadPalESLogsOrLogin() {
-	st := g.loadPalESLogs(20 * time.Second)
-	if st == http.StatusUnauthorized {
-		g.login(true)
-		g.loadPalESLogs(20 * time.Second)
-	}
-}
-
-func (g *Gate) login(force bool) {
-	if force {
-		g.PalESPortalUserToken.Store("")
-	} else if len(g.PalESPortalUserToken.Load().(string)) != 0 {
-		return
-	}
-	type loginForm struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-		B        string `json:"b"`
-	}
-	form := loginForm{Username: g.PalesPortalUser, Password: g.PalesPortalPwd, B: ""}
-	jsonData, err := json.Marshal(form)
+// login renews pal-es token if it is missing or about to expire
+func (g *Gate) login() {
+	err := g.Pales.Login(context.Background(), false)
 	if err != nil {
 		Logger.Errorf("pal-es login: %v", err)
-		return
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "POST", "https://portal.pal-es.com/api1/user/login1", bytes.NewBuffer(jsonData))
-	if err != nil {
-		Logger.Errorf("pal-es login: %v", err)
-		return
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		Logger.Errorf("pal-es login http: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-	Logger.Infof("pal-es login http %d", resp.StatusCode)
-	if resp.StatusCode != http.StatusOK {
-		return
-	}
-	var result PalesLoginResp
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		Logger.Errorf("error unmarshalling pal-es login http response: %v", err)
-		return
-	}
-	Logger.Infof("pal-es login %s", result.Msg)
-	g.PalESPortalUserToken.Store(result.User.Token)
-
-	err = os.WriteFile(g.PalesTokenFilename, []byte(result.User.Token), 0644)
-	if err != nil {
-		Logger.Errorf("error writing file %s %v", g.PalesTokenFilename, err)
 	}
 }
 
-func (g *Gate) loadPalESLogs(timeout time.Duration) int {
-	token := g.PalESPortalUserToken.Load().(string)
-	if len(token) == 0 {
-		return 0
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	url := "https://portal.pal-es.com/api1/device/4G600215575/log?skip=0&limit=10&filter=&startDate=%s&endDate=&approved=&reasons=&rly=&type="
-	//url = fmt.Sprintf(url, strconv.Itoa(int(g.palesLastLog.Tm)))
-	url = fmt.Sprintf(url, "")
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		Logger.Errorf("%v", err)
-		return -1
-	}
-	req.Header.Add("x-access-token", token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// loadPalESLogs handles log records since the last handled one, returns number of new records
+func (g *Gate) loadPalESLogs() int {
+	list, err := g.Pales.Logs(context.Background(), g.palesLastLog.Tm)
 	if err != nil {
-		Logger.Errorf("pal-es log http: %v", err)
+		Logger.Errorf("pal-es log: %v", err)
 		return -1
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		Logger.Infof("pal-es log http %d", resp.StatusCode)
-		return resp.StatusCode
-	}
-	Logger.Debugf("pal-es log http %d", resp.StatusCode)
-	var result PalESLog
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		Logger.Errorf("error unmarshalling pal-es log http response: %v", err)
-		return -1
-	}
-	Logger.Debugf("pal-es log %s, %d", result.Msg, len(result.Log.List))
-	if len(result.Log.List) == 0 {
+	Logger.Debugf("pal-es log %d", len(list))
+	if len(list) == 0 {
 		return 0
 	}
 	var msg strings.Builder
-	slices.SortFunc(result.Log.List, func(a, b *PalesLogUser) int {
-		return cmp.Compare(a.Tm, b.Tm)
-	})
 	n := 0
-	for _, l := range result.Log.List {
+	for _, pl := range list {
+		l := (*PalesLogUser)(pl)
 		if g.palesLastLog.Tm > l.Tm {
 			continue
 		}
@@ -1847,17 +1703,17 @@ func (g *Gate) loadPalESLogs(timeout time.Duration) int {
 		}
 	}
 	if n == 0 {
-		return resp.StatusCode
+		return 0
 	}
-	g.palesLastLog = result.Log.List[len(result.Log.List)-1]
-	Logger.Infof("received %d pal-es log records", len(result.Log.List))
+	g.palesLastLog = (*PalesLogUser)(list[len(list)-1])
+	Logger.Infof("received %d pal-es log records", n)
 	g.sendSystemNotification(msg.String())
 	l := g.palesLastLog
 	if l.Approved || l.isRemote() || !l.isWeakReason() ||
 		time.Since(l.Time()) > 3*time.Minute ||
 		time.Since(time.Unix(0, g.lastOpenedTime.Load())) < time.Minute {
 
-		return resp.StatusCode
+		return n
 	}
 	phone := l.Phone()
 	// {"UserId":"","Sn":"","Approved":false,"Type":100,"Tm":1779650919,"Reason":3,"Firstname":"Михаил","Lastname":""}
@@ -1868,7 +1724,7 @@ func (g *Gate) loadPalESLogs(timeout time.Duration) int {
 		g.openGate(phone, "")
 		g.sendSystemNotification(fmt.Sprintf("OPENED by received log %s  %s", phone, g.userName(phone, "")))
 	}
-	return resp.StatusCode
+	return n
 }
 
 func (g *Gate) findPhoneByName(firstname, lastname string) string {
@@ -1884,89 +1740,29 @@ func (g *Gate) findPhoneByName(firstname, lastname string) string {
 	return phone
 }
 
-func (g *Gate) loadPalesTimeGroups() int {
-	if g.palEsTimeGroups == nil {
-		var tg PalEsTimeGroups
-		tg.init()
-		g.palEsTimeGroups = &tg
-	}
-	token := g.PalESPortalUserToken.Load().(string)
-	if len(token) == 0 {
-		return 0
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://portal.pal-es.com/api1/device/4G600215575/groups", nil)
-
+func (g *Gate) loadPalesTimeGroups() error {
+	list, err := g.Pales.TimeGroups(context.Background())
 	if err != nil {
-		Logger.Errorf("%v", err)
-		return -1
-	}
-	req.Header.Add("x-access-token", token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		Logger.Errorf("pal-es log http: %v", err)
-		return -1
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		Logger.Infof("pal-es timegroups http %d", resp.StatusCode)
-		return resp.StatusCode
+		Logger.Errorf("pal-es timegroups: %v", err)
+		return err
 	}
-	Logger.Debugf("pal-es timegroups http %d", resp.StatusCode)
-	var result PalEsTimeGroups
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	Logger.Debugf("pal-es timegroups %d", len(list))
+	err = g.setTimeGroups(timeGroupSourcePales, palesTimeGroups(list))
 	if err != nil {
-		Logger.Errorf("error unmarshalling pal-es log http response: %v", err)
-		return -1
+		Logger.Errorf("saving pal-es timegroups: %v", err)
 	}
-	result.init()
-	g.palEsTimeGroups = &result
-	Logger.Debugf("pal-es timegroups %s, %d", result.Msg, len(result.Groups.List))
-	return resp.StatusCode
+	return err
 }
 
-func (g *Gate) loadPalesUsers() int {
-	token := g.PalESPortalUserToken.Load().(string)
-	if len(token) == 0 {
-		return 0
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "GET",
-		"https://portal.pal-es.com/api1/device/4G600215575/users?skip=0&limit=10000&filter=", nil)
-
-	if err != nil {
-		Logger.Errorf("%v", err)
-		return -1
-	}
-	req.Header.Add("x-access-token", token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		Logger.Errorf("pal-es users http: %v", err)
-		return -1
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		Logger.Infof("pal-es users http %d", resp.StatusCode)
-		return resp.StatusCode
-	}
-	Logger.Debugf("pal-es users http %d", resp.StatusCode)
-	var result PalesUsers
-	err = json.NewDecoder(resp.Body).Decode(&result)
+func (g *Gate) loadPalesUsers() error {
+	list, err := g.Pales.Users(context.Background())
 	if err != nil {
-		Logger.Errorf("error unmarshalling pal-es users http response: %v", err)
-		return -1
+		Logger.Errorf("pal-es users: %v", err)
+		return err
 	}
-	Logger.Debugf("pal-es users %s, %d", result.Msg, len(result.Users.List))
-	for _, u := range result.Users.List {
-		g.Phones[u.Id] = u
+	Logger.Debugf("pal-es users %d", len(list))
+	for _, u := range list {
+		g.Phones[u.Id] = (*PalESUser)(u)
 	}
 	var records [][]string
 	records = append(records, []string{
@@ -1975,7 +1771,7 @@ func (g *Gate) loadPalesUsers() int {
 		"Time group", "Remote control sn", "Dial to open",
 		"Dial number (read only)", "Nearby only", "Latch 1",
 		"Notes", "TimeGroupId"})
-	for _, u := range result.Users.List {
+	for _, u := range list {
 		records = append(records, []string{
 			u.Id, u.Firstname, u.Lastname,
 			If(u.Admin, "TRUE", "FALSE"), If(u.SecondaryDevice, "TRUE", "FALSE"), If(u.Output1, "TRUE", "FALSE"),
@@ -1987,6 +1783,7 @@ func (g *Gate) loadPalesUsers() int {
 	f, err := os.Create(fileName)
 	if err != nil {
 		Logger.Errorf("error creating file %s  %v", fileName, err)
+		return err
 	}
 	defer f.Close()
 	w := csv.NewWriter(f)
@@ -1994,7 +1791,7 @@ func (g *Gate) loadPalesUsers() int {
 	if err != nil {
 		Logger.Errorf("error writing csv to file %s  %v", fileName, err)
 	}
-	return resp.StatusCode
+	return err
 }
 
 func If[T any](cond bool, a, b T) T {
@@ -2034,7 +1831,22 @@ func (g *Gate) keypadCode(c KeypadCode) error {
 			if strings.HasPrefix(c.Code, "00") && n >= 3 && n <= 5 {
 				plotN, err := strconv.Atoi(c.Code)
 				if err == nil && plotN >= 1 && plotN <= 315 {
-					g.sendUserNotification(fmt.Sprintf("ввели код %s - гости %d участка запрашивают проезд", c.Code, plotN))
+					msg := fmt.Sprintf("ввели код %s - гости %d участка запрашивают проезд", c.Code, plotN)
+					g.sendUserNotification(msg)
+					if g.mattermost() != nil {
+						go func() {
+							if _, err := g.notifyGuest(context.Background(), strconv.Itoa(plotN), msg); err != nil {
+								Logger.Errorf("mattermost guests of %d: %v", plotN, err)
+							}
+						}()
+					}
+					if g.tg.Load() != nil {
+						go func() {
+							if _, err := g.notifyTelegramGuest(context.Background(), strconv.Itoa(plotN), msg); err != nil {
+								Logger.Errorf("telegram guests of %d: %v", plotN, err)
+							}
+						}()
+					}
 					return nil
 				}
 			}
@@ -2061,7 +1873,7 @@ func (g *Gate) keypadCode(c KeypadCode) error {
 			return nil
 		}
 		if n >= 9 && n <= 11 {
-			if phone, ok := g.Cfg.MaskedPhones[c.Code]; ok {
+			if phone := g.access().phone(accessMaskedPhone, c.Code); phone != "" {
 				if u, ok := g.Phones[phone]; ok {
 					if g.allowedNow(phone) {
 						g.openGate(fmt.Sprintf("keypad %s", c.Code), "")
@@ -2079,7 +1891,7 @@ func (g *Gate) keypadCode(c KeypadCode) error {
 		if n == 9 {
 			totpCode := c.Code[n-6:]
 			phonePostfix := c.Code[:n-6]
-			phone := g.findTOTPPhoneByCode(phonePostfix, totpCode)
+			phone := g.findTOTPPhoneByCode(phonePostfix, totpCode, time.Now())
 			if phone == "" {
 				if badKeys != "" {
 					break
@@ -2260,8 +2072,9 @@ func equalsMissingDigit2(s1, s2 string) bool {
 }
 
 func (g *Gate) phoneAsCodeEntered(phone string, c KeypadCode, smsIfNotFound bool) error {
-	for _, v := range g.Cfg.MaskedPhones {
-		if phone == v {
+	now := time.Now()
+	for _, e := range g.access().list(accessMaskedPhone) {
+		if phone == e.Phone && e.active(now) {
 			g.sendSystemNotification(fmt.Sprintf("SOMEONE TRIED ENTER MASKED PHONE %s", phone))
 			return nil
 		}
@@ -2282,139 +2095,6 @@ func (g *Gate) phoneAsCodeEntered(phone string, c KeypadCode, smsIfNotFound bool
 	return nil
 }
 
-func (g *Gate) findTOTPPhoneByCode(phonePostfix string, totpCode string) string {
-	totpPhones, err := g.TOTPPhones.ListEndsWith(phonePostfix)
-	if err != nil {
-		Logger.Errorf("error finding totp phone %v", err)
-		return ""
-	}
-	for _, p := range totpPhones {
-		phone := p.Phone
-		valid, err := validateTOTPCodeForPhone(phone, totpCode)
-		if err != nil {
-			Logger.Errorf("totp validation error %v", err)
-			continue
-		}
-		if valid {
-			return p.Phone
-		}
-	}
-	return ""
-}
-
-func validateTOTPCodeForPhone(phone string, totpCode string) (bool, error) {
-	secret := totpSecret(phone)
-	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(secret))
-
-	valid, err := totp.ValidateCustom(totpCode, secretBase32, time.Now(), totp.ValidateOpts{
-		Period:    30, // стандарт для Google Authenticator
-		Skew:      1,  // позволяет код из прошлого или следующего 30-секундного интервала
-		Digits:    otp.DigitsSix,
-		Algorithm: otp.AlgorithmSHA1,
-	})
-	return valid, err
-}
-
-func totpSecret(phone string) string {
-	salt := "SNT_Semislavka"
-	h := sha1.New()
-	h.Write([]byte(phone + salt))
-	hashBytes := h.Sum(nil)
-	hashStr := hex.EncodeToString(hashBytes)
-	secret := hashStr[:16]
-	return secret
-}
-
-func (g *Gate) sendingSystemNotification(abort chan struct{}) {
-Loop:
-	for {
-		select {
-		case m := <-g.TelegramNotification:
-			msg := m.msg
-			Logger.Infof("telegram: %s", msg)
-			g.sendTelegram(msg)
-
-		case <-abort:
-			break Loop
-		}
-	}
-}
-
-func (g *Gate) sendTelegram(msg string) {
-	var client *http.Client
-	if len(g.ProxyUrl) != 0 {
-		proxyURL, err := url.Parse(g.ProxyUrl)
-		if err != nil {
-			Logger.Errorf("error calling telegram: %v", err)
-			return
-		}
-		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
-	} else {
-		client = &http.Client{}
-	}
-	formData := url.Values{
-		"chat_id": {g.TelegramChatId},
-		"text":    {msg + time.Now().In(Location).Format(" (2006-01-02 15:04:05)")},
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(g.TelegramTimeoutSec)*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "POST", g.TelegramUrl, strings.NewReader(formData.Encode()))
-	if err != nil {
-		Logger.Errorf("error calling telegram: %v", err)
-		return
-	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
-	if err != nil {
-		Logger.Errorf("error calling telegram: %v", err)
-	} else {
-		defer resp.Body.Close()
-	}
-}
-
-func (g *Gate) sendingUserNotification(abort chan struct{}) {
-	server, _ := url.Parse(g.NtfyURL)
-	publisher, err := gotfy.NewPublisher(server, gotfy.WithAuth("", g.NtfyToken))
-	if err != nil {
-		Logger.Errorf("error NewPublisher: %v", err)
-	}
-Loop:
-	for {
-		select {
-		case m := <-g.NtfyNotification:
-			msg := m.msg
-			if publisher == nil {
-				Logger.Debugf("CAN'T SEND TO ntfy DUE TO PREVIOUS ERROR: %s", msg)
-				continue
-			}
-			if m.user {
-				g.sendNtfy(publisher, "7g-events", msg)
-			}
-			if m.system {
-				g.sendNtfy(publisher, "system", msg)
-			}
-
-		case <-abort:
-			break Loop
-		}
-	}
-}
-
-func (g *Gate) sendNtfy(publisher *gotfy.Publisher, topic, msg string) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(g.TelegramTimeoutSec)*time.Second)
-	defer cancel()
-	_, err := publisher.SendMessage(ctx, &gotfy.Message{
-		Topic:   topic,
-		Message: msg,
-	})
-	if err != nil {
-		Logger.Errorf("ntfy: %s  error: %v", msg, err)
-	} else {
-		Logger.Infof("ntfy: %s", msg)
-	}
-}
-
 type HitCounter struct {
 	N      int
 	buffer []time.Time
@@ -2509,9 +2189,6 @@ type AutomateSMS struct {
 	Text  string `json:"text"`
 }
 
-// Ключ должен быть 16, 24 или 32 байта (AES-128, 192, 256)
-
-var key = []byte("k9wkKLJqpa_lJl-l")
 var april2026 = time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC)
 
 func EncryptPhone(phone string, tm time.Time) (string, error) {
@@ -2530,8 +2207,10 @@ func encrypt(digits string) (string, error) {
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, num)
 
-	block, _ := aes.NewCipher(key)
-	gcm, _ := cipher.NewGCM(block)
+	gcm, err := newGCM(secretPhoneKey, Secrets.Get(secretPhoneKey))
+	if err != nil {
+		return "", err
+	}
 	nonce := make([]byte, gcm.NonceSize())
 	io.ReadFull(crand.Reader, nonce)
 
@@ -2549,21 +2228,43 @@ func DecryptPhone(cryptoText string) (string, time.Time, error) {
 	return "79" + s[:9], april2026.Add(time.Duration(months) * time.Hour), err
 }
 
+// newGCM: ключ секрета name должен быть 16, 24 или 32 байта (AES-128, 192, 256)
+func newGCM(name, key string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return cipher.NewGCM(block)
+}
+
 func decrypt(cryptoText string) (string, error) {
 	data, err := base64.RawURLEncoding.DecodeString(cryptoText)
 	if err != nil {
 		return "", err
 	}
-	block, _ := aes.NewCipher(key)
-	gcm, _ := cipher.NewGCM(block)
-
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	// ссылки, зашифрованные предыдущими версиями ключа, действуют до их удаления
+	var plaintext []byte
+	err = errors.New("no phone key")
+	for _, key := range Secrets.Values(secretPhoneKey) {
+		var gcm cipher.AEAD
+		if gcm, err = newGCM(secretPhoneKey, key); err != nil {
+			continue
+		}
+		nonceSize := gcm.NonceSize()
+		if len(data) < nonceSize {
+			return "", errors.New("too short")
+		}
+		nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+		if plaintext, err = gcm.Open(nil, nonce, ciphertext, nil); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return "", err
 	}
+	if len(plaintext) != 8 {
+		return "", errors.New("bad length")
+	}
 
 	// Конвертируем байты обратно в число, а число в строку
 	num := binary.BigEndian.Uint64(plaintext)
@@ -2571,318 +2272,3 @@ func decrypt(cryptoText string) (string, error) {
 }
 
 var ErrNotFound = errors.New("not found")
-
-func (g *Gate) handleMattermostSysCommand(cmd, args string, encoder *json.Encoder) bool {
-	res, err := g.doHandleMattermostSysCommand(cmd, args)
-	if err == ErrNotFound {
-		return false
-	}
-	msg, isStr := res.(string)
-	if err != nil {
-		errMsg := fmt.Sprintf("error: %v", err)
-		if msg == "" {
-			msg = errMsg
-		} else {
-			msg += " " + errMsg
-		}
-	}
-	if !isStr {
-		encoder.Encode(res)
-	} else if msg != "" {
-		encoder.Encode(NewMattermostResponse(msg))
-	}
-	return true
-}
-
-func (g *Gate) doHandleMattermostSysCommand(cmd, args string) (res any, err error) {
-	switch cmd {
-	case "/7_open":
-		atts := &MattermostUIResponse{Attachments: []*MattermostUIAttachment{{Text: "Открыть шлагбаум?"}}}
-		atts.Attachments[0].addAction(&MattermostUIAction{
-			Id:    "open_yes",
-			Name:  "Да",
-			Type:  UITypeButton,
-			Style: UIStylePrimary,
-			Integration: MMUIIntegration{
-				Url: fmt.Sprintf("%s/gate/mm/action", site),
-				Context: MMUIContext{
-					Action: UIActionOpen,
-					Value:  true,
-				},
-			},
-		})
-		atts.Attachments[0].addAction(&MattermostUIAction{
-			Id:    "open_no",
-			Name:  "Нет",
-			Type:  UITypeButton,
-			Style: UIStyleDefault,
-			Integration: MMUIIntegration{
-				Url: fmt.Sprintf("%s/gate/mm/action", site),
-				Context: MMUIContext{
-					Action: UIActionOpen,
-					Value:  false,
-				},
-			},
-		})
-		data, _ := json.Marshal(atts)
-		Logger.Debug(string(data))
-		return atts, nil
-
-	case "/7_timer":
-		args := strings.TrimSpace(args)
-		var sch map[string]int
-		if args == "" {
-			g.schedule <- sch
-			return "schedule is canceled", nil
-		}
-		var err error
-		if strings.Contains(args, ":") {
-			err = json.Unmarshal([]byte("{"+args+"}"), &sch)
-		} else {
-			sch = make(map[string]int)
-			var n int
-			n, err = strconv.Atoi(args)
-			sch["00:00"] = n
-		}
-		if err != nil {
-			return "", err
-		}
-		g.schedule <- sch
-		bytes, _ := json.Marshal(sch)
-		return fmt.Sprintf("%s schedule is set", strings.Trim(string(bytes), "{}")), nil
-
-	case "/7_ble_timer":
-		args := strings.TrimSpace(args)
-		var sch map[string]int
-		if args == "" {
-			g.bleSchedule <- sch
-			return "BLE schedule is canceled", nil
-		}
-		if strings.Contains(args, ":") {
-			return "", json.Unmarshal([]byte("{"+args+"}"), &sch)
-		}
-		sch = make(map[string]int)
-		n, err := strconv.Atoi(args)
-		if err != nil {
-			return "", err
-		}
-		sch["00:00"] = n
-		g.bleSchedule <- sch
-		bytes, _ := json.Marshal(sch)
-		return fmt.Sprintf("%s BLE schedule is set", strings.Trim(string(bytes), "{}")), nil
-
-	case "/7_open_after_m":
-		args := strings.TrimSpace(args)
-		n := 0
-		if args != "" {
-			if n, err = strconv.Atoi(args); err != nil {
-				return "", err
-			}
-		}
-		if n > 0 {
-			go func() {
-				wait := time.Duration(n) * time.Minute
-				time.Sleep(wait)
-				lastTime := g.lastOpenedTime.Load()
-				closedTime := time.Since(time.Unix(0, lastTime))
-				cancel := closedTime < wait // if was opened while waiting then cancel
-				if !cancel {
-					g.openGate(cmd, "")
-					g.sendSystemNotification(fmt.Sprintf("opened by %s %s (minutes). previously opened %s ago", cmd, args,
-						closedTime.Round(time.Second)))
-				}
-			}()
-		} else {
-			g.openGate(cmd, "")
-			g.sendSystemNotification(fmt.Sprintf("opened by %s", cmd))
-		}
-		return fmt.Sprintf(
-			"opening after %d minutes at %s", n,
-			time.Now().Add(time.Duration(n)*time.Minute).In(Location).Format("15:04:05")), nil
-
-	case "/7_keep_open":
-		g.keepOpenGate()
-		return "gate state changed to opened", nil
-
-	case "/7_keep_open_cancel":
-		g.endKeepOpenGate()
-		return "gate state changed to normal", nil
-
-	case "/7_lock":
-		args := strings.TrimSpace(args)
-		minutes := 0
-		if args != "" {
-			minutes, err = strconv.Atoi(args)
-			if err != nil {
-				return "number of minutes expected. 0 - unlock immediately", nil
-			}
-		}
-		g.lock(time.Duration(minutes) * time.Minute)
-		return "gate locked", nil
-
-	case "/7_set":
-		args := strings.TrimSpace(args)
-		if args == "" || !strings.Contains(args, " ") {
-			ss, err := g.Settings.FindN(args)
-			if err != nil {
-				return "", err
-			}
-			if len(*ss) == 0 {
-				return "not found", nil
-			}
-			var msg strings.Builder
-			for i, set := range *ss {
-				if i != 0 {
-					msg.WriteString("\n")
-				}
-				msg.WriteString(set.Key)
-				msg.WriteString(" ")
-				msg.WriteString(set.ValueString())
-			}
-			return msg.String(), nil
-		}
-		i := strings.Index(args, " ")
-		key := args[:i]
-		value := strings.TrimSpace(args[i+1:])
-		n := len(value)
-		value = strings.Trim(value, `"`)
-		if len(value) == n {
-			value = strings.Trim(value, "'")
-		}
-		set := gate.Setting{Key: key}
-		if value == "" {
-			err = g.Settings.Delete(&set)
-			if err != nil {
-				return "", err
-			}
-			return "deleted", nil
-		}
-		set.SetString(value)
-		err := set.Validate()
-		if err != nil {
-			return "", err
-		}
-		err = g.Settings.Update(&set)
-		if err != nil {
-			return "", err
-		}
-		return "updated", nil
-
-	case "/7_sms":
-		args := strings.TrimSpace(args)
-		aa := strings.SplitN(args, " ", 3)
-		if len(aa) != 3 && len(aa) != 2 {
-			return "usage: /7_sms [<duration>] <phone> <text>", nil
-		}
-		var phone, sms string
-		relevance := 24 * time.Hour
-		if len(aa) == 3 {
-			d, err := time.ParseDuration(aa[0])
-			if err == nil {
-				relevance = d
-				phone = aa[1]
-				sms = aa[2]
-			} else {
-				phone = aa[0]
-				sms = aa[1] + " " + aa[2]
-			}
-		} else {
-			phone = aa[0]
-			sms = aa[1]
-		}
-		if !phoneRegex.MatchString(phone) {
-			return fmt.Sprintf("phone must start with +7,7,8, and be exactly 11 digits long. %q is invalid.", phone), nil
-		}
-		if len(sms) > 160 {
-			return "text is too long", nil
-		}
-		g.sendSMS(phone, sms, time.Now().Add(relevance))
-		return "saved for sending", nil
-
-	default:
-		return "", ErrNotFound
-	}
-}
-
-func (g *Gate) handleMattermostUserCommand(req MattermostRequest, urlPath string, mmUser *gate.MattermostUser, encoder *json.Encoder) {
-	switch req.Command {
-	case "/7_totp_auth":
-		// if !req.systemBotDirectMessage() {encoder.Encode(NewMattermostResponse("напишите это сообщение system-bot"))
-		text := strings.TrimSpace(req.Text)
-		if text == "" {
-			if mmUser != nil {
-				encoder.Encode(NewMattermostResponse(fmt.Sprintf(
-					"Ваш подтвержденный номер телефона %s", maskPhone(mmUser.Phone))))
-				return
-			}
-		}
-		i := strings.LastIndex(text, " ")
-		if i < 0 {
-			encoder.Encode(NewMattermostResponse(fmt.Sprintf(
-				"формат команды: %s <номер телефона> <код totp>  например: %s 79990010203 123456", req.Command, req.Command)))
-			return
-		}
-		phone := text[:i]
-		code := text[i+1:]
-		replacer := strings.NewReplacer("+", "", "(", "", ")", "", "-", "", " ", "")
-		phone = replacer.Replace(phone)
-		if phone[:1] == "8" {
-			phone = "7" + phone[1:]
-		} else if phone[:1] != "7" {
-			phone = "7" + phone
-		}
-		if len(phone) != 11 {
-			encoder.Encode(NewMattermostResponse("номер телефона не распознан"))
-			return
-		}
-		_, err := strconv.Atoi(phone)
-		if err != nil {
-			encoder.Encode(NewMattermostResponse("номер телефона не распознан"))
-			return
-		}
-		if len(code) != 6 {
-			encoder.Encode(NewMattermostResponse("неверный формат кода TOTP"))
-			return
-		}
-		_, err = strconv.Atoi(code)
-		if err != nil {
-			encoder.Encode(NewMattermostResponse("неверный формат кода TOTP"))
-			return
-		}
-		valid, err := validateTOTPCodeForPhone(phone, code)
-		if err != nil {
-			Logger.Errorf("%s TOTP validation error phone: %s code: %s  %v", urlPath, phone, code, err)
-			encoder.Encode(NewMattermostResponse("неверный код TOTP"))
-			return
-		}
-		if !valid {
-			Logger.Infof("%s TOTP validation is not OK  phone: %s code: %s", urlPath, phone, code)
-			encoder.Encode(NewMattermostResponse("неверный код TOTP"))
-			return
-		}
-		u, err := g.MattermostUsers.Find(req.UserId)
-		if err != nil {
-			Logger.Errorf("db error: %v", err)
-			encoder.Encode(NewMattermostResponse("внутренняя ошибка"))
-			return
-		}
-		if u == nil {
-			err = g.MattermostUsers.Insert(&gate.MattermostUser{UserId: req.UserId, Phone: phone})
-			if err != nil {
-				Logger.Errorf("db error: %v", err)
-				encoder.Encode(NewMattermostResponse("внутренняя ошибка"))
-				return
-			}
-			encoder.Encode(NewMattermostResponse("Ваш номер телефона подтвержден. Вам доступен функционал авторизованного пользоваеля."))
-			return
-		}
-		if u.Phone == phone {
-			encoder.Encode(NewMattermostResponse("Ваш номер телефона подтвержден (повторно). Вам доступен функционал авторизованного пользоваеля."))
-			return
-		}
-		u.Phone = phone
-		g.MattermostUsers.Update(u)
-		encoder.Encode(NewMattermostResponse("Ваш номер телефона изменен."))
-
-	}
-}
@@ -1,11 +1,28 @@
 package tgsrv
 
 import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"7stgbot/pales"
+	"7stgbot/pales/palestest"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base32"
 	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pquerna/otp/totp"
 )
 
 func TestBTMacsFromTOML(t *testing.T) {
@@ -143,7 +160,7 @@ func TestPalEsTimeGroupsFromJson(t *testing.T) {
 		{"19292", "", time.Date(2026, time.June, 7, 20, 1, 0, 0, loc), false},
 		{"19292", "", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), false},
 
-		{"", "xxx", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), true},
+		{"", "xxx", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), false},
 		{"", "", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), true},
 	}
 	for _, tt := range tests {
@@ -170,8 +187,8 @@ func TestPalEsEmptyTimeGroups(t *testing.T) {
 		want      bool
 	}
 	tests := []test{
-		{"", "shop", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), true},
-		{"", "xxx", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), true},
+		{"", "shop", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), false},
+		{"", "xxx", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), false},
 		{"", "", time.Date(2026, time.November, 1, 12, 0, 0, 0, loc), true},
 	}
 	for _, tt := range tests {
@@ -430,3 +447,681 @@ func TestGenerateCode(t *testing.T) {
 		}
 	}
 }
+
+func TestPalesSync(t *testing.T) {
+	srv := palestest.NewServer("DEV1", "u", "p")
+	defer srv.Close()
+	srv.SetUsers(&pales.User{Id: "79990010203", Firstname: "Михаил", Lastname: "105", DialToOpen: true})
+	srv.SetGroups(&pales.TimeGroup{Id: "g1", GroupName: "day", EndDate: math.MaxInt64,
+		TimeArray: []*pales.TimeGroupDay{{DayOfWeek: 1, StartMinute: 0, EndMinute: 1439}}})
+
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Phones = make(map[string]*PalESUser)
+	g.Init(&config.Config{PalesPortalURL: srv.URL, PalesDeviceID: "DEV1", PalesPortalUser: "u", PalesPortalPwd: "p"}, nil)
+	telegram := telegramMessages(t, &g)
+
+	if err := g.loadPalesUsers(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := g.Phones["79990010203"].Lastname, "105"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := g.loadPalesTimeGroups(); err != nil {
+		t.Fatal(err)
+	}
+	if tg, err := g.timeGroups().get("g1", ""); tg == nil || err != nil {
+		t.Errorf("time group g1 not loaded")
+	}
+
+	g.palesLastLog.Tm = 1000
+	srv.AddLogs(&pales.LogRecord{UserId: "9990010203", Tm: 999, Reason: 12})
+	for i := range 15 {
+		srv.AddLogs(&pales.LogRecord{UserId: "9990010203", Tm: int64(1001 + i), Reason: 12})
+	}
+	if got, want := g.loadPalESLogs(), 15; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := g.palesLastLog.Tm, int64(1015); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := g.loadPalESLogs(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	srv.ExpireTokens()
+	srv.AddLogs(&pales.LogRecord{UserId: "9990010203", Tm: 1020, Reason: 12})
+	if got, want := g.loadPalESLogs(), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(telegram()), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRegistryPhones(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"89689504094", []string{"79689504094"}},
+		{"+7 (968) 950-40-94, 9689504095", []string{"79689504094", "79689504095"}},
+		{"8968950409", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got := registryPhones(tt.in)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPalesSyncPlan(t *testing.T) {
+	srv := palestest.NewServer("DEV1", "u", "p")
+	defer srv.Close()
+	srv.SetUsers(
+		&pales.User{Id: "79990000002", Firstname: "Иван", Lastname: "12", Output1: true, DialToOpen: true},
+		&pales.User{Id: "79990000005", Firstname: "Гость"},
+		&pales.User{Id: "79990000007", Firstname: "Мария", Lastname: "12", Output1: true})
+
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Phones = make(map[string]*PalESUser)
+	os.WriteFile(filepath.Join(g.CfgDir, "reestr.csv"), []byte(
+		"Номер участка,ФИО собственника,Телефон\n"+
+			"11,Петров Петр Петрович,89990000001\n"+
+			"12,Иванов Иван Иванович,89990000002\n"), 0644)
+	g.Init(&config.Config{PalesPortalURL: srv.URL, PalesDeviceID: "DEV1", PalesPortalUser: "u", PalesPortalPwd: "p"}, nil)
+	g.setRestricted("79990000002", true, "test")
+
+	res, err := g.doHandleMattermostSysCommand("/7_pales_sync", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := g.palesPlan.Load()
+	if plan == nil {
+		t.Fatalf("no plan: %v", res)
+	}
+	if got, want := len(plan.Changes), 3; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, plan)
+	}
+	if _, err := g.applyPalesSync(context.Background(), "wrong", "test"); err == nil {
+		t.Errorf("wrong plan id is applied")
+	}
+	if _, err := g.doHandleMattermostSysCommand("/7_pales_sync", "apply "+plan.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"79990000001": true, "79990000002": false, "79990000007": true}
+	users := srv.Users()
+	if got := len(users); got != len(want) {
+		t.Errorf("got %v, want %v", got, len(want))
+	}
+	for _, u := range users {
+		if got, ok := want[u.Id]; !ok || got != u.Output1 {
+			t.Errorf("%s: got %v, want %v", u.Id, u.Output1, got)
+		}
+	}
+	if g.palesPlan.Load() != nil {
+		t.Errorf("plan is not cleared")
+	}
+}
+
+func TestLocalTimeGroups(t *testing.T) {
+	spec, err := parseTimeGroupArgs(strings.Fields("shop 1-5 08:00-20:00 6,7 10:00-24:00 from 2026-05-01 to 2026-09-30 holidays 2026-06-12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := spec.toTimeGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	palesShop := &PalEsTimeGroup{Id: "19292", GroupName: "shop", EndDate: math.MaxInt64,
+		TimeArray: []*PalEsTimeGroupDay{{DayOfWeek: 2, StartMinute: 0, EndMinute: 1439}}}
+	tg := mergeTimeGroups([]*PalEsTimeGroup{palesShop}, []*PalEsTimeGroup{local})
+	loc := Location
+	tests := []struct {
+		date time.Time
+		want bool
+	}{
+		{time.Date(2026, time.June, 1, 7, 59, 0, 0, loc), false}, // Monday
+		{time.Date(2026, time.June, 1, 8, 0, 0, 0, loc), true},
+		{time.Date(2026, time.June, 1, 20, 1, 0, 0, loc), false},
+		{time.Date(2026, time.June, 6, 9, 59, 0, 0, loc), false},  // Saturday
+		{time.Date(2026, time.June, 7, 23, 59, 0, 0, loc), true},  // Sunday
+		{time.Date(2026, time.June, 12, 12, 0, 0, 0, loc), false}, // holiday
+		{time.Date(2026, time.April, 30, 12, 0, 0, 0, loc), false},
+		{time.Date(2026, time.September, 30, 12, 0, 0, 0, loc), true},
+		{time.Date(2026, time.October, 1, 12, 0, 0, 0, loc), false},
+	}
+	for _, tt := range tests {
+		// local group wins by name even over the id of the pal-es one, which is still found by id only
+		for _, id := range []string{"", "19292"} {
+			if got := tg.contains(id, "shop", tt.date); got != tt.want {
+				t.Errorf("%q %s got %v, want %v", id, tt.date.Format(time.DateTime), got, tt.want)
+			}
+		}
+	}
+	if got, want := tg.contains("19292", "", time.Date(2026, time.June, 1, 7, 0, 0, 0, loc)), true; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := local.String(), "shop [local] Вс 10:00-23:59 Пн 08:00-20:00 Вт 08:00-20:00 Ср 08:00-20:00 Чт 08:00-20:00 Пт 08:00-20:00 Сб 10:00-23:59 from 2026-05-01 to 2026-09-30 holidays 2026-06-12"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"x 0-5 08:00-20:00", "x 1-5 20:00-08:00", "x 1-5 8-25", "x 1-5"} {
+		spec, err := parseTimeGroupArgs(strings.Fields(bad))
+		if err == nil {
+			_, err = spec.toTimeGroup()
+		}
+		if err == nil {
+			t.Errorf("%q: error expected", bad)
+		}
+	}
+}
+
+func TestTimeGroupsCache(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	gate.Logger = Logger
+
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{}, db)
+	if _, err := g.doHandleMattermostSysCommand("/7_tg", "set day 1-7 08:00-20:00", "test"); err != nil {
+		t.Fatal(err)
+	}
+	err = g.setTimeGroups(timeGroupSourcePales, palesTimeGroups([]*pales.TimeGroup{{Id: "g1", GroupName: "night", EndDate: math.MaxInt64}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restart without the cloud
+	var g2 Gate
+	g2.CfgDir = t.TempDir()
+	g2.Init(&config.Config{}, db)
+	day, _ := g2.timeGroups().get("", "day")
+	if g1, _ := g2.timeGroups().get("g1", ""); day == nil || g1 == nil {
+		t.Errorf("groups are not restored: %v", g2.timeGroups().Groups.List)
+	}
+	if _, err := g2.doHandleMattermostSysCommand("/7_tg", "del day", "test"); err != nil {
+		t.Fatal(err)
+	}
+	var g3 Gate
+	g3.Init(&config.Config{}, db)
+	if got, want := len(g3.timeGroups().Groups.List), 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCalendarCommand(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	gate.Logger = Logger
+
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{}, db)
+	if _, err := g.doHandleMattermostSysCommand("/7_cal", "add holiday 2026-06-12 День России", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.doHandleMattermostSysCommand("/7_cal", "add season 2026-06-01/2026-08-31 Лето", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.doHandleMattermostSysCommand("/7_cal", "add vacation 2026-06-01 x", "test"); err == nil {
+		t.Error("unknown kind error expected")
+	}
+	summer := g.calendar().On(time.Date(2026, time.July, 1, 0, 0, 0, 0, Location)).Names
+	if len(summer) != 1 {
+		t.Fatalf("got %v, want one season", summer)
+	}
+	var id string
+	for _, e := range g.calendar().Exceptions {
+		if e.Name == "Лето" {
+			id = e.ID
+		}
+	}
+	if _, err := g.doHandleMattermostSysCommand("/7_cal", "timer "+id+` "07:00":5, "20:00":0`, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart restores the calendar
+	var g2 Gate
+	g2.CfgDir = t.TempDir()
+	g2.Init(&config.Config{}, db)
+	sch := NewOpenSchedule(map[string]int{"00:00": 15})
+	tests := []struct {
+		t    time.Time
+		want int
+	}{
+		{time.Date(2026, time.May, 31, 12, 0, 0, 0, Location), 15},
+		{time.Date(2026, time.June, 1, 12, 0, 0, 0, Location), 5},
+		{time.Date(2026, time.June, 1, 21, 0, 0, 0, Location), 0},
+	}
+	for _, tt := range tests {
+		if got := g2.calendarPeriod(sch, tt.t, false); got != tt.want {
+			t.Errorf("%s got %v, want %v", tt.t.Format(time.DateTime), got, tt.want)
+		}
+		if got := g2.calendarPeriod(sch, tt.t, true); got != 15 {
+			t.Errorf("%s ble got %v, want %v", tt.t.Format(time.DateTime), got, 15)
+		}
+	}
+	// 2026-06-12 is Friday, checked as Sunday
+	if got, want := g2.calendar().Weekday(time.Date(2026, time.June, 12, 12, 0, 0, 0, Location)), time.Sunday; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCalendarKeepOpen(t *testing.T) {
+	tests := []struct {
+		name               string
+		active, opened     bool
+		wantBegin, wantEnd bool
+	}{
+		{"exception starts", true, false, true, false},
+		{"exception goes on", true, true, false, false},
+		{"exception is over", false, true, false, true},
+		{"manual keep open", false, true, false, false},
+		{"exception starts while kept open", true, true, false, false},
+		{"exception is over, manual keep open stays", false, true, false, false},
+	}
+	var c calendarKeepOpenState
+	for _, tt := range tests {
+		if begin, end := c.tick(tt.active, tt.opened); begin != tt.wantBegin || end != tt.wantEnd {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, begin, end, tt.wantBegin, tt.wantEnd)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	gate.Logger = Logger
+
+	settings := gate.NewSettings(db)
+	s := gate.Setting{Key: gate.ScheduledSettingsKeyPrefix + "7_timer"}
+	s.SetString("{from: 22:30, to: 7:00, args: 10}")
+	settings.Update(&s)
+
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{}, db)
+	jj := g.Jobs.List()
+	if len(jj) != 1+len(readingJobs) || jj[0].ID != "mm-daily-7_timer" || jj[0].Cron != "30 22 * * *" || jj[0].Command != "/7_timer" || jj[0].Args != "10" ||
+		jj[0].CatchUpWithinMilli != (8*time.Hour+30*time.Minute).Milliseconds() {
+		t.Fatalf("got %v, want migrated mm-daily job", jj)
+	}
+	if ss, _ := g.Settings.FindN(gate.ScheduledSettingsKeyPrefix); len(*ss) != 0 {
+		t.Errorf("got %v, want no mm-daily settings", *ss)
+	}
+
+	if _, err := g.doHandleMattermostSysCommand("/7_open_after_m", "15", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.doHandleMattermostSysCommand("/7_jobs", "cron night 0 23 * * 1-5 /7_keep_open_cancel", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.doHandleMattermostSysCommand("/7_jobs", "cron readings-remind 0 10 26 * * /7_billing remind", "test"); err != nil {
+		t.Fatal(err)
+	}
+	// restart keeps pending opening
+	var g2 Gate
+	g2.CfgDir = t.TempDir()
+	g2.Init(&config.Config{}, db)
+	jj = g2.Jobs.List()
+	if got, want := len(jj), 3+len(readingJobs); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if i := slices.IndexFunc(jj, func(j gate.Job) bool { return j.ID == "readings-remind" }); i < 0 || jj[i].Cron != "0 10 26 * *" {
+		t.Errorf("got %v, want the reading reminder rescheduled", jj)
+	}
+	res, err := g2.doHandleMattermostSysCommand("/7_open_after_m", "cancel", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res, "1 pending openings cancelled"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := g2.doHandleMattermostSysCommand("/7_jobs", "del night", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g2.doHandleMattermostSysCommand("/7_jobs", "del night", "test"); err != ErrNotFound {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSetCommand(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	gate.Logger = Logger
+
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{}, db)
+	tests := []struct {
+		args string
+		want string
+		err  bool
+	}{
+		{"g.minCodeLn.i 8", "", true},
+		{"g.minCodeLen.i 8", "updated", false},
+		{"g.minCodeLen.i 99", "", true},
+		{"g.minCodeLen.i x", "", true},
+		{`g.schedule {"07:00":10}`, "updated, applied after restart", false},
+		{`g.schedule {"7":10}`, "", true},
+		{"pales-tg.79001234567 night", "updated", false},
+		{"g.minCodeLen.i 6", "updated", false},
+		{`g.minCodeLen.i ""`, "deleted", false},
+		{"g.minCodeLen.i", "not found", false},
+		{"describe g.minCodeLen", "g.minCodeLen.i int default 0 [0, 16] - any keypad code of this length or longer opens the gate, 0 - off = 0", false},
+	}
+	for _, tt := range tests {
+		res, err := g.doHandleMattermostSysCommand("/7_set", tt.args, "mm:admin")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.args, err, tt.err)
+		}
+		if err == nil && res != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.args, res, tt.want)
+		}
+	}
+	res, err := g.doHandleMattermostSysCommand("/7_set", "history g.minCodeLen.i", "mm:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(res.(string), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], `mm:admin g.minCodeLen.i: "6" -> ""`) ||
+		!strings.HasSuffix(lines[2], `mm:admin g.minCodeLen.i: "" -> "8"`) {
+		t.Errorf("got %v, want 3 changes", res)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{Port: 8084}, nil)
+	telegram := telegramMessages(t, &g)
+	var cfgSub config.ConfigSubscription
+	ch := cfgSub.Subscribe()
+	gateCh := g.cfgSub.Subscribe()
+	path := filepath.Join(g.CfgDir, "config.toml")
+	gates := Gates{&g}
+
+	os.WriteFile(path, []byte("Port = 8085\nAdminPhone = \"123\"\n"), 0600)
+	if err := gates.ReloadConfig(path, &cfgSub); err == nil {
+		t.Fatal("error expected")
+	}
+	if got, want := len(ch), 0; got != want {
+		t.Errorf("published %v, want %v", got, want)
+	}
+	if got, want := g.config().Port, 8084; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	os.WriteFile(path, []byte("Port = 8085\n[SMSRateLimiterCfg]\n5s = 1\n"), 0600)
+	if err := gates.ReloadConfig(path, &cfgSub); err != nil {
+		t.Fatal(err)
+	}
+	cfg := <-ch
+	if cfg != g.config() || cfg.Port != 8085 || len(cfg.SMSRateLimiter) != 1 {
+		t.Errorf("got %+v, want reloaded config", cfg)
+	}
+	if cfg := <-gateCh; cfg != g.config() {
+		t.Errorf("got %+v, want gate config", cfg)
+	}
+	if mm := telegram(); len(mm) != 2 || !strings.Contains(mm[0], "is rejected") || !strings.Contains(mm[1], `Port: "8084" -> "8085"`) {
+		t.Errorf("got %q, want rejected and diff", mm)
+	}
+}
+
+func TestReloadConfigGates(t *testing.T) {
+	Secrets.Set("gate-pwd", "top-pwd")
+	Secrets.Set("pales-portal-pwd", "portal-pwd")
+	Secrets.Set("service.telegram-token", "service-token")
+	Secrets.Set("service.gate-pwd", "service-pwd")
+	defer func() {
+		for _, name := range []string{"gate-pwd", "pales-portal-pwd", "service.telegram-token", "service.gate-pwd"} {
+			Secrets.Delete(name)
+		}
+	}()
+	var main, service Gate
+	main.CfgDir, service.CfgDir = t.TempDir(), t.TempDir()
+	main.Init(&config.Config{Port: 8084}, nil)
+	service.Init(&config.Config{Port: 8084, GateID: "service", GatePath: "/g/service"}, nil)
+	path := filepath.Join(main.CfgDir, "config.toml")
+	os.WriteFile(path, []byte("Port = 8085\n[[Gates]]\nID = \"service\"\nBLELocation = 101\nPalesDeviceID = \"4G600000\"\nGate.IP = \"10.0.0.2\"\n"), 0600)
+	var cfgSub config.ConfigSubscription
+	if err := (Gates{&main, &service}).ReloadConfig(path, &cfgSub); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		g                             *Gate
+		pwd, portalPwd, telegramToken string
+	}{
+		{&main, "top-pwd", "portal-pwd", ""},
+		{&service, "service-pwd", "portal-pwd", "service-token"},
+	}
+	for _, tt := range tests {
+		c := tt.g.config()
+		if c.Port != 8085 || c.Gate.Pwd != tt.pwd || c.PalesPortalPwd != tt.portalPwd || c.TgToken != tt.telegramToken {
+			t.Errorf("%s: got %q %q %q, want %q %q %q", c.GateID, c.Gate.Pwd, c.PalesPortalPwd, c.TgToken,
+				tt.pwd, tt.portalPwd, tt.telegramToken)
+		}
+	}
+}
+
+func TestGates(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+Port = 8084
+TelegramChatId = "-1"
+[OpenSchedule]
+"07:00" = 10
+
+[[Gates]]
+ID = "service"
+BLELocation = 101
+TelegramChatId = "-2"
+NtfySystemTopic = "service-system"
+PalesDeviceID = "4G600000"
+[Gates.Gate]
+IP = "10.0.0.2"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gates Gates
+	for _, c := range cfg.GateConfigs() {
+		g := new(Gate)
+		g.CfgDir = t.TempDir()
+		g.Init(c, nil)
+		gates = append(gates, g)
+	}
+	main, service := gates[0], gates.Find("service")
+	if main.ID != config.DefaultGateID || service == nil {
+		t.Fatalf("got %v, want main and service gates", []string{gates[0].ID, gates[1].ID})
+	}
+	tests := []struct {
+		got, want any
+	}{
+		{main.TelegramChatId, "-1"},
+		{service.TelegramChatId, "-2"},
+		{service.config().Gate.IP, "10.0.0.2"},
+		{service.config().OpenSchedule["07:00"], 10},
+		{main.bleLocation(), config.DefaultBLELocation},
+		{service.bleLocation(), 101},
+		{main.url("/gate/mm/action"), "https://7slavka.ru/gate/mm/action"},
+		{service.url("/gate/mm/action"), "https://7slavka.ru/g/service/gate/mm/action"},
+		{service.secretName("mattermost-token-7_open"), "service.mattermost-token-7_open"},
+	}
+	for i, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%d: got %v, want %v", i, tt.got, tt.want)
+		}
+	}
+
+	ws := webSrv{gate: main, gates: gates}
+	if got := ws.gateByBLELocation(101); got != service {
+		t.Errorf("got %v, want service", got.ID)
+	}
+	if got := ws.gateByBLELocation(7); got != main {
+		t.Errorf("got %v, want main", got.ID)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/g/service/", http.StripPrefix("/g/service", withGate(service, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ws.gateOf(r) != service || r.URL.Path != "/gate/keypad" {
+			t.Errorf("got %v %v, want service /gate/keypad", ws.gateOf(r).ID, r.URL.Path)
+		}
+	}))))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/g/service/gate/keypad", nil))
+}
+
+func TestTOTP(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	gate.Logger = Logger
+	const phone = "79990010203"
+	db.Exec(createTOTPBefore)
+	db.Exec("INSERT INTO totp (phone, created_at_ms) VALUES(?,?)", phone, 1)
+
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{}, db)
+	code := func(secret []byte, tm time.Time) string {
+		c, err := totp.GenerateCodeCustom(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), tm, totpOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	check := func(c string, tm time.Time) (bool, error) {
+		return g.checkTOTP(phone, c, tm)
+	}
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, Location)
+	legacy := legacyTOTPSecrets(phone)[0]
+	if ok, err := check(code(legacy, now), now); !ok || err != nil {
+		t.Errorf("legacy got %v %v, want true", ok, err)
+	}
+	if ok, err := check(code(legacy, now), now.Add(10*time.Second)); ok || err != errTOTPReplay {
+		t.Errorf("replay got %v %v, want %v", ok, err, errTOTPReplay)
+	}
+
+	secret, err := g.enrollTOTP(phone, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the QR code is reloaded, the secret being scanned stays pending
+	if again, err := g.enrollTOTP(phone, now.Add(time.Hour)); err != nil || !bytes.Equal(again, secret) {
+		t.Errorf("got %x %v, want the pending secret %x", again, err, secret)
+	}
+	other, _ := g.enrollTOTP("79990010204", now)
+	if again, _ := g.enrollTOTP("79990010204", now.Add(totpPendingTTL)); bytes.Equal(again, other) {
+		t.Error("got the expired pending secret, want a new one")
+	}
+	now = now.Add(time.Minute)
+	if ok, err := check(code(legacy, now), now); !ok || err != nil {
+		t.Errorf("legacy while pending got %v %v, want true", ok, err)
+	}
+	now = now.Add(time.Minute)
+	if ok, err := check(code(secret, now), now); !ok || err != nil {
+		t.Errorf("pending got %v %v, want true", ok, err)
+	}
+	now = now.Add(time.Minute)
+	if ok, _ := check(code(legacy, now), now); ok {
+		t.Errorf("legacy after activation got %v, want false", ok)
+	}
+	if got, want := g.findTOTPPhoneByCode("203", code(secret, now), now), phone; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, _ := g.doHandleMattermostSysCommand("/7_totp", "list", "test"); !strings.Contains(got.(string), "active since 2026-05-01") {
+		t.Errorf("got %v, want active", got)
+	}
+
+	if _, err := g.doHandleMattermostSysCommand("/7_totp", "reset "+phone, "test"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if ok, _ := check(code(secret, now), now); ok {
+		t.Errorf("after reset got %v, want false", ok)
+	}
+
+	db.Exec("UPDATE totp SET legacy = 1")
+	if _, err := g.setSetting(totpLegacyUntilKey, "2026-05-01", "test"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	if ok, _ := check(code(legacy, now), now); ok {
+		t.Errorf("legacy after migration window got %v, want false", ok)
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	gate.Logger = Logger
+	const phone = "79990010203"
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{}, db)
+	secret, err := g.enrollTOTP(phone, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := func(tm time.Time) string {
+		c, _ := totp.GenerateCodeCustom(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), tm, totpOpts)
+		return c
+	}
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, Location)
+	for i := range totpMaxFails {
+		if got, reply := g.totpPhone("tg:9", phone, "000000", "/totp_auth", now); got != "" || reply != "неверный код TOTP" {
+			t.Fatalf("%d: got %q %q, want a wrong code", i, got, reply)
+		}
+	}
+	tests := []struct {
+		actor string
+		now   time.Time
+		want  string
+	}{
+		{"tg:9", now, ""},                      // the chat is locked out
+		{"tg:10", now, ""},                     // the phone is locked out
+		{"tg:10", now.Add(totpLockout), phone}, // the lockout is over
+		{"tg:9", now.Add(totpLockout + time.Minute), phone},
+	}
+	for i, tt := range tests {
+		if got, _ := g.totpPhone(tt.actor, phone, code(tt.now), "/totp_auth", tt.now); got != tt.want {
+			t.Errorf("%d %s: got %q, want %q", i, tt.actor, got, tt.want)
+		}
+	}
+
+	var f totpFails
+	for i, want := range []time.Duration{totpLockout, 2 * totpLockout, 4 * totpLockout} {
+		var got map[string]time.Duration
+		for range totpMaxFails {
+			got = f.fail(now, "actor:tg:9")
+		}
+		if got["actor:tg:9"] != want || f.locked(now, "phone:1", "actor:tg:9") != want {
+			t.Errorf("%d: got %v, want the lockout of %v", i, got, want)
+		}
+		now = now.Add(want)
+	}
+	if f.fail(now.Add(totpFailsTTL+time.Second), "actor:tg:9"); f.m["actor:tg:9"].lockouts != 0 {
+		t.Errorf("got %+v, want lockouts forgotten", f.m["actor:tg:9"])
+	}
+}
+
+// createTOTPBefore is the table of derived secrets
+const createTOTPBefore = `CREATE TABLE totp (phone TEXT PRIMARY KEY, created_at_ms int NOT NULL);`
@@ -0,0 +1,97 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Gates are the gates served by the process, the first one is configured at the top level of config.toml
+// and is served without /g/<id> prefix
+type Gates []*Gate
+
+func (gg Gates) Find(id string) *Gate {
+	for _, g := range gg {
+		if g.ID == id {
+			return g
+		}
+	}
+	return nil
+}
+
+// start runs loops of the gate, ipReq is served by BLE tracking for the gate app
+func (g *Gate) start(abort chan struct{}, ipReq chan Pair[string, chan string]) {
+	topicEvents := make(chan string, 1)
+	go g.palesLoginAndLoadLoop(abort, topicEvents, g.config(), g.cfgSub.Subscribe())
+	go g.handlingCalls(abort)
+	go g.handlingSmses(abort)
+	go g.handlingBLETracking(abort, g.config(), g.cfgSub.Subscribe(), ipReq)
+	go g.readingSMSesForSend(abort)
+	go g.handlingKeypadRequests(abort)
+	go g.Notify.Run(abort)
+	go g.listenPalESMQTT(abort, topicEvents)
+	go g.handlingGateState(abort, g.config(), g.cfgSub.Subscribe())
+	go g.Jobs.Run(abort)
+}
+
+// url is the absolute URL of the path of the gate
+func (g *Gate) url(path string) string {
+	return fmt.Sprintf("https://%s%s%s", g.siteDomain(), g.config().GatePath, path)
+}
+
+func (g *Gate) siteDomain() string {
+	return cmp.Or(g.config().SiteDomain, config.DefaultSiteDomain)
+}
+
+func (g *Gate) appDomain() string {
+	return cmp.Or(g.config().AppDomain, config.DefaultAppDomain)
+}
+
+// bleLocation is the location of BLE trackers at the gate, 0 - the gate has no trackers
+func (g *Gate) bleLocation() int {
+	if g.config().GatePath != "" {
+		return g.config().BLELocation
+	}
+	return cmp.Or(g.config().BLELocation, config.DefaultBLELocation)
+}
+
+// secretName scopes secrets of additional gates by "<id>." prefix
+func (g *Gate) secretName(name string) string {
+	return gateSecretName(g.config(), name)
+}
+
+func gateSecretName(c *config.Config, name string) string {
+	if c.GatePath == "" {
+		return name
+	}
+	return c.GateID + "." + name
+}
+
+type gateCtxKey struct{}
+
+// withGate serves h for the gate, handlers take it by gateOf
+func withGate(g *Gate, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), gateCtxKey{}, g)))
+	})
+}
+
+// gateOf returns the gate of /g/<id> request, the default gate otherwise
+func (s *webSrv) gateOf(r *http.Request) *Gate {
+	if g, ok := r.Context().Value(gateCtxKey{}).(*Gate); ok {
+		return g
+	}
+	return s.gate
+}
+
+// gateByBLELocation returns the gate of the trackers location, the default one logs unknown locations
+func (s *webSrv) gateByBLELocation(loc int) *Gate {
+	for _, g := range s.gates {
+		if loc != 0 && g.bleLocation() == loc {
+			return g
+		}
+	}
+	return s.gate
+}
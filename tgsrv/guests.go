@@ -0,0 +1,114 @@
+package tgsrv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// guestRequestTTL is how long buttons of a guest request are accepted
+const guestRequestTTL = 30 * time.Minute
+
+// guestRequests are guest requests sent by one of the bots, Mattermost or Telegram
+type guestRequests struct {
+	mu sync.Mutex
+	m  map[string]*guestRequest // by ref
+}
+
+// guestRequest is "guests of the plot at the gate" sent to owners of the plot
+type guestRequest struct {
+	plot    string
+	created time.Time
+	posts   []guestPost
+	result  string // set when one of the owners opened
+}
+
+// guestPost is the message with buttons sent to an owner
+type guestPost struct {
+	userID string // mattermost user or telegram chat
+	phone  string
+	update func(ctx context.Context, text string) error // replaces the buttons by the text
+}
+
+// guestOpener opens the gate for the owner pressed the button
+type guestOpener func(ctx context.Context, phone, reason string) (string, bool)
+
+// add keeps the request if it was sent to anybody, expired ones are dropped
+func (rr *guestRequests) add(ref string, req *guestRequest) {
+	if len(req.posts) == 0 {
+		return
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.m == nil {
+		rr.m = make(map[string]*guestRequest)
+	}
+	for k, r := range rr.m {
+		if time.Since(r.created) > guestRequestTTL {
+			delete(rr.m, k)
+		}
+	}
+	rr.m[ref] = req
+}
+
+// guestButton handles a button of the request, the first owner opening the gate updates posts of the others.
+// done is false if the user may press the buttons again.
+func (g *Gate) guestButton(ctx context.Context, rr *guestRequests, via, ref, userID string, open bool, openGate guestOpener) (reply string, done bool) {
+	rr.mu.Lock()
+	req := rr.m[ref]
+	if req == nil || time.Since(req.created) > guestRequestTTL {
+		rr.mu.Unlock()
+		return "запрос устарел", true
+	}
+	if req.result != "" {
+		rr.mu.Unlock()
+		return req.result, true
+	}
+	i := slices.IndexFunc(req.posts, func(p guestPost) bool { return p.userID == userID })
+	if i < 0 {
+		rr.mu.Unlock()
+		return "нет доступа", false
+	}
+	phone := req.posts[i].phone
+	if !open {
+		rr.mu.Unlock()
+		return fmt.Sprintf("👍 гости %s участка не пропущены", req.plot), true
+	}
+	if !g.allowedNow(phone) {
+		rr.mu.Unlock()
+		return "нет доступа к шлагбауму", false
+	}
+	u := g.Phones[phone]
+	// the first click wins, others get the result, it is cleared if the gate did not open
+	req.result = fmt.Sprintf("⏳ %s %s открывает шлагбаум гостям %s участка", u.Firstname, u.Lastname, req.plot)
+	rr.mu.Unlock()
+
+	res, ok := openGate(ctx, phone, fmt.Sprintf("opened by %s %s for guests of %s", via, u.name(), req.plot))
+	rr.mu.Lock()
+	if !ok {
+		req.result = ""
+		rr.mu.Unlock()
+		return res, false
+	}
+	req.result = fmt.Sprintf("✅ %s %s открыл шлагбаум гостям %s участка", u.Firstname, u.Lastname, req.plot)
+	result := req.result
+	others := slices.Delete(slices.Clone(req.posts), i, i+1)
+	rr.mu.Unlock()
+
+	for _, p := range others {
+		if err := p.update(ctx, result); err != nil {
+			Logger.Errorf("%s update guest request of %s: %v", via, p.userID, err)
+		}
+	}
+	return result, true
+}
+
+func newGuestRef() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
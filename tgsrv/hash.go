@@ -1,6 +1,7 @@
 package tgsrv
 
 import (
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/base64"
@@ -9,22 +10,31 @@ import (
 	"strings"
 )
 
+// sha1Hash is salted by the current qr-salt
 func sha1Hash(p ...string) string {
+	return sha1HashSalt(Secrets.Get(secretQRSalt), p...)
+}
+
+func sha1HashSalt(salt string, p ...string) string {
 	hasher := sha1.New()
 	for _, s := range p {
 		io.WriteString(hasher, s)
 	}
-	io.WriteString(hasher, QRSalt)
+	io.WriteString(hasher, salt)
 	h := fmt.Sprintf("%x", hasher.Sum(nil))
 	return h
 }
 
 func md5HashBytes(p ...string) []byte {
+	return md5HashBytesSalt(Secrets.Get(secretQRSalt), p...)
+}
+
+func md5HashBytesSalt(salt string, p ...string) []byte {
 	hasher := md5.New()
 	for _, s := range p {
 		io.WriteString(hasher, s)
 	}
-	io.WriteString(hasher, QRSalt)
+	io.WriteString(hasher, salt)
 	return hasher.Sum(nil)
 }
 
@@ -87,7 +97,14 @@ func decodeEmailAndMD5(p string) (string, error, bool) {
 		email = strings.ReplaceAll(email[:i], "@", "+") + email[i:]
 	}
 	hash, err := base64.StdEncoding.DecodeString(hash64)
-	decodedHex := fmt.Sprintf("%x", hash)
-	emailHashHex := fmt.Sprintf("%x", md5HashBytes(email))
-	return email, err, emailHashHex == decodedHex
+	if err != nil {
+		return email, err, false
+	}
+	// links made with retired salts are still valid until the salt is retired
+	for _, salt := range Secrets.Values(secretQRSalt) {
+		if bytes.Equal(md5HashBytesSalt(salt, email), hash) {
+			return email, nil, true
+		}
+	}
+	return email, nil, false
 }
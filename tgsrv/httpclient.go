@@ -64,7 +64,9 @@ func decodeFunc(jsonToVal interface{}) func(r io.Reader) error {
 
 func doRequestFunc(req *http.Request, ff ...func(io.Reader) error) error {
 	//c := netrc.CredMap["svnhost.aftpro.com"]
-	req.AddCookie(&http.Cookie{Name: "PHPSESSID", Value: "g1fp8ls87llt19bse2119sl0ro"})
+	if sid := Secrets.Get(secretPHPSessID); sid != "" {
+		req.AddCookie(&http.Cookie{Name: "PHPSESSID", Value: sid})
+	}
 	client.Timeout = time.Second * 5
 	resp, err := client.Do(req)
 	if err != nil {
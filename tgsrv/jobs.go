@@ -0,0 +1,324 @@
+package tgsrv
+
+import (
+	"7stgbot/gate"
+	"7stgbot/jobs"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobOpenAfter is an internal command of /7_open_after_m jobs
+const jobOpenAfter = "open-after"
+
+// jobCreatorSystem is the creator of jobs scheduled by the gate, other creators are subjects of principals
+const jobCreatorSystem = "system"
+
+func (g *Gate) initJobs(db gate.JobsDAO) {
+	g.Jobs = jobs.New(db, g.runJob)
+	if err := g.Jobs.Load(); err != nil {
+		Logger.Errorf("loading jobs: %v", err)
+	}
+	g.migrateScheduledSettings()
+	g.scheduleReadings()
+}
+
+// readingJobs remind owners to send readings at the end of the month and on its last days, then report
+// missing readings of the month to the board. The board changes them by /7_jobs cron with the same id.
+var readingJobs = []gate.Job{
+	{ID: "readings-remind", Cron: "0 12 25 * *", Args: "remind"},
+	{ID: "readings-remind-late", Cron: "0 12 2 * *", Args: "remind"},
+	{ID: "readings-report", Cron: "0 9 6 * *", Args: "report"},
+}
+
+// scheduleReadings adds reading jobs which do not exist
+func (g *Gate) scheduleReadings() {
+	jj := g.Jobs.List()
+	for _, j := range readingJobs {
+		if slices.ContainsFunc(jj, func(e gate.Job) bool { return e.ID == j.ID }) {
+			continue
+		}
+		j.Command, j.CatchUp, j.CatchUpWithinMilli, j.Creator = "/7_billing", true, (2 * 24 * time.Hour).Milliseconds(), jobCreatorSystem
+		if _, err := g.Jobs.Add(j); err != nil {
+			Logger.Errorf("scheduling %s: %v", j.ID, err)
+		}
+	}
+}
+
+func (g *Gate) runJob(j *gate.Job) (string, error) {
+	if j.Command == jobOpenAfter {
+		return g.openAfterJob(j)
+	}
+	res, err := g.handleCommandAs(j.Command, j.Args, "job:"+j.ID, g.jobPrincipal(j))
+	msg, ok := res.(string)
+	if !ok && res != nil {
+		var sb strings.Builder
+		encoder := json.NewEncoder(&sb)
+		encoder.Encode(res)
+		msg = strings.TrimSpace(sb.String())
+	}
+	return msg, err
+}
+
+// jobPrincipal is the creator of the job with the roles it has now, a job loses rights revoked from the creator.
+// Jobs of the gate and migrated mm-daily. settings run as the system.
+func (g *Gate) jobPrincipal(j *gate.Job) *Principal {
+	if j.Creator == jobCreatorSystem || strings.HasPrefix(j.Creator, gate.ScheduledSettingsKeyPrefix) {
+		return systemPrincipal()
+	}
+	p := principalOfSubject(j.Creator)
+	if p == nil {
+		// created by a command before creators were kept, it has no rights until it is scheduled again
+		return &Principal{}
+	}
+	return g.resolvePrincipal(p)
+}
+
+// migrateScheduledSettings moves mm-daily. settings to jobs
+func (g *Gate) migrateScheduledSettings() {
+	ss, err := g.Settings.FindN(gate.ScheduledSettingsKeyPrefix)
+	if err != nil || ss == nil {
+		return
+	}
+	for i := range *ss {
+		s := &(*ss)[i]
+		j, err := g.scheduleSetting(s)
+		if err != nil {
+			Logger.Errorf("migrating %s %s: %v", s.Key, s.ValueString(), err)
+			continue
+		}
+		Logger.Infof("%s %s migrated to job %s", s.Key, s.ValueString(), j.ID)
+		g.Settings.Delete(s)
+	}
+}
+
+// scheduleSetting adds a daily job for "mm-daily.<command>" setting {from: 22:00, to: 7:00, args: ...}.
+// The job runs at from and catches up after downtime until to.
+func (g *Gate) scheduleSetting(s *gate.Setting) (*gate.Job, error) {
+	sch, err := s.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	if !sch.IsValid() {
+		return nil, fmt.Errorf("invalid schedule %s", s.ValueString())
+	}
+	hhmm := strings.Split(sch.From, ":")
+	h, err := strconv.Atoi(hhmm[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad time %q", sch.From)
+	}
+	m := 0
+	if len(hhmm) > 1 {
+		if m, err = strconv.Atoi(hhmm[1]); err != nil {
+			return nil, fmt.Errorf("bad time %q", sch.From)
+		}
+	}
+	from, to, _ := sch.PeriodContaining(time.Now(), true)
+	cmd := s.Key[len(gate.ScheduledSettingsKeyPrefix):]
+	return g.Jobs.Add(gate.Job{
+		ID:                 "mm-daily-" + cmd,
+		Command:            "/" + cmd,
+		Args:               sch.Args,
+		Cron:               fmt.Sprintf("%d %d * * *", m, h),
+		CatchUp:            true,
+		CatchUpWithinMilli: to.Sub(from).Milliseconds(),
+		Creator:            s.Key,
+	})
+}
+
+// openAfter schedules opening of the gate, it is cancelled if the gate is opened meanwhile
+func (g *Gate) openAfter(minutes int, cmd string) (*gate.Job, error) {
+	return g.Jobs.Add(gate.Job{
+		ID:           jobOpenAfter + "-" + generateRandomID(4),
+		Command:      jobOpenAfter,
+		Args:         strconv.Itoa(minutes),
+		NextRunMilli: time.Now().Add(time.Duration(minutes) * time.Minute).UnixMilli(),
+		CatchUp:      true,
+		Creator:      cmd,
+	})
+}
+
+func (g *Gate) openAfterJob(j *gate.Job) (string, error) {
+	lastOpened := time.Unix(0, g.lastOpenedTime.Load())
+	if lastOpened.UnixMilli() > j.CreatedAtMilli {
+		return fmt.Sprintf("cancelled, opened at %s", lastOpened.In(Location).Format("15:04:05")), nil
+	}
+	closedTime := time.Since(lastOpened).Round(time.Second)
+	g.openGate(j.Creator, "")
+	g.sendSystemNotification(fmt.Sprintf("opened by %s %s (minutes). previously opened %s ago", j.Creator, j.Args, closedTime))
+	return "opened", nil
+}
+
+// cancelOpenAfter cancels pending /7_open_after_m jobs
+func (g *Gate) cancelOpenAfter() (int, error) {
+	n := 0
+	for _, j := range g.Jobs.List() {
+		if j.Command != jobOpenAfter {
+			continue
+		}
+		ok, err := g.Jobs.Cancel(j.ID)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func jobString(j *gate.Job) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s", j.ID, time.UnixMilli(j.NextRunMilli).In(Location).Format("2006-01-02 15:04"))
+	if j.Cron != "" {
+		fmt.Fprintf(&sb, " [%s]", j.Cron)
+	}
+	sb.WriteString(" " + j.Command)
+	if j.Args != "" {
+		sb.WriteString(" " + j.Args)
+	}
+	if !j.CatchUp {
+		sb.WriteString(" skip-missed")
+	} else if j.CatchUpWithinMilli > 0 {
+		fmt.Fprintf(&sb, " catch-up-within %s", time.Duration(j.CatchUpWithinMilli)*time.Millisecond)
+	}
+	if j.Creator != "" {
+		sb.WriteString(" by " + j.Creator)
+	}
+	return sb.String()
+}
+
+func jobRunString(r *gate.JobRun) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s %s", time.UnixMilli(r.StartedAtMilli).In(Location).Format("2006-01-02 15:04:05"), r.JobID, r.Command)
+	if r.Args != "" {
+		sb.WriteString(" " + r.Args)
+	}
+	if r.Skipped {
+		sb.WriteString(" skipped")
+	}
+	if r.Error != "" {
+		sb.WriteString(" error: " + r.Error)
+	} else if r.Result != "" {
+		sb.WriteString(": " + r.Result)
+	}
+	return sb.String()
+}
+
+func (g *Gate) handleJobsCommand(c *mmCall) (string, error) {
+	cmd, args := c.Cmd, c.Args
+	usage := fmt.Sprintf("usage: %s [cron <id> <m h dom mon dow|@daily> </command> [args] | "+
+		"at <id> <2006-01-02T15:04> </command> [args] | catchup <id> on|off | del <id> | history [id]]", cmd)
+	aa := strings.Fields(args)
+	if len(aa) == 0 {
+		var sb strings.Builder
+		for i, j := range g.Jobs.List() {
+			if i != 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(jobString(&j))
+		}
+		if sb.Len() == 0 {
+			return "no jobs", nil
+		}
+		return sb.String(), nil
+	}
+	switch aa[0] {
+	case "cron", "at":
+		if len(aa) < 4 {
+			return usage, nil
+		}
+		j := gate.Job{ID: aa[1], CatchUp: true, Creator: jobCreator(c.Principal)}
+		rest := aa[2:]
+		if aa[0] == "cron" {
+			n := 5
+			if strings.HasPrefix(rest[0], "@") {
+				n = 1
+			}
+			if len(rest) <= n {
+				return usage, nil
+			}
+			j.Cron = strings.Join(rest[:n], " ")
+			rest = rest[n:]
+		} else {
+			t, err := time.ParseInLocation("2006-01-02T15:04", rest[0], Location)
+			if err != nil {
+				return usage, err
+			}
+			j.NextRunMilli = t.UnixMilli()
+			rest = rest[1:]
+		}
+		if !strings.HasPrefix(rest[0], "/") || rest[0] == cmd {
+			return usage, nil
+		}
+		j.Command = rest[0]
+		j.Args = strings.Join(rest[1:], " ")
+		added, err := g.Jobs.Add(j)
+		if err != nil {
+			return "", err
+		}
+		return "scheduled " + jobString(added), nil
+
+	case "catchup":
+		if len(aa) != 3 || (aa[2] != "on" && aa[2] != "off") {
+			return usage, nil
+		}
+		for _, j := range g.Jobs.List() {
+			if j.ID == aa[1] {
+				j.CatchUp = aa[2] == "on"
+				updated, err := g.Jobs.Add(j)
+				if err != nil {
+					return "", err
+				}
+				return "updated " + jobString(updated), nil
+			}
+		}
+		return "", ErrNotFound
+
+	case "del":
+		if len(aa) != 2 {
+			return usage, nil
+		}
+		ok, err := g.Jobs.Cancel(aa[1])
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", ErrNotFound
+		}
+		return "deleted", nil
+
+	case "history":
+		id := ""
+		if len(aa) > 1 {
+			id = aa[1]
+		}
+		rr, err := g.Jobs.History(id, 20)
+		if err != nil {
+			return "", err
+		}
+		var sb strings.Builder
+		for i, r := range rr {
+			if i != 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(jobRunString(&r))
+		}
+		if sb.Len() == 0 {
+			return "no runs", nil
+		}
+		return sb.String(), nil
+	}
+	return usage, nil
+}
+
+// jobCreator is the subject of the principal scheduling a job, jobCreatorSystem for the system
+func jobCreator(p *Principal) string {
+	if s := p.actorSubject(); s != "" {
+		return s
+	}
+	return jobCreatorSystem
+}
@@ -12,7 +12,8 @@ const (
 	UIStyleDefault = "default"
 	UIStylePrimary = "primary"
 
-	UIActionOpen = "open"
+	UIActionOpen  = "open"
+	UIActionGuest = "guest"
 )
 
 /*
@@ -66,6 +67,10 @@ type MattermostRequest struct {
 
 func (r *MattermostRequest) systemBotDirectMessage() bool {
 	const template = "%s__%s"
+	systemBotId := Secrets.Get(secretSystemBotID)
+	if systemBotId == "" {
+		return false
+	}
 	return r.ChannelName == fmt.Sprintf(template, systemBotId, r.UserId) ||
 		r.ChannelName == fmt.Sprintf(template, r.UserId, systemBotId)
 }
@@ -95,6 +100,10 @@ type MMUIIntegration struct {
 type MMUIContext struct {
 	Action string `json:"action"`
 	Value  bool   `json:"value"`
+	Ref    string `json:"ref,omitempty"`  // request of the action, e.g. guests at the gate
+	Plot   string `json:"plot,omitempty"` // plot number of guests
+	Exp    int64  `json:"exp,omitempty"`  // unix time the button expires
+	Sig    string `json:"sig,omitempty"`  // signature of the fields and the user, see signAction
 }
 
 func (a *MattermostUIAttachment) addAction(p *MattermostUIAction) {
@@ -0,0 +1,163 @@
+package tgsrv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	openActionTTL   = 10 * time.Minute
+	openWaitTimeout = 15 * time.Second
+)
+
+var errBadAction = errors.New("bad signature of mattermost action")
+
+// mattermostActionKeys returns keys signing contexts of buttons, a random one is made if the secret is not set
+// so buttons posted before a restart stop working
+func (g *Gate) mattermostActionKeys() []string {
+	name := g.secretName(secretMattermostActionKey)
+	if keys := Secrets.Values(name); len(keys) != 0 {
+		return keys
+	}
+	g.mmActionsMu.Lock()
+	defer g.mmActionsMu.Unlock()
+	if Secrets.Get(name) == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		Secrets.Set(name, hex.EncodeToString(b))
+	}
+	return Secrets.Values(name)
+}
+
+func actionSignature(key string, c *MMUIContext, userID string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s|%t|%s|%s|%s|%d", c.Action, c.Value, c.Ref, c.Plot, userID, c.Exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signAction binds the button to the user, a new ref makes it one-time
+func (g *Gate) signAction(c MMUIContext, userID string, ttl time.Duration) MMUIContext {
+	if c.Ref == "" {
+		c.Ref = newGuestRef()
+	}
+	c.Exp = time.Now().Add(ttl).Unix()
+	c.Sig = actionSignature(g.mattermostActionKeys()[0], &c, userID)
+	return c
+}
+
+// verifyAction checks the signature for the user clicked the button and the expiration
+func (g *Gate) verifyAction(req *MattermostActionRequest) error {
+	c := &req.Context
+	if c.Sig == "" || time.Now().Unix() > c.Exp {
+		return errBadAction
+	}
+	for _, key := range g.mattermostActionKeys() {
+		if hmac.Equal([]byte(c.Sig), []byte(actionSignature(key, c, req.UserId))) {
+			return nil
+		}
+	}
+	return errBadAction
+}
+
+// useAction marks the ref of the button as used, false if it was used already
+func (g *Gate) useAction(c *MMUIContext) bool {
+	g.mmActionsMu.Lock()
+	defer g.mmActionsMu.Unlock()
+	now := time.Now().Unix()
+	if g.mmActions == nil {
+		g.mmActions = make(map[string]int64)
+	}
+	for ref, exp := range g.mmActions {
+		if exp < now {
+			delete(g.mmActions, ref)
+		}
+	}
+	if _, ok := g.mmActions[c.Ref]; ok {
+		return false
+	}
+	g.mmActions[c.Ref] = c.Exp
+	return true
+}
+
+// mattermostAction handles buttons, the returned text replaces the post
+func (g *Gate) mattermostAction(ctx context.Context, req *MattermostActionRequest) string {
+	if err := g.verifyAction(req); err != nil {
+		Logger.Infof("mattermost action of %s %s: %v", req.UserId, req.Context.Action, err)
+		return "кнопка устарела, повторите команду"
+	}
+	switch req.Context.Action {
+	case UIActionOpen:
+		return g.openAction(ctx, req)
+	case UIActionGuest:
+		return g.guestAction(ctx, req)
+	}
+	return "неизвестная команда"
+}
+
+// mattermostPhone returns the confirmed phone of the user allowed to open now, or the reply if it is not
+func (g *Gate) mattermostPhone(userID string) (phone, reply string) {
+	mmUser, err := g.MattermostUsers.Find(userID)
+	if err != nil {
+		Logger.Errorf("error finding user %s: %v", userID, err)
+		return "", "произошла ошибка"
+	}
+	if mmUser == nil {
+		return "", "подтвердите телефон командой /7_totp_auth"
+	}
+	phone = mmUser.Phone
+	u, ok := g.Phones[phone]
+	if !ok {
+		g.sendSystemNotification(fmt.Sprintf("mattermost: phone %s is not found in gate register", phone))
+		return "", fmt.Sprintf("%s не найден в реестре. Отправить заявку можно так: /7_ask прошу внести в реестр шлагбаума уч. <номер участка> <ФИО>. Например: /7_gate прошу внести в реестр шлагбаума уч. 123 Иванов Иван Иванович", phone)
+	}
+	if !g.allowedNow(phone) {
+		g.sendSystemNotification(fmt.Sprintf("mattermost: user restricted %s", u.name()))
+		return "", "нет доступа к шлагбауму"
+	}
+	return phone, ""
+}
+
+func (g *Gate) openAction(ctx context.Context, req *MattermostActionRequest) string {
+	if !g.useAction(&req.Context) {
+		return "кнопка уже использована"
+	}
+	if !req.Context.Value {
+		return "👍 ресурс шлагбаума не безграниичный"
+	}
+	phone, reply := g.mattermostPhone(req.UserId)
+	if phone == "" {
+		return reply
+	}
+	reply, _ = g.openByMattermost(ctx, phone, fmt.Sprintf("opened by mattermost %s", g.Phones[phone].name()))
+	return reply
+}
+
+// openByMattermost opens the gate for the phone and returns the result of the relay, ok if the gate is open
+func (g *Gate) openByMattermost(ctx context.Context, phone, systemNotification string) (reply string, ok bool) {
+	return g.openRemote(ctx, phone+" mattermost", systemNotification)
+}
+
+// openRemote opens the gate with the text of the command and returns the reply for a chat, ok if the gate is open
+func (g *Gate) openRemote(ctx context.Context, text, systemNotification string) (reply string, ok bool) {
+	ctx, cancel := context.WithTimeout(ctx, openWaitTimeout)
+	defer cancel()
+	err := g.openGateWait(ctx, text, systemNotification)
+	switch {
+	case err == nil:
+		return "✅ шлагбаум открыт", true
+	case errors.Is(err, errGateKeptOpen):
+		return "✅ шлагбаум уже открыт", true
+	case errors.Is(err, errGateLocked):
+		return "🔒 шлагбаум заблокирован", false
+	case errors.Is(err, context.DeadlineExceeded):
+		return "⏳ шлагбаум не ответил", false
+	}
+	return fmt.Sprintf("❌ ошибка реле: %v", err), false
+}
@@ -0,0 +1,87 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMattermostOpenAction(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var g Gate
+	g.Init(&config.Config{}, db)
+	g.Phones = map[string]*PalESUser{"79990010203": {Id: "79990010203", Firstname: "Иван", DialToOpen: true}}
+	g.MattermostUsers.Insert(&gate.MattermostUser{UserId: "u1", Phone: "79990010203"})
+
+	prompt := func(user string) []MMUIContext {
+		res, err := g.mmOpen(&mmCall{Cmd: "/7_open", UserID: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ctxs []MMUIContext
+		for _, a := range res.(*MattermostUIResponse).Attachments[0].Actions {
+			ctxs = append(ctxs, a.Integration.Context)
+		}
+		return ctxs
+	}
+	click := func(user string, c MMUIContext) string {
+		return g.mattermostAction(t.Context(), &MattermostActionRequest{UserId: user, Context: c})
+	}
+
+	opened := serveGateCommands(t, &g, nil)
+	yes := prompt("u1")[0]
+	if got, want := click("u2", yes), "кнопка устарела, повторите команду"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := click("u1", yes), "✅ шлагбаум открыт"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := click("u1", yes), "кнопка уже использована"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := opened(); len(got) != 1 || !strings.HasPrefix(got[0], "79990010203 mattermost") {
+		t.Errorf("got %q, want open by u1", got)
+	}
+
+	forged := prompt("u1")[0]
+	forged.Exp = time.Now().Add(time.Hour).Unix()
+	if got, want := click("u1", forged), "кнопка устарела, повторите команду"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := click("u1", prompt("u1")[1]), "👍 ресурс шлагбаума не безграниичный"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := click("u2", prompt("u2")[0]), "подтвердите телефон командой /7_totp_auth"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := opened(); len(got) != 0 {
+		t.Errorf("got %q, want no commands", got)
+	}
+}
+
+func TestMattermostOpenResult(t *testing.T) {
+	tests := []struct {
+		result error
+		want   string
+	}{
+		{errGateLocked, "🔒 шлагбаум заблокирован"},
+		{errGateKeptOpen, "✅ шлагбаум уже открыт"},
+		{errBadAction, "❌ ошибка реле: " + errBadAction.Error()},
+	}
+	for _, tt := range tests {
+		var g Gate
+		g.Init(&config.Config{}, nil)
+		serveGateCommands(t, &g, tt.result)
+		if got, _ := g.openByMattermost(t.Context(), "79990010203", ""); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/mattermost"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errNoMattermostBot = errors.New("mattermost bot is not configured")
+
+// mmBot is the bot client of the gate, nil if MattermostURL or the token is not set
+type mmBot struct {
+	client *mattermost.Client
+	token  string
+
+	guests guestRequests
+}
+
+func (g *Gate) configureMattermost(cfg *config.Config) {
+	if cfg.MattermostURL == "" || cfg.MattermostBotToken == "" {
+		g.mm.Store(nil)
+		return
+	}
+	if b := g.mm.Load(); b != nil && b.client.BaseURL == strings.TrimSuffix(cfg.MattermostURL, "/") && b.token == cfg.MattermostBotToken {
+		return
+	}
+	g.mm.Store(&mmBot{client: mattermost.NewClient(cfg.MattermostURL, cfg.MattermostBotToken), token: cfg.MattermostBotToken})
+}
+
+// mattermost returns the bot client, nil if it is not configured
+func (g *Gate) mattermost() *mattermost.Client {
+	if b := g.mm.Load(); b != nil {
+		return b.client
+	}
+	return nil
+}
+
+// sendMattermost posts to the channel id, "@username" is a direct message
+func (g *Gate) sendMattermost(ctx context.Context, channel string, p *mattermost.Post) (*mattermost.Post, error) {
+	c := g.mattermost()
+	if c == nil {
+		return nil, errNoMattermostBot
+	}
+	if !strings.HasPrefix(channel, "@") {
+		post := *p
+		post.ChannelID = channel
+		return c.CreatePost(ctx, &post)
+	}
+	u, err := c.UserByUsername(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendDM(ctx, u.ID, p)
+}
+
+// plotOwners returns phones of the register with the plot number
+func (g *Gate) plotOwners(plot string) []string {
+	var phones []string
+	for phone, u := range g.Phones {
+		if u.hasPlotNumber(plot) {
+			phones = append(phones, phone)
+		}
+	}
+	sort.Strings(phones)
+	return phones
+}
+
+// notifyGuest sends Open/Ignore buttons to mattermost users of the plot owners, returns the number of messages sent
+func (g *Gate) notifyGuest(ctx context.Context, plot, text string) (int, error) {
+	b := g.mm.Load()
+	if b == nil {
+		return 0, errNoMattermostBot
+	}
+	ref := newGuestRef()
+	req := &guestRequest{plot: plot, created: time.Now()}
+	var errs []error
+	for _, phone := range g.plotOwners(plot) {
+		users, err := g.MattermostUsers.ListByPhone(phone)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, u := range users {
+			p, err := b.client.SendDM(ctx, u.UserId, g.guestPost(text, ref, plot, u.UserId))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", u.UserId, err))
+				continue
+			}
+			postID := p.ID
+			req.posts = append(req.posts, guestPost{userID: u.UserId, phone: phone, update: func(ctx context.Context, text string) error {
+				_, err := b.client.UpdatePost(ctx, &mattermost.Post{ID: postID, Message: text, Props: map[string]any{"attachments": []any{}}})
+				return err
+			}})
+		}
+	}
+	b.guests.add(ref, req)
+	return len(req.posts), errors.Join(errs...)
+}
+
+// guestPost has Open/Ignore buttons signed for the user
+func (g *Gate) guestPost(text, ref, plot, userID string) *mattermost.Post {
+	att := &MattermostUIAttachment{Text: text}
+	for _, a := range []struct {
+		id, name, style string
+		open            bool
+	}{{"guest_open", "Открыть", UIStylePrimary, true}, {"guest_ignore", "Игнорировать", UIStyleDefault, false}} {
+		ctx := MMUIContext{Action: UIActionGuest, Value: a.open, Ref: ref, Plot: plot}
+		att.addAction(&MattermostUIAction{
+			Id:    a.id,
+			Name:  a.name,
+			Type:  UITypeButton,
+			Style: a.style,
+			Integration: MMUIIntegration{
+				Url:     g.url("/gate/mm/action"),
+				Context: g.signAction(ctx, userID, guestRequestTTL),
+			},
+		})
+	}
+	return &mattermost.Post{Props: map[string]any{"attachments": []*MattermostUIAttachment{att}}}
+}
+
+// guestAction handles buttons of notifyGuest
+func (g *Gate) guestAction(ctx context.Context, mmReq *MattermostActionRequest) string {
+	b := g.mm.Load()
+	if b == nil {
+		return "запрос устарел"
+	}
+	reply, _ := g.guestButton(ctx, &b.guests, "mattermost", mmReq.Context.Ref, mmReq.UserId, mmReq.Context.Value, g.openByMattermost)
+	return reply
+}
@@ -0,0 +1,143 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"7stgbot/mattermost/mattermosttest"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMattermostGuest(t *testing.T) {
+	mm := mattermosttest.NewServer("bot-token")
+	defer mm.Close()
+	ivan, maria, other := mm.AddUser("ivan"), mm.AddUser("maria"), mm.AddUser("other")
+	mm.AddUser("board")
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg, err := config.Parse([]byte(`
+MattermostURL = "` + mm.URL + `"
+MattermostBotToken = "bot-token"
+
+[Notify.Sinks.board]
+Type = "mattermost"
+Target = "@board"
+
+[[Notify.Rules]]
+Events = ["user"]
+Sinks = ["board"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g Gate
+	g.Init(cfg, db)
+	g.Phones = map[string]*PalESUser{
+		"79990000001": {Id: "79990000001", Firstname: "Иван", Lastname: "12", DialToOpen: true},
+		"79990000002": {Id: "79990000002", Firstname: "Мария", Lastname: "12", DialToOpen: true},
+		"79990000003": {Id: "79990000003", Firstname: "Петр", Lastname: "13", DialToOpen: true},
+	}
+	for _, u := range []*gate.MattermostUser{{UserId: ivan.ID, Phone: "79990000001"}, {UserId: maria.ID, Phone: "79990000002"}, {UserId: other.ID, Phone: "79990000003"}} {
+		if err := g.MattermostUsers.Insert(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g.sendUserNotification("hello board")
+	g.Notify.RunDue()
+	if got := mm.DirectPosts("board"); len(got) != 1 || got[0].Message != "hello board" {
+		t.Errorf("got %+v, want direct message to board", got)
+	}
+
+	n, err := g.notifyGuest(t.Context(), "12", "гости 12 участка")
+	if err != nil || n != 2 {
+		t.Fatalf("got %v %v, want 2 messages", n, err)
+	}
+	if got := mm.DirectPosts(other.ID); len(got) != 0 {
+		t.Errorf("got %+v, want nothing to the owner of another plot", got)
+	}
+	buttons := map[string][]MMUIContext{}
+	for _, u := range []string{ivan.ID, maria.ID} {
+		posts := mm.DirectPosts(u)
+		if len(posts) != 1 {
+			t.Fatalf("got %+v, want one post", posts)
+		}
+		buttons[u] = postButtons(t, posts[0].Props)
+	}
+	opened := serveGateCommands(t, &g, nil)
+
+	tests := []struct {
+		user   string
+		button MMUIContext
+		want   string
+	}{
+		{other.ID, buttons[ivan.ID][0], "кнопка устарела, повторите команду"},
+		{ivan.ID, buttons[ivan.ID][1], "👍 гости 12 участка не пропущены"},
+		{maria.ID, buttons[maria.ID][0], "✅ Мария 12 открыл шлагбаум гостям 12 участка"},
+		{ivan.ID, buttons[ivan.ID][0], "✅ Мария 12 открыл шлагбаум гостям 12 участка"},
+	}
+	for _, tt := range tests {
+		if got := g.mattermostAction(t.Context(), &MattermostActionRequest{UserId: tt.user, Context: tt.button}); got != tt.want {
+			t.Errorf("%s %v: got %q, want %q", tt.user, tt.button.Value, got, tt.want)
+		}
+	}
+	if got := opened(); len(got) != 1 || !strings.HasPrefix(got[0], "79990000002 mattermost") {
+		t.Errorf("got %q, want open by maria", got)
+	}
+	if got := mm.DirectPosts(ivan.ID); got[0].Message != tests[2].want {
+		t.Errorf("got %q, want post of ivan updated", got[0].Message)
+	}
+	if got := g.guestAction(t.Context(), &MattermostActionRequest{UserId: ivan.ID, Context: MMUIContext{Action: UIActionGuest, Ref: "x"}}); got != "запрос устарел" {
+		t.Errorf("got %q, want unknown request", got)
+	}
+}
+
+// postButtons returns contexts of the buttons of the post
+func postButtons(t *testing.T, props map[string]any) []MMUIContext {
+	data, _ := json.Marshal(props["attachments"])
+	var atts []*MattermostUIAttachment
+	if err := json.Unmarshal(data, &atts); err != nil || len(atts) != 1 {
+		t.Fatalf("got %v %v, want one attachment", props, err)
+	}
+	var res []MMUIContext
+	for _, a := range atts[0].Actions {
+		res = append(res, a.Integration.Context)
+	}
+	return res
+}
+
+// serveGateCommands replies to open commands of the gate by the result, the returned func returns texts of the commands
+func serveGateCommands(t *testing.T, g *Gate, result error) func() []string {
+	var mu sync.Mutex
+	var texts []string
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case cmd := <-g.GateCommands:
+				mu.Lock()
+				texts = append(texts, cmd.text)
+				mu.Unlock()
+				cmd.reply(result)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		res := texts
+		texts = nil
+		return res
+	}
+}
@@ -0,0 +1,493 @@
+package tgsrv
+
+import (
+	"7stgbot/gate"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type mmArg struct {
+	Name     string
+	Optional bool
+	Rest     bool // takes the rest of the text, spaces included
+}
+
+// mmCall is a run of the command, User is nil for jobs and not confirmed users
+type mmCall struct {
+	Cmd       string
+	Args      string
+	Actor     string // mm:<user name> or job:<id>
+	UserID    string
+	User      *gate.MattermostUser
+	Principal *Principal
+}
+
+type mmCommand struct {
+	Name   string // with "/"
+	Secret string // secret of the token, "mattermost-token-<name without />" if empty
+	Args   []mmArg
+	Perm   Permission // anyone with the token of the command if empty
+	Help   string
+	Handle func(g *Gate, c *mmCall) (any, error)
+}
+
+// mmCommands is the registry of mattermost slash commands in the order of /7_help
+var mmCommands []*mmCommand
+
+func init() {
+	rest := func(name string) []mmArg { return []mmArg{{Name: name, Optional: true, Rest: true}} }
+	mmCommands = []*mmCommand{
+		{Name: "/7_help", Help: "список доступных команд", Handle: (*Gate).mmHelp},
+		{Name: "/7_totp_auth", Args: rest("телефон код"),
+			Help: "подтвердить телефон кодом TOTP", Handle: (*Gate).mmTOTPAuth},
+		{Name: "/7_open", Perm: PermOpen, Help: "открыть шлагбаум", Handle: (*Gate).mmOpen},
+		{Name: "/7_open_after_m", Args: []mmArg{{Name: "минуты|cancel", Optional: true}}, Perm: PermGateControl,
+			Help: "открыть сейчас или через N минут, cancel отменяет", Handle: (*Gate).mmOpenAfter},
+		{Name: "/7_keep_open", Perm: PermGateControl, Help: "держать шлагбаум открытым", Handle: func(g *Gate, c *mmCall) (any, error) {
+			g.keepOpenGate()
+			return "gate state changed to opened", nil
+		}},
+		{Name: "/7_keep_open_cancel", Perm: PermGateControl, Help: "вернуть обычный режим", Handle: func(g *Gate, c *mmCall) (any, error) {
+			g.endKeepOpenGate()
+			return "gate state changed to normal", nil
+		}},
+		{Name: "/7_lock", Args: []mmArg{{Name: "минуты", Optional: true}}, Perm: PermGateControl,
+			Help: "заблокировать открытие на N минут, 0 снимает блокировку", Handle: (*Gate).mmLock},
+		{Name: "/7_timer", Args: rest(`минуты|"07:00":5,...`), Perm: PermGateControl,
+			Help: "расписание открытий, без аргументов отменяет", Handle: (*Gate).mmTimer},
+		{Name: "/7_ble_timer", Args: rest(`минуты|"07:00":5,...`), Perm: PermGateControl,
+			Help: "расписание открытий по BLE, без аргументов отменяет", Handle: (*Gate).mmBLETimer},
+		{Name: "/7_jobs", Args: rest("cron|at|catchup|del|history ..."), Perm: PermAdmin,
+			Help: "задания по расписанию", Handle: func(g *Gate, c *mmCall) (any, error) { return g.handleJobsCommand(c) }},
+		{Name: "/7_cal", Args: rest("add|timer|ble_timer|del|import|ical ..."), Perm: PermAdmin,
+			Help: "календарь праздников и событий", Handle: func(g *Gate, c *mmCall) (any, error) { return g.handleCalendarCommand(c.Cmd, c.Args) }},
+		{Name: "/7_billing", Args: rest("bill|import|readings|accept|reject|missing|remind|report|statement|statements|assign|assign_charge|charges|remind_charges ..."), Perm: PermRegistry,
+			Help: "счета за электроэнергию, показания счётчиков, банковские выписки и взносы", Handle: func(g *Gate, c *mmCall) (any, error) {
+				return g.handleBillingCommand(c.Cmd, c.Args, c.Actor)
+			}},
+		{Name: "/7_tg", Args: rest("set|del ..."), Perm: PermAdmin,
+			Help: "группы времени доступа", Handle: func(g *Gate, c *mmCall) (any, error) { return g.handleTimeGroupCommand(c.Cmd, strings.Fields(c.Args)) }},
+		{Name: "/7_set", Args: rest("describe|history|<key> <value> ..."), Perm: PermAdmin,
+			Help: "настройки", Handle: func(g *Gate, c *mmCall) (any, error) { return g.handleSetCommand(c.Args, c.Actor) }},
+		{Name: "/7_totp", Args: rest("list|reset ..."), Perm: PermAdmin,
+			Help: "секреты TOTP телефонов", Handle: func(g *Gate, c *mmCall) (any, error) { return g.handleTOTPCommand(c.Cmd, c.Args) }},
+		{Name: "/7_notify", Args: rest("test [event type]"), Perm: PermAdmin,
+			Help: "правила уведомлений", Handle: func(g *Gate, c *mmCall) (any, error) { return g.handleNotifyCommand(c.Cmd, c.Args) }},
+		{Name: "/7_sms", Args: []mmArg{{Name: "duration", Optional: true}, {Name: "phone"}, {Name: "text", Rest: true}}, Perm: PermAdmin,
+			Help: "отправить SMS", Handle: (*Gate).mmSMS},
+		{Name: "/7_role", Args: rest("list|add|del ..."), Perm: PermAdmin,
+			Help: "роли пользователей", Handle: func(g *Gate, c *mmCall) (any, error) { return g.handleRoleCommand(c.Cmd, c.Args, c.Actor) }},
+		{Name: "/7_pales_sync", Args: []mmArg{{Name: "apply", Optional: true}, {Name: "plan id", Optional: true}}, Perm: PermAdmin,
+			Help: "синхронизация реестра с Pal-ES", Handle: (*Gate).mmPalesSync},
+	}
+}
+
+func mmCommandByName(name string) *mmCommand {
+	for _, c := range mmCommands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *mmCommand) secret() string {
+	if c.Secret != "" {
+		return c.Secret
+	}
+	return secretMattermostToken + strings.TrimPrefix(c.Name, "/")
+}
+
+// hint is like "<phone> [text]" for usage and autocomplete
+func (c *mmCommand) hint() string {
+	hints := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		name := a.Name
+		if a.Rest {
+			name += "..."
+		}
+		hints[i] = If(a.Optional, "["+name+"]", "<"+name+">")
+	}
+	return strings.Join(hints, " ")
+}
+
+func (c *mmCommand) usage() string {
+	return strings.TrimSpace("usage: " + c.Name + " " + c.hint())
+}
+
+// checkArgs checks the number of arguments, the rest argument takes any number of words
+func (c *mmCommand) checkArgs(args string) bool {
+	n := len(strings.Fields(args))
+	required := 0
+	rest := false
+	for _, a := range c.Args {
+		if !a.Optional {
+			required++
+		}
+		rest = rest || a.Rest
+	}
+	return n >= required && (rest || n <= len(c.Args))
+}
+
+// mattermostPrincipal is the principal of the user running a command
+func (g *Gate) mattermostPrincipal(userID, userName string) *Principal {
+	return g.resolvePrincipal(&Principal{MattermostID: userID, MattermostName: userName})
+}
+
+// runMattermostCommand checks the permission and arguments of the call and runs it
+func (g *Gate) runMattermostCommand(c *mmCommand, call *mmCall) (any, error) {
+	if c.Perm != "" && !g.authorize(call.Principal, c.Perm, "mattermost: "+c.Name) {
+		if call.Principal.Phone == "" {
+			return "подтвердите телефон командой /7_totp_auth", nil
+		}
+		return "нет прав на команду", nil
+	}
+	if !c.checkArgs(call.Args) {
+		return c.usage(), nil
+	}
+	return c.Handle(g, call)
+}
+
+// doHandleMattermostSysCommand handles the command of the system with the admin role, actor is for logs
+func (g *Gate) doHandleMattermostSysCommand(cmd, args, actor string) (res any, err error) {
+	return g.handleCommandAs(cmd, args, actor, systemPrincipal())
+}
+
+// handleCommandAs handles the command of the principal, actor is who runs it: mm:<user name> or job:<id>
+func (g *Gate) handleCommandAs(cmd, args, actor string, p *Principal) (res any, err error) {
+	c := mmCommandByName(cmd)
+	if c == nil {
+		return "", ErrNotFound
+	}
+	return g.runMattermostCommand(c, &mmCall{Cmd: cmd, Args: args, Actor: actor, Principal: p})
+}
+
+// systemPrincipal runs internal commands and jobs scheduled by the gate itself
+func systemPrincipal() *Principal {
+	return &Principal{Roles: []Role{RoleAdmin}}
+}
+
+// encodeMattermostResult writes a string result as a response, other ones as is
+func encodeMattermostResult(encoder *json.Encoder, res any, err error) {
+	msg, isStr := res.(string)
+	if err != nil {
+		errMsg := fmt.Sprintf("error: %v", err)
+		if msg == "" {
+			msg = errMsg
+		} else {
+			msg += " " + errMsg
+		}
+	}
+	if !isStr {
+		encoder.Encode(res)
+	} else if msg != "" {
+		encoder.Encode(NewMattermostResponse(msg))
+	}
+}
+
+// mattermostAutocomplete returns commands in the format of Mattermost API POST /api/v4/commands
+func (g *Gate) mattermostAutocomplete() []map[string]any {
+	res := make([]map[string]any, 0, len(mmCommands))
+	for _, c := range mmCommands {
+		res = append(res, map[string]any{
+			"trigger":            strings.TrimPrefix(c.Name, "/"),
+			"method":             "P",
+			"url":                g.url("/gate/mm/cmd"),
+			"auto_complete":      true,
+			"auto_complete_desc": c.Help,
+			"auto_complete_hint": c.hint(),
+			"description":        c.Help,
+			"display_name":       c.Name,
+		})
+	}
+	return res
+}
+
+func (g *Gate) mmHelp(c *mmCall) (any, error) {
+	var sb strings.Builder
+	for _, cmd := range mmCommands {
+		if cmd.Perm != "" && !c.Principal.Can(cmd.Perm) {
+			continue
+		}
+		if sb.Len() != 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(cmd.Name)
+		if h := cmd.hint(); h != "" {
+			sb.WriteString(" " + h)
+		}
+		sb.WriteString(" - " + cmd.Help)
+	}
+	return sb.String(), nil
+}
+
+func (g *Gate) mmOpen(c *mmCall) (any, error) {
+	ref := newGuestRef() // both buttons are used by one click
+	atts := &MattermostUIResponse{Attachments: []*MattermostUIAttachment{{Text: "Открыть шлагбаум?"}}}
+	atts.Attachments[0].addAction(&MattermostUIAction{
+		Id:    "open_yes",
+		Name:  "Да",
+		Type:  UITypeButton,
+		Style: UIStylePrimary,
+		Integration: MMUIIntegration{
+			Url: g.url("/gate/mm/action"),
+			Context: g.signAction(MMUIContext{
+				Action: UIActionOpen,
+				Value:  true,
+				Ref:    ref,
+			}, c.UserID, openActionTTL),
+		},
+	})
+	atts.Attachments[0].addAction(&MattermostUIAction{
+		Id:    "open_no",
+		Name:  "Нет",
+		Type:  UITypeButton,
+		Style: UIStyleDefault,
+		Integration: MMUIIntegration{
+			Url: g.url("/gate/mm/action"),
+			Context: g.signAction(MMUIContext{
+				Action: UIActionOpen,
+				Value:  false,
+				Ref:    ref,
+			}, c.UserID, openActionTTL),
+		},
+	})
+	data, _ := json.Marshal(atts)
+	Logger.Debug(string(data))
+	return atts, nil
+}
+
+func (g *Gate) mmTimer(c *mmCall) (any, error) {
+	args := strings.TrimSpace(c.Args)
+	var sch map[string]int
+	if args == "" {
+		g.schedule <- sch
+		return "schedule is canceled", nil
+	}
+	var err error
+	if strings.Contains(args, ":") {
+		err = json.Unmarshal([]byte("{"+args+"}"), &sch)
+	} else {
+		sch = make(map[string]int)
+		var n int
+		n, err = strconv.Atoi(args)
+		sch["00:00"] = n
+	}
+	if err != nil {
+		return "", err
+	}
+	g.schedule <- sch
+	bytes, _ := json.Marshal(sch)
+	return fmt.Sprintf("%s schedule is set", strings.Trim(string(bytes), "{}")), nil
+}
+
+func (g *Gate) mmBLETimer(c *mmCall) (any, error) {
+	args := strings.TrimSpace(c.Args)
+	var sch map[string]int
+	if args == "" {
+		g.bleSchedule <- sch
+		return "BLE schedule is canceled", nil
+	}
+	if strings.Contains(args, ":") {
+		return "", json.Unmarshal([]byte("{"+args+"}"), &sch)
+	}
+	sch = make(map[string]int)
+	n, err := strconv.Atoi(args)
+	if err != nil {
+		return "", err
+	}
+	sch["00:00"] = n
+	g.bleSchedule <- sch
+	bytes, _ := json.Marshal(sch)
+	return fmt.Sprintf("%s BLE schedule is set", strings.Trim(string(bytes), "{}")), nil
+}
+
+func (g *Gate) mmOpenAfter(c *mmCall) (any, error) {
+	args := strings.TrimSpace(c.Args)
+	if args == "cancel" {
+		n, err := g.cancelOpenAfter()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d pending openings cancelled", n), nil
+	}
+	n := 0
+	if args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil {
+			return "", err
+		}
+	}
+	if n <= 0 {
+		g.openGate(c.Cmd, "")
+		g.sendSystemNotification(fmt.Sprintf("opened by %s", c.Cmd))
+		return "opened", nil
+	}
+	j, err := g.openAfter(n, c.Cmd)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("opening after %d minutes at %s, cancel: %s cancel or /7_jobs del %s", n,
+		time.UnixMilli(j.NextRunMilli).In(Location).Format("15:04:05"), c.Cmd, j.ID), nil
+}
+
+func (g *Gate) mmLock(c *mmCall) (any, error) {
+	args := strings.TrimSpace(c.Args)
+	minutes := 0
+	if args != "" {
+		var err error
+		minutes, err = strconv.Atoi(args)
+		if err != nil {
+			return "number of minutes expected. 0 - unlock immediately", nil
+		}
+	}
+	g.lock(time.Duration(minutes) * time.Minute)
+	return "gate locked", nil
+}
+
+func (g *Gate) mmSMS(c *mmCall) (any, error) {
+	args := strings.TrimSpace(c.Args)
+	aa := strings.SplitN(args, " ", 3)
+	if len(aa) != 3 && len(aa) != 2 {
+		return mmCommandByName(c.Cmd).usage(), nil
+	}
+	var phone, sms string
+	relevance := 24 * time.Hour
+	if len(aa) == 3 {
+		d, err := time.ParseDuration(aa[0])
+		if err == nil {
+			relevance = d
+			phone = aa[1]
+			sms = aa[2]
+		} else {
+			phone = aa[0]
+			sms = aa[1] + " " + aa[2]
+		}
+	} else {
+		phone = aa[0]
+		sms = aa[1]
+	}
+	if !phoneRegex.MatchString(phone) {
+		return fmt.Sprintf("phone must start with +7,7,8, and be exactly 11 digits long. %q is invalid.", phone), nil
+	}
+	if len(sms) > 160 {
+		return "text is too long", nil
+	}
+	g.sendSMS(phone, sms, time.Now().Add(relevance))
+	return "saved for sending", nil
+}
+
+func (g *Gate) mmPalesSync(c *mmCall) (any, error) {
+	args := strings.Fields(c.Args)
+	ctx := context.Background()
+	switch {
+	case len(args) == 0:
+		plan, err := g.planPalesSync(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(plan.Changes) == 0 {
+			return plan.String(), nil
+		}
+		return fmt.Sprintf("%s\nto apply: %s apply %s", plan, c.Cmd, plan.ID), nil
+	case len(args) == 2 && args[0] == "apply":
+		return g.applyPalesSync(ctx, args[1], c.Actor)
+	}
+	return mmCommandByName(c.Cmd).usage(), nil
+}
+
+// mmTOTPAuth links the mattermost user to the phone confirmed by the TOTP code
+func (g *Gate) mmTOTPAuth(c *mmCall) (any, error) {
+	if c.UserID == "" {
+		return "", errors.New("mattermost user expected")
+	}
+	text := strings.TrimSpace(c.Args)
+	if text == "" && c.User != nil {
+		return fmt.Sprintf("Ваш подтвержденный номер телефона %s", maskPhone(c.User.Phone)), nil
+	}
+	i := strings.LastIndex(text, " ")
+	if i < 0 {
+		return fmt.Sprintf("формат команды: %s <номер телефона> <код totp>  например: %s 79990010203 123456", c.Cmd, c.Cmd), nil
+	}
+	phone, reply := g.totpPhone("mm:"+c.UserID, text[:i], text[i+1:], c.Cmd, time.Now())
+	if phone == "" {
+		return reply, nil
+	}
+	u, err := g.MattermostUsers.Find(c.UserID)
+	if err != nil {
+		Logger.Errorf("db error: %v", err)
+		return "внутренняя ошибка", nil
+	}
+	if u == nil {
+		err = g.MattermostUsers.Insert(&gate.MattermostUser{UserId: c.UserID, Phone: phone})
+		if err != nil {
+			Logger.Errorf("db error: %v", err)
+			return "внутренняя ошибка", nil
+		}
+		return "Ваш номер телефона подтвержден. Вам доступен функционал авторизованного пользоваеля.", nil
+	}
+	if u.Phone == phone {
+		return "Ваш номер телефона подтвержден (повторно). Вам доступен функционал авторизованного пользоваеля.", nil
+	}
+	u.Phone = phone
+	g.MattermostUsers.Update(u)
+	return "Ваш номер телефона изменен.", nil
+}
+
+// totpPhone returns the normalized phone if the TOTP code of it is valid, the reply to the user otherwise.
+// The actor is the chat of the command, failed codes lock out the actor and the phone.
+func (g *Gate) totpPhone(actor, phone, code, cmd string, now time.Time) (string, string) {
+	if left := g.totpFails.locked(now, "actor:"+actor); left > 0 {
+		return "", totpLockedReply(left)
+	}
+	replacer := strings.NewReplacer("+", "", "(", "", ")", "", "-", "", " ", "")
+	phone = replacer.Replace(phone)
+	if phone == "" {
+		return "", "номер телефона не распознан"
+	}
+	if phone[:1] == "8" {
+		phone = "7" + phone[1:]
+	} else if phone[:1] != "7" {
+		phone = "7" + phone
+	}
+	if len(phone) != 11 {
+		return "", "номер телефона не распознан"
+	}
+	if _, err := strconv.Atoi(phone); err != nil {
+		return "", "номер телефона не распознан"
+	}
+	if len(code) != 6 {
+		return "", "неверный формат кода TOTP"
+	}
+	if _, err := strconv.Atoi(code); err != nil {
+		return "", "неверный формат кода TOTP"
+	}
+	keys := []string{"actor:" + actor, "phone:" + phone}
+	if left := g.totpFails.locked(now, keys...); left > 0 {
+		return "", totpLockedReply(left)
+	}
+	valid, err := g.checkTOTP(phone, code, now)
+	if err != nil {
+		Logger.Errorf("%s TOTP validation error phone: %s code: %s  %v", cmd, phone, code, err)
+	} else if !valid {
+		Logger.Infof("%s TOTP validation is not OK  phone: %s code: %s", cmd, phone, code)
+	}
+	if err != nil || !valid {
+		for k, d := range g.totpFails.fail(now, keys...) {
+			g.sendSystemNotification(fmt.Sprintf("%s: %d failed TOTP codes, %s is locked out for %s, last by %s for %s",
+				cmd, totpMaxFails, k, d, actor, phone))
+		}
+		return "", "неверный код TOTP"
+	}
+	g.totpFails.reset(keys...)
+	return phone, ""
+}
+
+func totpLockedReply(left time.Duration) string {
+	return fmt.Sprintf("слишком много неверных кодов, повторите через %d мин", int(left.Minutes())+1)
+}
@@ -0,0 +1,113 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMattermostCommands(t *testing.T) {
+	for _, name := range []string{"7_help", "7_open", "7_lock", "7_sms"} {
+		Secrets.Set(secretMattermostToken+name, "tk-"+name)
+		defer Secrets.Delete(secretMattermostToken + name)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var g Gate
+	g.Init(&config.Config{MattermostAdmins: []string{"boss"}}, db)
+	g.Phones = map[string]*PalESUser{"79990010203": {Id: "79990010203", DialToOpen: true}}
+	g.MattermostUsers.Insert(&gate.MattermostUser{UserId: "u1", Phone: "79990010203"})
+	ws := webSrv{gate: &g}
+
+	run := func(user, cmd, text string) string {
+		form := url.Values{"command": {cmd}, "text": {text}, "token": {"tk-" + strings.TrimPrefix(cmd, "/")}, "user_id": {user}, "user_name": {user}}
+		r := httptest.NewRequest("POST", "/gate/mm/cmd", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ws.handleMattermostCommand(w, r)
+		var res map[string]any
+		json.NewDecoder(w.Body).Decode(&res)
+		if s, ok := res["text"].(string); ok {
+			return s
+		}
+		if _, ok := res["attachments"]; ok {
+			return "attachments"
+		}
+		return w.Body.String()
+	}
+	tests := []struct {
+		user, cmd, text string
+		want            string
+	}{
+		{"guest", "/7_open", "", "подтвердите телефон командой /7_totp_auth"},
+		{"u1", "/7_open", "", "attachments"},
+		{"u1", "/7_lock", "5", "нет прав на команду"},
+		{"boss", "/7_lock", "5 6", "usage: /7_lock [минуты]"},
+		{"boss", "/7_sms", "79990010203", "usage: /7_sms [duration] <phone> <text...>"},
+		{"boss", "/7_lock", "x", "number of minutes expected. 0 - unlock immediately"},
+		{"u1", "/7_unknown", "", "неизвестная команда"},
+		{"guest", "/7_help", "", "/7_help - список доступных команд\n/7_totp_auth [телефон код...] - подтвердить телефон кодом TOTP"},
+	}
+	for _, tt := range tests {
+		if got := run(tt.user, tt.cmd, tt.text); got != tt.want {
+			t.Errorf("%s %s %q: got %q, want %q", tt.user, tt.cmd, tt.text, got, tt.want)
+		}
+	}
+	if got := run("u1", "/7_help", ""); !strings.Contains(got, "/7_open - открыть шлагбаум") || strings.Contains(got, "/7_lock") {
+		t.Errorf("got %q, want resident commands", got)
+	}
+	if got := run("boss", "/7_help", ""); !strings.Contains(got, "/7_lock [минуты] - ") {
+		t.Errorf("got %q, want admin commands", got)
+	}
+
+	if got := g.mattermostAutocomplete(); len(got) != len(mmCommands) || got[0]["trigger"] != "7_help" {
+		t.Errorf("got %v, want commands of the registry", got)
+	}
+}
+
+func TestJobPrincipal(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var g Gate
+	g.CfgDir = t.TempDir()
+	g.Init(&config.Config{MattermostAdmins: []string{"boss"}}, db)
+	res, err := g.handleCommandAs("/7_jobs", "cron night 0 23 * * * /7_keep_open_cancel", "mm:boss", g.mattermostPrincipal("boss", "boss"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.(string); !strings.HasSuffix(got, " by mm:boss") {
+		t.Errorf("got %q, want the job of mm:boss", got)
+	}
+	j := g.Jobs.List()[0]
+	if got, want := j.Creator, "mm:boss"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if !g.jobPrincipal(&j).Has(RoleAdmin) {
+		t.Errorf("got no admin role, want one of the creator")
+	}
+	// the role is revoked after the job was created
+	g.cfg.Store(&config.Config{})
+	if got, _ := g.runJob(&j); got != "подтвердите телефон командой /7_totp_auth" {
+		t.Errorf("got %q, want no rights", got)
+	}
+	for _, creator := range []string{"/7_jobs", ""} {
+		if p := g.jobPrincipal(&gate.Job{Creator: creator}); len(p.Roles) != 0 {
+			t.Errorf("%q: got %v, want no roles", creator, p.Roles)
+		}
+	}
+	if p := g.jobPrincipal(&gate.Job{Creator: jobCreatorSystem}); !p.Has(RoleAdmin) {
+		t.Errorf("got %v, want the system", p.Roles)
+	}
+}
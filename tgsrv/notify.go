@@ -0,0 +1,334 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/mattermost"
+	"7stgbot/notify"
+	"7stgbot/telegram"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/AnthonyHewins/gotfy"
+)
+
+// secretNotifyURL overrides URL of the sink, "notify-url-<sink>", webhooks are secrets
+const secretNotifyURL = "notify-url-"
+
+// event types, a type matches rules of its parents
+const (
+	eventSystem       = "system"
+	eventUser         = "user"
+	eventBLE          = "system.ble"
+	eventOpened       = "system.opened"
+	eventConfig       = "system.config"
+	eventGateCommand  = "system.command"
+	eventNotifyTest   = "system.test"
+	telegramTemplate  = "{{.Text}} ({{ts .Time}})"
+	emailSubjectRunes = 60
+)
+
+func (g *Gate) sendSystemNotification(msg string) {
+	g.notify(eventSystem, notify.Info, msg)
+}
+
+func (g *Gate) sendUserNotification(msg string) {
+	g.notify(eventUser, notify.Info, msg)
+}
+
+// notifyResident sends the text to the phone by the rule of config.EventResident, it is not kept in the journal
+func (g *Gate) notifyResident(phone, text string) {
+	g.Notify.Publish(notify.Event{Type: config.EventResident, Severity: notify.Info, Gate: g.ID, Text: text, To: phone,
+		Time: time.Now()})
+}
+
+// notify publishes the event to the router of the gate, rules decide where it goes
+func (g *Gate) notify(typ string, severity notify.Severity, msg string) {
+	e := notify.Event{Type: typ, Severity: severity, Gate: g.ID, Text: msg, Time: time.Now()}
+	g.journal.add(e)
+	g.Notify.Publish(e)
+}
+
+// configureNotify applies rules and sinks of the config, a bad part is skipped with an error logged
+// as the config is validated on load
+func (g *Gate) configureNotify(cfg *config.Config) {
+	g.configureMattermost(cfg)
+	nc := notify.Config{
+		Sinks: map[string]notify.Sink{
+			config.SinkTelegram:   &telegramSink{g: g},
+			config.SinkNtfySystem: &ntfySink{g: g, topic: func() string { return cmp.Or(g.config().NtfySystemTopic, config.DefaultNtfySystemTopic) }},
+			config.SinkNtfyEvents: &ntfySink{g: g, topic: func() string { return cmp.Or(g.config().NtfyEventsTopic, config.DefaultNtfyEventsTopic) }},
+			config.SinkResident:   &residentSink{g: g},
+		},
+		Templates: map[string]*template.Template{},
+	}
+	if t, err := notify.ParseTemplate(config.SinkTelegram, telegramTemplate); err == nil {
+		nc.Templates[config.SinkTelegram] = t
+	}
+	for name, sc := range cfg.Notify.Sinks {
+		s, err := g.newSink(name, sc)
+		if err != nil {
+			Logger.Errorf("notify sink %s: %v", name, err)
+			continue
+		}
+		nc.Sinks[name] = s
+		if sc.Template != "" {
+			if nc.Templates[name], err = notify.ParseTemplate(name, sc.Template); err != nil {
+				Logger.Errorf("notify sink %s: %v", name, err)
+				delete(nc.Templates, name)
+			}
+		}
+	}
+	for i, rc := range cfg.NotifyRules() {
+		r, err := newNotifyRule(rc)
+		if err != nil {
+			Logger.Errorf("notify rule %d: %v", i, err)
+			continue
+		}
+		nc.Rules = append(nc.Rules, r)
+	}
+	g.Notify.Configure(nc)
+}
+
+func newNotifyRule(rc config.NotifyRule) (*notify.Rule, error) {
+	r := &notify.Rule{Events: rc.Events, Sinks: rc.Sinks, Templates: map[string]*template.Template{}}
+	var err error
+	if r.MinSeverity, err = notify.ParseSeverity(rc.MinSeverity); err != nil {
+		return nil, err
+	}
+	if r.Quiet, err = notify.ParseQuietHours(rc.QuietHours); err != nil {
+		return nil, err
+	}
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{{rc.Dedup, &r.Dedup}, {rc.Batch, &r.Batch}, {rc.BatchFirst, &r.BatchFirst}} {
+		if d.s == "" {
+			continue
+		}
+		if *d.d, err = time.ParseDuration(d.s); err != nil {
+			return nil, err
+		}
+	}
+	templates := map[string]string{"": rc.Template}
+	for k, v := range rc.Templates {
+		templates[k] = v
+	}
+	for sink, text := range templates {
+		if text == "" {
+			continue
+		}
+		if r.Templates[sink], err = notify.ParseTemplate(sink, text); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (g *Gate) newSink(name string, sc config.SinkConfig) (notify.Sink, error) {
+	u := cmp.Or(Secrets.Get(g.secretName(secretNotifyURL+name)), sc.URL)
+	switch sc.Type {
+	case "telegram":
+		return &telegramSink{g: g, chat: sc.Target}, nil
+	case "ntfy":
+		return &ntfySink{g: g, url: u, topic: func() string { return sc.Target }}, nil
+	case "mattermost":
+		return &mattermostSink{g: g, url: u, channel: sc.Target}, nil
+	case "discord":
+		return notify.SinkFunc(func(ctx context.Context, text string) error {
+			return postDiscord(ctx, u, text)
+		}), nil
+	case "email":
+		return &emailSink{g: g, to: sc.Target}, nil
+	case "webpush":
+		return &webPushSink{g: g, phone: sc.Target}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", sc.Type)
+}
+
+// residentSink sends to Telegram chats linked to the phone and to Web Push subscriptions of its sessions,
+// the text is retried only if nothing got it
+type residentSink struct {
+	g *Gate
+}
+
+var errNoRecipient = errors.New("recipient expected")
+
+func (s *residentSink) Send(ctx context.Context, text string) error {
+	return errNoRecipient
+}
+
+func (s *residentSink) SendTo(ctx context.Context, phone, text string) error {
+	var errs []error
+	sent := 0
+	if b := s.g.tg.Load(); b != nil {
+		users, err := s.g.TelegramUsers.ListByPhone(phone)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, u := range users {
+			if _, err := b.bot.SendMessage(ctx, &telegram.SendMessageParams{ChatID: u.ChatID, Text: text}); err != nil {
+				errs = append(errs, fmt.Errorf("%d: %w", u.ChatID, err))
+				continue
+			}
+			sent++
+		}
+	}
+	n, err := s.g.sendPushText(ctx, phone, text)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if sent += n; sent == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+type telegramSink struct {
+	g    *Gate
+	chat string // chat of the gate if empty
+}
+
+func (s *telegramSink) Send(ctx context.Context, text string) error {
+	return s.g.sendTelegram(ctx, cmp.Or(s.chat, s.g.config().TelegramChatId), text)
+}
+
+// telegramHTTP is the client of Telegram API by ProxyUrl if it is set
+func (g *Gate) telegramHTTP() (*http.Client, error) {
+	if len(g.ProxyUrl) == 0 {
+		return &http.Client{}, nil
+	}
+	proxyURL, err := url.Parse(g.ProxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}, nil
+}
+
+func (g *Gate) sendTelegram(ctx context.Context, chat, msg string) error {
+	client, err := g.telegramHTTP()
+	if err != nil {
+		return err
+	}
+	formData := url.Values{
+		"chat_id": {chat},
+		"text":    {msg},
+	}
+	if g.TelegramTimeoutSec > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(g.TelegramTimeoutSec)*time.Second)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", g.TelegramUrl, strings.NewReader(formData.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+// checkResponse closes the body, a status other than 2xx is an error with the start of the body
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+type ntfySink struct {
+	g     *Gate
+	url   string // server of the gate if empty
+	topic func() string
+}
+
+func (s *ntfySink) Send(ctx context.Context, text string) error {
+	server, err := url.Parse(cmp.Or(s.url, s.g.config().NtfyURL))
+	if err != nil || server.Host == "" {
+		return fmt.Errorf("bad ntfy URL %q", cmp.Or(s.url, s.g.config().NtfyURL))
+	}
+	publisher, err := gotfy.NewPublisher(server, gotfy.WithAuth("", s.g.config().NtfyToken))
+	if err != nil {
+		return err
+	}
+	_, err = publisher.SendMessage(ctx, &gotfy.Message{
+		Topic:   s.topic(),
+		Message: text,
+	})
+	return err
+}
+
+// mattermostSink posts to the incoming webhook, empty channel is the default one of the webhook.
+// Without the webhook it posts by the bot to the channel id or "@username" directly
+type mattermostSink struct {
+	g       *Gate
+	url     string
+	channel string
+}
+
+func (s *mattermostSink) Send(ctx context.Context, text string) error {
+	if s.url != "" {
+		return mattermost.PostWebhook(ctx, http.DefaultClient, s.url, &mattermost.WebhookPost{Channel: s.channel, Text: text})
+	}
+	_, err := s.g.sendMattermost(ctx, s.channel, &mattermost.Post{Message: text})
+	return err
+}
+
+// emailSink sends the first line as the subject
+type emailSink struct {
+	g  *Gate
+	to string
+}
+
+func (s *emailSink) Send(ctx context.Context, text string) error {
+	if s.g.Email == nil {
+		return errors.New("no email credentials")
+	}
+	subject, _, _ := strings.Cut(text, "\n")
+	if r := []rune(subject); len(r) > emailSubjectRunes {
+		subject = string(r[:emailSubjectRunes]) + "…"
+	}
+	return s.g.Email.send(s.to, subject, strings.ReplaceAll(template.HTMLEscapeString(text), "\n", "<br>"))
+}
+
+func (g *Gate) handleNotifyCommand(cmd, args string) (string, error) {
+	aa := strings.Fields(args)
+	switch {
+	case len(aa) == 0:
+		var sb strings.Builder
+		for i, r := range g.config().NotifyRules() {
+			fmt.Fprintf(&sb, "%d. %s -> %s", i+1, strings.Join(r.Events, ","), strings.Join(r.Sinks, ","))
+			for _, p := range []struct{ name, v string }{{"min", r.MinSeverity}, {"quiet", r.QuietHours},
+				{"dedup", r.Dedup}, {"batch", r.Batch}} {
+				if p.v != "" {
+					fmt.Fprintf(&sb, " %s %s", p.name, p.v)
+				}
+			}
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "queued: %d", g.Notify.Pending())
+		return sb.String(), nil
+
+	case aa[0] == "test" && len(aa) <= 2:
+		typ := eventNotifyTest
+		if len(aa) == 2 {
+			typ = aa[1]
+		}
+		g.notify(typ, notify.Info, fmt.Sprintf("test notification %s from %s", typ, g.ID))
+		return fmt.Sprintf("%s is published", typ), nil
+	}
+	return fmt.Sprintf("usage: %s [test [event type]]", cmd), nil
+}
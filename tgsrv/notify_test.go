@@ -0,0 +1,236 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/notify"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// telegramMessages serves Telegram API of the gate, the returned func delivers pending notifications and returns texts sent
+func telegramMessages(t *testing.T, g *Gate) func() []string {
+	var mu sync.Mutex
+	var texts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		texts = append(texts, r.FormValue("text"))
+	}))
+	t.Cleanup(srv.Close)
+	g.TelegramUrl = srv.URL
+	return func() []string {
+		g.Notify.RunDue()
+		mu.Lock()
+		defer mu.Unlock()
+		res := texts
+		texts = nil
+		return res
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var mu sync.Mutex
+	var board []string
+	mm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]string
+		json.NewDecoder(r.Body).Decode(&m)
+		mu.Lock()
+		defer mu.Unlock()
+		board = append(board, m["channel"]+": "+m["text"])
+	}))
+	defer mm.Close()
+
+	cfg, err := config.Parse([]byte(`
+[Notify.Sinks.board]
+Type = "mattermost"
+URL = "` + mm.URL + `"
+Target = "board"
+
+[[Notify.Rules]]
+Events = ["user"]
+Sinks = ["board"]
+Template = "{{.Gate}}: {{.Text}}"
+
+[[Notify.Rules]]
+Events = ["system"]
+MinSeverity = "warning"
+Sinks = ["telegram"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g Gate
+	g.Init(cfg, nil)
+	telegram := telegramMessages(t, &g)
+
+	g.sendUserNotification("79990010203 OK")
+	g.sendSystemNotification("info is below warning")
+	g.notify(eventGateCommand, notify.Warning, "relay error")
+	if got, want := telegram(), []string{"relay error"}; len(got) != 1 || !strings.HasPrefix(got[0], want[0]) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := board, []string{"board: main: 79990010203 OK"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	res, err := g.doHandleMattermostSysCommand("/7_notify", "", "mm:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "3. system -> telegram min warning\nqueued: 0"; !strings.HasSuffix(res.(string), want) {
+		t.Errorf("got %q, want suffix %q", res, want)
+	}
+}
+
+// decryptPush is the user agent side of RFC 8291
+func decryptPush(t *testing.T, ua *ecdh.PrivateKey, auth, body []byte) []byte {
+	salt, rs, idLen := body[:16], body[16:20], int(body[20])
+	asPub, ciphertext := body[21:21+idLen], body[21+idLen:]
+	if !bytes.Equal(rs, []byte{0, 0, 0x10, 0}) {
+		t.Errorf("got record size %v, want 4096", rs)
+	}
+	as, err := ecdh.P256().NewPublicKey(asPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := ua.ECDH(as)
+	prkKey, _ := hkdf.Extract(sha256.New, shared, auth)
+	ikm, _ := hkdf.Expand(sha256.New, prkKey, "WebPush: info\x00"+string(ua.PublicKey().Bytes())+string(asPub), 32)
+	prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+	cek, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSuffix(plain, []byte{2})
+}
+
+func TestWebPush(t *testing.T) {
+	Secrets.Set(secretVAPIDKey, "vapid")
+	defer Secrets.Delete(secretVAPIDKey)
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var g Gate
+	g.Init(&config.Config{}, db)
+
+	ua, _ := ecdh.P256().GenerateKey(rand.Reader)
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if err := verifyVAPID(r.Header.Get("Authorization")); err != "" {
+			t.Error(err)
+		}
+		got, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	for _, p := range []struct{ endpoint, phone string }{{srv.URL + "/ok", "79990010203"}, {srv.URL + "/gone", "79990010204"}} {
+		sub := PushSubscription{Endpoint: p.endpoint, Phone: p.phone}
+		sub.Keys.P256dh = b64url.EncodeToString(ua.PublicKey().Bytes())
+		sub.Keys.Auth = b64url.EncodeToString(auth)
+		if err := g.addPushSubscription(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (&webPushSink{g: &g}).Send(t.Context(), "gate opened"); err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]string
+	if err := json.Unmarshal(decryptPush(t, ua, auth, got), &msg); err != nil || msg["body"] != "gate opened" {
+		t.Errorf("got %q %v, want gate opened", msg, err)
+	}
+	subs, _ := g.pushSubscriptions()
+	if len(subs) != 1 || subs[0].Phone != "79990010203" {
+		t.Errorf("got %+v, want gone subscription removed", subs)
+	}
+}
+
+// verifyVAPID checks the ES256 signature of the JWT by the key of the header
+func verifyVAPID(header string) string {
+	var token, key string
+	for _, p := range strings.Split(strings.TrimPrefix(header, "vapid "), ", ") {
+		k, v, _ := strings.Cut(p, "=")
+		switch k {
+		case "t":
+			token = v
+		case "k":
+			key = v
+		}
+	}
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "no token in " + header
+	}
+	pubBytes, _ := b64url.DecodeString(key)
+	pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), pubBytes)
+	if err != nil {
+		return err.Error()
+	}
+	sig, _ := b64url.DecodeString(token[i+1:])
+	digest := sha256.Sum256([]byte(token[:i]))
+	if len(sig) != 64 || !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return "bad signature of " + token
+	}
+	return ""
+}
+
+func TestPushUnsubscribe(t *testing.T) {
+	g, _ := newAdminGate(t)
+	br := &ChatBroker{g: g}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /gate/app/push/subscribe", br.handlePushSubscribe)
+	mux.HandleFunc("POST /gate/app/push/unsubscribe", br.handlePushUnsubscribe)
+
+	const sub = `{"endpoint":"https://push.example.com/1","keys":{"p256dh":"key","auth":"auth"}}`
+	if w := adminRequest(mux, "POST", "/gate/app/push/subscribe", "resident", "application/json", sub); w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want subscribed", w.Code, w.Body)
+	}
+	const unsub = `{"endpoint":"https://push.example.com/1"}`
+	tests := []struct {
+		session string
+		want    int
+	}{
+		{"", http.StatusForbidden},
+		{"admin", http.StatusForbidden}, // a subscription of another phone
+		{"resident", http.StatusOK},
+		{"resident", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := adminRequest(mux, "POST", "/gate/app/push/unsubscribe", tt.session, "application/json", unsub).Code; got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.session, got, tt.want)
+		}
+	}
+	if subs, _ := g.pushSubscriptions(); len(subs) != 0 {
+		t.Errorf("got %+v, want unsubscribed", subs)
+	}
+}
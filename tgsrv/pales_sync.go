@@ -0,0 +1,175 @@
+package tgsrv
+
+import (
+	"7stgbot/gate"
+	"7stgbot/pales"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// palesTimeGroupKeyPrefix + phone = time group name, overrides the group of the registry owner
+const palesTimeGroupKeyPrefix = "pales-tg."
+
+const palesPlanTTL = time.Hour
+
+var phoneSeparatorRE = regexp.MustCompile(`[,;/]`)
+
+// registryPhones returns phones of the registry field in 7XXXXXXXXXX form
+func registryPhones(s string) []string {
+	var res []string
+	for _, p := range phoneSeparatorRE.Split(s, -1) {
+		p = notDigitRE.ReplaceAllString(p, "")
+		switch {
+		case len(p) == 11 && (p[0] == '7' || p[0] == '8'):
+			p = "7" + p[1:]
+		case len(p) == 10 && p[0] == '9':
+			p = "7" + p
+		default:
+			continue
+		}
+		if !slices.Contains(res, p) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// desiredPalesUsers builds device users from the gardeners' registry and local overrides:
+// restricted phones have no access, groups maps phone to time group
+func desiredPalesUsers(records map[string]*RegistryRecord, restricted map[string]bool,
+	groups map[string]string, timeGroups *PalEsTimeGroups) []*pales.User {
+
+	users := make(map[string]*pales.User)
+	for _, r := range records {
+		for _, phone := range registryPhones(r.Phone) {
+			u := users[phone]
+			if u != nil {
+				u.Lastname += " " + r.PlotNumber
+				continue
+			}
+			name := strings.Fields(r.FIO)
+			u = &pales.User{Id: phone, Lastname: r.PlotNumber, Output1: true, DialToOpen: true}
+			if len(name) > 1 {
+				u.Firstname = name[1]
+			} else if len(name) == 1 {
+				u.Firstname = name[0]
+			}
+			users[phone] = u
+		}
+	}
+	res := make([]*pales.User, 0, len(users))
+	for phone, u := range users {
+		if restricted[phone] {
+			u.Output1 = false
+			u.DialToOpen = false
+		}
+		if name := groups[phone]; name != "" {
+			u.TimeGroupName = name
+			if timeGroups != nil {
+				if tg, _ := timeGroups.get("", name); tg != nil {
+					u.TimeGroupId = tg.Id
+				}
+			}
+		}
+		res = append(res, u)
+	}
+	return res
+}
+
+// keepPalesUser returns true for device users not present in the registry but related to it:
+// linked devices and family members having the plot number in the name
+func keepPalesUser(records map[string]*RegistryRecord) func(*pales.User) bool {
+	return func(u *pales.User) bool {
+		if u.SecondaryDevice {
+			return true
+		}
+		pu := (*PalESUser)(u)
+		for n := range records {
+			if n != "" && pu.hasPlotNumber(n) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (g *Gate) palesTimeGroupOverrides() map[string]string {
+	res := make(map[string]string)
+	ss, err := g.Settings.FindN(palesTimeGroupKeyPrefix)
+	if err != nil || ss == nil {
+		return res
+	}
+	for _, s := range *ss {
+		res[strings.TrimPrefix(s.Key, palesTimeGroupKeyPrefix)] = s.ValueString()
+	}
+	return res
+}
+
+// planPalesSync computes changes and keeps them waiting for approval
+func (g *Gate) planPalesSync(ctx context.Context) (*pales.Plan, error) {
+	records := LoadRegistryRecords(g.CfgDir)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("registry is empty")
+	}
+	actual, err := g.Pales.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	desired := desiredPalesUsers(records, g.restrictedPhones(), g.palesTimeGroupOverrides(), g.timeGroups())
+	plan := &pales.Plan{
+		ID:      generateRandomID(6),
+		Created: time.Now(),
+		Changes: pales.Diff(desired, actual, keepPalesUser(records)),
+	}
+	if len(plan.Changes) != 0 {
+		g.palesPlan.Store(plan)
+	}
+	return plan, nil
+}
+
+// applyPalesSync applies the pending plan, every change is recorded
+func (g *Gate) applyPalesSync(ctx context.Context, planID, actor string) (string, error) {
+	plan := g.palesPlan.Load()
+	if plan == nil || plan.ID != planID {
+		return "", fmt.Errorf("plan %q not found", planID)
+	}
+	if time.Since(plan.Created) > palesPlanTTL {
+		return "", fmt.Errorf("plan %q is expired", planID)
+	}
+	if !g.palesPlan.CompareAndSwap(plan, nil) {
+		return "", fmt.Errorf("plan %q is already applied", planID)
+	}
+	var msg strings.Builder
+	failed := 0
+	for _, ch := range plan.Changes {
+		err := g.Pales.Apply(ctx, ch)
+		rec := gate.PalesChange{
+			PlanID:         plan.ID,
+			Op:             string(ch.Op),
+			Phone:          ch.Phone(),
+			Actor:          actor,
+			CreatedAtMilli: time.Now().UnixMilli(),
+		}
+		if ch.New != nil {
+			bb, _ := json.Marshal(ch.New)
+			rec.Data = string(bb)
+		}
+		if err != nil {
+			failed++
+			rec.Error = err.Error()
+			fmt.Fprintf(&msg, "%s error: %v\n", ch, err)
+		}
+		if err := g.PalesChanges.Insert(&rec); err != nil {
+			Logger.Errorf("recording pal-es change %s: %v", ch, err)
+		}
+	}
+	g.loadPalesUsers()
+	fmt.Fprintf(&msg, "plan %s applied: %d changes, %d failed", plan.ID, len(plan.Changes)-failed, failed)
+	g.sendSystemNotification(fmt.Sprintf("pal-es users %s by %s", msg.String(), actor))
+	return msg.String(), nil
+}
@@ -2,7 +2,9 @@ package tgsrv
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"os/exec"
@@ -253,24 +255,32 @@ func (m *pingMonitor) watchOnlineCnt() {
 }
 
 func reportToDiscord(url, msg string) {
-	client := http.Client{
-		Timeout: 5 * time.Second,
+	if len(url) == 0 {
+		Logger.Warn(msg)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := postDiscord(ctx, url, msg); err != nil {
+		Logger.Errorf("post %s error %v", url, err)
 	}
+}
+
+func postDiscord(ctx context.Context, url, msg string) error {
 	jsonMsg, err := discordFormat(msg)
 	if err != nil {
-		Logger.Errorf("message format error '%v' for %q", err, msg)
-		return
+		return fmt.Errorf("message format error '%v' for %q", err, msg)
 	}
-	if len(url) != 0 {
-		resp, err := client.Post(url, "application/json", strings.NewReader(jsonMsg))
-		if err != nil {
-			Logger.Errorf("post %s error %v", url, err)
-		} else {
-			resp.Body.Close()
-		}
-	} else {
-		Logger.Warn(msg)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(jsonMsg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
+	return checkResponse(resp)
 }
 
 func discordFormat(msg string) (string, error) {
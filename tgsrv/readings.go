@@ -0,0 +1,485 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/gate"
+	"7stgbot/notify"
+	"7stgbot/telegram"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Показания счётчиков передают жители в приложении шлагбаума и в боте, можно с фото счётчика. Показание
+// сверяется с предыдущим и ждет правления в /gate/admin/readings, принятое попадает в расчет счетов.
+
+const (
+	readingMaxKWhKey     = "g.readingMaxKWh.i"
+	defaultReadingMaxKWh = 1000
+	readingsDir          = "readings" // photos in CfgDir
+	readingPhotoMax      = 10 << 20
+	readingLateDays      = 5 // readings sent on the first days of the month are of the previous month
+	eventReadings        = "user.readings"
+
+	submissionPending  = "pending"
+	submissionAccepted = "accepted"
+	submissionRejected = "rejected"
+)
+
+var (
+	errPlotExpected = errors.New("plot number expected")
+	errNotPlotOwner = errors.New("not an owner of the plot")
+	errBadPhoto     = errors.New("photo is not a JPEG, PNG or WebP image")
+	errBadReading   = errors.New("reading is not a number")
+	errReadingTaken = errors.New("reading of the month is already accepted")
+)
+
+var readingPhotoTypes = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/webp": ".webp"}
+
+var plotRE = regexp.MustCompile(`^[1-9][0-9]{0,2}$`)
+
+// ReadingSubmission is a meter reading sent by a resident, By is the phone. It is billed when the board accepts it.
+type ReadingSubmission struct {
+	billing.Reading
+	Photo      string `json:",omitempty"` // file of readingsDir
+	Warning    string `json:",omitempty"` // why the board should look closer
+	Status     string
+	ReviewedBy string `json:",omitempty"`
+	Comment    string `json:",omitempty"`
+
+	Rejected []ReadingSubmission `json:",omitempty"` // earlier submissions of the month rejected by the board, with photos
+}
+
+func (e *ReadingSubmission) Type() string { return "ReadingSubmission" }
+func (e *ReadingSubmission) ID() string   { return e.Plot + "/" + e.Period.String() }
+func (e *ReadingSubmission) MarshalData() (string, error) {
+	bb, err := json.Marshal(e)
+	return string(bb), err
+}
+func (e *ReadingSubmission) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), e)
+}
+
+// readingPeriod is the month of a reading sent at t
+func readingPeriod(t time.Time) billing.Period {
+	t = t.In(Location)
+	p := billing.Period{Year: t.Year(), Month: int(t.Month())}
+	if t.Day() <= readingLateDays {
+		return p.Prev()
+	}
+	return p
+}
+
+// parseReading accepts "1234.5" and "1234,5"
+func parseReading(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(s), ",", "."), 64)
+	if err != nil || v < 0 {
+		return 0, errBadReading
+	}
+	return v, nil
+}
+
+// phonePlots returns plot numbers in the name of the phone of the register
+func (g *Gate) phonePlots(phone string) []string {
+	u, ok := g.Phones[phone]
+	if !ok {
+		return nil
+	}
+	var plots []string
+	for _, f := range strings.FieldsFunc(u.Firstname+" "+u.Lastname, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if plotRE.MatchString(f) && !slices.Contains(plots, f) {
+			plots = append(plots, f)
+		}
+	}
+	return plots
+}
+
+func (g *Gate) readingMaxKWh() float64 {
+	s, err := g.Settings.Find(readingMaxKWhKey)
+	if err != nil {
+		Logger.Errorf("read setting %q error: %v", readingMaxKWhKey, err)
+		return defaultReadingMaxKWh
+	}
+	return float64(s.ValueInt(defaultReadingMaxKWh))
+}
+
+// submitReading validates the reading of the plot of the phone and queues it for the board, the plot may be
+// empty if the phone has one. A reading above the plausible consumption is queued with a warning.
+func (g *Gate) submitReading(phone, plot string, value float64, photo []byte, now time.Time) (*ReadingSubmission, error) {
+	plots := g.phonePlots(phone)
+	switch {
+	case plot == "" && len(plots) == 1:
+		plot = plots[0]
+	case plot == "":
+		return nil, errPlotExpected
+	case !slices.Contains(plots, plot):
+		return nil, errNotPlotOwner
+	}
+	g.readingsMu.Lock()
+	defer g.readingsMu.Unlock()
+	s := &ReadingSubmission{Status: submissionPending, Reading: billing.Reading{Plot: plot, Period: readingPeriod(now),
+		Value: value, Time: now.UnixMilli(), By: phone}}
+	err := g.ledger().CheckReading(s.Reading, g.readingMaxKWh())
+	switch {
+	case errors.Is(err, billing.ErrReadingTooHigh):
+		s.Warning = err.Error()
+	case err != nil:
+		return nil, err
+	}
+	// a reviewed submission is kept: an accepted one is billed, a rejected one goes to the history
+	old := &ReadingSubmission{Reading: billing.Reading{Plot: s.Plot, Period: s.Period}}
+	found, err := g.Entities.Load(old)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case found && old.Status == submissionAccepted:
+		return nil, errReadingTaken
+	case found && old.Status == submissionRejected:
+		s.Rejected = old.Rejected
+		old.Rejected = nil
+		s.Rejected = append(s.Rejected, *old)
+	}
+	if len(photo) != 0 {
+		ext, ok := readingPhotoTypes[http.DetectContentType(photo)]
+		if !ok {
+			return nil, errBadPhoto
+		}
+		s.Photo = fmt.Sprintf("%s-%s-%d%s", s.Plot, s.Period, s.Time, ext)
+		if err := os.MkdirAll(filepath.Join(g.CfgDir, readingsDir), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(g.readingPhotoPath(s.Photo), photo, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	if found && old.Status == submissionPending && old.Photo != "" && old.Photo != s.Photo {
+		os.Remove(g.readingPhotoPath(old.Photo))
+	}
+	if err := saveEntity(g.Entities, s); err != nil {
+		return nil, err
+	}
+	msg := fmt.Sprintf("reading of plot %s for %s: %s kWh by %s", s.Plot, s.Period, billing.FormatKWh(s.Value),
+		g.Phones[phone].name())
+	if s.Warning != "" {
+		msg += ", " + s.Warning
+	}
+	g.notify(eventReadings, notify.Info, msg)
+	return s, nil
+}
+
+func (g *Gate) readingPhotoPath(name string) string {
+	return filepath.Join(g.CfgDir, readingsDir, filepath.Base(name))
+}
+
+// readingSubmissions returns submissions of the status sorted by month and plot, all if the status is empty
+func (g *Gate) readingSubmissions(status string) []*ReadingSubmission {
+	data, err := g.Entities.List((&ReadingSubmission{}).Type())
+	if err != nil {
+		Logger.Errorf("loading reading submissions: %v", err)
+	}
+	var ss []*ReadingSubmission
+	for id, d := range data {
+		s := &ReadingSubmission{}
+		if err := s.UnmarshalData(d); err != nil {
+			Logger.Errorf("reading submission %s: %v", id, err)
+			continue
+		}
+		if status == "" || s.Status == status {
+			ss = append(ss, s)
+		}
+	}
+	slices.SortFunc(ss, func(a, b *ReadingSubmission) int {
+		if c := a.Period.Compare(b.Period); c != 0 {
+			return c
+		}
+		return billing.ComparePlots(a.Plot, b.Plot)
+	})
+	return ss
+}
+
+// reviewReading accepts or rejects the pending submission, an accepted reading is billed.
+// The resident is notified of the decision.
+func (g *Gate) reviewReading(plot string, p billing.Period, accept bool, comment, by string) (*ReadingSubmission, error) {
+	g.readingsMu.Lock()
+	defer g.readingsMu.Unlock()
+	s := &ReadingSubmission{Reading: billing.Reading{Plot: plot, Period: p}}
+	ok, err := g.Entities.Load(s)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if s.Status != submissionPending {
+		return nil, adminBadRequest("reading of plot %s for %s is already %s", plot, p, s.Status)
+	}
+	s.Status, s.ReviewedBy, s.Comment = If(accept, submissionAccepted, submissionRejected), by, comment
+	if accept {
+		err = g.updateLedger(func(l *billing.Ledger) ([]gate.Entity, error) {
+			if err := l.PutReading(s.Reading); err != nil {
+				return nil, err
+			}
+			return []gate.Entity{&MeterReading{s.Reading}, s}, nil
+		})
+	} else {
+		err = saveEntity(g.Entities, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.sendSystemNotification(fmt.Sprintf("reading of plot %s for %s is %s by %s", plot, p, s.Status, by))
+	text := fmt.Sprintf("Показание %s кВт·ч участка %s за %s принято.", billing.FormatKWh(s.Value), plot, p)
+	if !accept {
+		text = fmt.Sprintf("Показание %s кВт·ч участка %s за %s отклонено правлением", billing.FormatKWh(s.Value), plot, p)
+		text += If(comment == "", ".", ": "+comment)
+	}
+	g.notifyResident(s.By, text)
+	return s, nil
+}
+
+// missingReadings returns plots of the register and of the ledger without a reading of the month,
+// plots with a submission waiting for the board are pending
+func (g *Gate) missingReadings(p billing.Period) (missing, pending []string) {
+	l := g.ledger()
+	submitted := make(map[string]bool)
+	for _, s := range g.readingSubmissions(submissionPending) {
+		submitted[s.Plot] = submitted[s.Plot] || s.Period == p
+	}
+	for _, plot := range g.billingPlots() {
+		if _, ok := l.Reading(plot, p); ok {
+			continue
+		}
+		if submitted[plot] {
+			pending = append(pending, plot)
+		} else {
+			missing = append(missing, plot)
+		}
+	}
+	return missing, pending
+}
+
+func missingReadingsText(p billing.Period, missing, pending []string) string {
+	res := fmt.Sprintf("%s: no readings of %d plots", p, len(missing))
+	if len(missing) != 0 {
+		res += ": " + strings.Join(missing, ", ")
+	}
+	if len(pending) != 0 {
+		res += fmt.Sprintf("\nwaiting for review: %s", strings.Join(pending, ", "))
+	}
+	return res
+}
+
+// remindReadings asks owners of plots without a reading of the month to send it, the report is published
+// as a user.readings event
+func (g *Gate) remindReadings(p billing.Period) string {
+	missing, pending := g.missingReadings(p)
+	reminded := 0
+	for _, plot := range missing {
+		text := fmt.Sprintf("Передайте показание счётчика участка %s за %s: /reading <показание> в боте "+
+			"или «Показания счётчика» в приложении шлагбаума.", plot, p)
+		for _, phone := range g.plotOwners(plot) {
+			g.notifyResident(phone, text)
+			reminded++
+		}
+	}
+	res := fmt.Sprintf("%s\n%d owners reminded", missingReadingsText(p, missing, pending), reminded)
+	g.notify(eventReadings, notify.Info, res)
+	return res
+}
+
+func submissionText(s *ReadingSubmission) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s plot %s: %s kWh", s.Period, s.Plot, billing.FormatKWh(s.Value))
+	fmt.Fprintf(&sb, " by %s at %s", s.By, time.UnixMilli(s.Time).In(Location).Format("2006-01-02 15:04"))
+	if s.Photo != "" {
+		sb.WriteString(", photo")
+	}
+	if s.Warning != "" {
+		sb.WriteString(", " + s.Warning)
+	}
+	if s.Status != submissionPending {
+		fmt.Fprintf(&sb, ", %s by %s", s.Status, s.ReviewedBy)
+	}
+	if s.Comment != "" {
+		sb.WriteString(": " + s.Comment)
+	}
+	if len(s.Rejected) != 0 {
+		fmt.Fprintf(&sb, ", %d rejected before", len(s.Rejected))
+	}
+	return sb.String()
+}
+
+// readingReply is the reply to the resident for the result of submitReading
+func readingReply(s *ReadingSubmission, err error) (string, int) {
+	switch {
+	case err == nil && s.Warning != "":
+		return fmt.Sprintf("Показание %s кВт·ч участка %s за %s отправлено в правление. Расход выше обычного, "+
+			"правление проверит показание.", billing.FormatKWh(s.Value), s.Plot, s.Period), http.StatusOK
+	case err == nil:
+		return fmt.Sprintf("Показание %s кВт·ч участка %s за %s отправлено в правление.",
+			billing.FormatKWh(s.Value), s.Plot, s.Period), http.StatusOK
+	case errors.Is(err, errPlotExpected):
+		return "Укажите номер участка.", http.StatusBadRequest
+	case errors.Is(err, errNotPlotOwner):
+		return "Участок не найден среди ваших участков в реестре.", http.StatusForbidden
+	case errors.Is(err, errBadReading):
+		return "Показание должно быть числом.", http.StatusBadRequest
+	case errors.Is(err, billing.ErrReadingDecreased):
+		return "Показание меньше предыдущего. Проверьте значение или обратитесь в правление.", http.StatusBadRequest
+	case errors.Is(err, errReadingTaken):
+		return "Показание за этот месяц уже принято правлением. Для исправления обратитесь в правление.", http.StatusConflict
+	case errors.Is(err, errBadPhoto):
+		return "Фото должно быть в формате JPEG, PNG или WebP.", http.StatusBadRequest
+	}
+	Logger.Errorf("reading submission: %v", err)
+	return "внутренняя ошибка", http.StatusInternalServerError
+}
+
+// ReadingsState is the page of readings of the gate app
+type ReadingsState struct {
+	Period billing.Period
+	Plots  []PlotReadings
+}
+
+type PlotReadings struct {
+	Plot      string
+	Last      *billing.Reading   `json:",omitempty"` // billed before the month
+	Submitted *ReadingSubmission `json:",omitempty"` // of the month
+}
+
+// ownerPhone returns the phone of the session of a plot owner
+func (b *ChatBroker) ownerPhone(w http.ResponseWriter, r *http.Request) (string, bool) {
+	p := b.g.webPrincipal(r)
+	if p == nil {
+		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
+		return "", false
+	}
+	if len(b.g.phonePlots(p.Phone)) == 0 {
+		http.Error(w, "Участки не найдены в реестре. Обратитесь в правление.", http.StatusForbidden)
+		return "", false
+	}
+	return p.Phone, true
+}
+
+func (b *ChatBroker) handleReadings(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.ownerPhone(w, r)
+	if !ok {
+		return
+	}
+	st := ReadingsState{Period: readingPeriod(time.Now())}
+	l := b.g.ledger()
+	for _, plot := range b.g.phonePlots(phone) {
+		pr := PlotReadings{Plot: plot}
+		if last, ok := l.LastReading(plot, st.Period); ok {
+			pr.Last = &last
+		}
+		s := &ReadingSubmission{Reading: billing.Reading{Plot: plot, Period: st.Period}}
+		if ok, _ := b.g.Entities.Load(s); ok {
+			pr.Submitted = s
+		}
+		st.Plots = append(st.Plots, pr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleReadingSubmit takes the multipart form of plot, value and photo
+func (b *ChatBroker) handleReadingSubmit(w http.ResponseWriter, r *http.Request) {
+	phone, ok := b.ownerPhone(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, readingPhotoMax+65536)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "Фото слишком большое.", http.StatusBadRequest)
+		return
+	}
+	value, err := parseReading(r.FormValue("value"))
+	if err != nil {
+		text, status := readingReply(nil, err)
+		http.Error(w, text, status)
+		return
+	}
+	var photo []byte
+	if f, _, err := r.FormFile("photo"); err == nil {
+		defer f.Close()
+		if photo, err = io.ReadAll(io.LimitReader(f, readingPhotoMax)); err != nil {
+			http.Error(w, "Не удалось получить фото, отправьте его еще раз.", http.StatusBadRequest)
+			return
+		}
+	}
+	s, err := b.g.submitReading(phone, r.FormValue("plot"), value, photo, time.Now())
+	text, status := readingReply(s, err)
+	if err != nil {
+		http.Error(w, text, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"result": text, "submission": s})
+}
+
+// handleReading takes "/reading [plot] <value>", a photo of the meter may be sent with the command as the caption
+func (b *TGBot) handleReading(ctx context.Context, m *telegram.Message) {
+	if !b.privateChat(ctx, m) {
+		return
+	}
+	g := b.ws.gate
+	u, err := g.TelegramUsers.Find(m.Chat.ID)
+	if err != nil {
+		Logger.Errorf("error finding telegram chat %d: %v", m.Chat.ID, err)
+		b.sendMessage(ctx, m.Chat.ID, "внутренняя ошибка", nil)
+		return
+	}
+	if u == nil {
+		b.sendMessage(ctx, m.Chat.ID, tgLinkHint, nil)
+		return
+	}
+	args := strings.Fields(m.CommandArgs())
+	plot := ""
+	if len(args) == 2 {
+		plot, args = args[0], args[1:]
+	}
+	if len(args) != 1 {
+		plots := g.phonePlots(u.Phone)
+		hint := fmt.Sprintf("Передайте показание счётчика за %s: /reading <показание>, можно подписью к фото счётчика.",
+			readingPeriod(time.Now()))
+		if len(plots) > 1 {
+			hint = fmt.Sprintf("Передайте показание счётчика за %s: /reading <участок> <показание>, можно подписью к фото счётчика.\nВаши участки: %s",
+				readingPeriod(time.Now()), strings.Join(plots, ", "))
+		}
+		b.sendMessage(ctx, m.Chat.ID, hint, nil)
+		return
+	}
+	value, err := parseReading(args[0])
+	if err != nil {
+		text, _ := readingReply(nil, err)
+		b.sendMessage(ctx, m.Chat.ID, text, nil)
+		return
+	}
+	var photo []byte
+	if len(m.Photo) != 0 {
+		// the largest size is the last
+		photo, err = b.bot.DownloadFile(ctx, m.Photo[len(m.Photo)-1].FileID, readingPhotoMax)
+		if err != nil {
+			Logger.Errorf("telegram photo of chat %d: %v", m.Chat.ID, err)
+			b.sendMessage(ctx, m.Chat.ID, "Не удалось получить фото, отправьте его еще раз.", nil)
+			return
+		}
+	}
+	text, _ := readingReply(g.submitReading(u.Phone, plot, value, photo, time.Now()))
+	b.sendMessage(ctx, m.Chat.ID, text, nil)
+}
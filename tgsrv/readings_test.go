@@ -0,0 +1,186 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/gate"
+	"7stgbot/telegram"
+	"7stgbot/telegram/telegramtest"
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jpegHeader is enough for the content type of a photo
+var jpegHeader = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+
+func TestReadingPeriod(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want billing.Period
+	}{
+		{time.Date(2024, 5, 25, 12, 0, 0, 0, Location), billing.Period{Year: 2024, Month: 5}},
+		{time.Date(2024, 6, 5, 23, 0, 0, 0, Location), billing.Period{Year: 2024, Month: 5}},
+		{time.Date(2024, 1, 2, 9, 0, 0, 0, Location), billing.Period{Year: 2023, Month: 12}},
+		{time.Date(2024, 6, 6, 0, 0, 0, 0, Location), billing.Period{Year: 2024, Month: 6}},
+	}
+	for _, tt := range tests {
+		if got := readingPeriod(tt.t); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestPhonePlots(t *testing.T) {
+	g := &Gate{Phones: map[string]*PalESUser{
+		"1": {Firstname: "Иван", Lastname: "12"},
+		"2": {Firstname: "Мария", Lastname: "уч.7, 8 и 7"},
+		"3": {Firstname: "Охрана", Lastname: "1000 abc12"},
+	}}
+	for phone, want := range map[string]string{"1": "12", "2": "7 8", "3": "", "4": ""} {
+		if got := strings.Join(g.phonePlots(phone), " "); got != want {
+			t.Errorf("%s: got %q, want %q", phone, got, want)
+		}
+	}
+}
+
+func TestSubmitReading(t *testing.T) {
+	g, admin := newAdminGate(t)
+	g.CfgDir = t.TempDir()
+	now := time.Date(2024, 5, 28, 10, 0, 0, 0, Location)
+	p := readingPeriod(now)
+	g.updateLedger(func(l *billing.Ledger) ([]gate.Entity, error) {
+		r := billing.Reading{Plot: "12", Period: p.Prev(), Value: 1000}
+		return []gate.Entity{&MeterReading{r}}, l.PutReading(r)
+	})
+
+	if _, err := g.submitReading("79990000001", "12", 999, nil, now); !errors.Is(err, billing.ErrReadingDecreased) {
+		t.Errorf("got %v, want %v", err, billing.ErrReadingDecreased)
+	}
+	if _, err := g.submitReading("79990000001", "7", 1100, nil, now); !errors.Is(err, errNotPlotOwner) {
+		t.Errorf("got %v, want %v", err, errNotPlotOwner)
+	}
+	if _, err := g.submitReading("79990000001", "", 1100, []byte("text"), now); !errors.Is(err, errBadPhoto) {
+		t.Errorf("got %v, want %v", err, errBadPhoto)
+	}
+	s, err := g.submitReading("79990000001", "", 2500, jpegHeader, now)
+	if err != nil || s.Plot != "12" || s.Period != p || s.Warning == "" || s.By != "79990000001" {
+		t.Fatalf("got %+v %v, want a pending reading with a warning", s, err)
+	}
+	if _, err := os.Stat(g.readingPhotoPath(s.Photo)); err != nil {
+		t.Errorf("got %v, want the photo saved", err)
+	}
+	if missing, pending := g.missingReadings(p); len(missing) != 0 || strings.Join(pending, " ") != "12" {
+		t.Errorf("got %v %v, want plot 12 pending", missing, pending)
+	}
+
+	w := adminRequest(admin, "GET", "/gate/admin/api/readings/12/"+p.String()+"/photo", "resident", "", "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %v, want the photo forbidden to residents", w.Code)
+	}
+	if w := adminRequest(admin, "GET", "/gate/admin/api/readings/12/"+p.String()+"/photo", "admin", "", ""); !bytes.Equal(w.Body.Bytes(), jpegHeader) {
+		t.Errorf("got %v %q, want the photo", w.Code, w.Body)
+	}
+	if w := adminRequest(admin, "POST", "/gate/admin/api/readings/12/"+p.String()+"/accept", "admin", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want accepted", w.Code, w.Body)
+	}
+	if r, ok := g.ledger().Reading("12", p); !ok || r.Value != 2500 || r.By != "79990000001" {
+		t.Errorf("got %+v %v, want the reading billed", r, ok)
+	}
+	if _, err := g.reviewReading("12", p, false, "", "test"); !errors.Is(err, errAdminBadRequest) {
+		t.Errorf("got %v, want already accepted", err)
+	}
+	if _, err := g.submitReading("79990000001", "", 2600, nil, now); !errors.Is(err, errReadingTaken) {
+		t.Errorf("got %v, want %v", err, errReadingTaken)
+	}
+	if got, _ := g.handleBillingCommand("/7_billing", "report "+p.String(), "test"); got != p.String()+": no readings of 0 plots" {
+		t.Errorf("got %q, want no missing readings", got)
+	}
+	g.loadBilling()
+	if b, ok := g.ledger().Bill("12", p); !ok || b.Spent != 1500 {
+		t.Errorf("got %+v, want 1500 kWh billed after restart", b)
+	}
+}
+
+func TestTelegramReading(t *testing.T) {
+	g, b, srv := newTelegramGate(t)
+	g.CfgDir = t.TempDir()
+	ctx := t.Context()
+	send := func(u telegram.Update) {
+		b.handleUpdate(ctx, &u)
+	}
+	send(telegramtest.TextUpdate(7, "/reading 1234"))
+	waitText(t, srv, 7, 0, tgLinkHint)
+	g.linkTelegram(7, "79990000001", "test")
+
+	send(telegramtest.TextUpdate(7, "/reading"))
+	waitText(t, srv, 7, 1, "Передайте показание счётчика")
+	srv.AddFile("meter", jpegHeader)
+	send(telegramtest.PhotoUpdate(7, "meter", "/reading 1234,5"))
+	waitText(t, srv, 7, 2, "Показание 1234.5 кВт·ч участка 12")
+
+	s := &ReadingSubmission{Reading: billing.Reading{Plot: "12", Period: readingPeriod(time.Now())}}
+	if ok, _ := g.Entities.Load(s); !ok || s.Photo == "" || s.Status != submissionPending {
+		t.Fatalf("got %+v, want the pending reading with the photo", s)
+	}
+	if _, err := g.handleBillingCommand("/7_billing", "reject 12 "+s.Period.String()+" нечитаемое фото", "test"); err != nil {
+		t.Fatal(err)
+	}
+	waitText(t, srv, 7, 3, "Показание 1234.5 кВт·ч участка 12 за "+s.Period.String()+" отклонено правлением: нечитаемое фото")
+	rejected := s.Photo
+
+	got, err := g.handleBillingCommand("/7_billing", "remind "+s.Period.String(), "test")
+	if err != nil || !strings.Contains(got, "no readings of 1 plots: 12") || !strings.Contains(got, "2 owners reminded") {
+		t.Errorf("got %q %v, want plot 12 reminded", got, err)
+	}
+	waitText(t, srv, 7, 4, "Передайте показание счётчика участка 12")
+
+	// the rejected reading and its photo stay for the board
+	send(telegramtest.PhotoUpdate(7, "meter", "/reading 1235"))
+	waitText(t, srv, 7, 5, "Показание 1235 кВт·ч участка 12")
+	s = &ReadingSubmission{Reading: s.Reading}
+	if ok, _ := g.Entities.Load(s); !ok || s.Status != submissionPending || len(s.Rejected) != 1 || s.Rejected[0].Photo != rejected {
+		t.Fatalf("got %+v, want the pending reading with the rejected one", s)
+	}
+	if _, err := os.Stat(g.readingPhotoPath(rejected)); err != nil {
+		t.Errorf("got %v, want the rejected photo kept", err)
+	}
+}
+
+func TestReadingSubmitHTTP(t *testing.T) {
+	g, _ := newAdminGate(t)
+	g.CfgDir = t.TempDir()
+	br := &ChatBroker{g: g}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /gate/app/readings", br.handleReadings)
+	mux.HandleFunc("POST /gate/app/readings", br.handleReadingSubmit)
+
+	form := func(value string) (string, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("value", value)
+		fw, _ := mw.CreateFormFile("photo", "meter.jpg")
+		fw.Write(jpegHeader)
+		mw.Close()
+		return mw.FormDataContentType(), buf.String()
+	}
+	ct, body := form("12a")
+	if w := adminRequest(mux, "POST", "/gate/app/readings", "resident", ct, body); w.Code != http.StatusBadRequest {
+		t.Errorf("got %v, want bad request", w.Code)
+	}
+	ct, body = form("345")
+	if w := adminRequest(mux, "POST", "/gate/app/readings", "admin", ct, body); w.Code != http.StatusForbidden {
+		t.Errorf("got %v, want forbidden without plots", w.Code)
+	}
+	if w := adminRequest(mux, "POST", "/gate/app/readings", "resident", ct, body); w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want submitted", w.Code, w.Body)
+	}
+	w := adminRequest(mux, "GET", "/gate/app/readings", "resident", "", "")
+	if !strings.Contains(w.Body.String(), `"Plot":"12"`) || !strings.Contains(w.Body.String(), `"Status":"pending"`) {
+		t.Errorf("got %s, want the pending reading of plot 12", w.Body)
+	}
+}
@@ -0,0 +1,346 @@
+package tgsrv
+
+import (
+	"7stgbot/notify"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mattermostIDRE is a user id of Mattermost, names are matched nowhere as a user may rename to a freed name
+var mattermostIDRE = regexp.MustCompile(`^[a-z0-9]{26}$`)
+
+// Role of a principal. Resident and plot owner are derived from the gate register, others are assigned
+// by /7_role, admins are also MattermostAdmins, AdminEmails, AdminPhone and admins of the register
+type Role string
+
+const (
+	RoleResident  Role = "resident"   // phone of the gate register
+	RolePlotOwner Role = "plot_owner" // phone of the register with a plot number in the name
+	RoleBoard     Role = "board"
+	RoleGuard     Role = "guard"
+	RoleAdmin     Role = "admin"
+)
+
+// assignableRoles are roles of /7_role
+var assignableRoles = []Role{RoleBoard, RoleGuard, RoleAdmin}
+
+type Permission string
+
+const (
+	PermOpen        Permission = "open"         // open the gate
+	PermGuestCode   Permission = "guest_code"   // keypad codes for guests
+	PermGateControl Permission = "gate_control" // keep open, lock, timers
+	PermRegistry    Permission = "registry"     // search the register, mailings to residents
+	PermAdmin       Permission = "admin"        // settings, SMS, roles, log level
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleResident:  {PermOpen},
+	RolePlotOwner: {PermOpen, PermGuestCode},
+	RoleGuard:     {PermOpen, PermGateControl},
+	RoleBoard:     {PermOpen, PermGuestCode, PermRegistry},
+	RoleAdmin:     {PermOpen, PermGuestCode, PermGateControl, PermRegistry, PermAdmin},
+}
+
+var plotNumberRE = regexp.MustCompile(`(?i)(^|[^a-zа-я0-9])[1-9][0-9]{0,2}([^a-zа-я0-9]|$)`)
+
+// Principal is who runs a command in any front end. The front end sets ids it knows,
+// the phone is resolved by links of the chat ids, roles by resolvePrincipal
+type Principal struct {
+	Phone          string // 79990010203
+	Email          string
+	ChatID         int64 // telegram
+	MattermostID   string
+	MattermostName string // for logs only, roles are matched by the id
+	Roles          []Role
+}
+
+func (p *Principal) Has(r Role) bool {
+	return p != nil && slices.Contains(p.Roles, r)
+}
+
+func (p *Principal) Can(perm Permission) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if slices.Contains(rolePermissions[r], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// String is for logs and notifications
+func (p *Principal) String() string {
+	var ss []string
+	if p.MattermostName != "" {
+		ss = append(ss, "mm:"+p.MattermostName)
+	} else if p.MattermostID != "" {
+		ss = append(ss, "mm:"+p.MattermostID)
+	}
+	if p.ChatID != 0 {
+		ss = append(ss, "tg:"+strconv.FormatInt(p.ChatID, 10))
+	}
+	if p.Email != "" {
+		ss = append(ss, p.Email)
+	}
+	if p.Phone != "" {
+		ss = append(ss, p.Phone)
+	}
+	if len(ss) == 0 {
+		return "anonymous"
+	}
+	return strings.Join(ss, " ")
+}
+
+// subjects are keys of role assignments of the principal
+func (p *Principal) subjects() []string {
+	var ss []string
+	if p.Phone != "" {
+		ss = append(ss, "phone:"+p.Phone)
+	}
+	if p.Email != "" {
+		ss = append(ss, "email:"+strings.ToLower(p.Email))
+	}
+	if p.ChatID != 0 {
+		ss = append(ss, "tg:"+strconv.FormatInt(p.ChatID, 10))
+	}
+	if p.MattermostID != "" {
+		ss = append(ss, "mm:"+p.MattermostID)
+	}
+	return ss
+}
+
+// actorSubject is the identity of the principal who did something, roles of it are resolved again when needed.
+// The front end identity goes first, the phone linked to it may change.
+func (p *Principal) actorSubject() string {
+	switch {
+	case p.MattermostID != "":
+		return "mm:" + p.MattermostID
+	case p.ChatID != 0:
+		return "tg:" + strconv.FormatInt(p.ChatID, 10)
+	case p.Email != "":
+		return "email:" + strings.ToLower(p.Email)
+	case p.Phone != "":
+		return "phone:" + p.Phone
+	}
+	return ""
+}
+
+// principalOfSubject is the reverse of actorSubject, nil if s is not a subject
+func principalOfSubject(s string) *Principal {
+	kind, v, _ := strings.Cut(s, ":")
+	if v == "" {
+		return nil
+	}
+	switch kind {
+	case "mm":
+		return &Principal{MattermostID: v}
+	case "tg":
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return &Principal{ChatID: id}
+		}
+	case "email":
+		return &Principal{Email: v}
+	case "phone":
+		return &Principal{Phone: v}
+	}
+	return nil
+}
+
+// RoleAssignments stores assigned roles as one entity, subject -> roles
+type RoleAssignments struct {
+	Subjects map[string][]Role
+}
+
+func (a *RoleAssignments) Type() string { return "Roles" }
+func (a *RoleAssignments) ID() string   { return "gate" }
+func (a *RoleAssignments) MarshalData() (string, error) {
+	bb, err := json.Marshal(a.Subjects)
+	return string(bb), err
+}
+func (a *RoleAssignments) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), &a.Subjects)
+}
+
+func (g *Gate) roleAssignments() *RoleAssignments {
+	a := RoleAssignments{Subjects: map[string][]Role{}}
+	if _, err := g.Entities.Load(&a); err != nil {
+		Logger.Errorf("loading roles: %v", err)
+	}
+	if a.Subjects == nil {
+		a.Subjects = map[string][]Role{}
+	}
+	return &a
+}
+
+// updateRoles changes role assignments and stores them
+func (g *Gate) updateRoles(update func(a *RoleAssignments) error) error {
+	g.rolesMu.Lock()
+	defer g.rolesMu.Unlock()
+	a := g.roleAssignments()
+	if err := update(a); err != nil {
+		return err
+	}
+	if ok, _ := g.Entities.Load(&RoleAssignments{}); ok {
+		return g.Entities.Update(a)
+	}
+	return g.Entities.Insert(a)
+}
+
+// resolvePrincipal sets the phone linked to the chat ids if it is not set and roles of the principal
+func (g *Gate) resolvePrincipal(p *Principal) *Principal {
+	if p.Phone == "" && p.ChatID != 0 {
+		if u, err := g.TelegramUsers.Find(p.ChatID); err != nil {
+			Logger.Errorf("error finding telegram chat %d: %v", p.ChatID, err)
+		} else if u != nil {
+			p.Phone = u.Phone
+		}
+	}
+	if p.Phone == "" && p.MattermostID != "" {
+		if u, err := g.MattermostUsers.Find(p.MattermostID); err != nil {
+			Logger.Errorf("error finding mattermost user %s: %v", p.MattermostID, err)
+		} else if u != nil {
+			p.Phone = u.Phone
+		}
+	}
+	roles := map[Role]bool{}
+	if u, ok := g.Phones[p.Phone]; ok && p.Phone != "" {
+		roles[RoleResident] = true
+		if plotNumberRE.MatchString(u.Firstname + " " + u.Lastname) {
+			roles[RolePlotOwner] = true
+		}
+		if u.Admin {
+			roles[RoleAdmin] = true
+		}
+	}
+	cfg := g.config()
+	if p.MattermostID != "" && slices.Contains(cfg.MattermostAdmins, p.MattermostID) ||
+		p.Email != "" && slices.Contains(cfg.AdminEmails, p.Email) ||
+		p.Phone != "" && cfg.AdminPhone != "" && normalizePhone(cfg.AdminPhone)[1:] == p.Phone {
+		roles[RoleAdmin] = true
+	}
+	assigned := g.roleAssignments()
+	for _, s := range p.subjects() {
+		for _, r := range assigned.Subjects[s] {
+			roles[r] = true
+		}
+	}
+	p.Roles = p.Roles[:0]
+	for r := range roles {
+		p.Roles = append(p.Roles, r)
+	}
+	slices.Sort(p.Roles)
+	return p
+}
+
+// authorize checks the permission of the principal, a denial is published for the audit
+func (g *Gate) authorize(p *Principal, perm Permission, what string) bool {
+	if p.Can(perm) {
+		return true
+	}
+	g.notify(eventGateCommand, notify.Info, fmt.Sprintf("%s is denied to %s, %s permission expected", what, p, perm))
+	return false
+}
+
+// webPrincipal returns the principal of the web app session, nil if there is no session
+func (g *Gate) webPrincipal(r *http.Request) *Principal {
+	s := g.webSession(r)
+	if s == nil {
+		return nil
+	}
+	return g.resolvePrincipal(&Principal{Phone: normalizePhone(s.Phone)[1:]})
+}
+
+func (g *Gate) webSession(r *http.Request) *HTTPSession {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	s := HTTPSession{Token: cookie.Value}
+	if ok, _ := g.Entities.Load(&s); !ok {
+		return nil
+	}
+	return &s
+}
+
+// roleSubject returns the key of the assignment: phone:<phone>, email:<email>, tg:<chat id> or mm:<user id>
+func roleSubject(s string) (string, error) {
+	kind, v, ok := strings.Cut(s, ":")
+	switch {
+	case !ok && strings.Contains(s, "@"):
+		return "email:" + strings.ToLower(s), nil
+	case !ok && digits(strings.TrimPrefix(s, "+")):
+		return "phone:" + normalizePhone(s)[1:], nil
+	case kind == "phone" && digits(strings.TrimPrefix(v, "+")):
+		return "phone:" + normalizePhone(v)[1:], nil
+	case kind == "email" && strings.Contains(v, "@"):
+		return "email:" + strings.ToLower(v), nil
+	case kind == "tg":
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return s, nil
+		}
+	case kind == "mm" && mattermostIDRE.MatchString(v):
+		return s, nil
+	}
+	return "", fmt.Errorf("bad subject %q, phone, email, tg:<chat id> or mm:<user id> expected", s)
+}
+
+func (g *Gate) handleRoleCommand(cmd, args, actor string) (string, error) {
+	names := make([]string, len(assignableRoles))
+	for i, r := range assignableRoles {
+		names[i] = string(r)
+	}
+	usage := fmt.Sprintf("usage: %s [list | add <subject> <role> | del <subject> <role>], subject: phone, email, tg:<chat id>, mm:<user id>, roles: %s",
+		cmd, strings.Join(names, "|"))
+	ff := strings.Fields(args)
+	if len(ff) == 0 || ff[0] == "list" && len(ff) == 1 {
+		a := g.roleAssignments()
+		if len(a.Subjects) == 0 {
+			return "no assigned roles", nil
+		}
+		var lines []string
+		for s, rr := range a.Subjects {
+			lines = append(lines, fmt.Sprintf("%s %v", s, rr))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n"), nil
+	}
+	if len(ff) != 3 || ff[0] != "add" && ff[0] != "del" {
+		return usage, nil
+	}
+	subject, err := roleSubject(ff[1])
+	if err != nil {
+		return usage, err
+	}
+	role := Role(ff[2])
+	if !slices.Contains(assignableRoles, role) {
+		return usage, fmt.Errorf("role %q is not assignable", role)
+	}
+	err = g.updateRoles(func(a *RoleAssignments) error {
+		rr := slices.DeleteFunc(a.Subjects[subject], func(r Role) bool { return r == role })
+		if ff[0] == "add" {
+			rr = append(rr, role)
+			slices.Sort(rr)
+		}
+		if len(rr) == 0 {
+			delete(a.Subjects, subject)
+		} else {
+			a.Subjects[subject] = rr
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	msg := fmt.Sprintf("role %s %s %s by %s", role, If(ff[0] == "add", "added to", "removed from"), subject, actor)
+	g.sendSystemNotification(msg)
+	return msg, nil
+}
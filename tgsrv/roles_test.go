@@ -0,0 +1,143 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const mmGuard = "g4xw1k9m7bf3jrz8a6yqp0tc5e"
+
+func TestRoles(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var g Gate
+	g.Init(&config.Config{MattermostAdmins: []string{"boss"}, AdminEmails: []string{"admin@example.com"}, AdminPhone: "89990000009"}, db)
+	g.Phones = map[string]*PalESUser{
+		"79990000001": {Id: "79990000001", Firstname: "Иван", Lastname: "12", DialToOpen: true},
+		"79990000002": {Id: "79990000002", Firstname: "Охрана", Lastname: "КПП", DialToOpen: true},
+		"79990000003": {Id: "79990000003", Firstname: "Мария", Lastname: "уч. 7", Admin: true},
+	}
+	g.TelegramUsers.Save(&gate.TelegramUser{ChatID: 1, Phone: "79990000001"})
+	g.MattermostUsers.Insert(&gate.MattermostUser{UserId: mmGuard, Phone: "79990000002"})
+
+	for _, args := range []string{"add 79990000002 guard", "add tg:5 board", "add mm:" + mmGuard + " board", "add tg:5 admin", "del tg:5 admin"} {
+		if _, err := g.handleRoleCommand("/7_role", args, "test"); err != nil {
+			t.Fatalf("%s: %v", args, err)
+		}
+	}
+	if _, err := g.handleRoleCommand("/7_role", "add tg:5 resident", "test"); err == nil {
+		t.Error("resident is derived, error expected")
+	}
+	if _, err := g.handleRoleCommand("/7_role", "add mm:guard board", "test"); err == nil {
+		t.Error("a user name is not a subject, error expected")
+	}
+	if got, want := mustRoleList(t, &g), "mm:"+mmGuard+" [board]\nphone:79990000002 [guard]\ntg:5 [board]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		p    Principal
+		want []Role
+	}{
+		{Principal{ChatID: 1}, []Role{RolePlotOwner, RoleResident}},
+		{Principal{MattermostID: mmGuard}, []Role{RoleBoard, RoleGuard, RoleResident}},
+		{Principal{Phone: "79990000003"}, []Role{RoleAdmin, RolePlotOwner, RoleResident}},
+		{Principal{ChatID: 5}, []Role{RoleBoard}},
+		{Principal{MattermostID: "boss"}, []Role{RoleAdmin}},
+		{Principal{MattermostID: "x", MattermostName: "boss"}, []Role{}}, // a name of another user
+		{Principal{Email: "admin@example.com"}, []Role{RoleAdmin}},
+		{Principal{Phone: "79990000009"}, []Role{RoleAdmin}},
+		{Principal{ChatID: 9}, []Role{}},
+	}
+	for _, tt := range tests {
+		p := tt.p
+		if got := g.resolvePrincipal(&p).Roles; !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", &p, got, tt.want)
+		}
+	}
+
+	perms := []struct {
+		p    Principal
+		perm Permission
+		want bool
+	}{
+		{Principal{ChatID: 1}, PermGuestCode, true},
+		{Principal{ChatID: 1}, PermGateControl, false},
+		{Principal{MattermostID: mmGuard}, PermGateControl, true},
+		{Principal{MattermostID: mmGuard}, PermAdmin, false},
+		{Principal{ChatID: 5}, PermRegistry, true},
+		{Principal{ChatID: 9}, PermOpen, false},
+	}
+	for _, tt := range perms {
+		p := tt.p
+		if got := g.authorize(g.resolvePrincipal(&p), tt.perm, "test"); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", &p, tt.perm, got, tt.want)
+		}
+	}
+
+	res, err := g.runMattermostCommand(mmCommandByName("/7_lock"), &mmCall{Cmd: "/7_lock", Args: "x", Principal: g.mattermostPrincipal(mmGuard, "guard")})
+	if err != nil || res != "number of minutes expected. 0 - unlock immediately" {
+		t.Errorf("got %v %v, want the lock usage for the guard", res, err)
+	}
+	res, _ = g.runMattermostCommand(mmCommandByName("/7_set"), &mmCall{Cmd: "/7_set", Principal: g.mattermostPrincipal(mmGuard, "guard")})
+	if res != "нет прав на команду" {
+		t.Errorf("got %v, want denied", res)
+	}
+}
+
+func mustRoleList(t *testing.T, g *Gate) string {
+	t.Helper()
+	res, err := g.handleRoleCommand("/7_role", "list", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestLogLevelAuth(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var g Gate
+	g.Init(&config.Config{AdminPhone: "79990000009"}, db)
+	g.Entities.Insert(&HTTPSession{Token: "admin", Phone: "+79990000009"})
+	g.Entities.Insert(&HTTPSession{Token: "resident", Phone: "+79990000001"})
+	ws := &webSrv{gate: &g}
+	level := AtomicLevel
+	defer func() { AtomicLevel = level }()
+	AtomicLevel = zap.NewAtomicLevel()
+
+	tests := []struct {
+		session string
+		want    int
+	}{
+		{"", http.StatusForbidden},
+		{"resident", http.StatusForbidden},
+		{"admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/app/log", strings.NewReader("1"))
+		if tt.session != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.session})
+		}
+		w := httptest.NewRecorder()
+		ws.handleLogLevel(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.session, w.Code, tt.want)
+		}
+	}
+}
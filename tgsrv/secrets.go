@@ -0,0 +1,77 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/secrets"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// Secrets is loaded by main from the config dir, see "7stgbot secrets"
+var Secrets = secrets.NewStore()
+
+const (
+	secretPhoneKey            = "phone-key" // AES key of phone links, 16, 24 or 32 bytes
+	secretQRSalt              = "qr-salt"
+	secretTOTPSalt            = "totp-salt"
+	secretSystemBotID         = "mattermost-system-bot-id"
+	secretPHPSessID           = "phpsessid"
+	secretMattermostToken     = "mattermost-token-"     // + command without "/"
+	secretMattermostActionKey = "mattermost-action-key" // HMAC key of button contexts
+)
+
+// config field -> secret, a set secret replaces the value of config.toml
+var configSecrets = map[string]func(c *config.Config) *string{
+	"telegram-token":          func(c *config.Config) *string { return &c.TgToken },
+	"telegram-webhook-secret": func(c *config.Config) *string { return &c.TgWebhookSecret },
+	"ifttt-key":               func(c *config.Config) *string { return &c.IfTTTKey },
+	"gate-pwd":                func(c *config.Config) *string { return &c.Gate.Pwd },
+	"pales-portal-pwd":        func(c *config.Config) *string { return &c.PalesPortalPwd },
+	"ntfy-token":              func(c *config.Config) *string { return &c.NtfyToken },
+	"mattermost-bot-token":    func(c *config.Config) *string { return &c.MattermostBotToken },
+}
+
+// requiredSecrets are checked on start, hashes of QR and email links would be unsalted without them
+var requiredSecrets = []string{secretQRSalt}
+
+// CheckSecrets returns an error naming the first required secret that is not set
+func CheckSecrets() error {
+	for _, name := range requiredSecrets {
+		if Secrets.Get(name) == "" {
+			return fmt.Errorf("secret %s is not set, run \"7stgbot secrets set %s <value>\" with the value of links already sent or random:32", name, name)
+		}
+	}
+	return nil
+}
+
+// ApplyConfigSecrets replaces config values by secrets, "<id>." prefixed ones for additional gates
+func ApplyConfigSecrets(c *config.Config) {
+	for name, field := range configSecrets {
+		if v := Secrets.Get(gateSecretName(c, name)); v != "" {
+			*field(c) = v
+		}
+	}
+}
+
+// mattermostTokens returns accepted tokens of the command, config MattermostCommandTokens is the last
+func (g *Gate) mattermostTokens(cmd string) []string {
+	name := secretMattermostToken + strings.TrimPrefix(cmd, "/")
+	if c := mmCommandByName(cmd); c != nil {
+		name = c.secret()
+	}
+	tokens := Secrets.Values(g.secretName(name))
+	if t := g.config().MattermostCommandTokens[cmd]; t != "" {
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+func matchSecret(v string, secrets []string) bool {
+	for _, s := range secrets {
+		if subtle.ConstantTimeCompare([]byte(v), []byte(s)) == 1 {
+			return true
+		}
+	}
+	return false
+}
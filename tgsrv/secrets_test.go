@@ -0,0 +1,91 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"testing"
+	"time"
+)
+
+func init() {
+	Secrets.Set(secretPhoneKey, "0123456789abcdef")
+	Secrets.Set(secretQRSalt, "qr-salt")
+	Secrets.Set(secretTOTPSalt, "totp-salt")
+	Secrets.Set(secretTOTPKey, "0123456789abcdef0123456789abcdef")
+}
+
+func TestSecretsRotation(t *testing.T) {
+	defer func() {
+		Secrets.Set(secretPhoneKey, "0123456789abcdef")
+		Secrets.Set(secretQRSalt, "qr-salt")
+	}()
+	link, err := EncryptPhone("79990010203", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1Hash("2026", "05", "42")
+	email := encodeEmailAndMD5("a@ya.ru")
+
+	Secrets.Rotate(secretPhoneKey, "fedcba9876543210fedcba9876543210")
+	Secrets.Rotate(secretQRSalt, "qr-salt-2")
+	if phone, _, err := DecryptPhone(link); err != nil || phone != "79990010203" {
+		t.Errorf("got %v %v, want old link valid", phone, err)
+	}
+	if !checkHash("2026", "05", "42", hash) {
+		t.Errorf("got false, want old hash valid")
+	}
+	if _, _, ok := decodeEmailAndMD5(email); !ok {
+		t.Errorf("got false, want old email link valid")
+	}
+	if got := sha1Hash("2026", "05", "42"); got == hash {
+		t.Errorf("got %v, want hash by new salt", got)
+	}
+
+	for _, name := range []string{secretPhoneKey, secretQRSalt} {
+		if err := Secrets.Retire(name, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := DecryptPhone(link); err == nil {
+		t.Errorf("got nil, want retired key error")
+	}
+	if checkHash("2026", "05", "42", hash) {
+		t.Errorf("got true, want retired hash invalid")
+	}
+}
+
+func TestMattermostTokens(t *testing.T) {
+	defer Secrets.Delete(secretMattermostToken + "7_open")
+	var g Gate
+	g.Init(&config.Config{MattermostCommandTokens: map[string]string{"/7_open": "cfg"}}, nil)
+	Secrets.Set(secretMattermostToken+"7_open", "old")
+	Secrets.Rotate(secretMattermostToken+"7_open", "new")
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"new", true},
+		{"old", true},
+		{"cfg", true},
+		{"", false},
+		{"other", false},
+	}
+	for _, tt := range tests {
+		if got := matchSecret(tt.token, g.mattermostTokens("/7_open")); got != tt.want {
+			t.Errorf("%q got %v, want %v", tt.token, got, tt.want)
+		}
+	}
+	if got := g.mattermostTokens("/7_unknown"); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+}
+
+func TestCheckSecrets(t *testing.T) {
+	if err := CheckSecrets(); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	Secrets.Delete(secretQRSalt)
+	defer Secrets.Set(secretQRSalt, "qr-salt")
+	if err := CheckSecrets(); err == nil {
+		t.Errorf("got nil, want an error of unset %s", secretQRSalt)
+	}
+}
@@ -0,0 +1,177 @@
+package tgsrv
+
+import (
+	"7stgbot/gate"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func checkSchedule(value string) error {
+	var m map[string]int
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return err
+	}
+	for k := range m {
+		if _, err := time.Parse("15:04", k); err != nil {
+			return fmt.Errorf("bad time %q", k)
+		}
+	}
+	return nil
+}
+
+// settingsRegistry lists all settings which may be changed by /7_set
+var settingsRegistry = gate.NewSettingsRegistry(
+	&gate.SettingDef{Key: gateInOpenStateKey, Type: gate.SettingBool, Default: "false",
+		Description: "gate is kept open by /7_keep_open"},
+	&gate.SettingDef{Key: lastOpenedTimeKey, Type: gate.SettingInt,
+		Description: "last opening time, unix nanoseconds"},
+	&gate.SettingDef{Key: scheduleKey, Type: gate.SettingJSON, Check: checkSchedule,
+		Description: `timer schedule {"07:00":10,...} set by /7_timer, empty - open_schedule of config`},
+	&gate.SettingDef{Key: bleScheduleKey, Type: gate.SettingJSON, Check: checkSchedule,
+		Description: `BLE timer schedule {"07:00":10,...} set by /7_ble_timer`},
+	&gate.SettingDef{Key: badKeysKey, HotApply: true,
+		Description: "failing keypad keys, codes typed with them are matched to phones"},
+	&gate.SettingDef{Key: minCodeLenKey, Type: gate.SettingInt, Default: "0", Min: 0, Max: 16, HotApply: true,
+		Description: "any keypad code of this length or longer opens the gate, 0 - off"},
+	&gate.SettingDef{Key: accessImportedKey, Type: gate.SettingBool, Default: "false",
+		Description: "MAC maps of the config and restricted phones are imported to access entries, false - import on start"},
+	&gate.SettingDef{Key: calendarKeepOpenKey, Type: gate.SettingBool, Default: "false",
+		Description: "gate is kept open by a calendar exception, it ends with the exception"},
+	&gate.SettingDef{Key: totpLegacyUntilKey, HotApply: true, Check: checkTOTPLegacyUntil,
+		Description: "yyyy-mm-dd, TOTP secrets derived from the phone are rejected since the date, empty - accepted"},
+	&gate.SettingDef{Key: readingMaxKWhKey, Type: gate.SettingInt, Default: "1000", Min: 0, Max: 100000, HotApply: true,
+		Description: "kWh a month, submitted meter readings above are flagged for the board, 0 - off"},
+	&gate.SettingDef{Key: palesTimeGroupKeyPrefix, HotApply: true,
+		Description: "pales-tg.<phone> time group name of the phone for /7_pales_sync"},
+	&gate.SettingDef{Key: gate.ScheduledSettingsKeyPrefix, Type: gate.SettingYAML, HotApply: true,
+		Check: func(value string) error {
+			s := gate.Setting{Key: gate.ScheduledSettingsKeyPrefix}
+			s.SetString(value)
+			_, err := s.Schedule()
+			return err
+		},
+		Description: "mm-daily.<command> {from: 22:00, to: 7:00, args: ...} is added to /7_jobs"},
+)
+
+// setSetting validates and saves the setting, empty value deletes it. The change is recorded in the history.
+func (g *Gate) setSetting(key, value, actor string) (*gate.SettingDef, error) {
+	def := settingsRegistry.Lookup(key)
+	if def == nil {
+		return nil, fmt.Errorf("unknown setting %q, see /7_set describe", key)
+	}
+	if err := def.Validate(value); err != nil {
+		return def, err
+	}
+	old, err := g.Settings.Find(key)
+	if err != nil {
+		return def, err
+	}
+	set := gate.Setting{Key: key}
+	set.SetString(value)
+	switch {
+	case value == "" && set.IsScheduled():
+		_, err = g.Jobs.Cancel("mm-daily-" + key[len(gate.ScheduledSettingsKeyPrefix):])
+	case value == "":
+		err = g.Settings.Delete(&set)
+	case set.IsScheduled():
+		_, err = g.scheduleSetting(&set)
+	default:
+		err = g.Settings.Update(&set)
+	}
+	if err != nil {
+		return def, err
+	}
+	err = g.SettingsHistory.Insert(&gate.SettingChange{Key: key, OldValue: old.ValueString(), NewValue: value,
+		Actor: actor, CreatedAtMilli: time.Now().UnixMilli()})
+	if err != nil {
+		Logger.Errorf("settings history %s: %v", key, err)
+	}
+	return def, nil
+}
+
+func (g *Gate) handleSetCommand(args, actor string) (string, error) {
+	args = strings.TrimSpace(args)
+	sub, rest, _ := strings.Cut(args, " ")
+	rest = strings.TrimSpace(rest)
+	switch {
+	case sub == "describe" && !strings.Contains(rest, " "):
+		var msg strings.Builder
+		for _, d := range settingsRegistry.Defs() {
+			if !strings.HasPrefix(d.Key, rest) {
+				continue
+			}
+			if msg.Len() != 0 {
+				msg.WriteString("\n")
+			}
+			msg.WriteString(d.String())
+			if !d.IsPrefix() {
+				if s, err := g.Settings.Find(d.Key); err == nil {
+					msg.WriteString(" = " + settingsRegistry.ValueOrDefault(s))
+				}
+			}
+		}
+		if msg.Len() == 0 {
+			return "not found", nil
+		}
+		return msg.String(), nil
+
+	case sub == "history" && !strings.Contains(rest, " "):
+		cc, err := g.SettingsHistory.List(rest, 20)
+		if err != nil {
+			return "", err
+		}
+		var msg strings.Builder
+		for i, c := range cc {
+			if i != 0 {
+				msg.WriteString("\n")
+			}
+			fmt.Fprintf(&msg, "%s %s %s: %q -> %q", time.UnixMilli(c.CreatedAtMilli).In(Location).Format("2006-01-02 15:04:05"),
+				c.Actor, c.Key, c.OldValue, c.NewValue)
+		}
+		if msg.Len() == 0 {
+			return "no changes", nil
+		}
+		return msg.String(), nil
+
+	case args == "" || !strings.Contains(args, " "):
+		ss, err := g.Settings.FindN(args)
+		if err != nil {
+			return "", err
+		}
+		if ss == nil || len(*ss) == 0 {
+			return "not found", nil
+		}
+		var msg strings.Builder
+		for i, set := range *ss {
+			if i != 0 {
+				msg.WriteString("\n")
+			}
+			msg.WriteString(set.Key)
+			msg.WriteString(" ")
+			msg.WriteString(set.ValueString())
+		}
+		return msg.String(), nil
+	}
+	key, value := sub, rest
+	n := len(value)
+	value = strings.Trim(value, `"`)
+	if len(value) == n {
+		value = strings.Trim(value, "'")
+	}
+	def, err := g.setSetting(key, value, actor)
+	if err != nil {
+		return "", err
+	}
+	res := "updated"
+	if value == "" {
+		res = "deleted"
+	} else if strings.HasPrefix(key, gate.ScheduledSettingsKeyPrefix) {
+		res = "scheduled, see /7_jobs"
+	}
+	if !def.HotApply {
+		res += ", applied after restart"
+	}
+	return res, nil
+}
@@ -0,0 +1,289 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/gate"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Банковские выписки (1C, CSV, CAMT.053) сверяются с назначениями платежей из QR-кодов счетов: платёж с участком
+// и месяцем добавляется в ledger, остальные остаются в отчёте выписки до ручной привязки.
+
+const (
+	statementMax         = 10 << 20
+	adminStatementsLimit = 20
+)
+
+// BankStatement is the log of the import of a statement, the ID is the hash of the file
+type BankStatement struct {
+	Hash      string
+	Name      string
+	Format    string
+	TimeMilli int64
+	By        string
+	Credits   int
+	Errors    string `json:",omitempty"` // credits not read
+	billing.Reconciliation
+	Charges      []ChargePayment `json:",omitempty"` // credits paying charges of the config
+	KnownCharges int             `json:",omitempty"`
+}
+
+func (e *BankStatement) Type() string { return "BankStatement" }
+func (e *BankStatement) ID() string   { return e.Hash }
+func (e *BankStatement) MarshalData() (string, error) {
+	bb, err := json.Marshal(e)
+	return string(bb), err
+}
+func (e *BankStatement) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), e)
+}
+
+// bankStatements returns imported statements, the latest first
+func (g *Gate) bankStatements() []*BankStatement {
+	data, err := g.Entities.List((&BankStatement{}).Type())
+	if err != nil {
+		Logger.Errorf("loading bank statements: %v", err)
+	}
+	var ss []*BankStatement
+	for id, d := range data {
+		s := &BankStatement{}
+		if err := s.UnmarshalData(d); err != nil {
+			Logger.Errorf("bank statement %s: %v", id, err)
+			continue
+		}
+		ss = append(ss, s)
+	}
+	slices.SortFunc(ss, func(a, b *BankStatement) int { return cmp.Compare(b.TimeMilli, a.TimeMilli) })
+	return ss
+}
+
+// importStatement adds payments of the statement to the ledger and notifies owners of paid plots,
+// credits added before are known on a repeated import
+func (g *Gate) importStatement(name string, data []byte, by string) (*BankStatement, error) {
+	h := sha256.Sum256(data)
+	s := &BankStatement{Hash: hex.EncodeToString(h[:8]), Name: filepath.Base(name), TimeMilli: time.Now().UnixMilli(),
+		By: by}
+	format, txs, err := billing.ReadStatement(data)
+	if len(txs) == 0 && err != nil {
+		return nil, adminBadRequest("%s: %v", s.Name, err)
+	}
+	if err != nil {
+		s.Errors = err.Error()
+	}
+	s.Format, s.Credits = format, len(txs)
+	var l *billing.Ledger
+	err = g.updateLedger(func(ll *billing.Ledger) ([]gate.Entity, error) {
+		l = ll
+		s.Reconciliation = *l.Reconcile(txs)
+		ee := append([]gate.Entity{s}, g.reconcileCharges(s)...)
+		for _, pm := range s.Matched {
+			ee = append(ee, &BillingPayment{pm})
+		}
+		return ee, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	g.sendSystemNotification(fmt.Sprintf("bank statement %s by %s: %s", s.Name, by, statementSummary(s)))
+	for _, pm := range s.Matched {
+		g.notifyPayment(l, pm)
+	}
+	for i := range s.Charges {
+		g.notifyChargePayment(&s.Charges[i])
+	}
+	return s, nil
+}
+
+// notifyPayment sends owners of the plot the payment received and the balance of the month
+func (g *Gate) notifyPayment(l *billing.Ledger, pm billing.Payment) {
+	text := fmt.Sprintf("Получен платёж %s ₽ за электроэнергию участка %s за %s", pm.Amount, pm.Plot, pm.Period)
+	if b, ok := l.Bill(pm.Plot, pm.Period); ok {
+		text += If(b.Debt > 0, ", задолженность "+b.Debt.String()+" ₽.", ", задолженности нет.")
+	}
+	for _, phone := range g.plotOwners(pm.Plot) {
+		g.notifyResident(phone, text)
+	}
+}
+
+// assignPayment adds the unmatched credit of a statement as the payment of the plot for the month
+func (g *Gate) assignPayment(id, plot string, p billing.Period, by string) (*billing.Payment, error) {
+	for _, s := range g.bankStatements() {
+		i := slices.IndexFunc(s.Unmatched, func(u billing.Unmatched) bool { return u.ID == id })
+		if i < 0 {
+			continue
+		}
+		pm := s.Unmatched[i].Payment(plot, p)
+		var l *billing.Ledger
+		err := g.updateLedger(func(ll *billing.Ledger) ([]gate.Entity, error) {
+			l = ll
+			if err := l.PutPayment(pm); err != nil {
+				return nil, adminBadRequest("%v", err)
+			}
+			s.Unmatched = slices.Delete(s.Unmatched, i, i+1)
+			s.Matched = append(s.Matched, pm)
+			return []gate.Entity{&BillingPayment{pm}, s}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		g.sendSystemNotification(fmt.Sprintf("payment %s %s of %s assigned to plot %s for %s by %s", pm.ID, pm.Amount,
+			pm.Date, plot, p, by))
+		g.notifyPayment(l, pm)
+		return &pm, nil
+	}
+	return nil, ErrNotFound
+}
+
+// statementsDir keeps statements to import by name, it is private unlike ElectrDir served to the web
+func (g *Gate) statementsDir() string {
+	return filepath.Join(g.CfgDir, "statements")
+}
+
+// importStatementFile imports the statement of statementsDir
+func (g *Gate) importStatementFile(name, by string) (*BankStatement, error) {
+	fp := filepath.Join(g.statementsDir(), filepath.Base(name))
+	st, err := os.Stat(fp)
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() > statementMax {
+		return nil, adminBadRequest("%s is larger than %d bytes", name, statementMax)
+	}
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	return g.importStatement(name, data, by)
+}
+
+func statementSummary(s *BankStatement) string {
+	res := fmt.Sprintf("%s, %d credits, %d payments added (%s), %d known, %d unmatched", s.Format, s.Credits,
+		len(s.Matched), billing.Total(s.Matched), len(s.Known), len(s.Unmatched))
+	if len(s.Duplicates) != 0 {
+		res += fmt.Sprintf(", %d possible duplicates", len(s.Duplicates))
+	}
+	if len(s.Charges) != 0 || s.KnownCharges != 0 {
+		var sum billing.Money
+		for _, pm := range s.Charges {
+			sum += pm.Amount
+		}
+		res += fmt.Sprintf(", %d charges paid (%s), %d known", len(s.Charges), sum, s.KnownCharges)
+	}
+	if s.Errors != "" {
+		res += "\n" + s.Errors
+	}
+	return res
+}
+
+// statementText is the reconciliation report with balances of paid plots
+func statementText(s *BankStatement, l *billing.Ledger) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: %s", s.Name, statementSummary(s))
+	for _, pm := range s.Matched {
+		fmt.Fprintf(&sb, "\n%s plot %s: %s of %s", pm.Period, pm.Plot, pm.Amount, pm.Date)
+		if b, ok := l.Bill(pm.Plot, pm.Period); ok {
+			fmt.Fprintf(&sb, ", debt %s", b.Debt)
+		}
+	}
+	for _, pm := range s.Charges {
+		fmt.Fprintf(&sb, "\n%s due %s plot %s: %s of %s", pm.Charge, pm.Due, pm.Plot, pm.Amount, pm.Date)
+	}
+	if len(s.Unmatched) != 0 {
+		sb.WriteString("\nunmatched:")
+	}
+	for _, u := range s.Unmatched {
+		fmt.Fprintf(&sb, "\n%s %s %s %s: %s (%s)", u.ID, u.Date, u.Amount, u.Payer, u.Purpose, u.Reason)
+	}
+	if len(s.Duplicates) != 0 {
+		sb.WriteString("\npossible duplicates, not added:")
+	}
+	for _, u := range s.Duplicates {
+		fmt.Fprintf(&sb, "\n%s %s %s %s: %s (%s)", u.ID, u.Date, u.Amount, u.Payer, u.Purpose, u.Reason)
+	}
+	return sb.String()
+}
+
+// handleAdminStatement imports the statement of the "statement" file of the form or of the body,
+// the reply of the form is the payments page
+func (g *Gate) handleAdminStatement(w http.ResponseWriter, r *http.Request) {
+	p := g.consolePrincipal(w, r, PermRegistry, "bank statement")
+	if p == nil {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, statementMax+65536)
+	name, body := r.URL.Query().Get("name"), io.Reader(r.Body)
+	form := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if form {
+		f, h, err := r.FormFile("statement")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		name, body = h.Filename, f
+	}
+	data, err := io.ReadAll(body)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "statement expected", http.StatusBadRequest)
+		return
+	}
+	s, err := g.importStatement(cmp.Or(name, "statement"), data, "web admin "+p.String())
+	if err == nil && form {
+		adminRedirect(w, r, "payments")
+		return
+	}
+	adminReply(w, r, "payments", s, err)
+}
+
+// handleAdminPaymentAssign assigns the unmatched credit to the plot and the month
+func (g *Gate) handleAdminPaymentAssign(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	p := g.consolePrincipal(w, r, PermRegistry, "assign payment "+id)
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	period, err := billing.ParsePeriod(args["month"])
+	if err != nil || strings.TrimSpace(args["plot"]) == "" {
+		adminReply(w, r, "payments", nil, adminBadRequest("plot and month yyyy-mm expected"))
+		return
+	}
+	pm, err := g.assignPayment(id, strings.TrimSpace(args["plot"]), period, "web admin "+p.String())
+	adminReply(w, r, "payments", pm, err)
+}
+
+// handleAdminChargeAssign assigns the unmatched credit to the charge of the plot due by the date
+func (g *Gate) handleAdminChargeAssign(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	p := g.consolePrincipal(w, r, PermRegistry, "assign charge payment "+id)
+	if p == nil {
+		return
+	}
+	args, err := adminArgs(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	charge, due, plot := strings.TrimSpace(args["charge"]), strings.TrimSpace(args["due"]), strings.TrimSpace(args["plot"])
+	if charge == "" || due == "" || plot == "" {
+		adminReply(w, r, "payments", nil, adminBadRequest("charge, due date yyyy-mm-dd and plot expected"))
+		return
+	}
+	pm, err := g.assignCharge(id, charge, due, plot, "web admin "+p.String())
+	adminReply(w, r, "payments", pm, err)
+}
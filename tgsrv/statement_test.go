@@ -0,0 +1,100 @@
+package tgsrv
+
+import (
+	"7stgbot/billing"
+	"7stgbot/config"
+	"7stgbot/gate"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const statementCSV = `Дата;Номер;Плательщик;Приход;Расход;Назначение платежа
+03.04.2024;15;Иванов;500,00;;За эл-энергию, мар 2024, участок 12, (1100.00 - 1000.00)x5.00x0.00 :: 500.00
+03.04.2024;16;Петров;100,00;;Членские взносы, уч 7
+04.04.2024;17;;;300,00;Оплата по счету 7
+`
+
+func TestImportStatement(t *testing.T) {
+	g, admin := newAdminGate(t)
+	g.ElectrDir = t.TempDir()
+	march := billing.Period{Year: 2024, Month: 3}
+	g.cfg.Store(&config.Config{AdminPhone: "79990000009", Price: map[string]float64{"202401": 5}})
+	g.updateLedger(func(l *billing.Ledger) ([]gate.Entity, error) {
+		var ee []gate.Entity
+		for _, r := range []billing.Reading{{Plot: "12", Period: march.Prev(), Value: 1000}, {Plot: "12", Period: march, Value: 1100}} {
+			ee = append(ee, &MeterReading{r})
+			l.PutReading(r)
+		}
+		return ee, nil
+	})
+
+	if w := adminRequest(admin, "POST", "/gate/admin/api/payments?name=april.csv", "resident", "text/csv", statementCSV); w.Code != http.StatusForbidden {
+		t.Errorf("got %v, want forbidden to residents", w.Code)
+	}
+	w := adminRequest(admin, "POST", "/gate/admin/api/payments?name=april.csv", "admin", "text/csv", statementCSV)
+	var s BankStatement
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %v %s, want the statement", w.Code, w.Body)
+	}
+	if s.Credits != 2 || len(s.Matched) != 1 || len(s.Unmatched) != 1 || s.Unmatched[0].Payer != "Петров" {
+		t.Fatalf("got %+v, want plot 12 matched and Петров unmatched", s)
+	}
+	if b, _ := g.ledger().Bill("12", march); b.Paid != 50000 || b.Debt != 0 {
+		t.Errorf("got %+v, want the bill of plot 12 paid", b)
+	}
+
+	got, err := g.handleBillingCommand("/7_billing", "assign "+s.Unmatched[0].ID+" 12 2024-04", "test")
+	if err != nil || !strings.Contains(got, "assigned to plot 12 for 2024-04") {
+		t.Fatalf("got %q %v, want the payment assigned", got, err)
+	}
+	if _, err := g.handleBillingCommand("/7_billing", "assign "+s.Unmatched[0].ID+" 12 2024-04", "test"); err != ErrNotFound {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+
+	// a repeated statement adds nothing, payments survive a restart
+	if err := os.WriteFile(filepath.Join(g.ElectrDir, "april.csv"), []byte(statementCSV), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.handleBillingCommand("/7_billing", "statement april.csv", "test"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want statements of the public dir not imported", err)
+	}
+	os.MkdirAll(g.statementsDir(), 0o700)
+	if err := os.WriteFile(filepath.Join(g.statementsDir(), "april.csv"), []byte(statementCSV), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err = g.handleBillingCommand("/7_billing", "statement april.csv", "test")
+	if err != nil || !strings.Contains(got, "0 payments added (0.00), 2 known, 0 unmatched") {
+		t.Errorf("got %q %v, want both payments known", got, err)
+	}
+	g.loadBilling()
+	if b, _ := g.ledger().Bill("12", march.Next()); b.Paid != 10000 || b.Debt != -10000 {
+		t.Errorf("got %+v, want the prepayment of plot 12", b)
+	}
+
+	// another purpose of the same reference, date and amount is reported, not added
+	dup := strings.Replace(statementCSV, "Членские взносы, уч 7", "Членские взносы, уч 8", 1)
+	s = BankStatement{}
+	w = adminRequest(admin, "POST", "/gate/admin/api/payments?name=april-2.csv", "admin", "text/csv", dup)
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || len(s.Known) != 1 || len(s.Duplicates) != 1 ||
+		!strings.Contains(s.Duplicates[0].Reason, "Членские взносы, уч 7") {
+		t.Errorf("got %v %s, want the credit of plot 8 a possible duplicate", w.Code, w.Body)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("statement", "bad.csv")
+	fw.Write([]byte("a;b\n1;2\n"))
+	mw.Close()
+	if w := adminRequest(admin, "POST", "/gate/admin/api/payments", "admin", mw.FormDataContentType(), buf.String()); w.Code != http.StatusBadRequest {
+		t.Errorf("got %v %s, want bad request", w.Code, w.Body)
+	}
+	if w := adminRequest(admin, "GET", "/gate/admin/payments", "admin", "", ""); !strings.Contains(w.Body.String(), "april.csv") {
+		t.Errorf("got %v %s, want the statement listed", w.Code, w.Body)
+	}
+}
@@ -57,6 +57,7 @@ func (g *Gate) startSyslogListener(abort <-chan struct{}) {
 			continue
 		}
 		nci := parseDHCPLog(cleanLine, time.Now(), hostnames, &hostnamesTime)
+		g.deviceSeen(deviceRouter, nil)
 		if nci != nil {
 			g.wifiClients <- nci
 		}
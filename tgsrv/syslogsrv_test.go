@@ -1,6 +1,7 @@
 package tgsrv
 
 import (
+	"7stgbot/gate"
 	"testing"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 
 func init() {
 	Logger = zap.NewNop().Sugar()
+	gate.Logger = Logger
 }
 
 // May 22 13:13:22 Netcraze-7708 ndhcps: DHCPDISCOVER received from 22:7c:b6:54:7d:27 hostname "Mihail-s-Galaxy-Note10".  (за < 2 сек до)
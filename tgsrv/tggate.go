@@ -0,0 +1,301 @@
+package tgsrv
+
+import (
+	"7stgbot/gate"
+	"7stgbot/telegram"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tgHelp = `/open - открыть шлагбаум
+/code - код для гостей
+/link - подтвердить телефон, поделившись контактом
+/totp_auth <номер телефона> <код totp> - подтвердить телефон кодом TOTP
+/unlink - отвязать телефон
+/reading <показание> - передать показание счётчика, можно подписью к фото счётчика
+/qr - QR-код для оплаты электричества за предыдущий месяц
+/pay - QR-коды для оплаты взносов и электроэнергии`
+
+const tgLinkHint = "подтвердите телефон: /link или /totp_auth <номер телефона> <код totp>"
+
+var errNoTelegramBot = errors.New("telegram bot is not running")
+
+// tgGuestCodes are buttons of /code -> requests of keypad codes as in SMS
+var tgGuestCodes = map[string]string{"30m": "30m", "16h": ".16h.", "48h": ".48h."}
+
+func init() {
+	tgCallbacks["open"] = (*TGBot).openCallback
+	tgCallbacks["code"] = (*TGBot).codeCallback
+	tgCallbacks["guest"] = (*TGBot).guestCallback
+}
+
+// tgBot sends guest requests of the gate to plot owners, it is set by RunBot
+type tgBot struct {
+	bot telegram.Bot
+
+	guests guestRequests
+}
+
+func (g *Gate) setTelegram(bot telegram.Bot) {
+	g.tg.Store(&tgBot{bot: bot})
+}
+
+// telegramPhone returns the linked phone of the chat allowed to open now, or the reply if it is not
+func (g *Gate) telegramPhone(chatID int64) (phone, reply string) {
+	tgUser, err := g.TelegramUsers.Find(chatID)
+	if err != nil {
+		Logger.Errorf("error finding telegram chat %d: %v", chatID, err)
+		return "", "произошла ошибка"
+	}
+	if tgUser == nil {
+		return "", tgLinkHint
+	}
+	phone = tgUser.Phone
+	u, ok := g.Phones[phone]
+	if !ok {
+		g.sendSystemNotification(fmt.Sprintf("telegram: phone %s is not found in gate register", phone))
+		return "", fmt.Sprintf("%s не найден в реестре шлагбаума. Обратитесь в правление.", maskPhone(phone))
+	}
+	if !g.allowedNow(phone) {
+		g.sendSystemNotification(fmt.Sprintf("telegram: user restricted %s", u.name()))
+		return "", "нет доступа к шлагбауму"
+	}
+	return phone, ""
+}
+
+// linkTelegram links the chat to the confirmed phone
+func (g *Gate) linkTelegram(chatID int64, phone, by string) string {
+	err := g.TelegramUsers.Save(&gate.TelegramUser{ChatID: chatID, Phone: phone, LinkedBy: by, LinkedMilli: time.Now().UnixMilli()})
+	if err != nil {
+		Logger.Errorf("db error: %v", err)
+		return "внутренняя ошибка"
+	}
+	u, ok := g.Phones[phone]
+	if !ok {
+		g.sendSystemNotification(fmt.Sprintf("telegram: chat %d linked by %s to %s not found in gate register", chatID, by, phone))
+		return fmt.Sprintf("Ваш номер телефона %s подтвержден, но не найден в реестре шлагбаума. Обратитесь в правление.", maskPhone(phone))
+	}
+	g.sendSystemNotification(fmt.Sprintf("telegram: chat %d linked by %s to %s", chatID, by, u.name()))
+	return "Ваш номер телефона подтвержден.\n" + tgHelp
+}
+
+// notifyTelegramGuest sends Open/Ignore buttons to chats of the plot owners, returns the number of messages sent
+func (g *Gate) notifyTelegramGuest(ctx context.Context, plot, text string) (int, error) {
+	b := g.tg.Load()
+	if b == nil {
+		return 0, errNoTelegramBot
+	}
+	ref := newGuestRef()
+	kb := &telegram.InlineKeyboardMarkup{InlineKeyboard: [][]telegram.InlineKeyboardButton{{
+		{Text: "Открыть", CallbackData: "guest:" + ref + ":1"},
+		{Text: "Игнорировать", CallbackData: "guest:" + ref + ":0"},
+	}}}
+	req := &guestRequest{plot: plot, created: time.Now()}
+	var errs []error
+	for _, phone := range g.plotOwners(plot) {
+		users, err := g.TelegramUsers.ListByPhone(phone)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, u := range users {
+			m, err := b.bot.SendMessage(ctx, &telegram.SendMessageParams{ChatID: u.ChatID, Text: text, ReplyMarkup: kb})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%d: %w", u.ChatID, err))
+				continue
+			}
+			chatID, messageID := u.ChatID, m.MessageID
+			req.posts = append(req.posts, guestPost{userID: strconv.FormatInt(chatID, 10), phone: phone, update: func(ctx context.Context, text string) error {
+				_, err := b.bot.EditMessageText(ctx, &telegram.EditMessageTextParams{ChatID: chatID, MessageID: messageID, Text: text})
+				return err
+			}})
+		}
+	}
+	b.guests.add(ref, req)
+	return len(req.posts), errors.Join(errs...)
+}
+
+// telegramGuestAction handles buttons of notifyTelegramGuest as guestAction, done if the buttons are not needed anymore
+func (g *Gate) telegramGuestAction(ctx context.Context, chatID int64, ref string, open bool) (reply string, done bool) {
+	b := g.tg.Load()
+	if b == nil {
+		return "запрос устарел", true
+	}
+	openGate := func(ctx context.Context, phone, reason string) (string, bool) {
+		return g.openRemote(ctx, phone+" telegram", reason)
+	}
+	return g.guestButton(ctx, &b.guests, "telegram", ref, strconv.FormatInt(chatID, 10), open, openGate)
+}
+
+// privateChat replies to messages of groups, the phone is linked to the chat
+func (b *TGBot) privateChat(ctx context.Context, m *telegram.Message) bool {
+	if m.Chat.Type == "private" {
+		return true
+	}
+	b.sendMessage(ctx, m.Chat.ID, "команда доступна в личном чате с ботом", nil)
+	return false
+}
+
+func (b *TGBot) handleLink(ctx context.Context, m *telegram.Message) {
+	if !b.privateChat(ctx, m) {
+		return
+	}
+	kb := &telegram.ReplyKeyboardMarkup{
+		Keyboard:        [][]telegram.KeyboardButton{{{Text: "📱 поделиться номером", RequestContact: true}}},
+		ResizeKeyboard:  true,
+		OneTimeKeyboard: true,
+	}
+	b.sendMessage(ctx, m.Chat.ID, "нажмите кнопку, чтобы подтвердить номер телефона", kb)
+}
+
+// handleContact links the phone of the contact shared by the button of /link, only own contacts are accepted
+func (b *TGBot) handleContact(ctx context.Context, m *telegram.Message) {
+	if !b.privateChat(ctx, m) {
+		return
+	}
+	remove := &telegram.ReplyKeyboardRemove{RemoveKeyboard: true}
+	if m.From == nil || m.Contact.UserID != m.From.ID {
+		b.sendMessage(ctx, m.Chat.ID, "поделитесь своим контактом кнопкой /link", remove)
+		return
+	}
+	phone := normalizePhone(m.Contact.PhoneNumber)[1:]
+	b.sendMessage(ctx, m.Chat.ID, b.ws.gate.linkTelegram(m.Chat.ID, phone, "contact"), remove)
+}
+
+func (b *TGBot) handleTOTPAuth(ctx context.Context, m *telegram.Message, text string) {
+	if !b.privateChat(ctx, m) {
+		return
+	}
+	g := b.ws.gate
+	i := strings.LastIndex(text, " ")
+	if i < 0 {
+		reply := "формат команды: /totp_auth <номер телефона> <код totp>  например: /totp_auth 79990010203 123456"
+		if u, _ := g.TelegramUsers.Find(m.Chat.ID); u != nil && text == "" {
+			reply = fmt.Sprintf("Ваш подтвержденный номер телефона %s", maskPhone(u.Phone))
+		}
+		b.sendMessage(ctx, m.Chat.ID, reply, nil)
+		return
+	}
+	phone, reply := g.totpPhone(fmt.Sprintf("tg:%d", m.Chat.ID), text[:i], text[i+1:], "/totp_auth", time.Now())
+	if phone != "" {
+		reply = g.linkTelegram(m.Chat.ID, phone, "totp")
+	}
+	b.sendMessage(ctx, m.Chat.ID, reply, nil)
+}
+
+func (b *TGBot) handleUnlink(ctx context.Context, m *telegram.Message) {
+	g := b.ws.gate
+	if err := g.TelegramUsers.Delete(m.Chat.ID); err != nil {
+		Logger.Errorf("db error: %v", err)
+		b.sendMessage(ctx, m.Chat.ID, "внутренняя ошибка", nil)
+		return
+	}
+	g.sendSystemNotification(fmt.Sprintf("telegram: chat %d unlinked", m.Chat.ID))
+	b.sendMessage(ctx, m.Chat.ID, "телефон отвязан", nil)
+}
+
+func (b *TGBot) handleOpen(ctx context.Context, m *telegram.Message) {
+	if !b.privateChat(ctx, m) {
+		return
+	}
+	if phone, reply := b.ws.gate.telegramPhone(m.Chat.ID); phone == "" {
+		b.sendMessage(ctx, m.Chat.ID, reply, nil)
+		return
+	}
+	b.sendMessage(ctx, m.Chat.ID, "Открыть шлагбаум?", &telegram.InlineKeyboardMarkup{InlineKeyboard: [][]telegram.InlineKeyboardButton{{
+		{Text: "Открыть", CallbackData: "open:1"},
+		{Text: "Нет", CallbackData: "open:0"},
+	}}})
+}
+
+func (b *TGBot) handleCode(ctx context.Context, m *telegram.Message) {
+	if !b.privateChat(ctx, m) {
+		return
+	}
+	if phone, reply := b.ws.gate.telegramPhone(m.Chat.ID); phone == "" {
+		b.sendMessage(ctx, m.Chat.ID, reply, nil)
+		return
+	}
+	if !b.authorizedActor(ctx, m.Chat.ID, PermGuestCode, "code") {
+		return
+	}
+	b.sendMessage(ctx, m.Chat.ID, "Код для гостей:", &telegram.InlineKeyboardMarkup{InlineKeyboard: [][]telegram.InlineKeyboardButton{{
+		{Text: "30 мин", CallbackData: "code:30m"},
+		{Text: "16 ч", CallbackData: "code:16h"},
+		{Text: "48 ч", CallbackData: "code:48h"},
+	}}})
+}
+
+// editMessage replaces the text and removes buttons of the message of the callback
+func (b *TGBot) editMessage(ctx context.Context, q *telegram.CallbackQuery, text string) {
+	_, err := b.bot.EditMessageText(ctx, &telegram.EditMessageTextParams{ChatID: q.Message.Chat.ID, MessageID: q.Message.MessageID, Text: text})
+	if err != nil {
+		Logger.Errorf("telegram edit message %d/%d: %v", q.Message.Chat.ID, q.Message.MessageID, err)
+	}
+}
+
+func (b *TGBot) openCallback(ctx context.Context, q *telegram.CallbackQuery, args string) {
+	b.answer(ctx, q, "")
+	if args != "1" {
+		b.editMessage(ctx, q, "👍 ресурс шлагбаума не безграниичный")
+		return
+	}
+	g := b.ws.gate
+	phone, reply := g.telegramPhone(q.From.ID)
+	if phone == "" {
+		b.editMessage(ctx, q, reply)
+		return
+	}
+	b.editMessage(ctx, q, "⏳ открываю шлагбаум")
+	// the relay is waited out of the update loop
+	go func() {
+		reply, _ := g.openRemote(ctx, phone+" telegram", fmt.Sprintf("opened by telegram %s", g.Phones[phone].name()))
+		b.editMessage(ctx, q, reply)
+	}()
+}
+
+func (b *TGBot) codeCallback(ctx context.Context, q *telegram.CallbackQuery, args string) {
+	b.answer(ctx, q, "")
+	text, ok := tgGuestCodes[args]
+	if !ok {
+		b.editMessage(ctx, q, "кнопка устарела")
+		return
+	}
+	g := b.ws.gate
+	phone, reply := g.telegramPhone(q.From.ID)
+	if phone == "" {
+		b.editMessage(ctx, q, reply)
+		return
+	}
+	if !g.authorize(b.principal(q.From.ID), PermGuestCode, "telegram: code") {
+		b.editMessage(ctx, q, "У вас нет прав")
+		return
+	}
+	chatID := q.Message.Chat.ID
+	sms := &PhoneSms{Phone: phone, Sms: text, reply: func(text string, _ error) { b.sendMessage(ctx, chatID, text, nil) }}
+	select {
+	case g.KeypadCodesRequests <- sms:
+		g.sendSystemNotification(fmt.Sprintf("guest code %s requested by telegram %s", args, g.Phones[phone].name()))
+		b.editMessage(ctx, q, "⏳ код запрошен")
+	default:
+		b.editMessage(ctx, q, "сервис занят, повторите позже")
+	}
+}
+
+// guestCallback handles "guest:<ref>:<1|0>" buttons of notifyTelegramGuest
+func (b *TGBot) guestCallback(ctx context.Context, q *telegram.CallbackQuery, args string) {
+	ref, value, _ := strings.Cut(args, ":")
+	go func() {
+		reply, done := b.ws.gate.telegramGuestAction(ctx, q.From.ID, ref, value == "1")
+		if !done {
+			b.answer(ctx, q, reply)
+			return
+		}
+		b.answer(ctx, q, "")
+		b.editMessage(ctx, q, reply)
+	}()
+}
@@ -0,0 +1,149 @@
+package tgsrv
+
+import (
+	"7stgbot/config"
+	"7stgbot/gate"
+	"7stgbot/telegram"
+	"7stgbot/telegram/telegramtest"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitText waits for the text of the i-th message of the chat, it is edited by callbacks
+func waitText(t *testing.T, srv *telegramtest.Server, chatID int64, i int, prefix string) telegram.Message {
+	t.Helper()
+	var mm []telegram.Message
+	for range 200 {
+		mm = srv.Messages(chatID)
+		if len(mm) > i && strings.HasPrefix(mm[i].Text, prefix) {
+			return mm[i]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got %+v, want message %d %q", mm, i, prefix)
+	return telegram.Message{}
+}
+
+func newTelegramGate(t *testing.T) (*Gate, *TGBot, *telegramtest.Server) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "gate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	srv := telegramtest.NewServer("123:tk")
+	t.Cleanup(srv.Close)
+	g := new(Gate)
+	g.Init(&config.Config{}, db)
+	g.Phones = map[string]*PalESUser{
+		"79990000001": {Id: "79990000001", Firstname: "Иван", Lastname: "12", DialToOpen: true},
+		"79990000002": {Id: "79990000002", Firstname: "Мария", Lastname: "12", DialToOpen: true},
+	}
+	g.setTelegram(srv.Client())
+	// messages to residents go by the router, out of quiet hours
+	g.Notify.Now = func() time.Time { return time.Date(2024, 6, 3, 12, 0, 0, 0, Location) }
+	abort := make(chan struct{})
+	t.Cleanup(func() { close(abort) })
+	go g.Notify.Run(abort)
+	return g, &TGBot{bot: srv.Client(), ws: &webSrv{gate: g}}, srv
+}
+
+func TestTelegramGate(t *testing.T) {
+	g, b, srv := newTelegramGate(t)
+	ctx := t.Context()
+	send := func(u telegram.Update) {
+		b.handleUpdate(ctx, &u)
+	}
+	contact := func(from int64, phone string, userID int64) telegram.Update {
+		u := telegramtest.TextUpdate(from, "")
+		u.Message.Contact = &telegram.Contact{PhoneNumber: phone, UserID: userID}
+		return u
+	}
+
+	send(telegramtest.TextUpdate(7, "/open"))
+	waitText(t, srv, 7, 0, tgLinkHint)
+	send(contact(7, "+79990000001", 8))
+	waitText(t, srv, 7, 1, "поделитесь своим контактом")
+	send(contact(7, "+79990000001", 7))
+	waitText(t, srv, 7, 2, "Ваш номер телефона подтвержден")
+	if u, _ := g.TelegramUsers.Find(7); u == nil || u.Phone != "79990000001" || u.LinkedBy != "contact" {
+		t.Errorf("got %+v, want linked by contact", u)
+	}
+	send(telegramtest.TextUpdate(9, "/totp_auth 79990000002 12345"))
+	waitText(t, srv, 9, 0, "неверный формат кода TOTP")
+
+	opened := serveGateCommands(t, g, nil)
+	send(telegramtest.TextUpdate(7, "/open"))
+	prompt := waitText(t, srv, 7, 3, "Открыть шлагбаум?")
+	send(telegramtest.CallbackUpdate(&prompt, "open:1"))
+	waitText(t, srv, 7, 3, "✅ шлагбаум открыт")
+	if got := opened(); len(got) != 1 || got[0] != "79990000001 telegram" {
+		t.Errorf("got %q, want open by telegram", got)
+	}
+
+	abort := make(chan struct{})
+	defer close(abort)
+	go g.handlingKeypadRequests(abort)
+	send(telegramtest.TextUpdate(7, "/code"))
+	codes := waitText(t, srv, 7, 4, "Код для гостей")
+	send(telegramtest.CallbackUpdate(&codes, "code:30m"))
+	waitText(t, srv, 7, 4, "⏳ код запрошен")
+	waitText(t, srv, 7, 5, "код для шлагбаума")
+	if cc, _ := g.KeypadCodes.ListActive(); len(cc) != 1 || cc[0].RequesterPhone != "79990000001" {
+		t.Errorf("got %+v, want code of 79990000001", cc)
+	}
+
+	g.Phones["79990000001"].DialToOpen = false
+	send(telegramtest.TextUpdate(7, "/open"))
+	waitText(t, srv, 7, 6, "нет доступа к шлагбауму")
+	send(telegramtest.TextUpdate(7, "/unlink"))
+	waitText(t, srv, 7, 7, "телефон отвязан")
+	send(telegramtest.TextUpdate(7, "/code"))
+	waitText(t, srv, 7, 8, tgLinkHint)
+
+	group := telegramtest.TextUpdate(-100, "/open")
+	group.Message.Chat.Type = "group"
+	send(group)
+	waitText(t, srv, -100, 0, "команда доступна в личном чате")
+}
+
+func TestTelegramGuest(t *testing.T) {
+	g, b, srv := newTelegramGate(t)
+	ctx := t.Context()
+	for _, u := range []*gate.TelegramUser{{ChatID: 1, Phone: "79990000001"}, {ChatID: 2, Phone: "79990000002"}, {ChatID: 3, Phone: "79990000003"}} {
+		if err := g.TelegramUsers.Save(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := g.notifyTelegramGuest(ctx, "12", "гости 12 участка")
+	if err != nil || n != 2 {
+		t.Fatalf("got %v %v, want 2 messages", n, err)
+	}
+	if got := srv.Messages(3); len(got) != 0 {
+		t.Errorf("got %+v, want nothing to another plot", got)
+	}
+	ivan, maria := srv.Messages(1)[0], srv.Messages(2)[0]
+	buttons := ivan.ReplyMarkup.InlineKeyboard[0]
+
+	opened := serveGateCommands(t, g, nil)
+	forged := maria
+	forged.Chat.ID = 3
+	b.handleUpdate(ctx, &telegram.Update{CallbackQuery: &telegram.CallbackQuery{ID: "x", From: telegram.User{ID: 3}, Message: &forged, Data: buttons[0].CallbackData}})
+	for i := 0; len(srv.Answers()) == 0; i++ {
+		if i == 200 {
+			t.Fatal("callback is not answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := srv.Answers()[0], "нет доступа"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	b.handleUpdate(ctx, &telegram.Update{CallbackQuery: &telegram.CallbackQuery{ID: "y", From: telegram.User{ID: 1}, Message: &ivan, Data: buttons[0].CallbackData}})
+	waitText(t, srv, 1, 0, "✅ Иван 12 открыл шлагбаум гостям 12 участка")
+	waitText(t, srv, 2, 0, "✅ Иван 12 открыл шлагбаум гостям 12 участка")
+	if got := opened(); len(got) != 1 || got[0] != "79990000001 telegram" {
+		t.Errorf("got %q, want one open by Иван", got)
+	}
+}
@@ -0,0 +1,346 @@
+package tgsrv
+
+import (
+	"7stgbot/gate"
+	"7stgbot/pales"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	timeGroupSourcePales = "pales"
+	timeGroupSourceLocal = "local"
+)
+
+var isoWeekdays = []string{"", "Пн", "Вт", "Ср", "Чт", "Пт", "Сб", "Вс"}
+
+// TimeGroupSpec is a human friendly description of a local time group.
+// Days keys are ISO weekdays (1 - Monday): "1-5", "6,7", values are "08:00-20:00".
+type TimeGroupSpec struct {
+	Name     string
+	Days     map[string]string
+	From     string   `json:",omitempty"` // 2006-01-02
+	To       string   `json:",omitempty"` // 2006-01-02 inclusive
+	Holidays []string `json:",omitempty"`
+}
+
+func (s *TimeGroupSpec) toTimeGroup() (*PalEsTimeGroup, error) {
+	if s.Name == "" {
+		return nil, errors.New("time group name is empty")
+	}
+	if len(s.Days) == 0 {
+		return nil, errors.New("time group days are empty")
+	}
+	tg := &PalEsTimeGroup{Id: timeGroupSourceLocal + "-" + s.Name, GroupName: s.Name, Source: timeGroupSourceLocal}
+	days := make(map[int]*PalEsTimeGroupDay)
+	for dd, tt := range s.Days {
+		wd, err := parseWeekdays(dd)
+		if err != nil {
+			return nil, err
+		}
+		start, end, err := parseMinuteRange(tt)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range wd {
+			// pal-es days: 1 - Sunday
+			days[d%7+1] = &PalEsTimeGroupDay{DayOfWeek: d%7 + 1, StartMinute: start, EndMinute: end}
+		}
+	}
+	var sb strings.Builder
+	for d := 1; d <= 7; d++ {
+		if day := days[d]; day != nil {
+			tg.TimeArray = append(tg.TimeArray, day)
+			sb.WriteString(strconv.Itoa(d))
+		}
+	}
+	tg.Days = sb.String()
+	if s.From != "" {
+		t, err := time.ParseInLocation(time.DateOnly, s.From, Location)
+		if err != nil {
+			return nil, err
+		}
+		tg.StartDate = t.Unix()
+	}
+	if s.To != "" {
+		t, err := time.ParseInLocation(time.DateOnly, s.To, Location)
+		if err != nil {
+			return nil, err
+		}
+		tg.EndDate = t.AddDate(0, 0, 1).Unix() - 1
+	}
+	for _, h := range s.Holidays {
+		if _, err := time.ParseInLocation(time.DateOnly, h, Location); err != nil {
+			return nil, err
+		}
+	}
+	tg.Holidays = slices.Clone(s.Holidays)
+	slices.Sort(tg.Holidays)
+	return tg, nil
+}
+
+// parseWeekdays parses "1-5", "6,7", "3" into ISO weekdays
+func parseWeekdays(s string) ([]int, error) {
+	var res []int
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("bad weekdays %q", s)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				return nil, fmt.Errorf("bad weekdays %q", s)
+			}
+		}
+		if a < 1 || b > 7 || a > b {
+			return nil, fmt.Errorf("bad weekdays %q, 1 - Monday, 7 - Sunday", s)
+		}
+		for d := a; d <= b; d++ {
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// parseMinuteRange parses "08:00-20:00" into minutes of a day, end is inclusive
+func parseMinuteRange(s string) (int, int, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("bad time range %q, 08:00-20:00 expected", s)
+	}
+	start, err := parseMinute(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseMinute(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end == 24*60 {
+		end--
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("bad time range %q", s)
+	}
+	return start, end, nil
+}
+
+func parseMinute(s string) (int, error) {
+	h, m, _ := strings.Cut(strings.TrimSpace(s), ":")
+	hh, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	mm := 0
+	if m != "" {
+		if mm, err = strconv.Atoi(m); err != nil {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+	}
+	if hh < 0 || mm < 0 || mm > 59 || hh*60+mm > 24*60 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// parseTimeGroupArgs parses chat arguments: <name> <days> <time range> ... [from <date>] [to <date>] [holidays <date,date>]
+func parseTimeGroupArgs(args []string) (*TimeGroupSpec, error) {
+	if len(args) < 3 {
+		return nil, errors.New("name, days and time range expected")
+	}
+	spec := &TimeGroupSpec{Name: args[0], Days: make(map[string]string)}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("value for %q expected", args[i])
+		}
+		k, v := args[i], args[i+1]
+		switch k {
+		case "from":
+			spec.From = v
+		case "to":
+			spec.To = v
+		case "holidays":
+			spec.Holidays = strings.Split(v, ",")
+		default:
+			spec.Days[k] = v
+		}
+	}
+	return spec, nil
+}
+
+func (tg *PalEsTimeGroup) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s [%s]", tg.GroupName, cmp.Or(tg.Source, timeGroupSourcePales))
+	for _, d := range tg.TimeArray {
+		iso := (d.DayOfWeek+5)%7 + 1
+		fmt.Fprintf(&sb, " %s %02d:%02d-%02d:%02d", isoWeekdays[iso], d.StartMinute/60, d.StartMinute%60,
+			d.EndMinute/60, d.EndMinute%60)
+	}
+	if tg.StartDate != 0 {
+		sb.WriteString(" from " + time.Unix(tg.StartDate, 0).In(Location).Format(time.DateOnly))
+	}
+	if tg.EndDate != 0 {
+		sb.WriteString(" to " + time.Unix(tg.EndDate, 0).In(Location).Format(time.DateOnly))
+	}
+	if len(tg.Holidays) != 0 {
+		sb.WriteString(" holidays " + strings.Join(tg.Holidays, ","))
+	}
+	return sb.String()
+}
+
+func palesTimeGroups(list []*pales.TimeGroup) []*PalEsTimeGroup {
+	res := make([]*PalEsTimeGroup, 0, len(list))
+	for _, g := range list {
+		days := make([]*PalEsTimeGroupDay, 0, len(g.TimeArray))
+		for _, d := range g.TimeArray {
+			days = append(days, (*PalEsTimeGroupDay)(d))
+		}
+		res = append(res, &PalEsTimeGroup{
+			Id:        g.Id,
+			GroupName: g.GroupName,
+			StartTime: g.StartTime,
+			EndTime:   g.EndTime,
+			Days:      g.Days,
+			StartDate: g.StartDate,
+			EndDate:   g.EndDate,
+			TimeArray: days,
+			Source:    timeGroupSourcePales,
+		})
+	}
+	return res
+}
+
+// mergeTimeGroups puts local groups after pal-es ones, so they win on name conflicts
+func mergeTimeGroups(palesList, localList []*PalEsTimeGroup) *PalEsTimeGroups {
+	var tg PalEsTimeGroups
+	// copies, as init() changes groups which may be in use by the previous merge
+	for _, g := range slices.Concat(palesList, localList) {
+		c := *g
+		tg.Groups.List = append(tg.Groups.List, &c)
+	}
+	tg.init()
+	return &tg
+}
+
+func (g *Gate) timeGroups() *PalEsTimeGroups {
+	tg := g.palEsTimeGroups.Load()
+	if tg == nil {
+		return mergeTimeGroups(nil, nil)
+	}
+	return tg
+}
+
+// loadTimeGroupsCache restores pal-es and local groups saved in db, so time restrictions work without the cloud
+func (g *Gate) loadTimeGroupsCache() {
+	rr, err := g.TimeGroups.List()
+	if err != nil {
+		Logger.Errorf("loading time groups: %v", err)
+	}
+	g.timeGroupsMu.Lock()
+	defer g.timeGroupsMu.Unlock()
+	g.timeGroupsBySource = make(map[string][]*PalEsTimeGroup)
+	for _, r := range rr {
+		var tg PalEsTimeGroup
+		if err := json.Unmarshal([]byte(r.Data), &tg); err != nil {
+			Logger.Errorf("time group %s:%s: %v", r.Source, r.ID, err)
+			continue
+		}
+		tg.Source = r.Source
+		g.timeGroupsBySource[r.Source] = append(g.timeGroupsBySource[r.Source], &tg)
+	}
+	g.publishTimeGroups()
+}
+
+// setTimeGroups replaces all groups of the source in memory and in db
+func (g *Gate) setTimeGroups(source string, list []*PalEsTimeGroup) error {
+	rr := make([]gate.TimeGroup, 0, len(list))
+	now := time.Now().Unix()
+	for _, tg := range list {
+		bb, err := json.Marshal(tg)
+		if err != nil {
+			return err
+		}
+		rr = append(rr, gate.TimeGroup{Source: source, ID: tg.Id, Data: string(bb), Updated: now})
+	}
+	g.timeGroupsMu.Lock()
+	defer g.timeGroupsMu.Unlock()
+	g.timeGroupsBySource[source] = list
+	g.publishTimeGroups()
+	return g.TimeGroups.ReplaceSource(source, rr)
+}
+
+func (g *Gate) localTimeGroups() []*PalEsTimeGroup {
+	g.timeGroupsMu.Lock()
+	defer g.timeGroupsMu.Unlock()
+	return slices.Clone(g.timeGroupsBySource[timeGroupSourceLocal])
+}
+
+func (g *Gate) upsertLocalTimeGroup(tg *PalEsTimeGroup) error {
+	list := slices.DeleteFunc(g.localTimeGroups(), func(x *PalEsTimeGroup) bool { return x.Id == tg.Id })
+	return g.setTimeGroups(timeGroupSourceLocal, append(list, tg))
+}
+
+func (g *Gate) deleteLocalTimeGroup(name string) error {
+	list := g.localTimeGroups()
+	n := len(list)
+	list = slices.DeleteFunc(list, func(x *PalEsTimeGroup) bool { return x.GroupName == name })
+	if len(list) == n {
+		return ErrNotFound
+	}
+	return g.setTimeGroups(timeGroupSourceLocal, list)
+}
+
+// publishTimeGroups must be called with timeGroupsMu locked
+func (g *Gate) publishTimeGroups() {
+	g.palEsTimeGroups.Store(mergeTimeGroups(
+		g.timeGroupsBySource[timeGroupSourcePales], g.timeGroupsBySource[timeGroupSourceLocal]))
+}
+
+func (g *Gate) handleTimeGroupCommand(cmd string, args []string) (string, error) {
+	usage := fmt.Sprintf("usage: %s [set <name> <days 1-5> <08:00-20:00> ... [from <2006-01-02>] [to <2006-01-02>] [holidays <2006-01-02,...>] | del <name>]", cmd)
+	if len(args) == 0 {
+		var sb strings.Builder
+		for i, tg := range g.timeGroups().Groups.List {
+			if i != 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(tg.String())
+		}
+		if sb.Len() == 0 {
+			return "no time groups", nil
+		}
+		return sb.String(), nil
+	}
+	switch args[0] {
+	case "set":
+		spec, err := parseTimeGroupArgs(args[1:])
+		if err != nil {
+			return usage, err
+		}
+		tg, err := spec.toTimeGroup()
+		if err != nil {
+			return usage, err
+		}
+		if err := g.upsertLocalTimeGroup(tg); err != nil {
+			return "", err
+		}
+		return "saved " + tg.String(), nil
+	case "del":
+		if len(args) != 2 {
+			return usage, nil
+		}
+		if err := g.deleteLocalTimeGroup(args[1]); err != nil {
+			return "", err
+		}
+		return "deleted", nil
+	}
+	return usage, nil
+}
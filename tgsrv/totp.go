@@ -0,0 +1,352 @@
+package tgsrv
+
+import (
+	"7stgbot/gate"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	secretTOTPKey = "totp-key" // AES key of TOTP secrets stored in the db
+
+	// totpLegacyUntilKey ends the migration window of secrets derived from the phone
+	totpLegacyUntilKey = "totp.legacy-until"
+
+	totpPeriod = 30
+	totpSkew   = 1
+
+	totpMaxFails   = 5              // failed codes of a chat or of a phone before a lockout
+	totpLockout    = time.Minute    // the first lockout, each next one is twice longer
+	totpLockoutMax = 24 * time.Hour // the longest lockout
+	totpFailsTTL   = 24 * time.Hour // failures and lockouts are forgotten after the last failure
+
+	totpPendingTTL = 24 * time.Hour // an unconfirmed secret is shown again until it is replaced by a new one
+)
+
+var (
+	totpOpts = totp.ValidateOpts{
+		Period:    totpPeriod, // стандарт для Google Authenticator
+		Skew:      totpSkew,   // позволяет код из прошлого или следующего 30-секундного интервала
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	errTOTPReplay = errors.New("totp code is already used")
+)
+
+func checkTOTPLegacyUntil(value string) error {
+	_, err := time.ParseInLocation("2006-01-02", value, Location)
+	return err
+}
+
+// legacyTOTPAllowed is true until totp.legacy-until date, empty setting keeps derived secrets working
+func (g *Gate) legacyTOTPAllowed(now time.Time) bool {
+	s, err := g.Settings.Find(totpLegacyUntilKey)
+	if err != nil || s.ValueString() == "" {
+		return err == nil
+	}
+	until, err := time.ParseInLocation("2006-01-02", s.ValueString(), Location)
+	return err == nil && now.Before(until)
+}
+
+// legacyTOTPSecrets are derived from the phone by all totp-salt versions
+func legacyTOTPSecrets(phone string) [][]byte {
+	var res [][]byte
+	for _, salt := range Secrets.Values(secretTOTPSalt) {
+		h := sha1.New()
+		h.Write([]byte(phone + salt))
+		res = append(res, []byte(hex.EncodeToString(h.Sum(nil))[:16]))
+	}
+	return res
+}
+
+func sealTOTPSecret(secret []byte) (string, error) {
+	gcm, err := newGCM(secretTOTPKey, Secrets.Get(secretTOTPKey))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+// openTOTPSecret decrypts by all totp-key versions
+func openTOTPSecret(sealed string) ([]byte, error) {
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.New("no " + secretTOTPKey)
+	for _, key := range Secrets.Values(secretTOTPKey) {
+		gcm, e := newGCM(secretTOTPKey, key)
+		if e != nil {
+			err = e
+			continue
+		}
+		if len(data) < gcm.NonceSize() {
+			return nil, errors.New("too short")
+		}
+		var secret []byte
+		if secret, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil); err == nil {
+			return secret, nil
+		}
+	}
+	return nil, err
+}
+
+// totpStep returns the time step of the code, 0 if the code does not match
+func totpStep(secret []byte, code string, now time.Time) int64 {
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	step := now.Unix() / totpPeriod
+	for i := step - totpSkew; i <= step+totpSkew; i++ {
+		c, err := totp.GenerateCodeCustom(secretBase32, time.Unix(i*totpPeriod, 0), totpOpts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return i
+		}
+	}
+	return 0
+}
+
+// enrollTOTP generates a new secret of the phone. It is pending until the first code confirms it,
+// the active secret keeps working meanwhile. A pending secret is returned again until it expires,
+// so reloading the QR code does not invalidate the one already scanned.
+func (g *Gate) enrollTOTP(phone string, now time.Time) ([]byte, error) {
+	g.totpMu.Lock()
+	defer g.totpMu.Unlock()
+	p, err := g.TOTPPhones.Find(phone)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil && p.PendingSecret != "" && now.Sub(time.UnixMilli(p.PendingAtMilli)) < totpPendingTTL {
+		return openTOTPSecret(p.PendingSecret)
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	sealed, err := sealTOTPSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		err = g.TOTPPhones.Insert(&gate.TOTPPhone{Phone: phone, CreatedAtMilli: now.UnixMilli(), PendingSecret: sealed,
+			PendingAtMilli: now.UnixMilli()})
+	} else {
+		p.PendingSecret, p.PendingAtMilli = sealed, now.UnixMilli()
+		err = g.TOTPPhones.Update(p)
+	}
+	return secret, err
+}
+
+// resetTOTP removes all secrets of the phone, including the legacy one. The phone has to enrol again.
+func (g *Gate) resetTOTP(phone string) error {
+	g.totpMu.Lock()
+	defer g.totpMu.Unlock()
+	p, err := g.TOTPPhones.Find(phone)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return ErrNotFound
+	}
+	p.Secret, p.PendingSecret, p.Legacy, p.ActivatedAtMilli = "", "", false, 0
+	return g.TOTPPhones.Update(p)
+}
+
+// checkTOTP validates the code by the active, pending or legacy secret of the phone.
+// A code of a pending secret activates it. A code of the same or earlier time step as the last accepted one is a replay.
+func (g *Gate) checkTOTP(phone, code string, now time.Time) (bool, error) {
+	g.totpMu.Lock()
+	defer g.totpMu.Unlock()
+	p, err := g.TOTPPhones.Find(phone)
+	if err != nil || p == nil {
+		return false, err
+	}
+	var step int64
+	activate := false
+	if p.Secret != "" {
+		secret, err := openTOTPSecret(p.Secret)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", p.Phone, err)
+		}
+		step = totpStep(secret, code, now)
+	}
+	if step == 0 && p.PendingSecret != "" {
+		secret, err := openTOTPSecret(p.PendingSecret)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", p.Phone, err)
+		}
+		step = totpStep(secret, code, now)
+		activate = step != 0
+	}
+	if step == 0 && p.Secret == "" && p.Legacy && g.legacyTOTPAllowed(now) {
+		for _, secret := range legacyTOTPSecrets(p.Phone) {
+			if step = totpStep(secret, code, now); step != 0 {
+				break
+			}
+		}
+	}
+	if step == 0 {
+		return false, nil
+	}
+	if step <= p.LastStep {
+		return false, errTOTPReplay
+	}
+	p.LastStep = step
+	if activate {
+		p.Secret, p.PendingSecret, p.Legacy, p.ActivatedAtMilli = p.PendingSecret, "", false, now.UnixMilli()
+		Logger.Infof("totp secret of %s is activated", p.Phone)
+	}
+	return true, g.TOTPPhones.Update(p)
+}
+
+// totpFails counts failed TOTP codes by keys of the chat and of the phone, a key is locked out after
+// totpMaxFails failures with an exponential backoff
+type totpFails struct {
+	mu sync.Mutex
+	m  map[string]*totpFailState
+}
+
+type totpFailState struct {
+	fails, lockouts int
+	last, until     time.Time
+}
+
+// locked returns the time left of the longest lockout of the keys
+func (f *totpFails) locked(now time.Time, keys ...string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var left time.Duration
+	for _, k := range keys {
+		if st, ok := f.m[k]; ok {
+			left = max(left, st.until.Sub(now))
+		}
+	}
+	return left
+}
+
+// fail counts the failure of the keys and returns lockouts started by it
+func (f *totpFails) fail(now time.Time, keys ...string) map[string]time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.m == nil {
+		f.m = make(map[string]*totpFailState)
+	}
+	for k, st := range f.m {
+		if now.Sub(st.last) > totpFailsTTL && !now.Before(st.until) {
+			delete(f.m, k)
+		}
+	}
+	var res map[string]time.Duration
+	for _, k := range keys {
+		st := f.m[k]
+		if st == nil {
+			st = &totpFailState{}
+			f.m[k] = st
+		}
+		st.fails++
+		st.last = now
+		if st.fails < totpMaxFails {
+			continue
+		}
+		d := min(totpLockout<<min(st.lockouts, 20), totpLockoutMax)
+		st.fails, st.lockouts, st.until = 0, st.lockouts+1, now.Add(d)
+		if res == nil {
+			res = make(map[string]time.Duration)
+		}
+		res[k] = d
+	}
+	return res
+}
+
+func (f *totpFails) reset(keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, k := range keys {
+		delete(f.m, k)
+	}
+}
+
+func (g *Gate) findTOTPPhoneByCode(phonePostfix string, totpCode string, now time.Time) string {
+	totpPhones, err := g.TOTPPhones.ListEndsWith(phonePostfix)
+	if err != nil {
+		Logger.Errorf("error finding totp phone %v", err)
+		return ""
+	}
+	for i := range totpPhones {
+		valid, err := g.checkTOTP(totpPhones[i].Phone, totpCode, now)
+		if err != nil {
+			Logger.Errorf("totp validation error %v", err)
+			continue
+		}
+		if valid {
+			return totpPhones[i].Phone
+		}
+	}
+	return ""
+}
+
+func totpPhoneString(p *gate.TOTPPhone) string {
+	var state []string
+	if p.Secret != "" {
+		state = append(state, "active since "+time.UnixMilli(p.ActivatedAtMilli).In(Location).Format("2006-01-02"))
+	}
+	if p.PendingSecret != "" {
+		state = append(state, "pending")
+	}
+	if p.Legacy {
+		state = append(state, "legacy")
+	}
+	if len(state) == 0 {
+		state = append(state, "reset")
+	}
+	return fmt.Sprintf("%s %s", maskPhone(p.Phone), strings.Join(state, ", "))
+}
+
+func (g *Gate) handleTOTPCommand(cmd, args string) (string, error) {
+	usage := fmt.Sprintf("usage: %s [list [phone postfix] | reset <phone>]", cmd)
+	aa := strings.Fields(args)
+	switch {
+	case len(aa) == 0 || aa[0] == "list" && len(aa) <= 2:
+		postfix := ""
+		if len(aa) == 2 {
+			postfix = aa[1]
+		}
+		pp, err := g.TOTPPhones.ListEndsWith(postfix)
+		if err != nil {
+			return "", err
+		}
+		var sb strings.Builder
+		for i := range pp {
+			if i != 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(totpPhoneString(&pp[i]))
+		}
+		if sb.Len() == 0 {
+			return "no phones", nil
+		}
+		return sb.String(), nil
+
+	case aa[0] == "reset" && len(aa) == 2:
+		phone := strings.TrimPrefix(aa[1], "+")
+		if err := g.resetTOTP(phone); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("totp of %s is reset, send SMS \"totp\" from the phone to enrol again", maskPhone(phone)), nil
+	}
+	return usage, nil
+}
@@ -1,8 +1,9 @@
 package tgsrv
 
 import (
+	"7stgbot/billing"
 	"7stgbot/config"
-	"7stgbot/gate"
+	"7stgbot/telegram"
 	"bytes"
 	"context"
 	"encoding/csv"
@@ -12,6 +13,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -56,24 +58,8 @@ const (
 
 	site = "https://7slavka.ru"
 
-	QRSalt = "ee1e4a719ddac2689"
-
-	// required
-	QRHeader          = "ST00012"
-	QRNameName        = "Name"        // <= 160
-	QRNamePersonalAcc = "PersonalAcc" // <= 20
-	QRNameBankName    = "BankName"    // <= 45
-	QRNameBIC         = "BIC"         // <= 9
-	QRNameCorrespAcc  = "CorrespAcc"  // <= 20
-	// optional
-	QRNamePurpose  = "Purpose"  // <= 210
-	QRNameSum      = "Sum"      // <= 18
-	QRNameLastName = "LastName" // <= 18
-	QRNamePayeeINN = "PayeeINN" // <= 12
-
 	mattermostCommandResponseUsername = "anjella"
 	mattermostCommandResponseIconUrl  = "https://7slavka.ru/images/anjella.png"
-	systemBotId                       = "f1bkn94xnfyutngcbphnzt18zr"
 )
 
 type PhoneCall struct {
@@ -95,6 +81,8 @@ type PhoneSms struct {
 	Phone        string `json:"sender_phone_number"`
 	Sms          string
 	SentUnixTime string `json:"timestamp_sent"`
+
+	reply func(text string, err error) // replies of requests from chats, SMS if nil
 }
 
 func (s *PhoneSms) timestampSent() string {
@@ -149,10 +137,10 @@ func init() {
 }
 
 func StartWebServer(port int, staticDir, dir string, QRElements map[string]string, price map[string]float64,
-	coef map[string]float64, abort chan struct{}, pinger *pingMonitor, g *Gate,
+	coef map[string]float64, abort chan struct{}, pinger *pingMonitor, gates Gates,
 	cfg *config.Config, cfgSub *config.ConfigSubscription) *webSrv {
 
-	webServer := newWebServer(port, staticDir, dir, QRElements, price, coef, pinger, abort, g, cfg, cfgSub)
+	webServer := newWebServer(port, staticDir, dir, QRElements, price, coef, pinger, abort, gates, cfg, cfgSub)
 	webServer.start(port)
 	srv := webServer.httpServer
 	go func() {
@@ -164,16 +152,16 @@ func StartWebServer(port int, staticDir, dir string, QRElements map[string]strin
 
 func newWebServer(port int, staticDir string, dir string, QRElements map[string]string,
 	price map[string]float64, coef map[string]float64, pinger *pingMonitor, abort chan struct{},
-	g *Gate, cfg *config.Config, cfgSub *config.ConfigSubscription) *webSrv {
+	gates Gates, cfg *config.Config, cfgSub *config.ConfigSubscription) *webSrv {
 
 	ws := new(webSrv)
-	(&ws.priceHist).fromMap(price)
-	ws.QRElements = QRElements
+	ws.webCfg.Store(newWebConfig(QRElements, cfg.QREncoding, price, coef))
 	ws.staticDir = staticDir
 	ws.dataDir = dir
 	ws.pinger = pinger
-	(&ws.coefHist).fromMap(coef)
-	ws.gate = g
+	ws.gate = gates[0]
+	ws.gates = gates
+	ws.gate.ElectrDir = staticDir
 
 	fs := http.FileServer(http.Dir(staticDir))
 	//ws.staticHandler = http.StripPrefix("/static/", fs)
@@ -197,22 +185,9 @@ func newWebServer(port int, staticDir string, dir string, QRElements map[string]
 		c.Stop()
 	}()
 
-	topicEvents := make(chan string, 1)
-
-	ipReq := make(chan Pair[string, chan string], 4)
-
-	go g.palesLoginAndLoadLoop(abort, topicEvents, cfg, cfgSub.Subscribe())
-	go g.handlingCalls(abort)
-	go g.handlingSmses(abort)
-	go g.handlingBLETracking(abort, cfg, cfgSub.Subscribe(), ipReq)
-	go g.readingSMSesForSend(abort)
-	go g.handlingKeypadRequests(abort)
-	go g.sendingSystemNotification(abort)
-	go g.sendingUserNotification(abort)
-	go g.listenPalESMQTT(abort, topicEvents)
-	go g.handlingGateState(abort, cfg, cfgSub.Subscribe())
-	go g.startSyslogListener(abort)
-	go g.handlingScheduledJobs(abort, cfg)
+	go ws.followConfig(abort, cfgSub.Subscribe())
+	// WiFi clients are reported by the router of the default gate
+	go ws.gate.startSyslogListener(abort)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /docs/оплата", ws.servePayTemplate)
@@ -228,8 +203,33 @@ func newWebServer(port int, staticDir string, dir string, QRElements map[string]
 	mux.HandleFunc("/docs/internet", ws.handleInternet)
 	mux.HandleFunc("/docs/electr.csv", ws.handleElectrCSV)
 	mux.HandleFunc("/docs", ws.handleDocs)
-	mux.HandleFunc("/app/log", handleLogLevel)
+	mux.HandleFunc("/app/log", ws.handleLogLevel)
 	mux.HandleFunc("/ble2", ws.handleBLE)
+	mux.Handle("POST /tg/webhook", &ws.tgWebhook)
+	mux.HandleFunc("/", ws.handle)
+
+	// the default gate is served at the root, every gate at /g/<id>
+	for i, g := range gates {
+		ipReq := make(chan Pair[string, chan string], 4)
+		g.start(abort, ipReq)
+		gateMux := http.NewServeMux()
+		ws.registerGateRoutes(gateMux)
+		g.RegisterGateAppHTTP(gateMux, cfg.StaticGateAppDir, ipReq)
+		g.RegisterAdminHTTP(gateMux)
+		prefix := "/g/" + g.ID
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, withGate(g, gateMux)))
+		if i == 0 {
+			mux.Handle("/gate/", withGate(g, gateMux))
+			mux.Handle("/totp/", withGate(g, gateMux))
+		}
+	}
+
+	ws.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: TrimSlashMiddleware(mux)}
+	return ws
+}
+
+// registerGateRoutes registers routes served for each gate
+func (ws *webSrv) registerGateRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/gate/call", ws.handleCall)
 	mux.HandleFunc("/gate/sms", ws.handleSMS)
 	mux.HandleFunc("/gate/opened", ws.handleOpened)
@@ -238,18 +238,14 @@ func newWebServer(port int, staticDir string, dir string, QRElements map[string]
 	mux.HandleFunc("/gate/automate/sms", ws.handleAutomateSMS)
 	mux.HandleFunc("/gate/mm/cmd", ws.handleMattermostCommand)
 	mux.HandleFunc("/gate/mm/action", ws.handleMattermostAction)
+	mux.HandleFunc("GET /gate/mm/commands", ws.handleMattermostCommands)
+	mux.HandleFunc("GET /gate/calendar.ics", ws.handleCalendarICS)
 	mux.HandleFunc("/totp/{secret}", ws.handleTOTP)
-	mux.HandleFunc("/", ws.handle)
-
-	g.RegisterGateAppHTTP(mux, cfg.StaticGateAppDir, ipReq)
-
-	ws.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: TrimSlashMiddleware(mux)}
-	return ws
 }
 
 func TrimSlashMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" && r.URL.Path != "/gate/app/" {
+		if r.URL.Path != "/" && !strings.HasSuffix(r.URL.Path, "/gate/app/") {
 			r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
 		}
 		next.ServeHTTP(w, r)
@@ -275,38 +271,22 @@ func (ws *webSrv) setRegistry(r *Registry) {
 	ws.registry.Store(r)
 }
 
-type valueDates []valueDate
-
-type valueDate struct {
-	date  string
-	value float64
-}
+// valueDates is the history of the tariff or the loss coefficient
+type valueDates billing.Rates
 
 func (vd *valueDates) fromMap(p map[string]float64) {
-	*vd = make([]valueDate, 0, len(p))
-	dates := make([]string, 0, len(p))
-	for k := range p {
-		dates = append(dates, k)
-	}
-	sort.Strings(dates)
-	for i := len(dates) - 1; i >= 0; i-- {
-		d := dates[i]
-		*vd = append(*vd, valueDate{date: d, value: p[d]})
+	rr, err := billing.RatesFromMap(p)
+	if err != nil {
+		Logger.Errorf("rates: %v", err)
 	}
+	*vd = valueDates(rr)
 }
 
 func (vd *valueDates) coef(year int, month int) float64 {
 	if vd == nil {
 		return 0
 	}
-	d := fmt.Sprintf("%d%02d", year, month)
-	var dv valueDate
-	for _, dv = range *vd {
-		if d >= dv.date {
-			return dv.value
-		}
-	}
-	return dv.value
+	return billing.Rates(*vd).At(billing.Period{Year: year, Month: month})
 }
 
 func (vd *valueDates) coefStr(year string, month string) float64 {
@@ -322,17 +302,17 @@ func (vd *valueDates) coefStr(year string, month string) float64 {
 }
 
 type webSrv struct {
-	priceHist     valueDates
-	coefHist      valueDates
-	QRElements    map[string]string
+	webCfg        atomic.Pointer[webConfig]
 	staticDir     string
 	dataDir       string
 	staticHandler http.Handler
 	httpServer    *http.Server
 	pinger        *pingMonitor
 	registry      atomic.Value
-	gate          *Gate
+	gate          *Gate // default one
+	gates         Gates
 	abort         chan struct{}
+	tgWebhook     telegram.Webhook
 }
 
 func (s *webSrv) start(port int) {
@@ -352,6 +332,7 @@ func (s *webSrv) handle(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *webSrv) handleMattermostAction(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
@@ -376,34 +357,7 @@ func (s *webSrv) handleMattermostAction(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	Logger.Debugf("%s  %q", r.URL.Path, string(bodyBytes))
-	if mmReq.Context.Action == UIActionOpen {
-		if !mmReq.Context.Value {
-			encoder.Encode(NewMattermostActionResponse("👍 ресурс шлагбаума не безграниичный"))
-			return
-		}
-		mmUser, err := s.gate.MattermostUsers.Find(mmReq.UserId)
-		if err != nil {
-			Logger.Errorf("error finding user %s: %v", mmReq.UserId, err)
-			encoder.Encode(NewMattermostActionResponse("произошла ошибка"))
-			return
-		}
-		phone := mmUser.Phone
-		u, ok := s.gate.Phones[phone]
-		if !ok {
-			s.gate.sendSystemNotification(fmt.Sprintf("mattermost: phone %s is not found in gate register", phone))
-			encoder.Encode(NewMattermostActionResponse(fmt.Sprintf("%s не найден в реестре. Отправить заявку можно так: /7_ask прошу внести в реестр шлагбаума уч. <номер участка> <ФИО>. Например: /7_gate прошу внести в реестр шлагбаума уч. 123 Иванов Иван Иванович", phone)))
-			return
-		}
-		info := fmt.Sprintf("%s %s %s", phone, u.Firstname, u.Lastname)
-		if !s.gate.allowedNow(phone) {
-			s.gate.sendSystemNotification(fmt.Sprintf("mattermost: user restricted %s", info))
-			encoder.Encode(NewMattermostActionResponse("нет доступа к шлагбауму"))
-			return
-		}
-		encoder.Encode(NewMattermostActionResponse("✅ шлагбаум открывается..."))
-	} else {
-		encoder.Encode(NewMattermostActionResponse("неизвестная команда"))
-	}
+	encoder.Encode(NewMattermostActionResponse(g.mattermostAction(r.Context(), &mmReq)))
 }
 
 func (s *webSrv) handleMattermostCommand(w http.ResponseWriter, r *http.Request) {
@@ -436,6 +390,7 @@ func (s *webSrv) handleMattermostCommand(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *webSrv) handleTOTP(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	secret := r.PathValue("secret")
 	phone, tm, err := DecryptPhone(secret)
 	if err != nil {
@@ -447,18 +402,25 @@ func (s *webSrv) handleTOTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ссылка просрочена (срок 1 час). запросите новую", http.StatusBadRequest)
 		msg := fmt.Sprintf("%s ссылка просрочена (срок 1 час) %s %s", r.URL.Path, phone, tm)
 		Logger.Debugf(msg)
-		s.gate.sendSystemNotification(msg)
+		g.sendSystemNotification(msg)
 		return
 	}
-	s.gate.TOTPPhones.Insert(&gate.TOTPPhone{Phone: phone, CreatedAtMilli: time.Now().UnixMilli()})
-	s.generateTOTPQRCodeImage(w, phone)
+	totpSecret, err := g.enrollTOTP(phone, time.Now())
+	if err != nil {
+		Logger.Errorf("%s enrolling %s: %v", r.URL.Path, phone, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.generateTOTPQRCodeImage(w, phone, totpSecret)
 }
 
 func (s *webSrv) handleAutomateSMS(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
 	}
+	g.deviceSeen(devicePhone, nil)
 	defer r.Body.Close()
 	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
 
@@ -481,7 +443,7 @@ func (s *webSrv) handleAutomateSMS(w http.ResponseWriter, r *http.Request) {
 	}
 	for {
 		select {
-		case m := <-s.gate.PendingSMSes:
+		case m := <-g.PendingSMSes:
 			if m.Expired() {
 				Logger.Debugf("expired SMS: %s %q", m.Phone, m.Msg)
 				continue
@@ -498,8 +460,8 @@ func (s *webSrv) handleAutomateSMS(w http.ResponseWriter, r *http.Request) {
 				Logger.Infof("%s <- %s", r.URL.Path, text)
 			}
 			m.Sent()
-			s.gate.SMSes.Update(m)
-			s.gate.sendSystemNotification(fmt.Sprintf("sent SMS: %s %q", m.Phone, m.Msg))
+			g.SMSes.Update(m)
+			g.sendSystemNotification(fmt.Sprintf("sent SMS: %s %q", m.Phone, m.Msg))
 			return
 
 		case <-timer55s.C:
@@ -514,13 +476,15 @@ func (s *webSrv) handleAutomateSMS(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *webSrv) handleAutomateCall(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
 	}
+	g.deviceSeen(devicePhone, nil)
 	for {
 		select {
-		case c := <-s.gate.PendingCalls:
+		case c := <-g.PendingCalls:
 			if c.Deadline < time.Now().UnixMilli() {
 				continue
 			}
@@ -533,6 +497,7 @@ func (s *webSrv) handleAutomateCall(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *webSrv) handleKeypad(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
@@ -554,8 +519,9 @@ func (s *webSrv) handleKeypad(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	Logger.Debugf("keypad %s", string(bodyBytes))
+	g.deviceSeen(deviceKeypad, nil)
 
-	err = s.gate.keypadCode(keypadCode)
+	err = g.keypadCode(keypadCode)
 	switch {
 	case errors.Is(err, Err400BadFormat):
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -570,11 +536,21 @@ func (s *webSrv) handleKeypad(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+// handleLogLevel sets the level of the log, it is allowed to admins of the web app
+func (s *webSrv) handleLogLevel(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
 	}
+	p := s.gate.webPrincipal(r)
+	if p == nil {
+		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
+		return
+	}
+	if !s.gate.authorize(p, PermAdmin, "web app: log level") {
+		http.Error(w, "Недостаточно прав.", http.StatusForbidden)
+		return
+	}
 	defer r.Body.Close()
 	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
 
@@ -599,6 +575,7 @@ func handleLogLevel(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *webSrv) handleOpened(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
@@ -616,10 +593,12 @@ func (s *webSrv) handleOpened(w http.ResponseWriter, r *http.Request) {
 		Logger.Debugf("%s  %q", r.URL.Path, string(bodyBytes))
 	}
 	w.WriteHeader(http.StatusOK)
-	s.gate.openedEvets <- openTime
+	g.deviceSeen(deviceOpened, nil)
+	g.openedEvets <- openTime
 }
 
 func (s *webSrv) handleSMS(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
@@ -640,11 +619,13 @@ func (s *webSrv) handleSMS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	Logger.Infof("Sms received: %s   %s", phoneSms.Phone, string(bodyBytes))
-	s.gate.phoneSmses <- &phoneSms
+	g.deviceSeen(devicePhone, nil)
+	g.phoneSmses <- &phoneSms
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *webSrv) handleCall(w http.ResponseWriter, r *http.Request) {
+	g := s.gateOf(r)
 	if r.Method != http.MethodPost {
 		http.Error(w, "Resource not found", http.StatusNotFound)
 		return
@@ -665,7 +646,8 @@ func (s *webSrv) handleCall(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	Logger.Infof("Call received: %s   %s", phoneCall.Phone, string(bodyBytes))
-	s.gate.phoneCalls <- &phoneCall
+	g.deviceSeen(devicePhone, nil)
+	g.phoneCalls <- &phoneCall
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -690,7 +672,9 @@ func (s *webSrv) handleBLE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if len(bleTrackings) != 0 {
-		s.gate.bleTrackings <- bleTrackings
+		g := s.gateByBLELocation(bleTrackings[0].Location)
+		g.deviceSeen(fmt.Sprintf("%s %d", deviceBLE, bleTrackings[0].Location), nil)
+		g.bleTrackings <- bleTrackings
 	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -715,11 +699,14 @@ func (s *webSrv) handleElectrCSV(w http.ResponseWriter, r *http.Request) {
 		Logger.Errorf("expected 2-digits month %s %v", month, err)
 		return
 	}
+	p := billing.Period{Year: y, Month: m}
+	if _, err := s.gate.importElectr(p, false); err != nil && !errors.Is(err, os.ErrNotExist) {
+		Logger.Errorf("importing %s: %v", p, err)
+	}
 	w.Header().Set("Content-Type", "text/csv")
 	w.Header().Set("Content-Disposition", "attachment;filename=electr_"+
 		year+month+".csv")
-	items := LoadElectrForMonth(s.staticDir, y, m)
-	items = anonymize(items)
+	items := s.gate.ledger().Export(p)
 	for _, it := range items {
 		if len(it.PlotNumber) == 0 {
 			continue
@@ -794,6 +781,12 @@ func (s *webSrv) handleQRCImg(w http.ResponseWriter, r *http.Request) {
 	var sum float64
 	var purpose template.HTML
 
+	if query.Has(paramNameCharge) {
+		if c, ok := s.queryCharge(query); ok && c.Amount > 0 {
+			s.writeImage(w, c.Amount.String(), c.Purpose, "")
+		}
+		return
+	}
 	var ok bool
 	if checkHash(year, month, number, hash) {
 		purpose, sum, ok = s.purpose(year, month, number)
@@ -881,52 +874,39 @@ func handlePay(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *webSrv) handleMattermostCommandEncoder(w http.ResponseWriter, r *http.Request, req MattermostRequest, encoder *json.Encoder) {
-	mmUser, err := s.gate.MattermostUsers.Find(req.UserId)
-	if err != nil {
-		Logger.Errorf("db error: %v", err)
-		encoder.Encode(NewMattermostResponse("внутренняя ошибка"))
-		return
-	}
-	token := mattermostToken(req.Command)
-	if token == "" {
+	g := s.gateOf(r)
+	c := mmCommandByName(req.Command)
+	tokens := g.mattermostTokens(req.Command)
+	if c == nil || len(tokens) == 0 {
 		Logger.Warnf("unknown mattermost command: %s", req.Command)
 		encoder.Encode(NewMattermostResponse("неизвестная команда"))
 		return
 	}
-	if req.Token != token {
+	if !matchSecret(req.Token, tokens) {
 		Logger.Infof("%s bad token", r.URL.Path)
 		http.Error(w, "wtf", http.StatusBadRequest)
 		return
 	}
-	if !s.gate.handleMattermostSysCommand(req.Command, req.Text, encoder) {
-		s.gate.handleMattermostUserCommand(req, r.URL.Path, mmUser, encoder)
-	}
-}
-
-func mattermostToken(cmd string) string {
-	switch cmd {
-	case "/7_totp_auth":
-		return "pbegqjtqu78w8nx5fw19sk6egc"
-	case "/7_open":
-		return "gm9nyssncibhtkrkchdgicd1fe"
-	case "/7_timer":
-		return "mfpcfn4br7b37ngd1fhnkxq7wa"
-	case "/7_ble_timer":
-		return "xuxaxzxrttdttpyau5aw7zz3th"
-	case "/7_open_after_m":
-		return "a97r7xopgtd48j653b8d9ru9yw"
-	case "/7_keep_open":
-		return "abmqoykj1iynmkw91ned5nr6uh"
-	case "/7_keep_open_cancel":
-		return "5c6nsgpkpj837fmd5o63pxopge"
-	case "/7_set":
-		return "pgxynxmuobbmudhfwgge7tyhxy"
-	case "/7_lock":
-		return "zf6jfxwextyg8prjippciocdur"
-	case "/7_sms":
-		return "as7g3kxm5tfgxcro5z4wxdygxh"
-	}
-	return ""
+	mmUser, err := g.MattermostUsers.Find(req.UserId)
+	if err != nil {
+		Logger.Errorf("db error: %v", err)
+		encoder.Encode(NewMattermostResponse("внутренняя ошибка"))
+		return
+	}
+	res, err := g.runMattermostCommand(c, &mmCall{
+		Cmd:       req.Command,
+		Args:      req.Text,
+		Actor:     "mm:" + req.UserName,
+		UserID:    req.UserId,
+		User:      mmUser,
+		Principal: g.mattermostPrincipal(req.UserId, req.UserName),
+	})
+	encodeMattermostResult(encoder, res, err)
+}
+
+func (s *webSrv) handleMattermostCommands(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.gateOf(r).mattermostAutocomplete())
 }
 
 func QRURL(year string, month string, plotNumber string) string {
@@ -965,16 +945,6 @@ func (b *Bool) False() bool {
 	return false
 }
 
-func anonymize(p []*ElectrEvidence) []*ElectrEvidence {
-	items := make([]*ElectrEvidence, 0, len(p))
-	for _, ev := range p {
-		c := ev.Copy()
-		c.FIO = ""
-		items = append(items, c)
-	}
-	return items
-}
-
 type byIP []string
 
 func (a byIP) Len() int      { return len(a) }
@@ -1077,18 +1047,18 @@ func (s *webSrv) calculate(yyyy string, mm string, number string, prevStr string
 	}
 	var price float64
 	if len(priceStr) == 0 {
-		price = s.priceHist.coef(year, month)
+		price = s.webCfg.Load().priceHist.coef(year, month)
 		priceStr = fmt.Sprintf("%.2f", price)
 	} else {
 		price, err = strconv.ParseFloat(priceStr, 64)
 		if err != nil {
 			price = 0
-			Logger.Error("error parsing price %s %v", s.priceHist, err)
+			Logger.Error("error parsing price %s %v", s.webCfg.Load().priceHist, err)
 		}
 	}
 	var coef float64
 	if len(coefStr) == 0 {
-		coef = s.coefHist.coef(year, month)
+		coef = s.webCfg.Load().coefHist.coef(year, month)
 		coefStr = fmt.Sprintf("%.2f", coef)
 	} else {
 		coef, err = strconv.ParseFloat(coefStr, 64)
@@ -1121,20 +1091,48 @@ func (s *webSrv) calculate(yyyy string, mm string, number string, prevStr string
 	return sum, purpose
 }
 
+var errBadSum = errors.New("bad sum")
+
+// parseSum returns kopecks of the sum in rubles, empty is 0, the sum is not set
+func parseSum(sum string) (int64, error) {
+	if sum == "" {
+		return 0, nil
+	}
+	summa, err := strconv.ParseFloat(sum, 64)
+	if err != nil || math.IsNaN(summa) || math.IsInf(summa, 0) {
+		return 0, fmt.Errorf("%w %q", errBadSum, sum)
+	}
+	return int64(math.Round(summa * 100)), nil
+}
+
+// qrContent is the payment QR code to the payee of the config, sum is in rubles
+func (c *webConfig) qrContent(sum, purpose, lastName string) ([]byte, error) {
+	p := c.qr
+	p.Purpose, p.LastName = purpose, lastName
+	var err error
+	if p.Sum, err = parseSum(sum); err != nil {
+		return nil, err
+	}
+	return p.Encode(c.qrEncoding)
+}
+
 func (s *webSrv) writeImage(w http.ResponseWriter, sum, purpose, lastName string) {
-	qr := QRHeader
-	for k, v := range s.QRElements {
-		qr += "|" + k + "=" + v
+	kopecks, err := parseSum(sum)
+	if err != nil {
+		http.Error(w, "неверная сумма", http.StatusBadRequest)
+		return
 	}
-	qr += "|" + QRNamePurpose + "=" + purpose
-	if len(lastName) != 0 {
-		qr += "|" + QRNameLastName + "=" + lastName
+	if kopecks < 0 {
+		http.Error(w, "нет задолженности", http.StatusUnprocessableEntity)
+		return
 	}
-	{
-		summa, _ := strconv.ParseFloat(sum, 64)
-		qr += "|" + QRNameSum + "=" + fmt.Sprintf("%.0f", summa*100)
+	content, err := s.webCfg.Load().qrContent(sum, purpose, lastName)
+	if err != nil {
+		Logger.Errorf("error encoding qr code: %v", err)
+		http.Error(w, fmt.Sprintf("500 error encoding qr code: %v", err), http.StatusInternalServerError)
+		return
 	}
-	imgBytes, err := qrcode.Encode(qr, qrcode.Medium, 256)
+	imgBytes, err := qrcode.Encode(string(content), qrcode.Medium, 256)
 	if err != nil {
 		Logger.Errorf("error encoding qr code: %v", err)
 		http.Error(w, fmt.Sprintf("500 error encoding qr code: %v", err), http.StatusInternalServerError)
@@ -1144,13 +1142,13 @@ func (s *webSrv) writeImage(w http.ResponseWriter, sum, purpose, lastName string
 	io.Copy(w, bytes.NewReader(imgBytes))
 }
 
-func (s *webSrv) generateTOTPQRCodeImage(w http.ResponseWriter, phone string) {
-	secret := totpSecret(phone)
+// generateTOTPQRCodeImage shows the pending secret, it is activated by the first code
+func (s *webSrv) generateTOTPQRCodeImage(w http.ResponseWriter, phone string, secret []byte) {
 
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      "СНТ Семиславка", // Название компании/приложения
 		AccountName: phone,            // Имя аккаунта (номер телефона)
-		Secret:      []byte(secret),   // Наш секрет из 16 символов
+		Secret:      secret,
 	})
 	if err != nil {
 		Logger.Errorf("Ошибка при создании QR: %v", err)
@@ -1269,23 +1267,22 @@ func (s *webSrv) servePayElectrTemplate(w http.ResponseWriter, r *http.Request)
 	fio := query.Get(paramNameFio)
 	price := query.Get(paramNamePrice)
 	if len(price) == 0 {
-		price = fmt.Sprintf("%.2f", s.priceHist.coefStr(year, month))
+		price = fmt.Sprintf("%.2f", s.webCfg.Load().priceHist.coefStr(year, month))
 	}
 	coef := query.Get(paramNameCoef)
 	if len(coef) == 0 {
-		coef = fmt.Sprintf("%.2f", s.coefHist.coefStr(year, month))
+		coef = fmt.Sprintf("%.2f", s.webCfg.Load().coefHist.coefStr(year, month))
 	}
 	if len(year) != 0 && len(month) != 0 && len(number) != 0 && (len(prev) == 0 || len(curr) == 0 || len(debt) == 0) {
-		ev := s.loadFromFile(year, month, number)
-		if ev != nil {
+		if b, _, ok := s.electrBill(year, month, number); ok {
 			if len(prev) == 0 {
-				prev = ev.PrevEvidence
+				prev = billing.FormatKWh(b.Prev)
 			}
 			if len(curr) == 0 {
-				curr = ev.CurrEvidence
+				curr = billing.FormatKWh(b.Curr)
 			}
-			if len(debt) == 0 {
-				debt = ev.prepaidMinusDebtAsStr()
+			if d := b.PrevDebt - b.Paid; len(debt) == 0 && d != 0 {
+				debt = d.String()
 			}
 		}
 	}
@@ -1395,7 +1392,19 @@ func (s *webSrv) serveQRTemplate(w http.ResponseWriter, r *http.Request) {
 	params.Add(paramNameHash, hash)
 
 	var ok bool
-	if checkHash(year, month, number, hash) {
+	if query.Has(paramNameCharge) {
+		params = query
+		var c *PlotCharge
+		c, ok = s.queryCharge(query)
+		switch {
+		case !ok:
+			tdata.Purpose = "неверная ссылка"
+		case c.Amount <= 0:
+			tdata.Purpose, ok = "оплачено", false
+		default:
+			tdata.Purpose = chargePurpose(c)
+		}
+	} else if checkHash(year, month, number, hash) {
 		tdata.Purpose, _, ok = s.purpose(year, month, number)
 	} else {
 		tdata.Purpose = "неверная ссылка"
@@ -1436,55 +1445,51 @@ func (s *webSrv) serveQRTemplate(w http.ResponseWriter, r *http.Request) {
 	}
 }
 func (s *webSrv) purpose(year string, month string, number string) (template.HTML, float64, bool) {
-	ev := s.loadFromFile(year, month, number)
-	if ev == nil {
-		return "файл не найден", 0, false
+	b, mismatch, ok := s.electrBill(year, month, number)
+	if !ok {
+		return "счет не найден", 0, false
 	}
-	purpose := ""
-	prev, err := strconv.ParseFloat(ev.PrevEvidence, 64)
-	if err != nil {
-		prev = 0
+	if b.Debt < 0 {
+		return template.HTML("нет задолженности, переплата " + (-b.Debt).String()), 0, false
 	}
-	curr, err := strconv.ParseFloat(ev.CurrEvidence, 64)
-	if err != nil {
-		curr = 0
-	}
-	price := s.priceHist.coefStr(year, month)
-	coef := s.coefHist.coefStr(year, month)
-	debt := ev.prepaidMinusDebt()
-	totalCalc := (curr - prev) * price * (1 + 0.01*coef)
-	currDebtCalc := debt + totalCalc
-	currDebt, err := strconv.ParseFloat(ev.CurrDebt, 64)
-	if err == nil && currDebtCalc-currDebt >= 1 {
+	if b.Debt == 0 {
+		return "нет задолженности", 0, false
+	}
+	purpose := ""
+	if mismatch {
 		purpose += "<b>Внимание! Рассчитанная сумма расходится  с ведомостью!  <b>"
 	}
 	debtText := ""
-	if debt != 0 {
-		debtText = fmt.Sprintf("%.2f + ", debt)
+	if debt := b.PrevDebt - b.Paid; debt != 0 {
+		debtText = debt.String() + " + "
 	}
 	replacer := strings.NewReplacer(
 		"{mnt}", month,
 		"{year}", year,
 		"{number}", number,
 		"{debt}", debtText,
-		"{curr}", fmt.Sprintf("%.2f", curr),
-		"{prev}", fmt.Sprintf("%.2f", prev),
-		"{price}", fmt.Sprintf("%.2f", s.priceHist.coefStr(year, month)),
-		"{coef}", fmt.Sprintf("%.2f", s.coefHist.coefStr(year, month)),
-		"{sum}", fmt.Sprintf("%.2f", currDebtCalc),
+		"{curr}", fmt.Sprintf("%.2f", b.Curr),
+		"{prev}", fmt.Sprintf("%.2f", b.Prev),
+		"{price}", fmt.Sprintf("%.2f", b.Price),
+		"{coef}", fmt.Sprintf("%.2f", b.Coef),
+		"{sum}", b.Debt.String(),
 	)
 	purpose += replacer.Replace(
 		"За эл-энергию, {mnt} {year}, участок {number}, {debt}({curr} - {prev})x{price}x{coef} :: {sum}")
 
-	return template.HTML(purpose), currDebt, true
+	return template.HTML(purpose), b.Debt.Rubles(), true
 }
 
 func checkHash(year string, month string, number string, hash string) bool {
 	if len(year) == 0 || len(month) == 0 || len(number) == 0 || len(hash) == 0 {
 		return false
 	}
-	h := sha1Hash(year, month, number)
-	return hash == h
+	for _, salt := range Secrets.Values(secretQRSalt) {
+		if hash == sha1HashSalt(salt, year, month, number) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *webSrv) serveTemplate(w http.ResponseWriter, r *http.Request, tdata any,
@@ -1523,20 +1528,18 @@ func (s *webSrv) serveTemplate(w http.ResponseWriter, r *http.Request, tdata any
 	}
 }
 
-func (s *webSrv) loadFromFile(year string, month string, number string) *ElectrEvidence {
+func (s *webSrv) electrBill(year string, month string, number string) (*billing.Bill, bool, bool) {
 	y, err := strconv.Atoi(year)
 	if err != nil {
 		Logger.Errorf("expected 4-digits year %s %v", year, err)
-		return nil
+		return nil, false, false
 	}
 	m, err := strconv.Atoi(month)
 	if err != nil {
 		Logger.Errorf("expected 2-digits month %s %v", month, err)
-		return nil
+		return nil, false, false
 	}
-	items := LoadElectrForMonth(s.staticDir, y, m)
-	ev := toMap(items)[number]
-	return ev
+	return s.gate.electrBill(billing.Period{Year: y, Month: m}, number)
 }
 
 func (s *webSrv) FindByEmailPrefix(email string) map[string]bool {
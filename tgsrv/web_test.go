@@ -1,6 +1,12 @@
 package tgsrv
 
 import (
+	"7stgbot/paymentqr"
+	"cmp"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -29,3 +35,39 @@ func TestValueDatesCoef(t *testing.T) {
 		}
 	}
 }
+
+// testQR are requisites of the payee of QR codes
+var testQR = map[string]string{"Name": "СНТ", "PersonalAcc": "40703810000000000001", "BankName": "Банк", "BIC": "044525225",
+	"CorrespAcc": "30101810400000000225", "PayeeINN": "5000000000"}
+
+func TestQRContent(t *testing.T) {
+	qr := maps.Clone(testQR)
+	purpose := "За эл-энергию, мар 2024, участок 12 | (1100.00 - 1000.00)x5.00"
+	for _, enc := range []string{"", "ST00011"} {
+		got, err := newWebConfig(qr, enc, nil, nil).qrContent("650.5", purpose, "Иванов")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, e, err := paymentqr.Decode(got)
+		if err != nil || e.String() != cmp.Or(enc, "ST00012") || p.Sum != 65050 || p.BIC != "044525225" ||
+			p.LastName != "Иванов" || p.Purpose != "За эл-энергию, мар 2024, участок 12 / (1100.00 - 1000.00)x5.00" {
+			t.Errorf("%q: got %+v %v %v", enc, p, e, err)
+		}
+	}
+	for _, sum := range []string{"12x", "NaN", "1,5"} {
+		if _, err := newWebConfig(qr, "", nil, nil).qrContent(sum, purpose, ""); !errors.Is(err, errBadSum) {
+			t.Errorf("%q: got %v, want %v", sum, err, errBadSum)
+		}
+	}
+	ws := &webSrv{}
+	ws.webCfg.Store(newWebConfig(qr, "", nil, nil))
+	rec := httptest.NewRecorder()
+	ws.handleQRImg(rec, httptest.NewRequest("GET", "/qr?sum=abc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+	delete(qr, "BIC")
+	if _, err := newWebConfig(qr, "", nil, nil).qrContent("1", "", ""); err == nil {
+		t.Error("got no error without BIC")
+	}
+}
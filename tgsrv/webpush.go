@@ -0,0 +1,374 @@
+package tgsrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// secretVAPIDKey is hashed to the P-256 key of VAPID, any random value works
+const secretVAPIDKey = "webpush-vapid-key"
+
+const (
+	webPushTTL        = 24 * time.Hour
+	webPushRecordSize = 4096
+)
+
+var (
+	b64url      = base64.RawURLEncoding
+	errPushGone = errors.New("push subscription is gone")
+	pushSubsMu  sync.Mutex // serializes updates of PushSubscriptions
+)
+
+// PushSubscription is PushSubscription.toJSON() of the browser with the phone of the session
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	Phone   string `json:"phone"`
+	Created int64  `json:"created"`
+}
+
+// PushSubscriptions are all Web Push subscriptions of the gate app
+type PushSubscriptions struct {
+	Subs []PushSubscription
+}
+
+func (s *PushSubscriptions) Type() string { return "PushSubscriptions" }
+func (s *PushSubscriptions) ID() string   { return "all" }
+func (s *PushSubscriptions) MarshalData() (string, error) {
+	data, err := json.Marshal(s.Subs)
+	return string(data), err
+}
+func (s *PushSubscriptions) UnmarshalData(data string) error {
+	return json.Unmarshal([]byte(data), &s.Subs)
+}
+
+func (g *Gate) pushSubscriptions() ([]PushSubscription, error) {
+	var s PushSubscriptions
+	_, err := g.Entities.Load(&s)
+	return s.Subs, err
+}
+
+// updatePushSubscriptions applies f to subscriptions and stores them
+func (g *Gate) updatePushSubscriptions(f func([]PushSubscription) []PushSubscription) error {
+	pushSubsMu.Lock()
+	defer pushSubsMu.Unlock()
+	var s PushSubscriptions
+	exists, err := g.Entities.Load(&s)
+	if err != nil {
+		return err
+	}
+	s.Subs = f(s.Subs)
+	if exists {
+		return g.Entities.Update(&s)
+	}
+	return g.Entities.Insert(&s)
+}
+
+func (g *Gate) addPushSubscription(sub PushSubscription) error {
+	return g.updatePushSubscriptions(func(ss []PushSubscription) []PushSubscription {
+		ss = slices.DeleteFunc(ss, func(s PushSubscription) bool { return s.Endpoint == sub.Endpoint })
+		return append(ss, sub)
+	})
+}
+
+func (g *Gate) removePushSubscription(endpoint string) error {
+	return g.updatePushSubscriptions(func(ss []PushSubscription) []PushSubscription {
+		return slices.DeleteFunc(ss, func(s PushSubscription) bool { return s.Endpoint == endpoint })
+	})
+}
+
+func vapidKey() (*ecdsa.PrivateKey, error) {
+	v := Secrets.Get(secretVAPIDKey)
+	if v == "" {
+		return nil, errors.New("no " + secretVAPIDKey)
+	}
+	seed := sha256.Sum256([]byte(v))
+	return ecdsa.ParseRawPrivateKey(elliptic.P256(), seed[:])
+}
+
+// vapidPublicKey is applicationServerKey of pushManager.subscribe()
+func vapidPublicKey() (string, error) {
+	key, err := vapidKey()
+	if err != nil {
+		return "", err
+	}
+	pub, err := key.PublicKey.Bytes()
+	if err != nil {
+		return "", err
+	}
+	return b64url.EncodeToString(pub), nil
+}
+
+// vapidAuthorization is the header of RFC 8292, a JWT signed by ES256 for the push service
+func vapidAuthorization(endpoint, subject string, now time.Time) (string, error) {
+	key, err := vapidKey()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := b64url.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + b64url.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	pub, err := key.PublicKey.Bytes()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, b64url.EncodeToString(sig), b64url.EncodeToString(pub)), nil
+}
+
+// encryptPush encrypts the message for the subscription by RFC 8291 aes128gcm content coding
+func encryptPush(sub *PushSubscription, msg []byte) ([]byte, error) {
+	uaPubBytes, err := b64url.DecodeString(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	auth, err := b64url.DecodeString(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	uaPub, err := ecdh.P256().NewPublicKey(uaPubBytes)
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPub := asKey.PublicKey().Bytes()
+	shared, err := asKey.ECDH(uaPub)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	prkKey, err := hkdf.Extract(sha256.New, shared, auth)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(uaPubBytes) + string(asPub)
+	ikm, err := hkdf.Expand(sha256.New, prkKey, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// a single record, 0x02 is the padding delimiter of the last record
+	if len(msg)+1+gcm.Overhead() > webPushRecordSize {
+		return nil, fmt.Errorf("push message of %d bytes is too long", len(msg))
+	}
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(webPushRecordSize))
+	body.WriteByte(byte(len(asPub)))
+	body.Write(asPub)
+	body.Write(gcm.Seal(nil, nonce, append(slices.Clip(msg), 2), nil))
+	return body.Bytes(), nil
+}
+
+func (g *Gate) sendPush(ctx context.Context, sub *PushSubscription, msg []byte) error {
+	body, err := encryptPush(sub, msg)
+	if err != nil {
+		return err
+	}
+	auth, err := vapidAuthorization(sub.Endpoint, "https://"+g.siteDomain(), time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL/time.Second)))
+	req.Header.Set("Authorization", auth)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return errPushGone
+	}
+	return checkResponse(resp)
+}
+
+// webPushSink sends to subscriptions of the phone, to all of them if the phone is empty.
+// Gone subscriptions are removed, the text is retried only if no subscription got it.
+type webPushSink struct {
+	g     *Gate
+	phone string
+}
+
+func (s *webPushSink) Send(ctx context.Context, text string) error {
+	sent, err := s.g.sendPushText(ctx, s.phone, text)
+	if sent == 0 {
+		return err
+	}
+	return nil
+}
+
+// sendPushText sends to subscriptions of the phone, to all of them if the phone is empty, and returns
+// how many got the text
+func (g *Gate) sendPushText(ctx context.Context, phone, text string) (int, error) {
+	subs, err := g.pushSubscriptions()
+	if err != nil {
+		return 0, err
+	}
+	msg, err := json.Marshal(map[string]string{"title": g.appDomain(), "body": text})
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	sent := 0
+	for i := range subs {
+		if phone != "" && subs[i].Phone != phone {
+			continue
+		}
+		err := g.sendPush(ctx, &subs[i], msg)
+		switch {
+		case errors.Is(err, errPushGone):
+			Logger.Infof("push subscription of %s is gone", subs[i].Phone)
+			if err := g.removePushSubscription(subs[i].Endpoint); err != nil {
+				Logger.Errorf("remove push subscription: %v", err)
+			}
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", subs[i].Phone, err))
+		default:
+			sent++
+		}
+	}
+	return sent, errors.Join(errs...)
+}
+
+func (b *ChatBroker) handlePushKey(w http.ResponseWriter, r *http.Request) {
+	key, err := vapidPublicKey()
+	if err != nil {
+		Logger.Errorf("vapid key: %v", err)
+		http.Error(w, "Web Push не настроен", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"key": key})
+}
+
+func (b *ChatBroker) handlePushSubscribe(w http.ResponseWriter, r *http.Request) {
+	_, phone, authorized := b.getSessionInfo(r)
+	if !authorized {
+		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
+		return
+	}
+	var sub PushSubscription
+	if json.NewDecoder(r.Body).Decode(&sub) != nil || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	sub.Phone = normalizePhone(phone)[1:]
+	sub.Created = time.Now().Unix()
+	if err := b.g.addPushSubscription(sub); err != nil {
+		Logger.Errorf("push subscribe %s: %v", sub.Phone, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePushUnsubscribe removes a subscription of the phone of the session only
+func (b *ChatBroker) handlePushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	_, phone, authorized := b.getSessionInfo(r)
+	if !authorized {
+		http.Error(w, "Доступ запрещен. Авторизуйтесь.", http.StatusForbidden)
+		return
+	}
+	var sub PushSubscription
+	if json.NewDecoder(r.Body).Decode(&sub) != nil || sub.Endpoint == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	subs, err := b.g.pushSubscriptions()
+	if err != nil {
+		Logger.Errorf("push unsubscribe: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(subs, func(s PushSubscription) bool { return s.Endpoint == sub.Endpoint })
+	if i < 0 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if subs[i].Phone != normalizePhone(phone)[1:] {
+		http.Error(w, "Доступ запрещен", http.StatusForbidden)
+		return
+	}
+	if err := b.g.removePushSubscription(sub.Endpoint); err != nil {
+		Logger.Errorf("push unsubscribe: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}